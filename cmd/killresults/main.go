@@ -17,6 +17,8 @@ func main() {
 
 	// Parse command line flags
 	workspaceDir := flag.String("dir", ".", "Workspace directory containing the results folder")
+	debounce := flag.Duration("debounce", watcher.DefaultKillDebounce, "Wait for writes to a file to settle for this long before acting")
+	cooldown := flag.Duration("cooldown", watcher.DefaultKillCooldown, "Minimum time between kills for the same file")
 	flag.Parse()
 
 	// Clean up any existing watchers
@@ -34,7 +36,7 @@ func main() {
 	resultsDir := filepath.Join(absWorkspaceDir, "impl1", "results")
 
 	// Create results watcher
-	w, err := watcher.NewResultsWatcher(resultsDir)
+	w, err := watcher.NewResultsWatcher(resultsDir, *debounce, *cooldown)
 	if err != nil {
 		log.Fatalf("Failed to create results watcher: %v", err)
 	}
@@ -0,0 +1,28 @@
+// Command pml-shout is a reference plugin directive. Registered with
+// "pml -plugin :shout=pml-shout", it answers each :shout block with its content
+// in upper case, or with the text of its prefix= attribute followed by it.
+package main
+
+import (
+	"errors"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/fireharp/pml/impl1/parser/directives"
+)
+
+func main() {
+	log.SetFlags(0)
+
+	err := directives.ServeSubprocess(os.Stdin, os.Stdout, func(req directives.SubprocessRequest) (string, error) {
+		text := strings.TrimSpace(strings.Join(req.Content, "\n"))
+		if text == "" {
+			return "", errors.New("nothing to shout")
+		}
+		return req.Attributes["prefix"] + strings.ToUpper(text), nil
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,302 @@
+package llm
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// DefaultAnthropicModel is the model used by an AnthropicClient when a prompt
+// does not request a specific one and none is configured
+const DefaultAnthropicModel = "claude-3-5-haiku-latest"
+
+// DefaultAnthropicMaxTokens is the answer length limit sent when the config sets
+// none; the Messages API requires one
+const DefaultAnthropicMaxTokens = 4096
+
+// AnthropicVersion is the Messages API version requested
+const AnthropicVersion = "2023-06-01"
+
+// defaultAnthropicBaseURL is the Anthropic API, without the /v1 path
+const defaultAnthropicBaseURL = "https://api.anthropic.com"
+
+// AnthropicConfig holds the credentials, models and sampling settings an
+// AnthropicClient is constructed with
+type AnthropicConfig struct {
+	APIKey  string
+	BaseURL string // API URL without the /v1 path; the Anthropic API if empty
+
+	Model        string // Model for prompts that don't request one; DefaultAnthropicModel if empty
+	SummaryModel string // Model for Summarize; Model if empty
+
+	// Sampling settings sent with every request, unset when nil. MaxTokens is
+	// DefaultAnthropicMaxTokens if 0, as the API requires a limit.
+	Temperature *float32
+	TopP        *float32
+	MaxTokens   int
+}
+
+// LoadAnthropicConfig reads the Anthropic credentials and models from
+// ANTHROPIC_API_KEY, ANTHROPIC_BASE_URL, ANTHROPIC_MODEL and ANTHROPIC_SUMMARY_MODEL
+func LoadAnthropicConfig() (AnthropicConfig, error) {
+	config := AnthropicConfig{
+		APIKey:       os.Getenv("ANTHROPIC_API_KEY"),
+		BaseURL:      os.Getenv("ANTHROPIC_BASE_URL"),
+		Model:        os.Getenv("ANTHROPIC_MODEL"),
+		SummaryModel: os.Getenv("ANTHROPIC_SUMMARY_MODEL"),
+	}
+	if config.APIKey == "" {
+		return config, fmt.Errorf("ANTHROPIC_API_KEY environment variable is not set")
+	}
+	return config, nil
+}
+
+// AnthropicClient is an LLM client for the Anthropic Messages API. It has the
+// same methods as Client, so either can be handed to the parser.
+type AnthropicClient struct {
+	httpClient   *http.Client
+	config       AnthropicConfig
+	baseURL      string
+	model        string // Model for prompts that don't request one
+	summaryModel string // Model for Summarize
+	modelsMu     sync.Mutex
+	models       []string // Models available to the client, once listed
+}
+
+// NewAnthropicClient creates an Anthropic client from the environment
+func NewAnthropicClient() (*AnthropicClient, error) {
+	config, err := LoadAnthropicConfig()
+	if err != nil {
+		return nil, err
+	}
+	return NewAnthropicClientWithConfig(config), nil
+}
+
+// NewAnthropicClientWithConfig creates an Anthropic client from explicit settings
+func NewAnthropicClientWithConfig(config AnthropicConfig) *AnthropicClient {
+	baseURL := strings.TrimSuffix(config.BaseURL, "/")
+	if baseURL == "" {
+		baseURL = defaultAnthropicBaseURL
+	}
+	model := config.Model
+	if model == "" {
+		model = DefaultAnthropicModel
+	}
+	summaryModel := config.SummaryModel
+	if summaryModel == "" {
+		summaryModel = model
+	}
+	return &AnthropicClient{
+		httpClient:   &http.Client{},
+		config:       config,
+		baseURL:      baseURL,
+		model:        model,
+		summaryModel: summaryModel,
+	}
+}
+
+// anthropicRequest is the body of a Messages API request
+type anthropicRequest struct {
+	Model       string             `json:"model"`
+	MaxTokens   int                `json:"max_tokens"`
+	System      string             `json:"system,omitempty"`
+	Messages    []anthropicMessage `json:"messages"`
+	Temperature *float32           `json:"temperature,omitempty"`
+	TopP        *float32           `json:"top_p,omitempty"`
+}
+
+type anthropicMessage struct {
+	Role    string             `json:"role"`
+	Content []anthropicContent `json:"content"`
+}
+
+// anthropicContent is a content block of a message: text or an image
+type anthropicContent struct {
+	Type   string                `json:"type"`
+	Text   string                `json:"text,omitempty"`
+	Source *anthropicImageSource `json:"source,omitempty"`
+}
+
+type anthropicImageSource struct {
+	Type      string `json:"type"`
+	MediaType string `json:"media_type"`
+	Data      string `json:"data"`
+}
+
+// anthropicResponse is the body of a Messages API response
+type anthropicResponse struct {
+	Content []anthropicContent `json:"content"`
+}
+
+// anthropicError is the body of an API error response
+type anthropicError struct {
+	Error struct {
+		Type    string `json:"type"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// Model returns the model used for prompts that don't request one
+func (c *AnthropicClient) Model() string {
+	return c.model
+}
+
+// Ask sends a prompt to the client's model and returns the response
+func (c *AnthropicClient) Ask(ctx context.Context, prompt string) (string, error) {
+	return c.AskWithModel(ctx, c.model, prompt)
+}
+
+// AskWithModel sends a prompt to the given model and returns the response. An
+// empty model uses the client's model.
+func (c *AnthropicClient) AskWithModel(ctx context.Context, model, prompt string) (string, error) {
+	return c.AskWithSystem(ctx, model, "", prompt)
+}
+
+// AskWithSystem sends a prompt with a system prompt to the given model and
+// returns the response. An empty model uses the client's model.
+func (c *AnthropicClient) AskWithSystem(ctx context.Context, model, system, prompt string) (string, error) {
+	answer, err := c.createMessage(ctx, model, system, anthropicContent{Type: "text", Text: prompt})
+	if err != nil {
+		return "", fmt.Errorf("failed to get LLM response: %w", err)
+	}
+	return answer, nil
+}
+
+// AskWithImage sends a prompt with an image, such as a PNG or JPEG of the given
+// MIME type, and returns the response. An empty model uses the client's model.
+func (c *AnthropicClient) AskWithImage(ctx context.Context, model, prompt string, image []byte, mimeType string) (string, error) {
+	answer, err := c.createMessage(ctx, model, "",
+		anthropicContent{Type: "image", Source: &anthropicImageSource{
+			Type:      "base64",
+			MediaType: mimeType,
+			Data:      base64.StdEncoding.EncodeToString(image),
+		}},
+		anthropicContent{Type: "text", Text: prompt},
+	)
+	if err != nil {
+		return "", fmt.Errorf("failed to get LLM response: %w", err)
+	}
+	return answer, nil
+}
+
+// Summarize generates a very short summary of the given text with the summary model
+func (c *AnthropicClient) Summarize(ctx context.Context, text string) (string, error) {
+	answer, err := c.createMessage(ctx, c.summaryModel, summarySystemPrompt,
+		anthropicContent{Type: "text", Text: "Summarize this in under 5 words:\n" + text})
+	if err != nil {
+		return "", fmt.Errorf("failed to get summary: %w", err)
+	}
+	return answer, nil
+}
+
+// Models returns the IDs of the models available to the client, sorted. The
+// API is only asked once; later calls return the same list.
+func (c *AnthropicClient) Models(ctx context.Context) ([]string, error) {
+	c.modelsMu.Lock()
+	defer c.modelsMu.Unlock()
+	if c.models != nil {
+		return c.models, nil
+	}
+
+	var list struct {
+		Data []struct {
+			ID string `json:"id"`
+		} `json:"data"`
+	}
+	if err := c.do(ctx, http.MethodGet, "/v1/models?limit=1000", nil, &list); err != nil {
+		return nil, fmt.Errorf("failed to list models: %w", err)
+	}
+	models := make([]string, 0, len(list.Data))
+	for _, model := range list.Data {
+		models = append(models, model.ID)
+	}
+	sort.Strings(models)
+	c.models = models
+	return models, nil
+}
+
+// createMessage sends a single user message made of content to model and
+// returns the trimmed text of the answer
+func (c *AnthropicClient) createMessage(ctx context.Context, model, system string, content ...anthropicContent) (string, error) {
+	if model == "" {
+		model = c.model
+	}
+	maxTokens := c.config.MaxTokens
+	if maxTokens == 0 {
+		maxTokens = DefaultAnthropicMaxTokens
+	}
+	req := anthropicRequest{
+		Model:       model,
+		MaxTokens:   maxTokens,
+		System:      system,
+		Messages:    []anthropicMessage{{Role: "user", Content: content}},
+		Temperature: c.config.Temperature,
+		TopP:        c.config.TopP,
+	}
+
+	var resp anthropicResponse
+	if err := c.do(ctx, http.MethodPost, "/v1/messages", req, &resp); err != nil {
+		return "", err
+	}
+	var text strings.Builder
+	for _, block := range resp.Content {
+		if block.Type == "text" {
+			text.WriteString(block.Text)
+		}
+	}
+	if text.Len() == 0 {
+		return "", fmt.Errorf("no text returned from LLM")
+	}
+	return strings.TrimSpace(text.String()), nil
+}
+
+// do sends an API request with body encoded as JSON, if not nil, and decodes
+// the response into out
+func (c *AnthropicClient) do(ctx context.Context, method, path string, body, out any) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("x-api-key", c.config.APIKey)
+	req.Header.Set("anthropic-version", AnthropicVersion)
+	if body != nil {
+		req.Header.Set("content-type", "application/json")
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		var apiErr anthropicError
+		if json.Unmarshal(data, &apiErr) == nil && apiErr.Error.Message != "" {
+			return fmt.Errorf("status %d: %s: %s", resp.StatusCode, apiErr.Error.Type, apiErr.Error.Message)
+		}
+		return fmt.Errorf("status %d: %s", resp.StatusCode, strings.TrimSpace(string(data)))
+	}
+	if err := json.Unmarshal(data, out); err != nil {
+		return fmt.Errorf("invalid response: %w", err)
+	}
+	return nil
+}
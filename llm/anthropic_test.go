@@ -0,0 +1,126 @@
+package llm
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestAnthropicClientAsk tests that a prompt is sent as a single user message
+// to the Messages API and the answer's text is returned trimmed
+func TestAnthropicClientAsk(t *testing.T) {
+	var req anthropicRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/messages" {
+			t.Errorf("Unexpected path %s", r.URL.Path)
+		}
+		if r.Header.Get("x-api-key") != "test-key" || r.Header.Get("anthropic-version") != AnthropicVersion {
+			t.Errorf("Missing API headers: %v", r.Header)
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("Invalid request payload: %v", err)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"id":"msg_1","type":"message","role":"assistant","content":[{"type":"text","text":"  Tokyo\n"}],"stop_reason":"end_turn"}`)
+	}))
+	defer srv.Close()
+
+	client := NewAnthropicClientWithConfig(AnthropicConfig{APIKey: "test-key", BaseURL: srv.URL})
+	answer, err := client.Ask(context.Background(), "What is the capital of Japan?")
+	if err != nil {
+		t.Fatalf("Ask() error = %v", err)
+	}
+	if answer != "Tokyo" {
+		t.Errorf("Expected the trimmed answer, got %q", answer)
+	}
+	if req.Model != DefaultAnthropicModel || req.MaxTokens != DefaultAnthropicMaxTokens || req.System != "" {
+		t.Errorf("Unexpected request settings: %+v", req)
+	}
+	if len(req.Messages) != 1 || req.Messages[0].Role != "user" || len(req.Messages[0].Content) != 1 ||
+		req.Messages[0].Content[0].Text != "What is the capital of Japan?" {
+		t.Errorf("Expected a single user message with the prompt, got %+v", req.Messages)
+	}
+
+	if _, err := client.AskWithSystem(context.Background(), "claude-3-opus-latest", "Be brief", "Hello"); err != nil {
+		t.Fatalf("AskWithSystem() error = %v", err)
+	}
+	if req.Model != "claude-3-opus-latest" || req.System != "Be brief" {
+		t.Errorf("Expected the model and system prompt to be sent, got %+v", req)
+	}
+}
+
+// TestAnthropicClientError tests that API errors are returned with their message
+func TestAnthropicClientError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(w, `{"type":"error","error":{"type":"authentication_error","message":"invalid x-api-key"}}`)
+	}))
+	defer srv.Close()
+
+	client := NewAnthropicClientWithConfig(AnthropicConfig{APIKey: "bad-key", BaseURL: srv.URL})
+	_, err := client.Ask(context.Background(), "Hello")
+	if err == nil || !strings.Contains(err.Error(), "invalid x-api-key") {
+		t.Errorf("Expected the API error message, got %v", err)
+	}
+}
+
+// TestNewClientForProvider tests that the provider is chosen from its name or PML_PROVIDER
+func TestNewClientForProvider(t *testing.T) {
+	t.Setenv("OPENAI_API_KEY", "openai-key")
+	t.Setenv("ANTHROPIC_API_KEY", "anthropic-key")
+	t.Setenv("ANTHROPIC_MODEL", "claude-3-5-sonnet-latest")
+	t.Setenv(ProfileEnv, "")
+
+	t.Setenv(ProviderEnv, "anthropic")
+	client, err := NewClientForProvider("")
+	if err != nil {
+		t.Fatalf("NewClientForProvider() error = %v", err)
+	}
+	if _, ok := client.(*AnthropicClient); !ok || client.Model() != "claude-3-5-sonnet-latest" {
+		t.Errorf("Expected an Anthropic client with the configured model, got %T %q", client, client.Model())
+	}
+
+	client, err = NewClientForProvider("openai")
+	if err != nil {
+		t.Fatalf("NewClientForProvider() error = %v", err)
+	}
+	if _, ok := client.(*Client); !ok {
+		t.Errorf("Expected an OpenAI client, got %T", client)
+	}
+
+	if _, err := NewClientForProvider("gemini"); err == nil {
+		t.Error("Expected an error for an unknown provider")
+	}
+
+	// A preset temperature replaces the environment's
+	t.Setenv("OPENAI_TEMPERATURE", "1")
+	temperature := float32(0.2)
+	for _, provider := range []string{"openai", "anthropic", "ollama"} {
+		client, err := NewClientForProviderWithTemperature(provider, &temperature)
+		if err != nil {
+			t.Fatalf("NewClientForProviderWithTemperature(%s) error = %v", provider, err)
+		}
+		var got *float32
+		switch c := client.(type) {
+		case *Client:
+			got = c.config.Temperature
+		case *AnthropicClient:
+			got = c.config.Temperature
+		case *OllamaClient:
+			got = c.config.Temperature
+		}
+		if got == nil || *got != temperature {
+			t.Errorf("Expected the %s client to use temperature %v, got %v", provider, temperature, got)
+		}
+	}
+
+	t.Setenv("ANTHROPIC_API_KEY", "")
+	if client, err := NewClientForProvider("anthropic"); err == nil || client != nil {
+		t.Errorf("Expected an error and no client without ANTHROPIC_API_KEY, got %v, %v", client, err)
+	}
+}
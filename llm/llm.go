@@ -1,45 +1,307 @@
 package llm
 
 import (
+	"bytes"
 	"context"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
+	"io"
+	"net/http"
 	"os"
+	"os/exec"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 
 	openai "github.com/sashabaranov/go-openai"
 )
 
+// DefaultModel is the model used when a prompt does not request a specific one
+// and none is configured
+const DefaultModel = "gpt-4o-mini"
+
+// DefaultEmbeddingModel is the model used by Embed when none is configured
+const DefaultEmbeddingModel = "text-embedding-3-small"
+
+// ModelEnv sets the model of clients whose Config has none
+const ModelEnv = "OPENAI_MODEL"
+
+// ProfileEnv selects the credential profile used by NewClient
+const ProfileEnv = "PML_PROFILE"
+
 // Client represents an LLM client
 type Client struct {
 	openaiClient *openai.Client
+	config       Config
+	model        string // Model for prompts that don't request one
+	summaryModel string // Model for Summarize
+	modelsMu     sync.Mutex
+	models       []string // Models available to the client, once listed
+}
+
+// Config holds the credentials and models a Client is constructed with
+type Config struct {
+	APIKey  string
+	BaseURL string
+	OrgID   string
+
+	Model          string // Model for prompts that don't request one; $OPENAI_MODEL, then DefaultModel, if empty
+	SummaryModel   string // Model for Summarize; Model if empty
+	EmbeddingModel string // Model for Embed; DefaultEmbeddingModel if empty
+
+	// Sampling settings sent with every request. A nil Temperature or TopP, or a
+	// MaxTokens of 0, is unset and leaves the provider's default; a Temperature
+	// of 0 is sent rather than omitted, for answers as reproducible as the
+	// provider allows.
+	Temperature *float32
+	TopP        *float32
+	MaxTokens   int
+}
+
+// Environment variables naming a secret source for the API key, preferred over
+// OPENAI_API_KEY. Profiles append their suffix, e.g. PML_OPENAI_API_KEY_FILE_TEAM_A.
+const (
+	APIKeyFileEnv = "PML_OPENAI_API_KEY_FILE" // File containing the key, e.g. a mounted Docker or Kubernetes secret
+	APIKeyCmdEnv  = "PML_OPENAI_API_KEY_CMD"  // Shell command printing the key, e.g. a secret manager CLI
+)
+
+// LoadConfig reads the credentials of a profile from the environment. The default
+// (empty) profile uses OPENAI_API_KEY, OPENAI_BASE_URL and OPENAI_ORG_ID; a named
+// profile such as "team-a" uses OPENAI_API_KEY_TEAM_A, OPENAI_BASE_URL_TEAM_A and
+// OPENAI_ORG_ID_TEAM_A. The key is read from PML_OPENAI_API_KEY_FILE or
+// PML_OPENAI_API_KEY_CMD instead when either is set.
+func LoadConfig(profile string) (Config, error) {
+	suffix := ""
+	if profile != "" {
+		suffix = "_" + strings.ToUpper(strings.NewReplacer("-", "_", ".", "_").Replace(profile))
+	}
+
+	apiKey, err := loadAPIKey(suffix)
+	if err != nil {
+		return Config{}, err
+	}
+	config := Config{
+		APIKey:         apiKey,
+		BaseURL:        os.Getenv("OPENAI_BASE_URL" + suffix),
+		OrgID:          os.Getenv("OPENAI_ORG_ID" + suffix),
+		Model:          os.Getenv(ModelEnv + suffix),
+		SummaryModel:   os.Getenv("OPENAI_SUMMARY_MODEL" + suffix),
+		EmbeddingModel: os.Getenv("OPENAI_EMBEDDING_MODEL" + suffix),
+	}
+	if err := loadSampling(&config, suffix); err != nil {
+		return config, err
+	}
+	if config.APIKey == "" {
+		if profile == "" {
+			return config, fmt.Errorf("OPENAI_API_KEY environment variable is not set. Please configure it in the PML extension settings")
+		}
+		return config, fmt.Errorf("OPENAI_API_KEY%s environment variable is not set for profile %q", suffix, profile)
+	}
+	return config, nil
+}
+
+// loadSampling reads the sampling settings of a profile from OPENAI_TEMPERATURE,
+// OPENAI_TOP_P and OPENAI_MAX_TOKENS, leaving those that aren't set unset
+func loadSampling(config *Config, suffix string) error {
+	for _, setting := range []struct {
+		env   string
+		value **float32
+	}{
+		{"OPENAI_TEMPERATURE" + suffix, &config.Temperature},
+		{"OPENAI_TOP_P" + suffix, &config.TopP},
+	} {
+		value := os.Getenv(setting.env)
+		if value == "" {
+			continue
+		}
+		f, err := strconv.ParseFloat(value, 32)
+		if err != nil {
+			return fmt.Errorf("invalid %s %q: %w", setting.env, value, err)
+		}
+		f32 := float32(f)
+		*setting.value = &f32
+	}
+	if value := os.Getenv("OPENAI_MAX_TOKENS" + suffix); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return fmt.Errorf("invalid OPENAI_MAX_TOKENS%s %q: expected a non-negative integer", suffix, value)
+		}
+		config.MaxTokens = n
+	}
+	return nil
 }
 
-// NewClient creates a new LLM client
+// loadAPIKey reads the API key from the key file, the key command or the
+// environment, in that order of preference
+func loadAPIKey(suffix string) (string, error) {
+	if path := os.Getenv(APIKeyFileEnv + suffix); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("failed to read API key from %s: %w", APIKeyFileEnv+suffix, err)
+		}
+		return strings.TrimSpace(string(data)), nil
+	}
+	if command := os.Getenv(APIKeyCmdEnv + suffix); command != "" {
+		cmd := exec.Command("sh", "-c", command)
+		cmd.Stderr = os.Stderr
+		out, err := cmd.Output()
+		if err != nil {
+			return "", fmt.Errorf("failed to run %s: %w", APIKeyCmdEnv+suffix, err)
+		}
+		return strings.TrimSpace(string(out)), nil
+	}
+	return os.Getenv("OPENAI_API_KEY" + suffix), nil
+}
+
+// NewClient creates a new LLM client using the profile selected by PML_PROFILE
 func NewClient() (*Client, error) {
-	apiKey := os.Getenv("OPENAI_API_KEY")
-	if apiKey == "" {
-		return nil, fmt.Errorf("OPENAI_API_KEY environment variable is not set. Please configure it in the PML extension settings")
+	return NewClientForProfile(os.Getenv(ProfileEnv))
+}
+
+// NewClientForProfile creates a new LLM client using a profile's credentials
+func NewClientForProfile(profile string) (*Client, error) {
+	config, err := LoadConfig(profile)
+	if err != nil {
+		return nil, err
+	}
+	return NewClientWithConfig(config), nil
+}
+
+// NewClientWithConfig creates a new LLM client from explicit credentials
+func NewClientWithConfig(config Config) *Client {
+	openaiConfig := openai.DefaultConfig(config.APIKey)
+	if config.BaseURL != "" {
+		openaiConfig.BaseURL = config.BaseURL
+	}
+	openaiConfig.OrgID = config.OrgID
+	// Requests slow down as the rate limits reported by the API run low
+	var transport http.RoundTripper = newRateLimiter(http.DefaultTransport)
+	if config.Temperature != nil && *config.Temperature == 0 {
+		transport = zeroTemperature{next: transport}
+	}
+	openaiConfig.HTTPClient = &http.Client{Transport: transport}
+
+	model := config.Model
+	if model == "" {
+		model = os.Getenv(ModelEnv)
+	}
+	if model == "" {
+		model = DefaultModel
+	}
+	summaryModel := config.SummaryModel
+	if summaryModel == "" {
+		summaryModel = model
 	}
 
 	return &Client{
-		openaiClient: openai.NewClient(apiKey),
-	}, nil
+		openaiClient: openai.NewClientWithConfig(openaiConfig),
+		config:       config,
+		model:        model,
+		summaryModel: summaryModel,
+	}
 }
 
-// Ask sends a prompt to the LLM and returns the response
+// Model returns the model used for prompts that don't request one
+func (c *Client) Model() string {
+	return c.model
+}
+
+// Ask sends a prompt to the client's model and returns the response
 func (c *Client) Ask(ctx context.Context, prompt string) (string, error) {
-	resp, err := c.openaiClient.CreateChatCompletion(
-		ctx,
-		openai.ChatCompletionRequest{
-			Model: "gpt-4o-mini",
-			Messages: []openai.ChatCompletionMessage{
-				{
-					Role:    openai.ChatMessageRoleUser,
-					Content: prompt,
+	return c.AskWithModel(ctx, c.model, prompt)
+}
+
+// AskWithModel sends a prompt to the given model and returns the response. An
+// empty model uses the client's model.
+func (c *Client) AskWithModel(ctx context.Context, model, prompt string) (string, error) {
+	if model == "" {
+		model = c.model
+	}
+	req := openai.ChatCompletionRequest{
+		Model: model,
+		Messages: []openai.ChatCompletionMessage{
+			{
+				Role:    openai.ChatMessageRoleUser,
+				Content: prompt,
+			},
+		},
+	}
+	c.applySampling(&req)
+	resp, err := c.openaiClient.CreateChatCompletion(ctx, req)
+	if err != nil {
+		return "", fmt.Errorf("failed to get LLM response: %w", err)
+	}
+
+	if len(resp.Choices) == 0 {
+		return "", fmt.Errorf("no choices returned from LLM")
+	}
+
+	return strings.TrimSpace(resp.Choices[0].Message.Content), nil
+}
+
+// AskWithSystem sends a prompt preceded by a system prompt to the given model and
+// returns the response. An empty model uses the client's model.
+func (c *Client) AskWithSystem(ctx context.Context, model, system, prompt string) (string, error) {
+	if model == "" {
+		model = c.model
+	}
+	req := openai.ChatCompletionRequest{
+		Model: model,
+		Messages: []openai.ChatCompletionMessage{
+			{
+				Role:    openai.ChatMessageRoleSystem,
+				Content: system,
+			},
+			{
+				Role:    openai.ChatMessageRoleUser,
+				Content: prompt,
+			},
+		},
+	}
+	c.applySampling(&req)
+	resp, err := c.openaiClient.CreateChatCompletion(ctx, req)
+	if err != nil {
+		return "", fmt.Errorf("failed to get LLM response: %w", err)
+	}
+
+	if len(resp.Choices) == 0 {
+		return "", fmt.Errorf("no choices returned from LLM")
+	}
+
+	return strings.TrimSpace(resp.Choices[0].Message.Content), nil
+}
+
+// AskWithImage sends a prompt with an image, such as a PNG or JPEG of the given
+// MIME type, to a vision-capable model and returns the response. An empty model
+// uses the client's model.
+func (c *Client) AskWithImage(ctx context.Context, model, prompt string, image []byte, mimeType string) (string, error) {
+	if model == "" {
+		model = c.model
+	}
+	req := openai.ChatCompletionRequest{
+		Model: model,
+		Messages: []openai.ChatCompletionMessage{
+			{
+				Role: openai.ChatMessageRoleUser,
+				MultiContent: []openai.ChatMessagePart{
+					{
+						Type: openai.ChatMessagePartTypeText,
+						Text: prompt,
+					},
+					{
+						Type: openai.ChatMessagePartTypeImageURL,
+						ImageURL: &openai.ChatMessageImageURL{
+							URL: "data:" + mimeType + ";base64," + base64.StdEncoding.EncodeToString(image),
+						},
+					},
 				},
 			},
 		},
-	)
+	}
+	c.applySampling(&req)
+	resp, err := c.openaiClient.CreateChatCompletion(ctx, req)
 	if err != nil {
 		return "", fmt.Errorf("failed to get LLM response: %w", err)
 	}
@@ -51,29 +313,103 @@ func (c *Client) Ask(ctx context.Context, prompt string) (string, error) {
 	return strings.TrimSpace(resp.Choices[0].Message.Content), nil
 }
 
-// Summarize generates a very short summary of the given text
-func (c *Client) Summarize(ctx context.Context, text string) (string, error) {
-	resp, err := c.openaiClient.CreateChatCompletion(
-		ctx,
-		openai.ChatCompletionRequest{
-			Model: "gpt-4o-mini",
-			Messages: []openai.ChatCompletionMessage{
-				{
-					Role:    openai.ChatMessageRoleSystem,
-					Content: `You are a summarizer that creates extremely concise summaries. 
+// applySampling sets the client's sampling settings on req. A temperature of 0
+// is left out of req by the API client and added back by zeroTemperature.
+func (c *Client) applySampling(req *openai.ChatCompletionRequest) {
+	if c.config.Temperature != nil {
+		req.Temperature = *c.config.Temperature
+	}
+	if c.config.TopP != nil {
+		req.TopP = *c.config.TopP
+	}
+	req.MaxTokens = c.config.MaxTokens
+}
+
+// zeroTemperature is an http.RoundTripper adding "temperature": 0 to chat
+// completion requests without a temperature. The API client omits a zero
+// temperature from the request body, which would leave the provider's default
+// of 1.
+type zeroTemperature struct {
+	next http.RoundTripper
+}
+
+// RoundTrip sends req with an explicit temperature of 0
+func (t zeroTemperature) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body == nil || !strings.HasSuffix(req.URL.Path, "/chat/completions") {
+		return t.next.RoundTrip(req)
+	}
+	data, err := io.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	var body map[string]json.RawMessage
+	if err := json.Unmarshal(data, &body); err == nil {
+		if _, ok := body["temperature"]; !ok {
+			body["temperature"] = json.RawMessage("0")
+			if patched, err := json.Marshal(body); err == nil {
+				data = patched
+			}
+		}
+	}
+
+	// Send a copy, as a RoundTripper must not modify the request
+	req = req.Clone(req.Context())
+	req.Body = io.NopCloser(bytes.NewReader(data))
+	req.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(data)), nil
+	}
+	req.ContentLength = int64(len(data))
+	return t.next.RoundTrip(req)
+}
+
+// Models returns the IDs of the models available to the client, sorted. The
+// provider is only asked once; later calls return the same list.
+func (c *Client) Models(ctx context.Context) ([]string, error) {
+	c.modelsMu.Lock()
+	defer c.modelsMu.Unlock()
+	if c.models != nil {
+		return c.models, nil
+	}
+
+	list, err := c.openaiClient.ListModels(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list models: %w", err)
+	}
+	models := make([]string, 0, len(list.Models))
+	for _, model := range list.Models {
+		models = append(models, model.ID)
+	}
+	sort.Strings(models)
+	c.models = models
+	return models, nil
+}
+
+// summarySystemPrompt instructs the summary model to answer in a few words
+const summarySystemPrompt = `You are a summarizer that creates extremely concise summaries. 
                              Keep summaries under 5 words. 
 							 As short as possible. But not loosing the point.
 							 For example:
 							 "The capital of Japan is Tokyo." -> "Tokyo"
-							 "Hello, world!" -> "Hello, world!"`,
-				},
-				{
-					Role:    openai.ChatMessageRoleUser,
-					Content: "Summarize this in under 5 words:\n" + text,
-				},
+							 "Hello, world!" -> "Hello, world!"`
+
+// Summarize generates a very short summary of the given text with the summary model
+func (c *Client) Summarize(ctx context.Context, text string) (string, error) {
+	req := openai.ChatCompletionRequest{
+		Model: c.summaryModel,
+		Messages: []openai.ChatCompletionMessage{
+			{
+				Role:    openai.ChatMessageRoleSystem,
+				Content: summarySystemPrompt,
+			},
+			{
+				Role:    openai.ChatMessageRoleUser,
+				Content: "Summarize this in under 5 words:\n" + text,
 			},
 		},
-	)
+	}
+	c.applySampling(&req)
+	resp, err := c.openaiClient.CreateChatCompletion(ctx, req)
 	if err != nil {
 		return "", fmt.Errorf("failed to get summary: %w", err)
 	}
@@ -84,3 +420,22 @@ func (c *Client) Summarize(ctx context.Context, text string) (string, error) {
 
 	return strings.TrimSpace(resp.Choices[0].Message.Content), nil
 }
+
+// Embed returns the embedding vector of text, computed by the embedding model
+func (c *Client) Embed(ctx context.Context, text string) ([]float32, error) {
+	model := c.config.EmbeddingModel
+	if model == "" {
+		model = DefaultEmbeddingModel
+	}
+	resp, err := c.openaiClient.CreateEmbeddings(ctx, openai.EmbeddingRequestStrings{
+		Input: []string{text},
+		Model: openai.EmbeddingModel(model),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get embedding: %w", err)
+	}
+	if len(resp.Data) == 0 {
+		return nil, fmt.Errorf("no embedding returned from LLM")
+	}
+	return resp.Data[0].Embedding, nil
+}
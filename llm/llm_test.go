@@ -2,7 +2,15 @@ package llm
 
 import (
 	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"sync/atomic"
 	"testing"
 )
 
@@ -56,7 +64,7 @@ func TestClientAsk(t *testing.T) {
 
 	ctx := context.Background()
 	prompt := "What is 2+2?"
-	
+
 	response, err := client.Ask(ctx, prompt)
 	if err != nil {
 		t.Errorf("Ask() error = %v", err)
@@ -65,4 +73,345 @@ func TestClientAsk(t *testing.T) {
 	if response == "" {
 		t.Error("Ask() returned empty response")
 	}
-} 
\ No newline at end of file
+}
+
+func TestNewClientForProfile(t *testing.T) {
+	t.Setenv("OPENAI_API_KEY", "default-key")
+	t.Setenv("OPENAI_API_KEY_TEAM_A", "team-a-key")
+	t.Setenv("OPENAI_BASE_URL_TEAM_A", "https://team-a.example.com/v1")
+	t.Setenv("OPENAI_ORG_ID_TEAM_A", "org-team-a")
+	t.Setenv("OPENAI_API_KEY_TEAM_B", "")
+
+	client, err := NewClientForProfile("team-a")
+	if err != nil {
+		t.Fatalf("NewClientForProfile() error = %v", err)
+	}
+	want := Config{
+		APIKey:  "team-a-key",
+		BaseURL: "https://team-a.example.com/v1",
+		OrgID:   "org-team-a",
+	}
+	if client.config != want {
+		t.Errorf("Expected config %+v, got %+v", want, client.config)
+	}
+
+	// The default profile still uses OPENAI_API_KEY
+	t.Setenv(ProfileEnv, "")
+	client, err = NewClient()
+	if err != nil {
+		t.Fatalf("NewClient() error = %v", err)
+	}
+	if client.config.APIKey != "default-key" {
+		t.Errorf("Expected default key, got %q", client.config.APIKey)
+	}
+
+	// PML_PROFILE selects the profile for NewClient
+	t.Setenv(ProfileEnv, "team-a")
+	client, err = NewClient()
+	if err != nil {
+		t.Fatalf("NewClient() error = %v", err)
+	}
+	if client.config.APIKey != "team-a-key" {
+		t.Errorf("Expected team-a key, got %q", client.config.APIKey)
+	}
+
+	// A profile without a key is an error rather than a fallback to the default key
+	if _, err := NewClientForProfile("team-b"); err == nil {
+		t.Error("Expected error for profile without an API key")
+	}
+}
+
+func TestLoadConfigAPIKeyFile(t *testing.T) {
+	keyFile := filepath.Join(t.TempDir(), "openai-key")
+	if err := os.WriteFile(keyFile, []byte("  file-key\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("OPENAI_API_KEY", "inline-key")
+	t.Setenv(APIKeyFileEnv, keyFile)
+	t.Setenv(APIKeyCmdEnv, "echo cmd-key")
+
+	config, err := LoadConfig("")
+	if err != nil {
+		t.Fatalf("LoadConfig() error = %v", err)
+	}
+	if config.APIKey != "file-key" {
+		t.Errorf("APIKey = %q, want the trimmed key from the file", config.APIKey)
+	}
+
+	t.Setenv(APIKeyFileEnv, filepath.Join(t.TempDir(), "missing"))
+	if _, err := LoadConfig(""); err == nil {
+		t.Error("LoadConfig() should fail when the key file is missing")
+	}
+}
+
+func TestLoadConfigAPIKeyCommand(t *testing.T) {
+	t.Setenv("OPENAI_API_KEY", "inline-key")
+	t.Setenv(APIKeyFileEnv, "")
+	t.Setenv(APIKeyCmdEnv, "printf '  cmd-key\\n'")
+	t.Setenv(APIKeyCmdEnv+"_TEAM_A", "echo team-a-cmd-key")
+
+	config, err := LoadConfig("")
+	if err != nil {
+		t.Fatalf("LoadConfig() error = %v", err)
+	}
+	if config.APIKey != "cmd-key" {
+		t.Errorf("APIKey = %q, want the trimmed output of the command", config.APIKey)
+	}
+
+	config, err = LoadConfig("team-a")
+	if err != nil {
+		t.Fatalf("LoadConfig(team-a) error = %v", err)
+	}
+	if config.APIKey != "team-a-cmd-key" {
+		t.Errorf("APIKey = %q, want the profile's command output", config.APIKey)
+	}
+
+	t.Setenv(APIKeyCmdEnv, "exit 1")
+	if _, err := LoadConfig(""); err == nil {
+		t.Error("LoadConfig() should fail when the key command fails")
+	}
+}
+
+// TestClientAskWithImage tests that the image is sent base64-encoded alongside the prompt
+func TestClientAskWithImage(t *testing.T) {
+	var body []byte
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ = io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"id":"1","object":"chat.completion","model":"gpt-4o","choices":[{"index":0,"message":{"role":"assistant","content":"A cat"},"finish_reason":"stop"}]}`)
+	}))
+	defer srv.Close()
+	client := NewClientWithConfig(Config{APIKey: "test-key", BaseURL: srv.URL + "/v1"})
+
+	answer, err := client.AskWithImage(context.Background(), "gpt-4o", "What is in this picture?", []byte("png-bytes"), "image/png")
+	if err != nil {
+		t.Fatalf("AskWithImage() error = %v", err)
+	}
+	if answer != "A cat" {
+		t.Errorf("Expected the response, got %q", answer)
+	}
+
+	var req struct {
+		Model    string `json:"model"`
+		Messages []struct {
+			Content []struct {
+				Type     string `json:"type"`
+				Text     string `json:"text"`
+				ImageURL struct {
+					URL string `json:"url"`
+				} `json:"image_url"`
+			} `json:"content"`
+		} `json:"messages"`
+	}
+	if err := json.Unmarshal(body, &req); err != nil {
+		t.Fatalf("Invalid request payload %s: %v", body, err)
+	}
+	if req.Model != "gpt-4o" || len(req.Messages) != 1 || len(req.Messages[0].Content) != 2 {
+		t.Fatalf("Unexpected request payload: %s", body)
+	}
+	parts := req.Messages[0].Content
+	if parts[0].Type != "text" || parts[0].Text != "What is in this picture?" {
+		t.Errorf("Expected the prompt as the first part, got %+v", parts[0])
+	}
+	want := "data:image/png;base64," + base64.StdEncoding.EncodeToString([]byte("png-bytes"))
+	if parts[1].Type != "image_url" || parts[1].ImageURL.URL != want {
+		t.Errorf("Expected the image as a data URL, got %+v", parts[1])
+	}
+}
+
+// TestClientModels tests that the available models are listed once and cached
+func TestClientModels(t *testing.T) {
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if r.URL.Path != "/v1/models" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"object":"list","data":[{"id":"gpt-4o-mini","object":"model"},{"id":"gpt-4o","object":"model"}]}`)
+	}))
+	defer srv.Close()
+	client := NewClientWithConfig(Config{APIKey: "test-key", BaseURL: srv.URL + "/v1"})
+
+	for i := 0; i < 2; i++ {
+		models, err := client.Models(context.Background())
+		if err != nil {
+			t.Fatalf("Models() error = %v", err)
+		}
+		if len(models) != 2 || models[0] != "gpt-4o" || models[1] != "gpt-4o-mini" {
+			t.Errorf("Expected the sorted model list, got %v", models)
+		}
+	}
+	if got := atomic.LoadInt32(&requests); got != 1 {
+		t.Errorf("Expected the list to be requested once, got %d requests", got)
+	}
+}
+
+// TestClientConfiguredModels tests that prompts and summaries use the models of
+// the config, falling back to $OPENAI_MODEL and then DefaultModel
+func TestClientConfiguredModels(t *testing.T) {
+	var models []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Model string `json:"model"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("Invalid request payload: %v", err)
+		}
+		models = append(models, req.Model)
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"id":"1","object":"chat.completion","choices":[{"index":0,"message":{"role":"assistant","content":"OK"},"finish_reason":"stop"}]}`)
+	}))
+	defer srv.Close()
+
+	tests := []struct {
+		name        string
+		config      Config
+		env         string
+		wantAsk     string
+		wantSummary string
+	}{
+		{"configured", Config{Model: "gpt-4o", SummaryModel: "gpt-4o-mini"}, "o3", "gpt-4o", "gpt-4o-mini"},
+		{"summary follows model", Config{Model: "gpt-4o"}, "", "gpt-4o", "gpt-4o"},
+		{"environment", Config{}, "o3", "o3", "o3"},
+		{"default", Config{}, "", DefaultModel, DefaultModel},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv(ModelEnv, tt.env)
+			tt.config.APIKey = "test-key"
+			tt.config.BaseURL = srv.URL + "/v1"
+			client := NewClientWithConfig(tt.config)
+			models = nil
+			if _, err := client.Ask(context.Background(), "Hello"); err != nil {
+				t.Fatalf("Ask() error = %v", err)
+			}
+			if _, err := client.Summarize(context.Background(), "Hello"); err != nil {
+				t.Fatalf("Summarize() error = %v", err)
+			}
+			if len(models) != 2 || models[0] != tt.wantAsk || models[1] != tt.wantSummary {
+				t.Errorf("Expected models %q and %q, got %v", tt.wantAsk, tt.wantSummary, models)
+			}
+			if client.Model() != tt.wantAsk {
+				t.Errorf("Model() = %q, want %q", client.Model(), tt.wantAsk)
+			}
+		})
+	}
+}
+
+// TestClientSampling tests that the configured sampling settings are sent with
+// every request, including an explicit temperature of 0, and omitted when unset
+func TestClientSampling(t *testing.T) {
+	var payloads []map[string]any
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req map[string]any
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("Invalid request payload: %v", err)
+		}
+		payloads = append(payloads, req)
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"id":"1","object":"chat.completion","choices":[{"index":0,"message":{"role":"assistant","content":"OK"},"finish_reason":"stop"}]}`)
+	}))
+	defer srv.Close()
+
+	zero, topP := float32(0), float32(0.5)
+	tests := []struct {
+		name   string
+		config Config
+		check  func(t *testing.T, req map[string]any)
+	}{
+		{"unset", Config{}, func(t *testing.T, req map[string]any) {
+			for _, key := range []string{"temperature", "top_p", "max_tokens"} {
+				if _, ok := req[key]; ok {
+					t.Errorf("Expected %s to be omitted, got %v", key, req[key])
+				}
+			}
+		}},
+		{"zero temperature", Config{Temperature: &zero, TopP: &topP, MaxTokens: 256}, func(t *testing.T, req map[string]any) {
+			if temperature, ok := req["temperature"].(float64); !ok || temperature != 0 {
+				t.Errorf("Expected a temperature of 0 to be sent, got %v", req["temperature"])
+			}
+			if req["top_p"] != 0.5 {
+				t.Errorf("Expected top_p 0.5, got %v", req["top_p"])
+			}
+			if req["max_tokens"] != float64(256) {
+				t.Errorf("Expected max_tokens 256, got %v", req["max_tokens"])
+			}
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.config.APIKey = "test-key"
+			tt.config.BaseURL = srv.URL + "/v1"
+			client := NewClientWithConfig(tt.config)
+			payloads = nil
+			if _, err := client.Ask(context.Background(), "Hello"); err != nil {
+				t.Fatalf("Ask() error = %v", err)
+			}
+			if _, err := client.AskWithSystem(context.Background(), "", "Be brief", "Hello"); err != nil {
+				t.Fatalf("AskWithSystem() error = %v", err)
+			}
+			if len(payloads) != 2 {
+				t.Fatalf("Expected 2 requests, got %d", len(payloads))
+			}
+			for _, req := range payloads {
+				tt.check(t, req)
+			}
+		})
+	}
+}
+
+func TestClientEmbed(t *testing.T) {
+	var req map[string]any
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/embeddings" {
+			t.Errorf("Unexpected path %s", r.URL.Path)
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("Invalid request payload: %v", err)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"object":"list","data":[{"object":"embedding","index":0,"embedding":[0.25,-0.5,1]}],"model":"text-embedding-3-large"}`)
+	}))
+	defer srv.Close()
+
+	client := NewClientWithConfig(Config{APIKey: "test-key", BaseURL: srv.URL + "/v1", EmbeddingModel: "text-embedding-3-large"})
+	vector, err := client.Embed(context.Background(), "Hello")
+	if err != nil {
+		t.Fatalf("Embed() error = %v", err)
+	}
+	if len(vector) != 3 || vector[0] != 0.25 || vector[1] != -0.5 || vector[2] != 1 {
+		t.Errorf("Unexpected embedding %v", vector)
+	}
+	if req["model"] != "text-embedding-3-large" {
+		t.Errorf("Expected the configured embedding model, got %v", req["model"])
+	}
+}
+
+// TestLoadConfigSampling tests that sampling settings are read from the
+// environment, telling a temperature of 0 apart from an unset one
+func TestLoadConfigSampling(t *testing.T) {
+	t.Setenv("OPENAI_API_KEY", "test-key")
+	t.Setenv("OPENAI_TEMPERATURE", "0")
+	t.Setenv("OPENAI_TOP_P", "")
+	t.Setenv("OPENAI_MAX_TOKENS", "512")
+	config, err := LoadConfig("")
+	if err != nil {
+		t.Fatalf("LoadConfig() error = %v", err)
+	}
+	if config.Temperature == nil || *config.Temperature != 0 {
+		t.Errorf("Expected an explicit temperature of 0, got %v", config.Temperature)
+	}
+	if config.TopP != nil {
+		t.Errorf("Expected top_p to be unset, got %v", *config.TopP)
+	}
+	if config.MaxTokens != 512 {
+		t.Errorf("Expected max tokens 512, got %d", config.MaxTokens)
+	}
+
+	t.Setenv("OPENAI_MAX_TOKENS", "many")
+	if _, err := LoadConfig(""); err == nil {
+		t.Error("Expected an error for an invalid OPENAI_MAX_TOKENS")
+	}
+}
@@ -0,0 +1,271 @@
+package llm
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// DefaultOllamaBaseURL is the address of a local Ollama server
+const DefaultOllamaBaseURL = "http://localhost:11434"
+
+// DefaultOllamaModel is the model used by an OllamaClient when a prompt does
+// not request a specific one and none is configured
+const DefaultOllamaModel = "llama3.2"
+
+// OllamaConfig holds the server, models and sampling settings an OllamaClient
+// is constructed with
+type OllamaConfig struct {
+	BaseURL string // Server URL; DefaultOllamaBaseURL if empty
+
+	Model        string // Model for prompts that don't request one; DefaultOllamaModel if empty
+	SummaryModel string // Model for Summarize; Model if empty
+
+	// Sampling settings sent with every request, leaving the model's defaults
+	// when nil or 0. MaxTokens is sent as num_predict.
+	Temperature *float32
+	TopP        *float32
+	MaxTokens   int
+}
+
+// LoadOllamaConfig reads the Ollama server and models from OLLAMA_HOST,
+// OLLAMA_MODEL and OLLAMA_SUMMARY_MODEL. No credentials are needed.
+func LoadOllamaConfig() OllamaConfig {
+	return OllamaConfig{
+		BaseURL:      os.Getenv("OLLAMA_HOST"),
+		Model:        os.Getenv("OLLAMA_MODEL"),
+		SummaryModel: os.Getenv("OLLAMA_SUMMARY_MODEL"),
+	}
+}
+
+// OllamaClient is an LLM client for a local Ollama server, for running without
+// network access. It has the same methods as Client, so either can be handed
+// to the parser.
+type OllamaClient struct {
+	httpClient   *http.Client
+	config       OllamaConfig
+	baseURL      string
+	model        string // Model for prompts that don't request one
+	summaryModel string // Model for Summarize
+	modelsMu     sync.Mutex
+	models       []string // Models available on the server, once listed
+}
+
+// NewOllamaClient creates an Ollama client from the environment
+func NewOllamaClient() *OllamaClient {
+	return NewOllamaClientWithConfig(LoadOllamaConfig())
+}
+
+// NewOllamaClientWithConfig creates an Ollama client from explicit settings
+func NewOllamaClientWithConfig(config OllamaConfig) *OllamaClient {
+	baseURL := strings.TrimSuffix(config.BaseURL, "/")
+	if baseURL == "" {
+		baseURL = DefaultOllamaBaseURL
+	}
+	if !strings.Contains(baseURL, "://") {
+		// OLLAMA_HOST is often just host:port
+		baseURL = "http://" + baseURL
+	}
+	model := config.Model
+	if model == "" {
+		model = DefaultOllamaModel
+	}
+	summaryModel := config.SummaryModel
+	if summaryModel == "" {
+		summaryModel = model
+	}
+	return &OllamaClient{
+		httpClient:   &http.Client{},
+		config:       config,
+		baseURL:      baseURL,
+		model:        model,
+		summaryModel: summaryModel,
+	}
+}
+
+// ollamaRequest is the body of an /api/generate request
+type ollamaRequest struct {
+	Model   string         `json:"model"`
+	Prompt  string         `json:"prompt"`
+	System  string         `json:"system,omitempty"`
+	Images  []string       `json:"images,omitempty"` // Base64-encoded
+	Stream  bool           `json:"stream"`
+	Options map[string]any `json:"options,omitempty"`
+}
+
+// ollamaResponse is a response object of /api/generate; a streamed answer is
+// split over several
+type ollamaResponse struct {
+	Response string `json:"response"`
+	Done     bool   `json:"done"`
+	Error    string `json:"error"`
+}
+
+// Model returns the model used for prompts that don't request one
+func (c *OllamaClient) Model() string {
+	return c.model
+}
+
+// Ask sends a prompt to the client's model and returns the response
+func (c *OllamaClient) Ask(ctx context.Context, prompt string) (string, error) {
+	return c.AskWithModel(ctx, c.model, prompt)
+}
+
+// AskWithModel sends a prompt to the given model and returns the response. An
+// empty model uses the client's model.
+func (c *OllamaClient) AskWithModel(ctx context.Context, model, prompt string) (string, error) {
+	return c.AskWithSystem(ctx, model, "", prompt)
+}
+
+// AskWithSystem sends a prompt with a system prompt to the given model and
+// returns the response. An empty model uses the client's model.
+func (c *OllamaClient) AskWithSystem(ctx context.Context, model, system, prompt string) (string, error) {
+	answer, err := c.generate(ctx, ollamaRequest{Model: model, System: system, Prompt: prompt})
+	if err != nil {
+		return "", fmt.Errorf("failed to get LLM response: %w", err)
+	}
+	return answer, nil
+}
+
+// AskWithImage sends a prompt with an image to a multimodal model, such as
+// llava, and returns the response. An empty model uses the client's model.
+func (c *OllamaClient) AskWithImage(ctx context.Context, model, prompt string, image []byte, mimeType string) (string, error) {
+	answer, err := c.generate(ctx, ollamaRequest{
+		Model:  model,
+		Prompt: prompt,
+		Images: []string{base64.StdEncoding.EncodeToString(image)},
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to get LLM response: %w", err)
+	}
+	return answer, nil
+}
+
+// Summarize generates a very short summary of the given text with the summary model
+func (c *OllamaClient) Summarize(ctx context.Context, text string) (string, error) {
+	answer, err := c.generate(ctx, ollamaRequest{
+		Model:  c.summaryModel,
+		System: summarySystemPrompt,
+		Prompt: "Summarize this in under 5 words:\n" + text,
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to get summary: %w", err)
+	}
+	return answer, nil
+}
+
+// Models returns the names of the models pulled on the server, sorted. The
+// server is only asked once; later calls return the same list.
+func (c *OllamaClient) Models(ctx context.Context) ([]string, error) {
+	c.modelsMu.Lock()
+	defer c.modelsMu.Unlock()
+	if c.models != nil {
+		return c.models, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.baseURL+"/api/tags", nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list models: %w", err)
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list models: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to list models: status %d", resp.StatusCode)
+	}
+	var tags struct {
+		Models []struct {
+			Name string `json:"name"`
+		} `json:"models"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tags); err != nil {
+		return nil, fmt.Errorf("failed to list models: %w", err)
+	}
+	models := make([]string, 0, len(tags.Models))
+	for _, model := range tags.Models {
+		models = append(models, model.Name)
+	}
+	sort.Strings(models)
+	c.models = models
+	return models, nil
+}
+
+// generate sends a non-streaming /api/generate request and returns the trimmed
+// answer. Should the server stream anyway, the parts are concatenated.
+func (c *OllamaClient) generate(ctx context.Context, body ollamaRequest) (string, error) {
+	if body.Model == "" {
+		body.Model = c.model
+	}
+	body.Stream = false
+	body.Options = c.options()
+	data, err := json.Marshal(body)
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.baseURL+"/api/generate", bytes.NewReader(data))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var answer strings.Builder
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var part ollamaResponse
+		if err := decoder.Decode(&part); err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if resp.StatusCode != http.StatusOK {
+				return "", fmt.Errorf("status %d", resp.StatusCode)
+			}
+			return "", fmt.Errorf("invalid response: %w", err)
+		}
+		if part.Error != "" {
+			return "", fmt.Errorf("status %d: %s", resp.StatusCode, part.Error)
+		}
+		answer.WriteString(part.Response)
+		if part.Done {
+			break
+		}
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return strings.TrimSpace(answer.String()), nil
+}
+
+// options returns the sampling settings of a request, or nil if none are set
+func (c *OllamaClient) options() map[string]any {
+	options := make(map[string]any)
+	if c.config.Temperature != nil {
+		options["temperature"] = *c.config.Temperature
+	}
+	if c.config.TopP != nil {
+		options["top_p"] = *c.config.TopP
+	}
+	if c.config.MaxTokens > 0 {
+		options["num_predict"] = c.config.MaxTokens
+	}
+	if len(options) == 0 {
+		return nil
+	}
+	return options
+}
@@ -0,0 +1,118 @@
+package llm
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// TestOllamaClientAsk tests that a prompt is posted to /api/generate without
+// streaming and the trimmed answer is returned
+func TestOllamaClientAsk(t *testing.T) {
+	var req map[string]any
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/api/generate" {
+			t.Errorf("Unexpected request %s %s", r.Method, r.URL.Path)
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("Invalid request payload: %v", err)
+		}
+		fmt.Fprint(w, `{"model":"llama3.2","response":" Tokyo\n","done":true}`)
+	}))
+	defer srv.Close()
+
+	client := NewOllamaClientWithConfig(OllamaConfig{BaseURL: srv.URL})
+	answer, err := client.Ask(context.Background(), "What is the capital of Japan?")
+	if err != nil {
+		t.Fatalf("Ask() error = %v", err)
+	}
+	if answer != "Tokyo" {
+		t.Errorf("Expected the trimmed answer, got %q", answer)
+	}
+	if req["model"] != DefaultOllamaModel || req["prompt"] != "What is the capital of Japan?" || req["stream"] != false {
+		t.Errorf("Unexpected request payload: %v", req)
+	}
+	if _, ok := req["options"]; ok {
+		t.Errorf("Expected no options without sampling settings, got %v", req["options"])
+	}
+}
+
+// TestOllamaClientStreamedResponse tests that a streamed answer is concatenated
+func TestOllamaClientStreamedResponse(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, `{"response":"Hello","done":false}`)
+		fmt.Fprintln(w, `{"response":", world","done":false}`)
+		fmt.Fprintln(w, `{"response":"!","done":true}`)
+	}))
+	defer srv.Close()
+
+	client := NewOllamaClientWithConfig(OllamaConfig{BaseURL: srv.URL, Model: "mistral"})
+	answer, err := client.Summarize(context.Background(), "Hello, world!")
+	if err != nil {
+		t.Fatalf("Summarize() error = %v", err)
+	}
+	if answer != "Hello, world!" {
+		t.Errorf("Expected the parts concatenated, got %q", answer)
+	}
+}
+
+// TestOllamaClientError tests that a server error is returned
+func TestOllamaClientError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, `{"error":"model \"missing\" not found, try pulling it first"}`)
+	}))
+	defer srv.Close()
+
+	client := NewOllamaClientWithConfig(OllamaConfig{BaseURL: srv.URL, Model: "missing"})
+	if _, err := client.Ask(context.Background(), "Hello"); err == nil {
+		t.Error("Expected the server's error")
+	}
+}
+
+// TestOllamaClientCancel tests that cancelling the context aborts the request
+func TestOllamaClientCancel(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-release:
+		}
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	client := NewOllamaClientWithConfig(OllamaConfig{BaseURL: srv.URL})
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := client.Ask(ctx, "Hello")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected the context's error, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected the request to stop with its context, took %v", elapsed)
+	}
+}
+
+// TestNewOllamaClientHost tests that OLLAMA_HOST may omit the scheme
+func TestNewOllamaClientHost(t *testing.T) {
+	t.Setenv("OLLAMA_HOST", "127.0.0.1:11500")
+	t.Setenv("OLLAMA_MODEL", "qwen2.5")
+	client, err := NewClientForProvider(ProviderOllama)
+	if err != nil {
+		t.Fatalf("NewClientForProvider() error = %v", err)
+	}
+	ollama, ok := client.(*OllamaClient)
+	if !ok {
+		t.Fatalf("Expected an Ollama client, got %T", client)
+	}
+	if ollama.baseURL != "http://127.0.0.1:11500" || ollama.Model() != "qwen2.5" {
+		t.Errorf("Unexpected server %q or model %q", ollama.baseURL, ollama.Model())
+	}
+}
@@ -0,0 +1,80 @@
+package llm
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// ProviderEnv selects the LLM provider used by NewClientForProvider
+const ProviderEnv = "PML_PROVIDER"
+
+// Providers accepted by NewClientForProvider
+const (
+	ProviderOpenAI    = "openai"
+	ProviderAnthropic = "anthropic"
+	ProviderOllama    = "ollama"
+)
+
+// Backend is an LLM client of any provider: a *Client, *AnthropicClient or *OllamaClient
+type Backend interface {
+	Model() string
+	Ask(ctx context.Context, prompt string) (string, error)
+	AskWithModel(ctx context.Context, model, prompt string) (string, error)
+	AskWithSystem(ctx context.Context, model, system, prompt string) (string, error)
+	AskWithImage(ctx context.Context, model, prompt string, image []byte, mimeType string) (string, error)
+	Models(ctx context.Context) ([]string, error)
+	Summarize(ctx context.Context, text string) (string, error)
+}
+
+// Embedder is implemented by backends that can compute embeddings; of the
+// providers, only OpenAI's *Client does
+type Embedder interface {
+	Embed(ctx context.Context, text string) ([]float32, error)
+}
+
+// NewClientForProvider creates a client for the named provider, "openai",
+// "anthropic" or "ollama", configured from the environment. An empty provider
+// is read from PML_PROVIDER and defaults to OpenAI, using the profile selected
+// by PML_PROFILE.
+func NewClientForProvider(provider string) (Backend, error) {
+	return NewClientForProviderWithTemperature(provider, nil)
+}
+
+// NewClientForProviderWithTemperature is NewClientForProvider with the
+// sampling temperature of the environment replaced by temperature, if not nil
+func NewClientForProviderWithTemperature(provider string, temperature *float32) (Backend, error) {
+	if provider == "" {
+		provider = os.Getenv(ProviderEnv)
+	}
+	// Return a nil Backend, not a nil client, on errors
+	switch strings.ToLower(provider) {
+	case "", ProviderOpenAI:
+		config, err := LoadConfig(os.Getenv(ProfileEnv))
+		if err != nil {
+			return nil, err
+		}
+		if temperature != nil {
+			config.Temperature = temperature
+		}
+		return NewClientWithConfig(config), nil
+	case ProviderAnthropic:
+		config, err := LoadAnthropicConfig()
+		if err != nil {
+			return nil, err
+		}
+		if temperature != nil {
+			config.Temperature = temperature
+		}
+		return NewAnthropicClientWithConfig(config), nil
+	case ProviderOllama:
+		config := LoadOllamaConfig()
+		if temperature != nil {
+			config.Temperature = temperature
+		}
+		return NewOllamaClientWithConfig(config), nil
+	default:
+		return nil, fmt.Errorf("unknown LLM provider %q (expected %s, %s or %s)", provider, ProviderOpenAI, ProviderAnthropic, ProviderOllama)
+	}
+}
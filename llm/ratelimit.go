@@ -0,0 +1,142 @@
+package llm
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Rate limit windows reported by the API in x-ratelimit-* response headers
+var rateLimitWindows = []string{"requests", "tokens"}
+
+// rateLimitLowFraction is the share of a window's limit below which requests are
+// spread out over the time left until the window resets
+const rateLimitLowFraction = 10
+
+// rateLimiter is an http.RoundTripper that throttles requests using the rate
+// limit headers of previous responses, so the client slows down before the API
+// starts answering with 429s
+type rateLimiter struct {
+	next    http.RoundTripper
+	now     func() time.Time
+	mu      sync.Mutex
+	windows map[string]rateWindow
+}
+
+// rateWindow is the state of one rate limit window as last reported by the API
+type rateWindow struct {
+	limit     int
+	remaining int
+	reset     time.Time
+}
+
+// newRateLimiter returns a rate limiter sending requests through next
+func newRateLimiter(next http.RoundTripper) *rateLimiter {
+	return &rateLimiter{
+		next:    next,
+		now:     time.Now,
+		windows: make(map[string]rateWindow),
+	}
+}
+
+// RoundTrip waits as long as the rate limits require, then sends the request
+func (l *rateLimiter) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := l.wait(req.Context()); err != nil {
+		return nil, err
+	}
+	resp, err := l.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	l.update(resp.Header)
+	return resp, nil
+}
+
+// wait blocks until the next request may be sent or ctx is done
+func (l *rateLimiter) wait(ctx context.Context) error {
+	l.mu.Lock()
+	delay := l.delay()
+	// Count the request against the window until the next response reports it
+	if w, ok := l.windows["requests"]; ok && w.remaining > 0 {
+		w.remaining--
+		l.windows["requests"] = w
+	}
+	l.mu.Unlock()
+
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// delay returns how long to wait before the next request. An exhausted window
+// waits until it resets; a window below its low-water mark spreads the remaining
+// requests over the time left.
+func (l *rateLimiter) delay() time.Duration {
+	now := l.now()
+	var delay time.Duration
+	for name, w := range l.windows {
+		untilReset := w.reset.Sub(now)
+		if untilReset <= 0 {
+			// The window has reset since it was reported
+			delete(l.windows, name)
+			continue
+		}
+		var d time.Duration
+		switch {
+		case w.remaining <= 0:
+			d = untilReset
+		case w.limit > 0 && w.remaining*rateLimitLowFraction <= w.limit:
+			d = untilReset / time.Duration(w.remaining+1)
+		}
+		if d > delay {
+			delay = d
+		}
+	}
+	return delay
+}
+
+// update records the rate limit windows reported in response headers
+func (l *rateLimiter) update(header http.Header) {
+	now := l.now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, name := range rateLimitWindows {
+		remaining, err := strconv.Atoi(header.Get("x-ratelimit-remaining-" + name))
+		if err != nil {
+			continue
+		}
+		reset, ok := parseResetDuration(header.Get("x-ratelimit-reset-" + name))
+		if !ok {
+			continue
+		}
+		limit, _ := strconv.Atoi(header.Get("x-ratelimit-limit-" + name))
+		l.windows[name] = rateWindow{limit: limit, remaining: remaining, reset: now.Add(reset)}
+	}
+}
+
+// parseResetDuration parses a reset header such as "1s", "6m0s" or "20ms", or a
+// plain number of seconds
+func parseResetDuration(value string) (time.Duration, bool) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, false
+	}
+	if d, err := time.ParseDuration(value); err == nil {
+		return d, true
+	}
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil {
+		return time.Duration(seconds * float64(time.Second)), true
+	}
+	return 0, false
+}
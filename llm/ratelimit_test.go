@@ -0,0 +1,114 @@
+package llm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// rateLimitedServer answers chat completions with the given rate limit headers
+func rateLimitedServer(t *testing.T, remaining, reset string) (*httptest.Server, *int32) {
+	t.Helper()
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("x-ratelimit-limit-requests", "100")
+		w.Header().Set("x-ratelimit-remaining-requests", remaining)
+		w.Header().Set("x-ratelimit-reset-requests", reset)
+		fmt.Fprint(w, `{"id":"1","object":"chat.completion","model":"gpt-4o-mini","choices":[{"index":0,"message":{"role":"assistant","content":"4"},"finish_reason":"stop"}]}`)
+	}))
+	return srv, &requests
+}
+
+// TestRateLimiterBacksOff tests that the client waits for the reset once the API reports no requests remaining
+func TestRateLimiterBacksOff(t *testing.T) {
+	srv, requests := rateLimitedServer(t, "0", "300ms")
+	defer srv.Close()
+	client := NewClientWithConfig(Config{APIKey: "test-key", BaseURL: srv.URL + "/v1"})
+
+	if _, err := client.Ask(context.Background(), "What is 2+2?"); err != nil {
+		t.Fatalf("Ask() error = %v", err)
+	}
+	start := time.Now()
+	if _, err := client.Ask(context.Background(), "What is 2+2?"); err != nil {
+		t.Fatalf("Ask() error = %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 250*time.Millisecond {
+		t.Errorf("Expected the second request to wait for the reset, it took %v", elapsed)
+	}
+	if got := atomic.LoadInt32(requests); got != 2 {
+		t.Errorf("Expected 2 requests, got %d", got)
+	}
+}
+
+// TestRateLimiterRespectsContext tests that waiting for a reset stops when the context is done
+func TestRateLimiterRespectsContext(t *testing.T) {
+	srv, requests := rateLimitedServer(t, "0", "10s")
+	defer srv.Close()
+	client := NewClientWithConfig(Config{APIKey: "test-key", BaseURL: srv.URL + "/v1"})
+
+	if _, err := client.Ask(context.Background(), "What is 2+2?"); err != nil {
+		t.Fatalf("Ask() error = %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := client.Ask(ctx, "What is 2+2?")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected a deadline error, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected the wait to stop with the context, it took %v", elapsed)
+	}
+	if got := atomic.LoadInt32(requests); got != 1 {
+		t.Errorf("Expected the second request not to be sent, got %d requests", got)
+	}
+}
+
+// TestRateLimiterDelay tests how long requests wait as a window's remaining budget shrinks
+func TestRateLimiterDelay(t *testing.T) {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name      string
+		remaining string
+		reset     string
+		want      time.Duration
+	}{
+		{"plenty left", "50", "10s", 0},
+		{"running low", "4", "10s", 2 * time.Second},
+		{"exhausted", "0", "10s", 10 * time.Second},
+		{"seconds reset", "0", "1.5", 1500 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newRateLimiter(http.DefaultTransport)
+			l.now = func() time.Time { return now }
+			header := http.Header{}
+			header.Set("x-ratelimit-limit-requests", "100")
+			header.Set("x-ratelimit-remaining-requests", tt.remaining)
+			header.Set("x-ratelimit-reset-requests", tt.reset)
+			l.update(header)
+			if got := l.delay(); got != tt.want {
+				t.Errorf("delay() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	// A window that has reset no longer delays requests
+	l := newRateLimiter(http.DefaultTransport)
+	l.now = func() time.Time { return now }
+	header := http.Header{}
+	header.Set("x-ratelimit-remaining-tokens", "0")
+	header.Set("x-ratelimit-reset-tokens", "1s")
+	l.update(header)
+	l.now = func() time.Time { return now.Add(2 * time.Second) }
+	if got := l.delay(); got != 0 {
+		t.Errorf("Expected no delay after the reset, got %v", got)
+	}
+}
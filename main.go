@@ -2,12 +2,20 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/fireharp/pml/impl1/llm"
 	"github.com/fireharp/pml/impl1/parser"
@@ -19,17 +27,119 @@ func main() {
 	// Set up logging
 	log.SetFlags(0)
 
+	if err := run(os.Args[1:]); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// run parses the command line and executes the requested command
+func run(args []string) error {
 	// Parse command line flags
-	forceProcess := flag.Bool("force", false, "Force processing of all files, ignoring cache")
-	targetFile := flag.String("file", "", "Process only this specific file")
-	cleanup := flag.Bool("cleanup", false, "Clean up all generated files (*.pml.py and .pml folders)")
-	workspaceDirFlag := flag.String("dir", "", "Set workspace directory (defaults to current directory)")
-	flag.Parse()
+	flags := flag.NewFlagSet("pml", flag.ContinueOnError)
+	forceProcess := flags.Bool("force", false, "Force processing of all files, ignoring cache")
+	interactive := flags.Bool("interactive", false, "Answer :input blocks by reading a line from stdin for each")
+	rewriteUnchanged := flags.Bool("rewrite-unchanged", false, "Write a new result file even when a block's new answer is identical to its previous one")
+	targetFile := flags.String("file", "", "Process only this specific file")
+	cleanup := flags.Bool("cleanup", false, "Clean up all generated files (*.pml.py and .pml folders)")
+	centralResults := flags.Bool("central-results", false, "Write results under the results directory, mirroring the sources tree")
+	modelConcurrency := flags.String("model-concurrency", "", "Per-model limits on in-flight LLM calls, e.g. gpt-4o=2,gpt-4o-mini=8")
+	stripFences := flags.Bool("strip-fences", false, "Remove a single Markdown code fence around an answer before storing it")
+	summarizeLinks := flags.Bool("summarize-links", false, "Label result links with a short summary of the answer")
+	summaryStrategy := flags.String("summary-strategy", "llm", "With -summarize-links, how links are labeled: llm, first-line or none (start of the answer)")
+	bestOfReducer := flags.String("reducer", parser.ReducerMajority, "How the answer of best_of blocks without a reducer attribute is chosen: majority, longest or judge")
+	batchSummaries := flags.Bool("batch-summaries", false, "With -summarize-links, title all links of a file with a single LLM request")
+	envName := flags.String("env", "", "Environment selecting the [env.<name>] section of settings files, e.g. dev or prod (defaults to $PML_ENV)")
+	askSystem := flags.String("ask-system", "", "System prompt sent with every :ask block, or @file to read it from a file")
+	model := flags.String("model", "", "Model for blocks without a model= attribute or settings, checked against the models available to the API key")
+	profile := flags.String("profile", "", "Credential profile selecting OPENAI_API_KEY_<PROFILE> (defaults to $PML_PROFILE)")
+	doctor := flags.Bool("doctor", false, "Check the Python environment used to run generated files")
+	refine := flags.Bool("refine", false, "When a block changed, ask the model to revise its previous answer")
+	maxTokens := flags.Int("max-tokens", 0, "Stop sending blocks to the LLM once this many tokens have been used (0 means unlimited)")
+	maxPromptTokens := flags.Int("max-prompt-tokens", 0, "Reject blocks whose prompt is larger than this many tokens (0 means unlimited)")
+	streamMB := flags.Int("stream-mb", 0, "Stream files of at least this many megabytes instead of reading them into memory (0 means never)")
+	maxBlocks := flags.Int("max-blocks", parser.DefaultMaxBlocksPerFile, "Reject files with more blocks than this without processing them (0 means unlimited)")
+	renderHTML := flags.Bool("html", false, "Render the questions and answers of processed files to standalone HTML next to them")
+	resume := flags.Bool("resume", false, "With -force, skip files an interrupted run already completed")
+	transaction := flags.Bool("transaction", false, "With -force, update the PML files only if every file succeeds, all together at the end of the run")
+	timeout := flags.Duration("timeout", 0, "Stop the run after this long, e.g. 10m, keeping the answers completed so far and exiting non-zero (0 means no limit)")
+	sla := flags.Duration("sla", 0, "Warn about each file taking longer than this to process, e.g. 30s (0 means no limit)")
+	slaFail := flags.Bool("sla-fail", false, "With -sla, fail the run when a file takes longer than the SLA")
+	bestEffort := flags.Bool("best-effort", false, "With -force, keep processing the other files when one fails and report all failures at the end")
+	cacheList := flags.Bool("cache-list", false, "List cached files with their block counts and ages")
+	cacheGet := flags.String("cache-get", "", "Print the cached block results of this file")
+	cacheRm := flags.String("cache-rm", "", "Remove this file from the cache")
+	cacheExport := flags.String("cache-export", "", "Write all cached block results to this file, keyed by block checksum, for sharing with -cache-import")
+	strictCache := flags.Bool("strict-cache", false, "Fail blocks without a cached result instead of calling the LLM, e.g. for reproducible CI runs")
+	warm := flags.String("warm", "", "Ask and cache the prompts in this file (a JSON array or one per line), so blocks with the same text hit the cache")
+	cacheImport := flags.String("cache-import", "", "Merge the block results of a -cache-export file into the local cache")
+	valuesFile := flags.String("values", "", "JSON or YAML file with values for {{.Name}} prompt templates")
+	listDirectives := flags.Bool("list-directives", false, "List the available directives and whether they can generate blocks")
+	search := flags.String("search", "", "Print the results whose question or answer contains this text, ignoring case")
+	searchRegex := flags.Bool("search-regex", false, "Treat the -search query as a regular expression")
+	rebuildIndex := flags.Bool("rebuild-index", false, "Regenerate the results index (sources/.pml/index.json) from all PML files")
+	preview := flags.Bool("preview", false, "Print the prompt each block would send, without calling the LLM")
+	var redactPatterns []string
+	flags.Func("redact", "Regular expression whose matches are replaced by [REDACTED] in result files and logs; may be repeated", func(pattern string) error {
+		redactPatterns = append(redactPatterns, pattern)
+		return nil
+	})
+	var plugins []string
+	flags.Func("plugin", "Directive handled by an external command instead of the LLM, as :name=command args; may be repeated", func(plugin string) error {
+		plugins = append(plugins, plugin)
+		return nil
+	})
+	redactEnv := flags.Bool("redact-env", true, "Replace the values of interpolated environment variables by [REDACTED] in result files and logs")
+	expandEnv := flags.Bool("expand-env", false, "Replace ${NAME} in blocks with the environment variable NAME")
+	emitPython := flags.Bool("emit-python", false, "Write the Python translation of each processed file next to it (*.pml.py)")
+	executeDo := flags.Bool("execute-do", false, "Run the content of :do blocks as Python scripts; their output is the result and stderr is kept as warnings")
+	prune := flags.String("prune", "", "Comma-separated directory names to skip when looking for PML files, in addition to node_modules, .git, vendor and __pycache__")
+	grammar := flags.Bool("grammar", false, "Print a JSON description of the PML format for editors and exit")
+	initWorkspaceFlag := flags.Bool("init", false, "Create the workspace layout with a sample PML file and exit")
+	finalNewline := flags.Bool("final-newline", false, "End rewritten PML files with exactly one newline (by default the original ending is kept)")
+	normalize := flags.String("normalize", "", "Comma-separated prompt normalizations for cache lookups: lowercase, punctuation, whitespace")
+	diffOnly := flags.Bool("diff", false, "Print a unified diff of the changes to each PML file instead of writing them, and save no results")
+	extensions := flags.String("ext", "", "Comma-separated file extensions treated as PML files, e.g. .pml,.prompt (default .pml)")
+	onlyChanged := flags.Bool("only-changed-blocks", false, "Only process blocks overlapping lines changed since git HEAD (whole files if git can't compare them)")
+	preCmd := flags.String("pre-cmd", "", "Shell command run before processing; the run is aborted if it fails (defaults to $PML_PRE_CMD)")
+	postCmd := flags.String("post-cmd", "", "Shell command run after processing, with the run's exit status in $PML_EXIT_STATUS (defaults to $PML_POST_CMD)")
+	testMode := flags.Bool("test", false, "Check block answers against their expect= attributes and exit non-zero if any fail or there are none")
+	closeAtEOF := flags.Bool("close-at-eof", false, "Close a block left open at the end of a file there, with a warning, instead of failing")
+	markdown := flags.Bool("markdown", false, "Also process Markdown files, parsing only their ```pml fenced code blocks")
+	laxDirectives := flags.Bool("lax-directives", false, "Keep lines such as :note that aren't known directives, and the :-- closing them, as plain text instead of failing")
+	scanInjection := flags.Bool("scan-injection", false, "With -validate, warn about block content resembling a prompt injection, such as \"ignore previous instructions\"")
+	var injectionPatterns []string
+	flags.Func("injection-pattern", "With -scan-injection, an additional regular expression to flag; may be repeated", func(pattern string) error {
+		injectionPatterns = append(injectionPatterns, pattern)
+		return nil
+	})
+	validate := flags.Bool("validate", false, "Report syntax errors and other issues in PML files without processing")
+	workspaceDirFlag := flags.String("dir", "", "Set workspace directory (defaults to current directory)")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if *grammar {
+		data, err := json.MarshalIndent(parser.Grammar(), "", "  ")
+		if err != nil {
+			return fmt.Errorf("failed to marshal grammar: %w", err)
+		}
+		fmt.Println(string(data))
+		return nil
+	}
 
 	// Environment variables:
 	// PML_DEBUG=1 - Enable debug logging
 	// Load .env if exists, but don't warn if missing
 	_ = godotenv.Load()
+	if *profile == "" {
+		*profile = os.Getenv(llm.ProfileEnv)
+	}
+	if *preCmd == "" {
+		*preCmd = os.Getenv(preCmdEnv)
+	}
+	if *postCmd == "" {
+		*postCmd = os.Getenv(postCmdEnv)
+	}
 
 	// Get workspace directory
 	workspaceDir := *workspaceDirFlag
@@ -37,25 +147,29 @@ func main() {
 		var err error
 		workspaceDir, err = os.Getwd()
 		if err != nil {
-			log.Fatalf("Failed to get workspace directory: %v", err)
+			return fmt.Errorf("failed to get workspace directory: %w", err)
 		}
 	} else {
 		// Convert to absolute path if relative
 		if !filepath.IsAbs(workspaceDir) {
 			cwd, err := os.Getwd()
 			if err != nil {
-				log.Fatalf("Failed to get current directory: %v", err)
+				return fmt.Errorf("failed to get current directory: %w", err)
 			}
 			workspaceDir = filepath.Join(cwd, workspaceDir)
 		}
 	}
 
+	if *initWorkspaceFlag {
+		return initWorkspace(os.Stdout, workspaceDir)
+	}
+
 	// Handle cleanup if requested
 	if *cleanup {
 		if err := cleanupGeneratedFiles(workspaceDir); err != nil {
-			log.Fatalf("Cleanup failed: %v", err)
+			return fmt.Errorf("cleanup failed: %w", err)
 		}
-		return
+		return nil
 	}
 
 	// Setup directory structure
@@ -65,69 +179,575 @@ func main() {
 	// Create directories if they don't exist
 	for _, dir := range []string{sourcesDir, resultsDir} {
 		if err := os.MkdirAll(dir, 0755); err != nil {
-			log.Fatalf("Failed to create directory %s: %v", dir, err)
+			return fmt.Errorf("failed to create directory %s: %w", dir, err)
 		}
 	}
 
 	// Create .pml directory for cache
 	pmlDir := filepath.Join(sourcesDir, ".pml")
 	if err := os.MkdirAll(pmlDir, 0755); err != nil {
-		log.Fatalf("Failed to create .pml directory: %v", err)
+		return fmt.Errorf("failed to create .pml directory: %w", err)
 	}
 
-	// Initialize LLM client
-	llmClient, err := llm.NewClient()
-	if err != nil {
-		log.Fatalf("Failed to create LLM client: %v", err)
-	}
+	// The LLM client is created on first use so that commands which never
+	// reach the LLM work without an API key
+	llmClient := &lazyLLMClient{profile: *profile, model: *model}
 
 	// Initialize parser - using sourcesDir for both source and compiled files
 	pmlParser := parser.NewParser(llmClient, sourcesDir, sourcesDir, resultsDir)
 	pmlParser.SetForceProcess(*forceProcess)
+	pmlParser.SetRewriteUnchangedResults(*rewriteUnchanged)
+	pmlParser.SetStrictCache(*strictCache)
+	if *interactive {
+		pmlParser.SetInputFunc(parser.LineInput(os.Stdin, os.Stderr))
+	}
+	pmlParser.SetCentralResults(*centralResults)
+	pmlParser.SetSummarizeLinks(*summarizeLinks)
+	pmlParser.SetStripCodeFences(*stripFences)
+	pmlParser.SetBatchLinkSummaries(*batchSummaries)
+	strategy, err := parser.ParseSummaryStrategy(*summaryStrategy)
+	if err != nil {
+		return err
+	}
+	pmlParser.SetSummaryStrategy(strategy)
+	if err := pmlParser.SetBestOfReducer(*bestOfReducer); err != nil {
+		return err
+	}
+	pmlParser.SetRefinePriorResults(*refine)
+	pmlParser.SetBudget(*maxTokens)
+	pmlParser.SetMaxPromptTokens(*maxPromptTokens)
+	pmlParser.SetMaxBlocksPerFile(*maxBlocks)
+	pmlParser.SetStreamingThreshold(int64(*streamMB) << 20)
+	pmlParser.SetFailFast(!*bestEffort)
+	pmlParser.SetFileSLA(*sla, *slaFail)
+	pmlParser.SetSLAWarning(func(stat parser.FileStat) {
+		log.Printf("Warning: %s took %s to process, exceeding the -sla of %s\n", stat.Path, stat.Duration.Round(time.Millisecond), *sla)
+	})
+	pmlParser.SetCheckpoint(filepath.Join(pmlDir, "checkpoint.json"), *resume)
+	pmlParser.SetTransactional(*transaction)
+	pmlParser.SetEnvInterpolation(*expandEnv)
+	pmlParser.SetRedactEnvValues(*redactEnv)
+	if err := pmlParser.SetRedactPatterns(redactPatterns); err != nil {
+		return err
+	}
+	for _, plugin := range plugins {
+		name, command, ok := strings.Cut(plugin, "=")
+		if !ok {
+			return fmt.Errorf("invalid -plugin %q: expected :name=command", plugin)
+		}
+		if err := pmlParser.RegisterPlugin(name, strings.Fields(command)...); err != nil {
+			return err
+		}
+	}
+	if err := pmlParser.SetInjectionScan(*scanInjection, injectionPatterns); err != nil {
+		return err
+	}
+	pmlParser.SetStrictDirectives(!*laxDirectives)
+	pmlParser.SetStrictEOF(!*closeAtEOF)
+	if *envName != "" {
+		pmlParser.SetEnv(*envName)
+	}
+	// The environment's preset temperature applies to the whole run
+	if llmClient.temperature, err = pmlParser.Temperature(); err != nil {
+		return err
+	}
+	pmlParser.SetEmitPython(*emitPython)
+	pmlParser.SetExecuteDo(*executeDo)
+	if *normalize != "" {
+		normalization, err := parseNormalization(*normalize)
+		if err != nil {
+			return err
+		}
+		pmlParser.SetPromptNormalization(normalization)
+	}
+	if *diffOnly {
+		pmlParser.SetDiffOutput(os.Stdout)
+	}
+	if *finalNewline {
+		pmlParser.SetTrailingNewline(parser.NewlineEnsureOne)
+	}
+	if *onlyChanged {
+		pmlParser.SetOnlyChangedBlocks(true)
+	}
+	if *extensions != "" {
+		pmlParser.SetExtensions(strings.Split(*extensions, ","))
+	}
+	// After -ext, which would drop the Markdown extensions
+	pmlParser.SetMarkdownFences(*markdown)
+	if *prune != "" {
+		pmlParser.AddPruneDirs(strings.Split(*prune, ",")...)
+	}
+	if *valuesFile != "" {
+		values, err := parser.LoadTemplateValues(*valuesFile)
+		if err != nil {
+			return err
+		}
+		pmlParser.SetTemplateValues(values)
+	}
+	if *askSystem != "" {
+		system, err := readFlagText(*askSystem)
+		if err != nil {
+			return err
+		}
+		if err := pmlParser.SetSystemPrompt(parser.DirectiveAsk, system); err != nil {
+			return err
+		}
+	}
+	if *modelConcurrency != "" {
+		limits, err := parseModelLimits(*modelConcurrency)
+		if err != nil {
+			return err
+		}
+		pmlParser.SetLLMConcurrencyByModel(limits)
+	}
+
+	if *doctor {
+		return runDoctor(pmlParser)
+	}
 
+	if *listDirectives {
+		printDirectives(os.Stdout, pmlParser)
+		return nil
+	}
+
+	if *validate {
+		return validateFiles(pmlParser, sourcesDir, *targetFile, workspaceDir)
+	}
+
+	if *cacheImport != "" || *cacheExport != "" {
+		return transferCache(pmlParser, *cacheImport, *cacheExport, workspaceDir)
+	}
+
+	if *cacheList || *cacheGet != "" || *cacheRm != "" {
+		return runCacheCommand(pmlParser, *cacheList, *cacheGet, *cacheRm, workspaceDir)
+	}
+
+	if *preview {
+		return previewPrompts(os.Stdout, pmlParser, *targetFile, workspaceDir)
+	}
+
+	if *rebuildIndex {
+		return pmlParser.RebuildIndex()
+	}
+
+	if *search != "" {
+		return searchResults(os.Stdout, pmlParser, *search, *searchRegex, workspaceDir)
+	}
+
+	if *renderHTML {
+		return renderHTMLFiles(pmlParser, *targetFile, workspaceDir)
+	}
+
+	// Catch a mistyped model before any block is sent
+	if *model != "" {
+		if err := checkModel(context.Background(), llmClient, *model); err != nil {
+			return err
+		}
+	}
+
+	if *warm != "" {
+		prompts, err := parser.LoadPrompts(*warm)
+		if err != nil {
+			return err
+		}
+		if err := pmlParser.WarmFromPrompts(context.Background(), prompts); err != nil {
+			return fmt.Errorf("failed to warm cache: %w", err)
+		}
+		fmt.Printf("Warmed cache with %d prompts\n", len(prompts))
+		return nil
+	}
+
+	if err := runHook("pre-cmd", *preCmd, workspaceDir); err != nil {
+		return err
+	}
+	ctx := context.Background()
+	if *timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *timeout)
+		defer cancel()
+	}
+	err = processWorkspace(ctx, pmlParser, *forceProcess, *targetFile, workspaceDir, sourcesDir)
+	if errors.Is(err, context.DeadlineExceeded) {
+		err = fmt.Errorf("run exceeded -timeout %s, answers completed before it were kept: %w", *timeout, err)
+	}
+	if err == nil && *testMode {
+		err = reportExpectations(os.Stdout, pmlParser)
+	}
+	status := 0
+	if err != nil {
+		status = 1
+	}
+	if hookErr := runHook("post-cmd", *postCmd, workspaceDir, fmt.Sprintf("%s=%d", exitStatusEnv, status)); hookErr != nil {
+		return errors.Join(err, hookErr)
+	}
+	return err
+}
+
+// Environment variables setting the default -pre-cmd and -post-cmd, e.g. in .env
+const (
+	preCmdEnv  = "PML_PRE_CMD"
+	postCmdEnv = "PML_POST_CMD"
+)
+
+// exitStatusEnv passes the exit status of the run to the -post-cmd command:
+// 0 on success, 1 on failure
+const exitStatusEnv = "PML_EXIT_STATUS"
+
+// runHook runs a -pre-cmd or -post-cmd shell command in the workspace directory
+// with the given environment variables added. An empty command does nothing.
+func runHook(name, command, dir string, env ...string) error {
+	if command == "" {
+		return nil
+	}
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), env...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s failed: %w", name, err)
+	}
+	return nil
+}
+
+// processWorkspace processes the target file, or all PML files in sourcesDir,
+// stopping when ctx is done
+func processWorkspace(ctx context.Context, pmlParser *parser.Parser, forceProcess bool, targetFile, workspaceDir, sourcesDir string) error {
 	// Initialize file processor
 	processor := &FileProcessor{
 		parser:       pmlParser,
-		forceProcess: *forceProcess,
+		forceProcess: forceProcess,
 	}
 
-	if *targetFile != "" {
+	if targetFile != "" {
 		// Process only the specified file
-		filePath := *targetFile
+		filePath := targetFile
 		if !filepath.IsAbs(filePath) {
 			filePath = filepath.Join(workspaceDir, filePath)
 		}
-		if err := processor.ProcessFile(context.Background(), filePath); err != nil {
-			log.Fatalf("Error processing %s: %v\n", filePath, err)
+		if err := processor.ProcessFile(ctx, filePath); err != nil {
+			return fmt.Errorf("error processing %s: %w", filePath, err)
 		}
-		return
+		return nil
 	}
 
 	// Process all PML files
 	log.Printf("Processing all PML files in %s\n", sourcesDir)
-	if *forceProcess {
+	files, err := pmlParser.FindPMLFiles()
+	if err != nil {
+		return fmt.Errorf("error finding PML files: %w", err)
+	}
+	if forceProcess {
 		// Use concurrent processing for all files
-		if err := processor.ProcessFile(context.Background(), ""); err != nil {
-			log.Fatalf("Error processing files: %v\n", err)
+		if err := pmlParser.ProcessAllFiles(ctx, files); err != nil {
+			return fmt.Errorf("error processing files: %w", err)
 		}
-	} else {
-		// Process files sequentially
-		err = filepath.Walk(sourcesDir, func(path string, info os.FileInfo, err error) error {
+		return nil
+	}
+
+	// Process files sequentially
+	for _, path := range files {
+		fmt.Printf("Processing file: %s\n", path)
+		if err := processor.ProcessFile(ctx, path); err != nil {
+			if ctx.Err() != nil {
+				// The run is out of time; skip the remaining files
+				return fmt.Errorf("error processing %s: %w", path, err)
+			}
+			log.Printf("Error processing %s: %v\n", path, err)
+		}
+	}
+	return nil
+}
+
+// lazyLLMClient defers creating the real LLM client until a block needs it
+type lazyLLMClient struct {
+	profile     string
+	model       string   // Model for prompts without a model override (the client's default if empty)
+	temperature *float32 // Replaces the sampling temperature of the environment if not nil
+	once        sync.Once
+	client      llm.Backend
+	err         error
+}
+
+// get returns the underlying client, creating it on first call. A credential
+// profile selects OpenAI; otherwise PML_PROVIDER picks the provider.
+func (c *lazyLLMClient) get() (llm.Backend, error) {
+	c.once.Do(func() {
+		if c.profile != "" {
+			config, err := llm.LoadConfig(c.profile)
 			if err != nil {
-				return err
+				c.err = err
+				return
 			}
-			if !info.IsDir() && parser.IsPMLFile(path) {
-				fmt.Printf("Processing file: %s\n", path)
-				if err := processor.ProcessFile(context.Background(), path); err != nil {
-					log.Printf("Error processing %s: %v\n", path, err)
-				}
+			if c.temperature != nil {
+				config.Temperature = c.temperature
 			}
+			c.client = llm.NewClientWithConfig(config)
+			return
+		}
+		c.client, c.err = llm.NewClientForProviderWithTemperature("", c.temperature)
+	})
+	return c.client, c.err
+}
+
+// Ask implements parser.LLMClient
+func (c *lazyLLMClient) Ask(ctx context.Context, prompt string) (string, error) {
+	client, err := c.get()
+	if err != nil {
+		return "", err
+	}
+	if c.model != "" {
+		return client.AskWithModel(ctx, c.model, prompt)
+	}
+	return client.Ask(ctx, prompt)
+}
+
+// AskWithModel implements parser.ModelLLMClient
+func (c *lazyLLMClient) AskWithModel(ctx context.Context, model, prompt string) (string, error) {
+	client, err := c.get()
+	if err != nil {
+		return "", err
+	}
+	return client.AskWithModel(ctx, model, prompt)
+}
+
+// AskWithSystem implements parser.SystemLLMClient
+func (c *lazyLLMClient) AskWithSystem(ctx context.Context, model, system, prompt string) (string, error) {
+	client, err := c.get()
+	if err != nil {
+		return "", err
+	}
+	if model == "" {
+		model = c.model
+	}
+	return client.AskWithSystem(ctx, model, system, prompt)
+}
+
+// AskWithImage implements parser.ImageLLMClient
+func (c *lazyLLMClient) AskWithImage(ctx context.Context, model, prompt string, image []byte, mimeType string) (string, error) {
+	client, err := c.get()
+	if err != nil {
+		return "", err
+	}
+	if model == "" {
+		model = c.model
+	}
+	return client.AskWithImage(ctx, model, prompt, image, mimeType)
+}
+
+// Models implements modelLister
+func (c *lazyLLMClient) Models(ctx context.Context) ([]string, error) {
+	client, err := c.get()
+	if err != nil {
+		return nil, err
+	}
+	return client.Models(ctx)
+}
+
+// Summarize implements parser.LLMClient
+func (c *lazyLLMClient) Summarize(ctx context.Context, text string) (string, error) {
+	client, err := c.get()
+	if err != nil {
+		return "", err
+	}
+	return client.Summarize(ctx, text)
+}
+
+// Embed implements parser.EmbeddingLLMClient, failing for providers without embeddings
+func (c *lazyLLMClient) Embed(ctx context.Context, text string) ([]float32, error) {
+	client, err := c.get()
+	if err != nil {
+		return nil, err
+	}
+	embedder, ok := client.(llm.Embedder)
+	if !ok {
+		return nil, fmt.Errorf("the %s provider does not support embeddings", providerName(client))
+	}
+	return embedder.Embed(ctx, text)
+}
+
+// providerName returns the name of a backend's provider for messages
+func providerName(client llm.Backend) string {
+	switch client.(type) {
+	case *llm.AnthropicClient:
+		return llm.ProviderAnthropic
+	case *llm.OllamaClient:
+		return llm.ProviderOllama
+	}
+	return llm.ProviderOpenAI
+}
+
+// readFlagText returns the value of a text flag, read from a file if it starts with @
+func readFlagText(value string) (string, error) {
+	path, ok := strings.CutPrefix(value, "@")
+	if !ok {
+		return value, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// modelLister lists the models available to an LLM client
+type modelLister interface {
+	Models(ctx context.Context) ([]string, error)
+}
+
+// checkModel returns an error suggesting similar names if model is not one of
+// the models available to the client
+func checkModel(ctx context.Context, lister modelLister, model string) error {
+	models, err := lister.Models(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to check model %q: %w", model, err)
+	}
+	for _, available := range models {
+		if available == model {
 			return nil
-		})
+		}
+	}
+	if suggestions := suggestModels(model, models); len(suggestions) > 0 {
+		return fmt.Errorf("unknown model %q, did you mean %s?", model, strings.Join(suggestions, ", "))
+	}
+	return fmt.Errorf("unknown model %q, available models: %s", model, strings.Join(models, ", "))
+}
+
+// suggestModels returns up to three available models whose names are close to
+// model, closest first
+func suggestModels(model string, models []string) []string {
+	type candidate struct {
+		name     string
+		distance int
+	}
+	var candidates []candidate
+	lower := strings.ToLower(model)
+	for _, name := range models {
+		distance := editDistance(lower, strings.ToLower(name))
+		if distance <= max(2, len(model)/3) || strings.Contains(strings.ToLower(name), lower) {
+			candidates = append(candidates, candidate{name, distance})
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool { return candidates[i].distance < candidates[j].distance })
+
+	var suggestions []string
+	for i := 0; i < len(candidates) && i < 3; i++ {
+		suggestions = append(suggestions, candidates[i].name)
+	}
+	return suggestions
+}
+
+// editDistance returns the Levenshtein distance between a and b
+func editDistance(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		cur := make([]int, len(rb)+1)
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev = cur
+	}
+	return prev[len(rb)]
+}
+
+// parseModelLimits parses a comma-separated list of model=limit pairs
+func parseModelLimits(value string) (map[string]int, error) {
+	limits := make(map[string]int)
+	for _, pair := range strings.Split(value, ",") {
+		model, limit, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok || model == "" {
+			return nil, fmt.Errorf("invalid model concurrency %q, expected model=limit", pair)
+		}
+		n, err := strconv.Atoi(limit)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("invalid concurrency limit for model %s: %q", model, limit)
+		}
+		limits[model] = n
+	}
+	return limits, nil
+}
+
+// parseNormalization parses a comma-separated list of prompt normalizations
+func parseNormalization(value string) (parser.PromptNormalization, error) {
+	var n parser.PromptNormalization
+	for _, name := range strings.Split(value, ",") {
+		switch strings.TrimSpace(name) {
+		case "lowercase":
+			n.Lowercase = true
+		case "punctuation":
+			n.StripTrailingPunctuation = true
+		case "whitespace":
+			n.CollapseWhitespace = true
+		default:
+			return n, fmt.Errorf("unknown normalization %q (want lowercase, punctuation or whitespace)", name)
+		}
+	}
+	return n, nil
+}
+
+// runDoctor reports the outcome of each Python environment check
+func runDoctor(p *parser.Parser) error {
+	failed := 0
+	for _, check := range p.CheckPythonEnvironment(context.Background()) {
+		if check.Err == nil {
+			fmt.Printf("OK %s\n", check.Name)
+			for _, warning := range check.Warnings {
+				fmt.Printf("  Warning: %s\n", warning)
+			}
+			continue
+		}
+		failed++
+		fmt.Printf("FAIL %s: %v\n", check.Name, check.Err)
+		if check.Hint != "" {
+			fmt.Printf("  Hint: %s\n", check.Hint)
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d environment checks failed", failed)
+	}
+	return nil
+}
+
+// validateFiles reports the issues in PML files without calling the LLM; warnings
+// alone do not fail validation
+func validateFiles(p *parser.Parser, sourcesDir, targetFile, workspaceDir string) error {
+	files, err := targetFiles(p, targetFile, workspaceDir)
+	if err != nil {
+		return err
+	}
+
+	failed := 0
+	for _, file := range files {
+		issues, err := p.Validate(file)
 		if err != nil {
-			log.Fatalf("Error walking directory: %v", err)
+			fmt.Printf("INVALID %s: %v\n", file, err)
+			failed++
+			continue
+		}
+		for _, issue := range issues {
+			fmt.Println(issue)
+		}
+		if parser.HasErrors(issues) {
+			fmt.Printf("INVALID %s\n", file)
+			failed++
+			continue
 		}
+		fmt.Printf("OK %s\n", file)
 	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d files failed validation", failed, len(files))
+	}
+	return nil
 }
 
 // FileProcessor implements the file processing logic
@@ -138,7 +758,7 @@ type FileProcessor struct {
 
 // ProcessFile processes a file
 func (p *FileProcessor) ProcessFile(ctx context.Context, path string) error {
-	if !parser.IsPMLFile(path) {
+	if !p.parser.IsPMLFile(path) {
 		return nil // Skip non-PML files
 	}
 
@@ -148,13 +768,290 @@ func (p *FileProcessor) ProcessFile(ctx context.Context, path string) error {
 		fmt.Printf("=== Processing file: %s ===\n", path)
 	}
 
-	// Use concurrent processing for multiple files
-	if p.forceProcess {
-		return p.parser.ProcessAllFiles(ctx)
-	}
 	return p.parser.ProcessFile(ctx, path)
 }
 
+// reportExpectations prints the outcome of each block with an expect attribute and
+// returns an error if any of them failed, or if there were none to check
+func reportExpectations(w io.Writer, p *parser.Parser) error {
+	results := p.ExpectationResults()
+	if len(results) == 0 {
+		fmt.Fprintln(w, "0 expectations")
+		return errors.New("no blocks with an expect attribute were checked")
+	}
+	failed := 0
+	for _, r := range results {
+		status := "PASS"
+		if !r.Passed {
+			status = "FAIL"
+			failed++
+		}
+		fmt.Fprintf(w, "%s %s block %d: expect=%s\n", status, r.SourceFile, r.BlockIndex, r.Expect)
+		if r.Err != nil {
+			fmt.Fprintf(w, "    %v\n", r.Err)
+		} else if !r.Passed {
+			fmt.Fprintf(w, "    got: %s\n", parser.SummaryFirstLine(r.Answer))
+		}
+	}
+	fmt.Fprintf(w, "%d expectations, %d failed\n", len(results), failed)
+	if failed > 0 {
+		return fmt.Errorf("%d of %d expectations failed", failed, len(results))
+	}
+	return nil
+}
+
+// printDirectives writes the parser's directives and whether each can generate blocks
+func printDirectives(w io.Writer, p *parser.Parser) {
+	registry := p.Directives()
+	for _, name := range registry.List() {
+		d, _ := registry.Get(name)
+		fmt.Fprintf(w, "%s\tcan generate blocks: %t\n", name, d.CanGenerateBlocks())
+	}
+}
+
+// transferCache merges the exported cache in importPath into the local cache,
+// then exports the cache to exportPath; either may be empty
+func transferCache(p *parser.Parser, importPath, exportPath, workspaceDir string) error {
+	resolve := func(path string) string {
+		if !filepath.IsAbs(path) {
+			return filepath.Join(workspaceDir, path)
+		}
+		return path
+	}
+
+	if importPath != "" {
+		f, err := os.Open(resolve(importPath))
+		if err != nil {
+			return fmt.Errorf("failed to open exported cache: %w", err)
+		}
+		defer f.Close()
+		if err := p.ImportCache(f); err != nil {
+			return err
+		}
+		fmt.Printf("Imported cache from %s\n", importPath)
+	}
+	if exportPath != "" {
+		f, err := os.Create(resolve(exportPath))
+		if err != nil {
+			return fmt.Errorf("failed to create cache export: %w", err)
+		}
+		if err := p.ExportCache(f); err != nil {
+			f.Close()
+			return err
+		}
+		if err := f.Close(); err != nil {
+			return fmt.Errorf("failed to write cache export: %w", err)
+		}
+		fmt.Printf("Exported cache to %s\n", exportPath)
+	}
+	return nil
+}
+
+// runCacheCommand lists, prints or removes cache entries
+func runCacheCommand(p *parser.Parser, list bool, get, rm, workspaceDir string) error {
+	resolve := func(path string) string {
+		if !filepath.IsAbs(path) && path != parser.AskBlockCachePath {
+			return filepath.Join(workspaceDir, path)
+		}
+		return path
+	}
+
+	switch {
+	case list:
+		entries, err := p.CachedEntries()
+		if err != nil {
+			return fmt.Errorf("failed to read cache: %w", err)
+		}
+		paths := make([]string, 0, len(entries))
+		for path := range entries {
+			paths = append(paths, path)
+		}
+		sort.Strings(paths)
+		for _, path := range paths {
+			entry := entries[path]
+			fmt.Printf("%s\t%d blocks\t%s old\n", path, len(entry.Blocks), time.Since(entry.ModTime).Round(time.Second))
+		}
+	case get != "":
+		path := resolve(get)
+		entry, ok, err := p.CachedEntry(path)
+		if err != nil {
+			return fmt.Errorf("failed to read cache: %w", err)
+		}
+		if !ok {
+			return fmt.Errorf("no cache entry for %s", path)
+		}
+		data, err := json.MarshalIndent(entry, "", "  ")
+		if err != nil {
+			return fmt.Errorf("failed to format cache entry: %w", err)
+		}
+		fmt.Println(string(data))
+	case rm != "":
+		path := resolve(rm)
+		removed, err := p.RemoveCacheEntry(path)
+		if err != nil {
+			return fmt.Errorf("failed to update cache: %w", err)
+		}
+		if !removed {
+			return fmt.Errorf("no cache entry for %s", path)
+		}
+		fmt.Printf("Removed %s from cache\n", path)
+	}
+	return nil
+}
+
+// targetFiles returns the file given with -file, or all PML files
+func targetFiles(p *parser.Parser, targetFile, workspaceDir string) ([]string, error) {
+	if targetFile != "" {
+		if !filepath.IsAbs(targetFile) {
+			targetFile = filepath.Join(workspaceDir, targetFile)
+		}
+		return []string{targetFile}, nil
+	}
+	files, err := p.FindPMLFiles()
+	if err != nil {
+		return nil, fmt.Errorf("error finding PML files: %w", err)
+	}
+	return files, nil
+}
+
+// previewPrompts prints the prompts the target file, or all PML files, would send
+func previewPrompts(w io.Writer, p *parser.Parser, targetFile, workspaceDir string) error {
+	files, err := targetFiles(p, targetFile, workspaceDir)
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		previews, err := p.PreviewPrompts(file)
+		if err != nil {
+			return fmt.Errorf("failed to preview %s: %w", file, err)
+		}
+		fmt.Fprintf(w, "== %s\n", file)
+		for _, preview := range previews {
+			var notes []string
+			if preview.Model != "" {
+				notes = append(notes, "model "+preview.Model)
+			}
+			notes = append(notes, fmt.Sprintf("~%d tokens", preview.Tokens))
+			if preview.Cached {
+				notes = append(notes, "cached, not sent")
+			}
+			if preview.Skipped {
+				notes = append(notes, "skipped by tags")
+			}
+			fmt.Fprintf(w, "-- block %d %s (%s)\n%s\n", preview.Index, preview.Type, strings.Join(notes, ", "), preview.Prompt)
+		}
+	}
+	return nil
+}
+
+// searchResults prints the results matching query with their source block and a snippet
+func searchResults(w io.Writer, p *parser.Parser, query string, isRegex bool, workspaceDir string) error {
+	pattern, err := parser.SearchPattern(query, isRegex)
+	if err != nil {
+		return err
+	}
+	results, err := p.SearchResults(pattern)
+	if err != nil {
+		return fmt.Errorf("failed to search results: %w", err)
+	}
+	for _, result := range results {
+		source := result.SourceFile
+		if rel, err := filepath.Rel(workspaceDir, source); err == nil {
+			source = rel
+		}
+		resultFile := result.ResultFile
+		if rel, err := filepath.Rel(workspaceDir, resultFile); err == nil {
+			resultFile = rel
+		}
+		location := fmt.Sprintf("block %d", result.BlockIndex)
+		if result.BlockLine > 0 {
+			location = fmt.Sprintf("block %d, line %d", result.BlockIndex, result.BlockLine)
+		}
+		fmt.Fprintf(w, "%s (%s): %s\n    %s\n", source, location, resultFile, result.Snippet)
+	}
+	fmt.Fprintf(w, "%d matching results\n", len(results))
+	return nil
+}
+
+// renderHTMLFiles renders the target file, or all PML files, to HTML
+func renderHTMLFiles(p *parser.Parser, targetFile, workspaceDir string) error {
+	files, err := targetFiles(p, targetFile, workspaceDir)
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		out, err := p.RenderHTML(file)
+		if err != nil {
+			return fmt.Errorf("failed to render %s: %w", file, err)
+		}
+		fmt.Printf("Rendered %s\n", out)
+	}
+	return nil
+}
+
+// scaffoldFiles are the files created by -init, relative to the workspace
+var scaffoldFiles = []struct {
+	path    string
+	content string
+}{
+	{filepath.Join("sources", "example.pml"), `:ask
+What are three good practices for writing clear prompts?
+:--
+`},
+	{filepath.Join("sources", "example.pml"+parser.SidecarExt), `# Settings for example.pml only
+model = "gpt-4o-mini"
+timeout = "2m"
+`},
+	{filepath.Join("src", "__init__.py"), ""},
+	{filepath.Join("src", "pml", "__init__.py"), ""},
+	{filepath.Join("src", "pml", "directives", "__init__.py"), `"""PML directives called by generated Python files."""
+
+import subprocess
+
+
+def process_ask(prompt: str) -> str:
+    """Answer an :ask block. Replace with a call to your LLM of choice."""
+    raise NotImplementedError("process_ask is not implemented yet")
+
+
+def process_do(action: str) -> str:
+    """Run a :do block as a shell command and return its output."""
+    result = subprocess.run(action, shell=True, capture_output=True, text=True, timeout=60)
+    return result.stdout + result.stderr
+
+
+__all__ = ["process_ask", "process_do"]
+`},
+}
+
+// initWorkspace creates the directory layout and sample files of a new
+// workspace. Existing files are left untouched.
+func initWorkspace(w io.Writer, workspaceDir string) error {
+	for _, dir := range []string{"sources", filepath.Join("sources", ".pml"), "results"} {
+		if err := os.MkdirAll(filepath.Join(workspaceDir, dir), 0755); err != nil {
+			return fmt.Errorf("failed to create directory %s: %w", dir, err)
+		}
+	}
+
+	for _, file := range scaffoldFiles {
+		path := filepath.Join(workspaceDir, file.path)
+		if _, err := os.Stat(path); err == nil {
+			fmt.Fprintf(w, "Keeping existing %s\n", file.path)
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return fmt.Errorf("failed to create directory for %s: %w", file.path, err)
+		}
+		if err := os.WriteFile(path, []byte(file.content), 0644); err != nil {
+			return fmt.Errorf("failed to write %s: %w", file.path, err)
+		}
+		fmt.Fprintf(w, "Created %s\n", file.path)
+	}
+	return nil
+}
+
 // cleanupGeneratedFiles removes all generated PML files and directories
 func cleanupGeneratedFiles(workspaceDir string) error {
 	// Find and remove all .pml.py files and .pml directories
@@ -207,8 +1104,8 @@ func cleanupGeneratedFiles(workspaceDir string) error {
 			}
 		}
 
-		// Remove .pml.py files and block files
-		if !info.IsDir() && (strings.HasSuffix(path, ".pml.py") || strings.Contains(path, ".pml.block_")) {
+		// Remove .pml.py files, rendered HTML and block files
+		if !info.IsDir() && (strings.HasSuffix(path, ".pml.py") || strings.HasSuffix(path, ".pml"+parser.HTMLExt) || strings.Contains(path, ".pml.block_")) {
 			fmt.Printf("Removing file: %s\n", path)
 			if err := os.Remove(path); err != nil {
 				if !os.IsNotExist(err) {
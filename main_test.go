@@ -0,0 +1,359 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fireharp/pml/impl1/parser"
+)
+
+// TestValidateWithoutAPIKey verifies that -validate never needs an LLM client
+func TestValidateWithoutAPIKey(t *testing.T) {
+	t.Setenv("OPENAI_API_KEY", "")
+
+	tmpDir, err := os.MkdirTemp("", "pml-validate-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	sourcesDir := filepath.Join(tmpDir, "sources")
+	if err := os.MkdirAll(sourcesDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	content := ":ask\nWhat is 2+2?\n:--\n"
+	if err := os.WriteFile(filepath.Join(sourcesDir, "valid.pml"), []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := run([]string{"-validate", "-dir", tmpDir}); err != nil {
+		t.Fatalf("-validate failed without API key: %v", err)
+	}
+
+	// Invalid files are still reported
+	if err := os.WriteFile(filepath.Join(sourcesDir, "invalid.pml"), []byte(":ask\nunterminated\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := run([]string{"-validate", "-dir", tmpDir}); err == nil {
+		t.Error("Expected -validate to fail for an unterminated block")
+	}
+}
+
+// TestCacheCommands verifies -cache-get and -cache-rm round-trip through the cache file
+func TestCacheCommands(t *testing.T) {
+	t.Setenv("OPENAI_API_KEY", "")
+
+	tmpDir, err := os.MkdirTemp("", "pml-cache-cli-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	pmlDir := filepath.Join(tmpDir, "sources", ".pml")
+	if err := os.MkdirAll(pmlDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	cachedFile := filepath.Join(tmpDir, "sources", "cached.pml")
+	now := time.Now()
+	cache := map[string]parser.CacheEntry{
+		cachedFile: {
+			Checksum: "abc",
+			ModTime:  now,
+			Blocks:   map[string]parser.BlockCache{"b1": {Checksum: "b1", Result: "Answer", ModTime: now}},
+		},
+	}
+	data, err := json.Marshal(cache)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cachePath := filepath.Join(pmlDir, "cache.json")
+	if err := os.WriteFile(cachePath, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := run([]string{"-cache-list", "-dir", tmpDir}); err != nil {
+		t.Fatalf("-cache-list failed: %v", err)
+	}
+	if err := run([]string{"-cache-get", "sources/cached.pml", "-dir", tmpDir}); err != nil {
+		t.Fatalf("-cache-get failed: %v", err)
+	}
+	if err := run([]string{"-cache-rm", "sources/cached.pml", "-dir", tmpDir}); err != nil {
+		t.Fatalf("-cache-rm failed: %v", err)
+	}
+
+	data, err = os.ReadFile(cachePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var after map[string]parser.CacheEntry
+	if err := json.Unmarshal(data, &after); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := after[cachedFile]; ok {
+		t.Error("Expected -cache-rm to remove the entry")
+	}
+	if err := run([]string{"-cache-get", "sources/cached.pml", "-dir", tmpDir}); err == nil {
+		t.Error("Expected -cache-get to fail after removal")
+	}
+}
+
+// TestListDirectives verifies the built-in directives are listed
+func TestListDirectives(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "pml-directives-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	p := parser.NewParser(&lazyLLMClient{}, tmpDir, tmpDir, filepath.Join(tmpDir, "results"))
+	var out bytes.Buffer
+	printDirectives(&out, p)
+
+	for _, want := range []string{
+		":ask\tcan generate blocks: false",
+		":do\tcan generate blocks: true",
+		":include\tcan generate blocks: true",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("Expected output to contain %q, got:\n%s", want, out.String())
+		}
+	}
+
+	if err := run([]string{"-list-directives", "-dir", tmpDir}); err != nil {
+		t.Errorf("-list-directives failed: %v", err)
+	}
+}
+
+// TestReportExpectationsNone verifies -test fails when no block had an expectation to check
+func TestReportExpectationsNone(t *testing.T) {
+	tmpDir := t.TempDir()
+	p := parser.NewParser(&lazyLLMClient{}, tmpDir, tmpDir, filepath.Join(tmpDir, "results"))
+	var out bytes.Buffer
+	if err := reportExpectations(&out, p); err == nil {
+		t.Errorf("Expected an error without expectations, got output:\n%s", out.String())
+	}
+}
+
+// TestPreviewCommand verifies -preview prints resolved prompts without an API key
+func TestPreviewCommand(t *testing.T) {
+	t.Setenv("OPENAI_API_KEY", "")
+	t.Setenv("PML_TEST_TOPIC", "tides")
+
+	tmpDir, err := os.MkdirTemp("", "pml-preview-cli-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	sourcesDir := filepath.Join(tmpDir, "sources")
+	if err := os.MkdirAll(sourcesDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(sourcesDir, "p.pml"), []byte(":ask\nExplain ${PML_TEST_TOPIC}\n:--\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	p := parser.NewParser(&lazyLLMClient{}, sourcesDir, sourcesDir, filepath.Join(tmpDir, "results"))
+	p.SetEnvInterpolation(true)
+	var out bytes.Buffer
+	if err := previewPrompts(&out, p, "", tmpDir); err != nil {
+		t.Fatalf("previewPrompts failed: %v", err)
+	}
+	if !strings.Contains(out.String(), "-- block 0 :ask") || !strings.Contains(out.String(), "Explain tides") {
+		t.Errorf("Unexpected preview output:\n%s", out.String())
+	}
+
+	if err := run([]string{"-preview", "-expand-env", "-dir", tmpDir}); err != nil {
+		t.Errorf("-preview failed: %v", err)
+	}
+}
+
+// fakeLLM answers every prompt with a fixed response
+type fakeLLM struct {
+	response string
+}
+
+func (f *fakeLLM) Ask(ctx context.Context, prompt string) (string, error) {
+	return f.response, nil
+}
+
+func (f *fakeLLM) Summarize(ctx context.Context, text string) (string, error) {
+	return f.response, nil
+}
+
+// TestInitWorkspace verifies -init scaffolds a workspace whose sample file processes
+func TestInitWorkspace(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "pml-init-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	if err := run([]string{"-init", "-dir", tmpDir}); err != nil {
+		t.Fatalf("-init failed: %v", err)
+	}
+	for _, file := range scaffoldFiles {
+		if _, err := os.Stat(filepath.Join(tmpDir, file.path)); err != nil {
+			t.Errorf("Expected %s to be created: %v", file.path, err)
+		}
+	}
+	for _, dir := range []string{"results", filepath.Join("sources", ".pml")} {
+		if info, err := os.Stat(filepath.Join(tmpDir, dir)); err != nil || !info.IsDir() {
+			t.Errorf("Expected directory %s to be created", dir)
+		}
+	}
+
+	// The scaffolded sample is processed as written
+	sample := filepath.Join(tmpDir, "sources", "example.pml")
+	sourcesDir := filepath.Join(tmpDir, "sources")
+	p := parser.NewParser(&fakeLLM{response: "4"}, sourcesDir, sourcesDir, filepath.Join(tmpDir, "results"))
+	if err := p.ProcessFile(context.Background(), sample); err != nil {
+		t.Fatalf("Processing the sample file failed: %v", err)
+	}
+	processed, err := os.ReadFile(sample)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(processed), ":--(r/") {
+		t.Errorf("Expected the sample block to be replaced by a result link, got:\n%s", processed)
+	}
+
+	// Running it again keeps existing files
+	var out bytes.Buffer
+	if err := initWorkspace(&out, tmpDir); err != nil {
+		t.Fatalf("initWorkspace failed: %v", err)
+	}
+	if !strings.Contains(out.String(), "Keeping existing "+filepath.Join("sources", "example.pml")) {
+		t.Errorf("Expected the sample file to be kept, got:\n%s", out.String())
+	}
+	content, err := os.ReadFile(sample)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != string(processed) {
+		t.Errorf("Expected the processed sample to be left alone, got:\n%s", content)
+	}
+}
+
+// TestRunHooks verifies that -pre-cmd and -post-cmd run around processing and
+// that a failing -pre-cmd aborts the run
+func TestRunHooks(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "pml-hooks-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	logFile := filepath.Join(tmpDir, "hooks.log")
+	preCmd := "echo pre >> " + logFile
+	postCmd := "echo post $PML_EXIT_STATUS >> " + logFile
+	if err := run([]string{"-dir", tmpDir, "-pre-cmd", preCmd, "-post-cmd", postCmd}); err != nil {
+		t.Fatalf("run failed: %v", err)
+	}
+	data, err := os.ReadFile(logFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(data), "pre\npost 0\n"; got != want {
+		t.Errorf("Expected hooks to log %q, got %q", want, got)
+	}
+
+	// A failing run passes its status to the post-cmd
+	os.Remove(logFile)
+	if err := run([]string{"-dir", tmpDir, "-file", "missing.pml", "-post-cmd", postCmd}); err == nil {
+		t.Fatal("Expected the run to fail for a missing file")
+	}
+	if data, _ := os.ReadFile(logFile); string(data) != "post 1\n" {
+		t.Errorf("Expected the post-cmd to get exit status 1, got %q", data)
+	}
+
+	// A failing pre-cmd aborts the run before processing and the post-cmd
+	os.Remove(logFile)
+	sourceFile := filepath.Join(tmpDir, "sources", "test.pml")
+	content := ":ask\nWhat is 2+2?\n:--\n"
+	if err := os.WriteFile(sourceFile, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PML_POST_CMD", postCmd)
+	if err := run([]string{"-dir", tmpDir, "-pre-cmd", "exit 3"}); err == nil || !strings.Contains(err.Error(), "pre-cmd failed") {
+		t.Errorf("Expected a pre-cmd error, got %v", err)
+	}
+	if _, err := os.Stat(logFile); !os.IsNotExist(err) {
+		t.Error("Expected the post-cmd not to run after a failed pre-cmd")
+	}
+	if data, _ := os.ReadFile(sourceFile); string(data) != content {
+		t.Error("Expected the file not to be processed after a failed pre-cmd")
+	}
+}
+
+// TestSearchCommand verifies -search prints the matching results with their source
+func TestSearchCommand(t *testing.T) {
+	t.Setenv("OPENAI_API_KEY", "")
+
+	tmpDir, err := os.MkdirTemp("", "pml-search-cli-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	sourcesDir := filepath.Join(tmpDir, "sources")
+	if err := os.MkdirAll(sourcesDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	source := filepath.Join(sourcesDir, "s.pml")
+	if err := os.WriteFile(source, []byte(":ask\nWhere is the Louvre?\n:--\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	p := parser.NewParser(&fakeLLM{response: "In Paris."}, sourcesDir, sourcesDir, filepath.Join(tmpDir, "results"))
+	if err := p.ProcessFile(context.Background(), source); err != nil {
+		t.Fatalf("ProcessFile failed: %v", err)
+	}
+
+	var out bytes.Buffer
+	if err := searchResults(&out, p, "paris", false, tmpDir); err != nil {
+		t.Fatalf("searchResults failed: %v", err)
+	}
+	if !strings.Contains(out.String(), "sources/s.pml (block 0, line 1)") || !strings.Contains(out.String(), "In Paris.") ||
+		!strings.Contains(out.String(), "1 matching results") {
+		t.Errorf("Unexpected search output:\n%s", out.String())
+	}
+
+	if err := run([]string{"-search", "[", "-search-regex", "-dir", tmpDir}); err == nil {
+		t.Error("Expected -search to reject an invalid regular expression")
+	}
+}
+
+// stubModels lists a fixed set of models
+type stubModels []string
+
+func (s stubModels) Models(ctx context.Context) ([]string, error) {
+	return s, nil
+}
+
+// TestCheckModel verifies -model is checked against the available models with suggestions
+func TestCheckModel(t *testing.T) {
+	models := stubModels{"gpt-4o", "gpt-4o-mini", "o3-mini", "text-embedding-3-small"}
+
+	if err := checkModel(context.Background(), models, "gpt-4o-mini"); err != nil {
+		t.Errorf("Expected an available model to pass, got %v", err)
+	}
+
+	err := checkModel(context.Background(), models, "gpt-4o-mnii")
+	if err == nil {
+		t.Fatal("Expected an unknown model to be rejected")
+	}
+	if !strings.Contains(err.Error(), `unknown model "gpt-4o-mnii", did you mean gpt-4o-mini`) {
+		t.Errorf("Expected a suggestion, got %v", err)
+	}
+
+	err = checkModel(context.Background(), models, "claude")
+	if err == nil || !strings.Contains(err.Error(), "available models: gpt-4o, gpt-4o-mini") {
+		t.Errorf("Expected the available models to be listed without a close match, got %v", err)
+	}
+}
@@ -0,0 +1,73 @@
+package parser
+
+import (
+	"context"
+	"fmt"
+)
+
+// AskBlockCachePath is the pseudo-path the cache entries of blocks asked with
+// AskBlock, which don't belong to a file, are listed under
+const AskBlockCachePath = "<ask-block>"
+
+// AskBlock returns the answer to a single block without touching any files. A
+// cached result for a block with the same checksum, from any file, is returned
+// unless processing is forced; otherwise the block is sent to the LLM and its
+// answer is cached.
+func (p *Parser) AskBlock(ctx context.Context, block Block) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+
+	checksum := p.calculateBlockChecksum(block)
+	if !p.forceProcess {
+		if result, ok := p.cachedResult(checksum); ok {
+			return result, nil
+		}
+	}
+	if p.strictCache && block.Type != DirectiveInput {
+		return "", fmt.Errorf("%w for block with checksum %s", ErrCacheMiss, checksum)
+	}
+
+	approved, err := p.approveBlock(block)
+	if err != nil {
+		return "", fmt.Errorf("failed to approve block: %w", err)
+	}
+	if !approved {
+		return ResultNotApproved, nil
+	}
+
+	result, _, err := p.runBlock(ctx, block)
+	if err != nil {
+		return "", err
+	}
+
+	p.cacheMu.Lock()
+	entry, ok := p.cache[AskBlockCachePath]
+	if !ok {
+		entry = CacheEntry{Blocks: make(map[string]BlockCache)}
+	}
+	entry.Blocks[checksum] = BlockCache{
+		Checksum:   checksum,
+		Result:     p.redact(result),
+		Attributes: block.Attributes,
+		ModTime:    p.now(),
+	}
+	entry.ModTime = p.now()
+	p.cache[AskBlockCachePath] = entry
+	p.cacheDirty = true
+	p.cacheMu.Unlock()
+
+	return result, nil
+}
+
+// cachedResult returns the cached result of a block with the given checksum in any file
+func (p *Parser) cachedResult(checksum string) (string, bool) {
+	p.cacheMu.RLock()
+	defer p.cacheMu.RUnlock()
+	for _, entry := range p.cache {
+		if cached, ok := entry.Blocks[checksum]; ok {
+			return cached.Result, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,51 @@
+package parser
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestAskBlock tests that AskBlock returns the answer, caches it and writes no files
+func TestAskBlock(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "pml-askblock-*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	calls := 0
+	mock := &mockLLM{response: "Paris", Delay: 10 * time.Millisecond, callback: func() { calls++ }}
+	resultsDir := filepath.Join(tmpDir, "results")
+	p := NewParser(mock, tmpDir, filepath.Join(tmpDir, "compiled"), resultsDir)
+
+	block := Block{Type: DirectiveAsk, Content: []string{"Capital of France?"}}
+	result, err := p.AskBlock(context.Background(), block)
+	if err != nil {
+		t.Fatalf("AskBlock failed: %v", err)
+	}
+	if result != "Paris" {
+		t.Errorf("Expected Paris, got %q", result)
+	}
+
+	checksum := p.calculateBlockChecksum(block)
+	if cached, ok := p.cache[AskBlockCachePath].Blocks[checksum]; !ok || cached.Result != "Paris" {
+		t.Errorf("Expected the answer to be cached, got %+v", p.cache[AskBlockCachePath])
+	}
+	if !p.cacheChanged() {
+		t.Error("Expected the cached answer to be saved with the cache")
+	}
+
+	if _, err := p.AskBlock(context.Background(), block); err != nil {
+		t.Fatalf("AskBlock failed: %v", err)
+	}
+	if calls != 1 {
+		t.Errorf("Expected the second call to be served from the cache, got %d LLM calls", calls)
+	}
+
+	if entries, _ := os.ReadDir(resultsDir); len(entries) != 0 {
+		t.Errorf("Expected no result files, got %d", len(entries))
+	}
+}
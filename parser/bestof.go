@@ -0,0 +1,185 @@
+package parser
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Directive line attributes of a best-of-N block, e.g. ":ask best_of=3 reducer=judge".
+// The LLM is asked best_of times and the reducer chooses the answer.
+const (
+	BestOfAttribute  = "best_of"
+	ReducerAttribute = "reducer"
+)
+
+// MaxBestOf is the largest best_of a block can ask for
+const MaxBestOf = 10
+
+// Reducers choosing the answer of a best-of-N block
+const (
+	ReducerMajority = "majority" // The most common answer, ties going to the earliest
+	ReducerLongest  = "longest"  // The longest answer, ties going to the earliest
+	ReducerJudge    = "judge"    // The answer the LLM judges best
+)
+
+// SetBestOfReducer sets the reducer of best-of-N blocks without a reducer
+// attribute: "majority" (the default), "longest" or "judge"
+func (p *Parser) SetBestOfReducer(name string) error {
+	if err := checkReducer(name); err != nil {
+		return err
+	}
+	p.bestOfReducer = name
+	return nil
+}
+
+func checkReducer(name string) error {
+	switch name {
+	case ReducerMajority, ReducerLongest, ReducerJudge:
+		return nil
+	}
+	return fmt.Errorf("unknown reducer %q (want majority, longest or judge)", name)
+}
+
+// bestOf returns how many answers to ask for a block and the reducer choosing
+// among them. Blocks without a best_of attribute ask once.
+func (p *Parser) bestOf(block Block) (int, string, error) {
+	n := 1
+	if value, ok := block.Attributes[BestOfAttribute]; ok {
+		var err error
+		if n, err = strconv.Atoi(value); err != nil || n < 1 || n > MaxBestOf {
+			return 0, "", fmt.Errorf("invalid %s=%s: want a number from 1 to %d", BestOfAttribute, value, MaxBestOf)
+		}
+	}
+	reducer := p.bestOfReducer
+	if reducer == "" {
+		reducer = ReducerMajority
+	}
+	if value, ok := block.Attributes[ReducerAttribute]; ok {
+		if err := checkReducer(value); err != nil {
+			return 0, "", err
+		}
+		reducer = value
+	}
+	return n, reducer, nil
+}
+
+// askBestOf asks the LLM for n answers to prompt, with system and image if any,
+// concurrently and returns the one chosen by reducer, along with all n answers
+// in the order they were requested. Each request takes a slot of the pool the
+// block runs in, in place of the block's own, so the block doesn't exceed the
+// file's concurrency.
+func (p *Parser) askBestOf(ctx context.Context, model, system, prompt string, image *Image, n int, reducer string) (string, []string, error) {
+	slot := blockSlotFrom(ctx)
+	if slot != nil {
+		slot.release()
+	}
+	answers := make([]string, n)
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		if slot != nil {
+			if err := slot.slots.Acquire(ctx); err != nil {
+				wg.Wait()
+				return "", nil, err
+			}
+		}
+		// Reserve every request's tokens before sending so concurrent blocks can't overspend
+		if err := p.reserveTokens(model, prompt); err != nil {
+			if slot != nil {
+				slot.slots.Release()
+			}
+			wg.Wait()
+			return "", nil, err
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if slot != nil {
+				defer slot.slots.Release()
+			}
+			answers[i], errs[i] = p.ask(ctx, model, system, prompt, image)
+			if errs[i] == nil {
+				p.recordTokens(model, answers[i])
+			}
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return "", nil, err
+		}
+	}
+
+	var chosen int
+	switch reducer {
+	case ReducerLongest:
+		chosen = longestAnswer(answers)
+	case ReducerJudge:
+		var err error
+		if chosen, err = p.judgeAnswers(ctx, model, prompt, answers); err != nil {
+			return "", nil, err
+		}
+	default:
+		chosen = majorityAnswer(answers)
+	}
+	return answers[chosen], answers, nil
+}
+
+// majorityAnswer returns the index of the most common answer, ignoring
+// surrounding whitespace. Ties go to the answer given first.
+func majorityAnswer(answers []string) int {
+	counts := make(map[string]int)
+	best := 0
+	for i, answer := range answers {
+		key := strings.TrimSpace(answer)
+		counts[key]++
+		if counts[key] > counts[strings.TrimSpace(answers[best])] {
+			best = i
+		}
+	}
+	return best
+}
+
+// longestAnswer returns the index of the longest answer. Ties go to the answer
+// given first.
+func longestAnswer(answers []string) int {
+	best := 0
+	for i, answer := range answers {
+		if len(strings.TrimSpace(answer)) > len(strings.TrimSpace(answers[best])) {
+			best = i
+		}
+	}
+	return best
+}
+
+var judgeChoice = regexp.MustCompile(`\d+`)
+
+// judgeAnswers asks the LLM which of the answers to prompt is best and returns
+// its index
+func (p *Parser) judgeAnswers(ctx context.Context, model, prompt string, answers []string) (int, error) {
+	var judge strings.Builder
+	fmt.Fprintf(&judge, "Question:\n%s\n\n", prompt)
+	for i, answer := range answers {
+		fmt.Fprintf(&judge, "Answer %d:\n%s\n\n", i+1, answer)
+	}
+	judge.WriteString("Which answer is best? Reply with only its number.")
+
+	if err := p.reserveTokens(model, judge.String()); err != nil {
+		return 0, err
+	}
+	reply, err := p.ask(ctx, model, "", judge.String(), nil)
+	if err != nil {
+		return 0, fmt.Errorf("failed to judge answers: %w", err)
+	}
+	p.recordTokens(model, reply)
+
+	choice, err := strconv.Atoi(judgeChoice.FindString(reply))
+	if err != nil || choice < 1 || choice > len(answers) {
+		return 0, fmt.Errorf("judge chose no answer between 1 and %d: %q", len(answers), reply)
+	}
+	return choice - 1, nil
+}
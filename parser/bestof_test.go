@@ -0,0 +1,202 @@
+package parser
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// sequenceLLM answers prompts with the next of its answers, and judge prompts
+// with the number of the answer containing judgePick
+type sequenceLLM struct {
+	mockLLM
+	mu        sync.Mutex
+	answers   []string
+	asked     int
+	judged    int
+	judgePick string
+}
+
+func (s *sequenceLLM) Ask(ctx context.Context, prompt string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if strings.Contains(prompt, "Which answer is best?") {
+		s.judged++
+		// The answers come back in no fixed order, so find the one to pick
+		for i := 1; ; i++ {
+			start := strings.Index(prompt, fmt.Sprintf("Answer %d:\n", i))
+			if start < 0 {
+				return "none", nil
+			}
+			if strings.HasPrefix(prompt[start:], fmt.Sprintf("Answer %d:\n%s\n", i, s.judgePick)) {
+				return fmt.Sprintf("Answer %d", i), nil
+			}
+		}
+	}
+	answer := s.answers[s.asked%len(s.answers)]
+	s.asked++
+	return answer, nil
+}
+
+// TestBestOf tests that a best_of block asks several times and keeps the answer
+// chosen by its reducer, recording all answers in the result metadata
+func TestBestOf(t *testing.T) {
+	tests := []struct {
+		name       string
+		directive  string
+		want       string
+		wantJudged int
+	}{
+		{"majority", ":ask best_of=3", "yes", 0},
+		{"longest", ":ask best_of=3 reducer=longest", "yes, it is prime", 0},
+		{"judge", ":ask best_of=3 reducer=judge", "yes, it is prime", 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpDir, err := os.MkdirTemp("", "pml-bestof-*")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(tmpDir)
+
+			llm := &sequenceLLM{answers: []string{"yes", "yes, it is prime", "yes"}, judgePick: "yes, it is prime"}
+			parser := NewParser(llm, tmpDir, filepath.Join(tmpDir, "compiled"), filepath.Join(tmpDir, "results"))
+			srcFile := filepath.Join(tmpDir, "prime.pml")
+			if err := os.WriteFile(srcFile, []byte(tt.directive+"\nIs 1997 a prime number?\n:--\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := parser.ProcessFile(context.Background(), srcFile); err != nil {
+				t.Fatalf("ProcessFile() error = %v", err)
+			}
+			if llm.asked != 3 {
+				t.Errorf("Expected 3 LLM calls, got %d", llm.asked)
+			}
+			if llm.judged != tt.wantJudged {
+				t.Errorf("Expected %d judge calls, got %d", tt.wantJudged, llm.judged)
+			}
+
+			content, err := os.ReadFile(srcFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			link, ok := parseResultLink(strings.TrimSpace(string(content)))
+			if !ok {
+				t.Fatalf("Expected a result link, got:\n%s", content)
+			}
+			resultPath := parser.ResolveResultLink(srcFile, link)
+			result, err := os.ReadFile(resultPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.HasSuffix(string(result), "Answer:\n"+tt.want+"\n") {
+				t.Errorf("Expected answer %q, got:\n%s", tt.want, result)
+			}
+
+			metadataJSON, _, err := readMetadataLine(resultPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var metadata struct {
+				Alternatives []string `json:"alternatives"`
+			}
+			if err := json.Unmarshal([]byte(metadataJSON), &metadata); err != nil {
+				t.Fatal(err)
+			}
+			// The answers are requested concurrently, so their order varies
+			sort.Strings(metadata.Alternatives)
+			if want := []string{"yes", "yes", "yes, it is prime"}; strings.Join(metadata.Alternatives, "|") != strings.Join(want, "|") {
+				t.Errorf("Expected alternatives %v, got %v", want, metadata.Alternatives)
+			}
+		})
+	}
+}
+
+// TestBestOfSlots tests that each request of a best_of block takes a slot of
+// the file's concurrency in place of the block's own
+func TestBestOfSlots(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "pml-bestof-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	srcFile := filepath.Join(tmpDir, "prime.pml")
+	if err := os.WriteFile(srcFile, []byte(":ask best_of=3\nIs 1997 a prime number?\n:--\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(srcFile+SidecarExt, []byte("concurrency = 1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	llm := &sequenceLLM{answers: []string{"yes"}}
+	scheduler := &fakeScheduler{}
+	parser := NewParser(llm, tmpDir, filepath.Join(tmpDir, "compiled"), filepath.Join(tmpDir, "results"))
+	parser.SetScheduler(scheduler)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := parser.ProcessFile(ctx, srcFile); err != nil {
+		t.Fatalf("ProcessFile() error = %v", err)
+	}
+	held, maxHeld, acquired := scheduler.slots.counts()
+	if maxHeld != 1 {
+		t.Errorf("Expected at most 1 slot held at once, got %d", maxHeld)
+	}
+	// One slot for the block, then one per request
+	if acquired != 4 {
+		t.Errorf("Expected 4 slots acquired, got %d", acquired)
+	}
+	if held != 0 {
+		t.Errorf("Expected every slot released, got %d held", held)
+	}
+}
+
+// TestBestOfChecksum tests that best_of and reducer change a block's checksum
+func TestBestOfChecksum(t *testing.T) {
+	parser := NewParser(&mockLLM{response: "Test response", Delay: 10 * time.Millisecond}, "sources", "compiled", "results")
+	block := Block{Type: DirectiveAsk, Content: []string{"Is 1997 a prime number?"}}
+	plain := parser.calculateBlockChecksum(block)
+
+	block.Attributes = map[string]string{BestOfAttribute: "3"}
+	bestOf := parser.calculateBlockChecksum(block)
+	if bestOf == plain {
+		t.Error("Expected best_of to change the checksum")
+	}
+	block.Attributes[ReducerAttribute] = ReducerJudge
+	if parser.calculateBlockChecksum(block) == bestOf {
+		t.Error("Expected reducer to change the checksum")
+	}
+	judge := parser.calculateBlockChecksum(block)
+
+	// The -reducer default counts as the block's reducer
+	delete(block.Attributes, ReducerAttribute)
+	if err := parser.SetBestOfReducer(ReducerJudge); err != nil {
+		t.Fatal(err)
+	}
+	if got := parser.calculateBlockChecksum(block); got != judge {
+		t.Error("Expected the judge default to checksum like reducer=judge")
+	}
+	if err := parser.SetBestOfReducer(ReducerMajority); err != nil {
+		t.Fatal(err)
+	}
+	if got := parser.calculateBlockChecksum(block); got != bestOf {
+		t.Error("Expected the majority default to keep the checksum")
+	}
+
+	if _, _, err := parser.bestOf(Block{Attributes: map[string]string{BestOfAttribute: "0"}}); err == nil {
+		t.Error("Expected an error for best_of=0")
+	}
+	if _, _, err := parser.bestOf(Block{Attributes: map[string]string{BestOfAttribute: fmt.Sprint(MaxBestOf + 1)}}); err == nil {
+		t.Errorf("Expected an error for best_of above %d", MaxBestOf)
+	}
+	if _, _, err := parser.bestOf(Block{Attributes: map[string]string{ReducerAttribute: "vote"}}); err == nil {
+		t.Error("Expected an error for an unknown reducer")
+	}
+}
@@ -1,10 +1,15 @@
 package parser
 
 import (
+	"bufio"
 	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
+	"regexp"
 	"strings"
+	"unicode"
 )
 
 // calculateBlockChecksum calculates SHA-256 checksum of a block's content, ignoring whitespace
@@ -16,9 +21,50 @@ func (p *Parser) calculateBlockChecksum(block Block) string {
 	normalized.WriteString(strings.ToLower(strings.TrimSpace(block.Type)))
 	normalized.WriteString("\n")
 
+	// A model override changes the answer, so it is part of the checksum
+	if block.Model != "" {
+		normalized.WriteString("model=" + block.Model)
+		normalized.WriteString("\n")
+	}
+
+	// Asking several times and choosing among the answers changes the answer
+	// too, including through the -reducer default
+	for _, key := range []string{BestOfAttribute, ReducerAttribute} {
+		if value, ok := block.Attributes[key]; ok {
+			normalized.WriteString("attr " + key + "=" + value)
+			normalized.WriteString("\n")
+		}
+	}
+	if _, ok := block.Attributes[ReducerAttribute]; !ok && p.bestOfReducer != "" && p.bestOfReducer != ReducerMajority {
+		if _, ok := block.Attributes[BestOfAttribute]; ok {
+			normalized.WriteString("attr " + ReducerAttribute + "=" + p.bestOfReducer)
+			normalized.WriteString("\n")
+		}
+	}
+
+	// The system prompt of the block's directive changes the answer too
+	if system := p.systemPrompts[block.Type]; system != "" {
+		normalized.WriteString("system=" + system)
+		normalized.WriteString("\n")
+	}
+
+	// An attached image is part of the checksum through its content
+	if block.Image != nil {
+		normalized.WriteString("image=" + block.Image.checksum())
+		normalized.WriteString("\n")
+	}
+
+	// Attributes that change the answer are part of the checksum, in a fixed order
+	for _, key := range p.cacheKeyAttributes {
+		if value, ok := block.Attributes[key]; ok {
+			normalized.WriteString("attr " + key + "=" + value)
+			normalized.WriteString("\n")
+		}
+	}
+
 	// Normalize content lines
 	for _, line := range block.Content {
-		trimmed := strings.TrimSpace(line)
+		trimmed := p.normalization.apply(strings.TrimSpace(line))
 		if trimmed != "" {
 			normalized.WriteString(trimmed)
 			normalized.WriteString("\n")
@@ -29,78 +75,463 @@ func (p *Parser) calculateBlockChecksum(block Block) string {
 	return hex.EncodeToString(hash[:])
 }
 
+// blockText returns a block's content as sent to the LLM and stored in its
+// result file: the lines verbatim, with their indentation and blank lines, and
+// only the line endings of CRLF files turned into "\n". Whitespace is ignored
+// by calculateBlockChecksum alone.
+func blockText(block Block) string {
+	lines := make([]string, len(block.Content))
+	for i, line := range block.Content {
+		lines[i] = strings.TrimSuffix(line, "\r")
+	}
+	return strings.Join(lines, "\n")
+}
+
+// PromptNormalization makes prompts that differ only trivially share a block
+// checksum, and so a cached result. All options are off by default.
+type PromptNormalization struct {
+	Lowercase                bool // Ignore case
+	StripTrailingPunctuation bool // Ignore punctuation at the end of each line
+	CollapseWhitespace       bool // Treat runs of spaces and tabs within a line as one space
+}
+
+// SetPromptNormalization sets how block content is normalized before checksumming.
+// Normalization only affects cache lookups; prompts are sent as written.
+func (p *Parser) SetPromptNormalization(n PromptNormalization) {
+	p.normalization = n
+}
+
+// apply normalizes one trimmed content line
+func (n PromptNormalization) apply(line string) string {
+	if n.CollapseWhitespace {
+		line = strings.Join(strings.Fields(line), " ")
+	}
+	if n.Lowercase {
+		line = strings.ToLower(line)
+	}
+	if n.StripTrailingPunctuation {
+		line = strings.TrimRight(line, ".,;:!?")
+	}
+	return line
+}
+
+// DefaultMaxBlocksPerFile is the default limit on the number of blocks in a file
+const DefaultMaxBlocksPerFile = 10000
+
+// ErrTooManyBlocks is returned for files with more blocks than the limit
+var ErrTooManyBlocks = errors.New("too many blocks")
+
+// SetMaxBlocksPerFile sets the largest number of blocks a file may have before
+// it is rejected without processing any of them. Zero disables the limit.
+func (p *Parser) SetMaxBlocksPerFile(maxBlocks int) {
+	p.maxBlocksPerFile = maxBlocks
+}
+
+// checkBlockCount fails if a file has more blocks than the limit
+func (p *Parser) checkBlockCount(count int) error {
+	if p.maxBlocksPerFile > 0 && count > p.maxBlocksPerFile {
+		return fmt.Errorf("%w: file has %d blocks, exceeds limit %d", ErrTooManyBlocks, count, p.maxBlocksPerFile)
+	}
+	return nil
+}
+
+// SyntaxError reports malformed PML at a line of the file
+type SyntaxError struct {
+	Line int
+	Msg  string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("%s at line %d", e.Msg, e.Line)
+}
+
 // parseBlocks parses blocks from PML content
 func (p *Parser) parseBlocks(content string) ([]Block, error) {
 	var blocks []Block
-	lines := strings.Split(content, "\n")
-	var currentBlock *Block
-	var blockStartPos int
-	var currentPos int
+	scanner := p.newBlockScanner(strings.NewReader(content))
+	for {
+		item, err := scanner.next()
+		if err == io.EOF {
+			return blocks, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if item.Block != nil {
+			blocks = append(blocks, *item.Block)
+		}
+	}
+}
 
-	for i, line := range lines {
-		lineLen := len(line) + 1 // +1 for newline
-		trimmedLine := strings.TrimSpace(line)
+// maxTextChunk is the most text outside blocks a blockScanner returns at once
+const maxTextChunk = 64 * 1024
 
-		// Handle empty lines
-		if trimmedLine == "" {
-			if currentBlock != nil {
-				currentBlock.Content = append(currentBlock.Content, line)
-			}
-			currentPos += lineLen
-			continue
+// scanItem is a piece of a PML file: either text outside blocks or a block
+type scanItem struct {
+	Text    string // Text outside blocks, when Block is nil
+	Block   *Block
+	Raw     string      // The block's source from its directive line to its end marker, if kept
+	Include *includeRef // The :include line Text holds, if any
+}
+
+// blockScanner reads PML source line by line, returning the text between blocks
+// and the blocks themselves, so a file can be parsed without being held in
+// memory. Text and block sources are only collected when asked for.
+type blockScanner struct {
+	r        *bufio.Reader
+	keepText bool              // Return the text outside blocks
+	keepRaw  bool              // Set the Raw source of blocks
+	onLine   func(line string) // Called with every line read, without its newline
+	line     int               // Number of lines read
+	pos      int               // Offset of the next line
+	text     strings.Builder   // Text outside blocks read but not yet returned
+	queued   *scanItem         // Block read while returning the text before it
+	eof      bool
+	lax      bool // Unknown directives and the end markers closing them are text
+	unknown  bool // In lax mode, inside an unknown directive awaiting its end marker
+
+	closeAtEOF bool      // A block still open at the end of the file is closed there
+	onUnclosed func(int) // Called with the line of each block closed at the end of the file
+
+	plugins func(name string) bool // Reports whether name is a plugin or registered directive opening blocks
+}
+
+func newBlockScanner(r io.Reader) *blockScanner {
+	return &blockScanner{r: bufio.NewReader(r)}
+}
+
+// isDirective reports whether name opens a block: a built-in directive or a plugin's
+func (s *blockScanner) isDirective(name string) bool {
+	return isBuiltinDirective(name) || (s.plugins != nil && s.plugins(name))
+}
+
+// newBlockScanner returns a scanner opening blocks for the parser's plugin and
+// registered processing directives and handling unknown directives and blocks
+// left open at the end of the file as set with SetStrictDirectives and
+// SetStrictEOF
+func (p *Parser) newBlockScanner(r io.Reader) *blockScanner {
+	s := newBlockScanner(r)
+	s.lax = p.laxDirectives
+	s.closeAtEOF = p.closeAtEOF
+	s.plugins = func(name string) bool {
+		if _, ok := p.pluginDirective(name); ok {
+			return true
 		}
+		_, ok := p.directiveProcessor(name)
+		return ok
+	}
+	s.onUnclosed = func(line int) {
+		p.debugf("Warning: block starting at line %d was not closed; closing it at the end of the file\n", line)
+	}
+	return s
+}
 
-		// Treat a line exactly equal to ":--" as the end marker.
-		if trimmedLine == DirectiveEnd {
-			if currentBlock == nil {
-				return nil, fmt.Errorf("found end marker without a block at line %d", i+1)
+// readLine returns the next line without its newline, and whether it had one
+func (s *blockScanner) readLine() (string, bool, error) {
+	line, err := s.r.ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", false, err
+	}
+	if err == io.EOF {
+		s.eof = true
+		if line == "" {
+			return "", false, io.EOF
+		}
+	}
+	s.line++
+	newline := strings.HasSuffix(line, "\n")
+	line = strings.TrimSuffix(line, "\n")
+	if s.onLine != nil {
+		s.onLine(line)
+	}
+	return line, newline, nil
+}
+
+// addText records text outside blocks
+func (s *blockScanner) addText(text string) {
+	if s.keepText {
+		s.text.WriteString(text)
+	}
+}
+
+// takeText returns the text recorded so far
+func (s *blockScanner) takeText() scanItem {
+	item := scanItem{Text: s.text.String()}
+	s.text.Reset()
+	return item
+}
+
+// next returns the next piece of the file, or io.EOF after the last one. A block
+// that is not closed properly is reported as a SyntaxError, except a block left
+// open at the end of the file when closeAtEOF is set.
+func (s *blockScanner) next() (scanItem, error) {
+	if s.queued != nil {
+		item := *s.queued
+		s.queued = nil
+		return item, nil
+	}
+
+	var block *Block
+	var raw strings.Builder
+	for {
+		if s.text.Len() >= maxTextChunk && block == nil {
+			return s.takeText(), nil
+		}
+		if s.eof {
+			break
+		}
+		start := s.pos
+		line, newline, err := s.readLine()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return scanItem{}, err
+		}
+		s.pos += len(line) + 1 // +1 for newline
+		ending := ""
+		if newline {
+			ending = "\n"
+		}
+		trimmedLine := strings.TrimSpace(line)
+
+		if block == nil {
+			// Treat a line exactly equal to ":--", or an error marker, as the end marker.
+			if isBlockEnd(trimmedLine) {
+				if s.unknown {
+					// Closes an unknown directive kept as text
+					s.unknown = false
+					s.addText(line + ending)
+					continue
+				}
+				return scanItem{}, &SyntaxError{Line: s.line, Msg: "found end marker without a block"}
 			}
-			currentBlock.End = currentPos + len(line)
-			blocks = append(blocks, *currentBlock)
-			currentBlock = nil
-			currentPos += lineLen
-			continue
-		} else if strings.HasPrefix(trimmedLine, DirectiveEnd) {
-			// If the line starts with something like ":--(r/...", skip block termination and treat as normal content.
-			if currentBlock != nil {
-				currentBlock.Content = append(currentBlock.Content, line)
+			if target, ok := includeTarget(trimmedLine); ok && !s.unknown {
+				if target == "" {
+					return scanItem{}, &SyntaxError{Line: s.line, Msg: "include without a file"}
+				}
+				item := scanItem{Include: &includeRef{Path: target, Line: s.line, Start: start, End: start + len(line)}}
+				if s.keepText {
+					item.Text = line + ending
+				}
+				if s.text.Len() == 0 {
+					return item, nil
+				}
+				// Return the text before the line first
+				s.queued = &item
+				return s.takeText(), nil
+			}
+			directive, attrs, ok := parseDirective(trimmedLine, s.isDirective)
+			if !ok {
+				if name, unknown := unknownDirective(trimmedLine, s.isDirective); unknown {
+					if !s.lax {
+						return scanItem{}, &SyntaxError{Line: s.line, Msg: fmt.Sprintf("unknown directive %s", name)}
+					}
+					s.unknown = true
+				}
+				// Text, including result links such as ":--(r/..."
+				s.addText(line + ending)
+				continue
+			}
+			s.unknown = false
+			block = &Block{
+				Type:       directive,
+				Tags:       splitTags(attrs["tags"]),
+				Model:      attrs["model"],
+				Attributes: attrs,
+				Start:      start,
+				End:        start + len(line),
+				Line:       s.line,
+			}
+			if s.keepRaw {
+				raw.WriteString(line)
 			}
-			currentPos += lineLen
 			continue
 		}
 
-		switch trimmedLine {
-		case DirectiveAsk, DirectiveDo:
-			if currentBlock != nil {
-				// Found new block without ending previous one
-				return nil, fmt.Errorf("found new block without ending previous one at line %d", i+1)
-			}
-			currentBlock = &Block{
-				Type:  trimmedLine,
-				Start: currentPos,
+		if s.keepRaw {
+			raw.WriteString("\n" + line)
+		}
+		if isBlockEnd(trimmedLine) {
+			block.End = start + len(line)
+			trimTrailingBlankLines(block)
+			item := scanItem{Block: block, Raw: raw.String()}
+			if s.text.Len() == 0 {
+				s.addText(ending)
+				return item, nil
 			}
-			blockStartPos = currentPos
-		default:
-			if currentBlock != nil {
-				currentBlock.Content = append(currentBlock.Content, line)
+			// Return the text before the block first
+			s.queued = &item
+			text := s.takeText()
+			s.addText(ending)
+			return text, nil
+		}
+		if _, _, ok := parseDirective(trimmedLine, s.isDirective); ok {
+			// Found new block without ending previous one
+			return scanItem{}, &SyntaxError{Line: s.line, Msg: "found new block without ending previous one"}
+		}
+		// Empty lines and lines such as ":--(r/..." are part of the content
+		block.Content = append(block.Content, line)
+		block.End = start + len(line)
+	}
+
+	if block != nil {
+		if !s.closeAtEOF {
+			// File ended without closing block
+			return scanItem{}, &SyntaxError{Line: block.Line, Msg: "file ended without closing block starting"}
+		}
+		// Close the block at the end of its last line
+		if s.onUnclosed != nil {
+			s.onUnclosed(block.Line)
+		}
+		trimTrailingBlankLines(block)
+		item := scanItem{Block: block, Raw: raw.String()}
+		if s.text.Len() == 0 {
+			return item, nil
+		}
+		s.queued = &item
+		return s.takeText(), nil
+	}
+	if s.text.Len() > 0 {
+		return s.takeText(), nil
+	}
+	return scanItem{}, io.EOF
+}
+
+// trimTrailingBlankLines trims trailing empty lines from a block's content
+func trimTrailingBlankLines(block *Block) {
+	for len(block.Content) > 0 && strings.TrimSpace(block.Content[len(block.Content)-1]) == "" {
+		block.Content = block.Content[:len(block.Content)-1]
+	}
+}
+
+// directiveName matches a word starting with a colon, such as ":note", that is
+// written like a directive
+var directiveName = regexp.MustCompile(`^:[A-Za-z][\w-]*$`)
+
+// unknownDirective returns the name of the directive a line outside blocks
+// starts with if it is written like a directive but isDirective doesn't know it
+func unknownDirective(line string, isDirective func(string) bool) (string, bool) {
+	fields := strings.Fields(line)
+	if len(fields) == 0 || !directiveName.MatchString(fields[0]) {
+		return "", false
+	}
+	if isDirective(fields[0]) {
+		return "", false
+	}
+	return fields[0], true
+}
+
+// isBuiltinDirective reports whether name is one of the directives of the PML format
+func isBuiltinDirective(name string) bool {
+	switch name {
+	case DirectiveAsk, DirectiveDo, DirectiveSummary, DirectiveSummarize, DirectiveEmbed, DirectiveInput, DirectiveInclude:
+		return true
+	}
+	return false
+}
+
+// parseDirectiveLine splits a directive line such as ":ask tags=smoke,fast"
+// into the directive and its key=value attributes. ok is false when the line
+// does not open a block.
+func parseDirectiveLine(line string) (directive string, attrs map[string]string, ok bool) {
+	return parseDirective(line, isBuiltinDirective)
+}
+
+// parseDirective is parseDirectiveLine for the directives isDirective accepts
+func parseDirective(line string, isDirective func(string) bool) (directive string, attrs map[string]string, ok bool) {
+	fields := directiveFields(line)
+	if len(fields) == 0 || !isDirective(fields[0]) {
+		return "", nil, false
+	}
+
+	attrs = make(map[string]string)
+	for _, field := range fields[1:] {
+		key, value, found := strings.Cut(field, "=")
+		if !found || key == "" {
+			// Not an attribute list, so this is plain text starting with a directive name
+			return "", nil, false
+		}
+		if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+			value = value[1 : len(value)-1]
+		}
+		attrs[key] = value
+	}
+	return fields[0], attrs, true
+}
+
+// directiveFields splits a directive line around whitespace like strings.Fields,
+// except within double quotes, so an attribute value such as expect="New York"
+// can hold spaces
+func directiveFields(line string) []string {
+	var fields []string
+	var field strings.Builder
+	inField, quoted := false, false
+	for _, r := range line {
+		switch {
+		case r == '"':
+			quoted = !quoted
+		case !quoted && unicode.IsSpace(r):
+			if inField {
+				fields = append(fields, field.String())
+				field.Reset()
+				inField = false
 			}
+			continue
 		}
-		currentPos += lineLen
+		field.WriteRune(r)
+		inField = true
 	}
+	if inField {
+		fields = append(fields, field.String())
+	}
+	return fields
+}
 
-	if currentBlock != nil {
-		// File ended without closing block
-		return nil, fmt.Errorf("file ended without closing block starting at position %d", blockStartPos)
+// splitTags splits a comma-separated tag list, dropping empty entries
+func splitTags(value string) []string {
+	var tags []string
+	for _, tag := range strings.Split(value, ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			tags = append(tags, tag)
+		}
 	}
+	return tags
+}
 
-	// Trim trailing empty lines from each block's content
-	for i := range blocks {
-		for len(blocks[i].Content) > 0 && strings.TrimSpace(blocks[i].Content[len(blocks[i].Content)-1]) == "" {
-			blocks[i].Content = blocks[i].Content[:len(blocks[i].Content)-1]
+// matchesTagFilter reports whether a block passes the parser's exclude filter
+// and the given include filter
+func (p *Parser) matchesTagFilter(block Block, includeTags []string) bool {
+	for _, tag := range block.Tags {
+		for _, excluded := range p.excludeTags {
+			if tag == excluded {
+				return false
+			}
+		}
+	}
+	if len(includeTags) == 0 {
+		return true
+	}
+	for _, tag := range block.Tags {
+		for _, included := range includeTags {
+			if tag == included {
+				return true
+			}
 		}
 	}
+	return false
+}
 
-	return blocks, nil
+// ValidateFile parses a PML file and reports syntax errors without processing any blocks
+func (p *Parser) ValidateFile(path string) error {
+	content, err := readSource(path)
+	if err != nil {
+		return fmt.Errorf("failed to read file: %w", err)
+	}
+	if _, err := p.parseBlocks(p.blockSource(path, string(content))); err != nil {
+		return fmt.Errorf("failed to parse blocks: %w", err)
+	}
+	return nil
 }
 
 // replaceBlocksInContent replaces blocks in content with their results
@@ -118,8 +549,9 @@ func (p *Parser) replaceBlocksInContent(content string, blocks []Block) string {
 	for _, line := range lines {
 		trimmedLine := strings.TrimSpace(line)
 
+		_, _, isDirective := parseDirectiveLine(trimmedLine)
 		switch {
-		case trimmedLine == DirectiveAsk || trimmedLine == DirectiveDo:
+		case isDirective:
 			inBlock = true
 			if currentBlock < len(blocks) {
 				block := blocks[currentBlock]
@@ -132,7 +564,7 @@ func (p *Parser) replaceBlocksInContent(content string, blocks []Block) string {
 				result.WriteString(strings.Join(block.Content, "\n"))
 				result.WriteString("\n''')\n")
 			}
-		case trimmedLine == DirectiveEnd:
+		case isBlockEnd(trimmedLine) && inBlock:
 			inBlock = false
 			result.WriteString("# :--\n")
 			currentBlock++
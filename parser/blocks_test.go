@@ -1,6 +1,7 @@
 package parser
 
 import (
+	"errors"
 	"strings"
 	"testing"
 )
@@ -117,3 +118,136 @@ Some content
 		})
 	}
 }
+
+// TestParseBlocksAttributes verifies that directive line attributes are kept on the block
+func TestParseBlocksAttributes(t *testing.T) {
+	parser := NewParser(&mockLLM{response: "Test response"}, "sources", "compiled", "results")
+	blocks, err := parser.parseBlocks(":ask model=gpt-4o tags=smoke seed=42 note=\"two words\"\nQuestion\n:--\n:ask\nQuestion\n:--")
+	if err != nil {
+		t.Fatalf("parseBlocks failed: %v", err)
+	}
+	if len(blocks) != 2 {
+		t.Fatalf("Expected 2 blocks, got %d", len(blocks))
+	}
+	want := map[string]string{"model": "gpt-4o", "tags": "smoke", "seed": "42", "note": "two words"}
+	if len(blocks[0].Attributes) != len(want) {
+		t.Errorf("Expected attributes %v, got %v", want, blocks[0].Attributes)
+	}
+	for key, value := range want {
+		if blocks[0].Attributes[key] != value {
+			t.Errorf("Expected attribute %s=%s, got %q", key, value, blocks[0].Attributes[key])
+		}
+	}
+	if len(blocks[1].Attributes) != 0 {
+		t.Errorf("Expected no attributes, got %v", blocks[1].Attributes)
+	}
+}
+
+// TestCacheKeyAttributesAffectChecksum verifies that only the configured attributes change the checksum
+func TestCacheKeyAttributesAffectChecksum(t *testing.T) {
+	parser := NewParser(&mockLLM{response: "Test response"}, "sources", "compiled", "results")
+	plain := Block{Type: ":ask", Content: []string{"Question"}}
+	seeded := Block{Type: ":ask", Content: []string{"Question"}, Attributes: map[string]string{"seed": "42", "note": "x"}}
+
+	if parser.calculateBlockChecksum(plain) != parser.calculateBlockChecksum(seeded) {
+		t.Error("Expected attributes not to affect the checksum by default")
+	}
+
+	parser.SetCacheKeyAttributes("seed")
+	if parser.calculateBlockChecksum(plain) == parser.calculateBlockChecksum(seeded) {
+		t.Error("Expected the seed attribute to affect the checksum")
+	}
+
+	renoted := Block{Type: ":ask", Content: []string{"Question"}, Attributes: map[string]string{"seed": "42", "note": "y"}}
+	if parser.calculateBlockChecksum(seeded) != parser.calculateBlockChecksum(renoted) {
+		t.Error("Expected attributes outside the cache key not to affect the checksum")
+	}
+}
+
+// TestPromptNormalization verifies that trivially different prompts share a checksum only when enabled
+func TestPromptNormalization(t *testing.T) {
+	parser := NewParser(&mockLLM{response: "Test response"}, "sources", "compiled", "results")
+	blockA := Block{Type: ":ask", Content: []string{"What is the capital of France?"}}
+	blockB := Block{Type: ":ask", Content: []string{"what is the  capital of France"}}
+
+	if parser.calculateBlockChecksum(blockA) == parser.calculateBlockChecksum(blockB) {
+		t.Error("Expected different checksums without normalization")
+	}
+
+	parser.SetPromptNormalization(PromptNormalization{
+		Lowercase:                true,
+		StripTrailingPunctuation: true,
+		CollapseWhitespace:       true,
+	})
+	if parser.calculateBlockChecksum(blockA) != parser.calculateBlockChecksum(blockB) {
+		t.Error("Expected normalized prompts to share a checksum")
+	}
+}
+
+// TestStrictDirectives tests that unknown directives are syntax errors by
+// default and plain text when directives are not strict
+func TestStrictDirectives(t *testing.T) {
+	content := ":invalid\nSome content\n:--\n\n:ask\nWhat is 2+2?\n:note kept in the prompt\n:--\n"
+
+	parser := NewParser(&mockLLM{response: "Test response"}, "sources", "compiled", "results")
+	_, err := parser.parseBlocks(content)
+	var syntaxErr *SyntaxError
+	if !errors.As(err, &syntaxErr) || syntaxErr.Line != 1 || !strings.Contains(syntaxErr.Msg, "unknown directive :invalid") {
+		t.Fatalf("Expected an unknown directive error on line 1, got %v", err)
+	}
+
+	parser.SetStrictDirectives(false)
+	blocks, err := parser.parseBlocks(content)
+	if err != nil {
+		t.Fatalf("parseBlocks() error = %v", err)
+	}
+	if len(blocks) != 1 || blocks[0].Type != DirectiveAsk || blocks[0].Line != 5 {
+		t.Fatalf("Expected only the :ask block, got %+v", blocks)
+	}
+	if got := strings.Join(blocks[0].Content, "\n"); got != "What is 2+2?\n:note kept in the prompt" {
+		t.Errorf("Unexpected block content %q", got)
+	}
+	if got := content[:blocks[0].Start]; got != ":invalid\nSome content\n:--\n\n" {
+		t.Errorf("Expected the unknown directive to stay text before the block, got %q", got)
+	}
+
+	// An end marker without any directive is still an error
+	if _, err := parser.parseBlocks("text\n:--\n"); err == nil {
+		t.Error("Expected an error for an end marker without a block")
+	}
+}
+
+// TestStrictEOF tests that a block left open at the end of the file is an error
+// by default, and is closed there when not strict
+func TestStrictEOF(t *testing.T) {
+	content := ":ask\nWhat is 2+2?\n:--\n\n:ask\nWhat is 3+3?\n\n"
+
+	parser := NewParser(&mockLLM{response: "Test response"}, "sources", "compiled", "results")
+	_, err := parser.parseBlocks(content)
+	var syntaxErr *SyntaxError
+	if !errors.As(err, &syntaxErr) || syntaxErr.Line != 5 || !strings.Contains(syntaxErr.Msg, "file ended without closing block") {
+		t.Fatalf("Expected an unclosed block error on line 5, got %v", err)
+	}
+
+	parser.SetStrictEOF(false)
+	blocks, err := parser.parseBlocks(content)
+	if err != nil {
+		t.Fatalf("parseBlocks() error = %v", err)
+	}
+	if len(blocks) != 2 {
+		t.Fatalf("Expected 2 blocks, got %+v", blocks)
+	}
+	last := blocks[1]
+	if last.Line != 5 || strings.Join(last.Content, "\n") != "What is 3+3?" {
+		t.Errorf("Unexpected closed block %+v", last)
+	}
+	if got := content[last.Start:last.End]; got != ":ask\nWhat is 3+3?\n" {
+		t.Errorf("Expected the block to end at the end of the file, got %q", got)
+	}
+
+	// A file ending right after the directive closes an empty block
+	blocks, err = parser.parseBlocks(":ask")
+	if err != nil || len(blocks) != 1 || len(blocks[0].Content) != 0 || blocks[0].End != len(":ask") {
+		t.Errorf("Expected an empty block closed at the end of the file, got %+v, %v", blocks, err)
+	}
+}
@@ -0,0 +1,42 @@
+package parser
+
+import (
+	"errors"
+	"sync/atomic"
+)
+
+// ErrBudgetExceeded is returned once a run has used up its token budget
+var ErrBudgetExceeded = errors.New("token budget exceeded")
+
+// SetBudget limits the total number of tokens (prompts and answers) a run may use.
+// Once the budget is used up no new blocks are sent to the LLM and processing
+// returns ErrBudgetExceeded; results completed before that are kept. Zero disables the limit.
+func (p *Parser) SetBudget(maxTokens int) {
+	atomic.StoreInt64(&p.maxTokens, int64(maxTokens))
+}
+
+// TokensUsed returns the number of tokens used so far
+func (p *Parser) TokensUsed() int {
+	return int(atomic.LoadInt64(&p.tokensUsed))
+}
+
+// reserveTokens accounts for a prompt about to be sent, failing if the budget
+// has already been used up
+func (p *Parser) reserveTokens(model, prompt string) error {
+	maxTokens := atomic.LoadInt64(&p.maxTokens)
+	tokens := int64(p.countTokens(model, prompt))
+	for {
+		used := atomic.LoadInt64(&p.tokensUsed)
+		if maxTokens > 0 && used >= maxTokens {
+			return ErrBudgetExceeded
+		}
+		if atomic.CompareAndSwapInt64(&p.tokensUsed, used, used+tokens) {
+			return nil
+		}
+	}
+}
+
+// recordTokens accounts for an answer received from the LLM
+func (p *Parser) recordTokens(model, answer string) {
+	atomic.AddInt64(&p.tokensUsed, int64(p.countTokens(model, answer)))
+}
@@ -5,9 +5,11 @@ import (
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"hash"
 	"os"
 	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -38,70 +40,333 @@ func (p *Parser) loadCache() {
 	p.cacheMu.Lock()
 	p.cache = make(map[string]CacheEntry)
 	for path, entry := range tempCache {
+		p.markCacheSeen(path, entry)
 		if entry.Blocks == nil {
 			entry.Blocks = make(map[string]BlockCache)
 		}
 		// Clean up expired block entries (older than 24 hours)
 		for blockID, blockCache := range entry.Blocks {
-			if time.Since(blockCache.ModTime) > 24*time.Hour {
+			if !blockCache.Locked && p.now().Sub(blockCache.ModTime) > 24*time.Hour {
 				delete(entry.Blocks, blockID)
 			}
 		}
 		// If no blocks remain and entry is older than 24 hours, skip adding this file entry
-		if len(entry.Blocks) == 0 && time.Since(entry.ModTime) > 24*time.Hour {
+		if len(entry.Blocks) == 0 && p.now().Sub(entry.ModTime) > 24*time.Hour {
 			continue
 		}
-		p.cache[path] = entry
+		p.cache[path] = p.migrateBlockKeys(path, entry)
 	}
 	p.cacheMu.Unlock()
 }
 
-// saveCache saves the cache to disk
+// legacyBlockKey matches the index-based block keys ("<file>_block_<n>") of older caches
+var legacyBlockKey = regexp.MustCompile(`_block_(\d+)$`)
+
+// migrateBlockKeys rekeys index-based block results from older caches by the
+// checksum of the block now at that index in the file. Results that can't be
+// matched to a block are dropped since they would never be hit.
+func (p *Parser) migrateBlockKeys(path string, entry CacheEntry) CacheEntry {
+	var blocks []Block
+	parsed := false
+	for key, cached := range entry.Blocks {
+		m := legacyBlockKey.FindStringSubmatch(key)
+		if m == nil {
+			continue
+		}
+		delete(entry.Blocks, key)
+
+		if !parsed {
+			parsed = true
+			if content, err := readSource(path); err == nil {
+				blocks, _ = p.parseBlocks(p.blockSource(path, string(content)))
+			}
+		}
+		index, _ := strconv.Atoi(m[1])
+		if index >= len(blocks) {
+			p.debugf("Dropping cached result %s: no block %d in %s\n", key, index, path)
+			continue
+		}
+
+		checksum := p.calculateBlockChecksum(blocks[index])
+		if _, ok := entry.Blocks[checksum]; ok {
+			continue
+		}
+		cached.Checksum = checksum
+		cached.Index = index
+		entry.Blocks[checksum] = cached
+	}
+	return entry
+}
+
+// Cross-process cache lock settings
+const (
+	cacheLockTimeout = 10 * time.Second // How long to wait for another process to release the lock
+	cacheLockStale   = 30 * time.Second // Locks older than this are assumed abandoned
+)
+
+// saveCache merges the cache with the one on disk and saves the result. The merge
+// happens under a cross-process lock so concurrent PML processes don't drop each
+// other's entries. Only entries this process has never seen are taken from
+// disk, so the ones it removed stay removed.
 func (p *Parser) saveCache() error {
+	return p.withCacheLock(func() error {
+		// Merge entries written by other processes since we loaded the cache
+		onDisk := p.readCacheFile()
+
+		// Merge into the in-memory cache and take a copy under the lock
+		p.cacheMu.Lock()
+		for path, diskEntry := range onDisk {
+			if merged, ok := p.mergeUnseen(path, diskEntry); ok {
+				p.cache[path] = merged
+			}
+		}
+		cacheCopy := make(map[string]CacheEntry)
+		for k, v := range p.cache {
+			cacheCopy[k] = v
+			p.markCacheSeen(k, v)
+		}
+		p.cacheDirty = false
+		p.cacheMu.Unlock()
+
+		if err := p.writeCacheFile(cacheCopy); err != nil {
+			p.cacheMu.Lock()
+			p.cacheDirty = true
+			p.cacheMu.Unlock()
+			return err
+		}
+		p.debugf("Cache saved to %s\n", p.cacheFile)
+		return nil
+	})
+}
+
+// cacheChanged reports whether the in-memory cache has changes not yet saved
+func (p *Parser) cacheChanged() bool {
+	p.cacheMu.RLock()
+	defer p.cacheMu.RUnlock()
+	return p.cacheDirty
+}
+
+// CachedEntries returns all entries of the cache on disk, keyed by file path
+func (p *Parser) CachedEntries() (map[string]CacheEntry, error) {
+	var entries map[string]CacheEntry
+	err := p.withCacheLock(func() error {
+		entries = p.readCacheFile()
+		return nil
+	})
+	if entries == nil {
+		entries = make(map[string]CacheEntry)
+	}
+	return entries, err
+}
+
+// CachedEntry returns the cache entry on disk for the file at path
+func (p *Parser) CachedEntry(path string) (CacheEntry, bool, error) {
+	entries, err := p.CachedEntries()
+	if err != nil {
+		return CacheEntry{}, false, err
+	}
+	entry, ok := entries[path]
+	return entry, ok, nil
+}
+
+// RemoveCacheEntry removes the file at path from the cache, both in memory and
+// on disk, so its blocks are sent to the LLM again on the next run. It reports
+// whether the file had an entry. Other running processes that already loaded the
+// entry may write it back when they next save.
+func (p *Parser) RemoveCacheEntry(path string) (bool, error) {
+	removed := false
+	err := p.withCacheLock(func() error {
+		p.cacheMu.Lock()
+		if _, ok := p.cache[path]; ok {
+			delete(p.cache, path)
+			removed = true
+		}
+		p.cacheMu.Unlock()
+
+		onDisk := p.readCacheFile()
+		if _, ok := onDisk[path]; !ok {
+			return nil
+		}
+		delete(onDisk, path)
+		removed = true
+		return p.writeCacheFile(onDisk)
+	})
+	return removed, err
+}
+
+// withCacheLock runs fn holding both the in-process and the cross-process cache lock
+func (p *Parser) withCacheLock(fn func() error) error {
+	p.saveMu.Lock()
+	defer p.saveMu.Unlock()
+
 	// Ensure cache directory exists
 	if err := os.MkdirAll(filepath.Dir(p.cacheFile), 0755); err != nil {
 		return fmt.Errorf("error creating cache directory: %w", err)
 	}
 
-	// Get a copy of the cache under read lock
-	p.cacheMu.RLock()
-	cacheCopy := make(map[string]CacheEntry)
-	for k, v := range p.cache {
-		cacheCopy[k] = v
+	unlock, err := lockFile(p.cacheFile + ".lock")
+	if err != nil {
+		return fmt.Errorf("error locking cache file: %w", err)
 	}
-	p.cacheMu.RUnlock()
+	defer unlock()
 
+	return fn()
+}
+
+// readCacheFile reads the cache on disk, returning nil if it is missing or unreadable
+func (p *Parser) readCacheFile() map[string]CacheEntry {
+	var onDisk map[string]CacheEntry
+	if data, err := os.ReadFile(p.cacheFile); err == nil {
+		if err := json.Unmarshal(data, &onDisk); err != nil {
+			p.debugf("Ignoring unreadable cache on disk: %v\n", err)
+			onDisk = nil
+		}
+	}
+	return onDisk
+}
+
+// writeCacheFile replaces the cache on disk with entries
+func (p *Parser) writeCacheFile(entries map[string]CacheEntry) error {
 	// Marshal cache with indentation for readability
-	data, err := json.MarshalIndent(cacheCopy, "", "  ")
+	data, err := json.MarshalIndent(entries, "", "  ")
 	if err != nil {
 		return fmt.Errorf("error marshaling cache: %w", err)
 	}
 
-	// Write cache file
-	if err := os.WriteFile(p.cacheFile, data, 0644); err != nil {
+	// Write to a temporary file and rename so readers never see a partial cache
+	tmpFile := p.cacheFile + ".tmp"
+	if err := os.WriteFile(tmpFile, data, 0644); err != nil {
+		return fmt.Errorf("error writing cache file: %w", err)
+	}
+	if err := os.Rename(tmpFile, p.cacheFile); err != nil {
+		os.Remove(tmpFile)
 		return fmt.Errorf("error writing cache file: %w", err)
 	}
-
-	p.debugf("Cache saved to %s\n", p.cacheFile)
 	return nil
 }
 
+// mergeCacheEntries returns the union of two entries for the same file. Blocks are
+// merged by checksum preferring the newer result; the file checksum of the newer
+// entry wins.
+func mergeCacheEntries(mine, theirs CacheEntry) CacheEntry {
+	merged := mine
+	if theirs.ModTime.After(mine.ModTime) {
+		merged.Checksum = theirs.Checksum
+		merged.ModTime = theirs.ModTime
+	}
+
+	merged.Blocks = make(map[string]BlockCache, len(mine.Blocks)+len(theirs.Blocks))
+	for checksum, block := range mine.Blocks {
+		merged.Blocks[checksum] = block
+	}
+	for checksum, block := range theirs.Blocks {
+		if existing, ok := merged.Blocks[checksum]; !ok || block.ModTime.After(existing.ModTime) {
+			merged.Blocks[checksum] = block
+		}
+	}
+	return merged
+}
+
+// mergeUnseen merges the disk entry of the file at path into the in-memory one,
+// leaving out the blocks, or whole file, this process has seen and since
+// removed. ok is false when nothing of the disk entry is kept. Callers must
+// hold cacheMu.
+func (p *Parser) mergeUnseen(path string, diskEntry CacheEntry) (CacheEntry, bool) {
+	mine, ok := p.cache[path]
+	seen := p.cacheSeen[path]
+	blocks := make(map[string]BlockCache, len(diskEntry.Blocks))
+	for key, block := range diskEntry.Blocks {
+		if _, kept := mine.Blocks[key]; kept || !seen[key] {
+			blocks[key] = block
+		}
+	}
+	if !ok && seen != nil && len(blocks) == 0 {
+		return CacheEntry{}, false
+	}
+	diskEntry.Blocks = blocks
+	return mergeCacheEntries(mine, diskEntry), true
+}
+
+// markCacheSeen records the file at path and the blocks of its entry as seen
+// by this process. Callers must hold cacheMu.
+func (p *Parser) markCacheSeen(path string, entry CacheEntry) {
+	if p.cacheSeen == nil {
+		p.cacheSeen = make(map[string]map[string]bool)
+	}
+	seen := p.cacheSeen[path]
+	if seen == nil {
+		seen = make(map[string]bool, len(entry.Blocks))
+		p.cacheSeen[path] = seen
+	}
+	for key := range entry.Blocks {
+		seen[key] = true
+	}
+}
+
+// lockFile acquires an exclusive lock by creating path, waiting for other
+// processes to release it. The returned function releases the lock.
+func lockFile(path string) (func(), error) {
+	deadline := time.Now().Add(cacheLockTimeout)
+	for {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if err == nil {
+			fmt.Fprintf(f, "%d", os.Getpid())
+			f.Close()
+			return func() { os.Remove(path) }, nil
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+
+		// Break locks left behind by processes that died while holding them
+		if info, statErr := os.Stat(path); statErr == nil && time.Since(info.ModTime()) > cacheLockStale {
+			os.Remove(path)
+			continue
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("timed out waiting for %s", path)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
 // calculateChecksum calculates SHA-256 checksum of file content, ignoring result links
 func (p *Parser) calculateChecksum(content string) string {
-	// Remove result links before calculating checksum
-	resultLinkPattern := regexp.MustCompile(`:-+\(r/[a-z]+_[a-z]+\)`)
-	contentWithoutLinks := resultLinkPattern.ReplaceAllString(content, ":--")
+	checksum := newFileChecksum()
+	for _, line := range strings.Split(content, "\n") {
+		checksum.addLine(line)
+	}
+	return checksum.sum()
+}
 
-	// Normalize whitespace
-	lines := strings.Split(contentWithoutLinks, "\n")
-	var normalized []string
-	for _, line := range lines {
-		trimmed := strings.TrimSpace(line)
-		if trimmed != "" {
-			normalized = append(normalized, trimmed)
-		}
+// checksumLinkPattern matches result links, which are removed before checksumming
+var checksumLinkPattern = regexp.MustCompile(`:-+\(r/[a-z]+_[a-z]+\)`)
+
+// fileChecksum computes a file checksum line by line, so a file doesn't have to
+// be held in memory to be checksummed
+type fileChecksum struct {
+	hash  hash.Hash
+	empty bool // No line has been added yet
+}
+
+func newFileChecksum() *fileChecksum {
+	return &fileChecksum{hash: sha256.New(), empty: true}
+}
+
+// addLine adds a line, without its newline, to the checksum. Result links and
+// whitespace are ignored.
+func (c *fileChecksum) addLine(line string) {
+	trimmed := strings.TrimSpace(checksumLinkPattern.ReplaceAllString(line, ":--"))
+	if trimmed == "" {
+		return
 	}
+	if !c.empty {
+		c.hash.Write([]byte("\n"))
+	}
+	c.hash.Write([]byte(trimmed))
+	c.empty = false
+}
 
-	hash := sha256.Sum256([]byte(strings.Join(normalized, "\n")))
-	return hex.EncodeToString(hash[:])
+func (c *fileChecksum) sum() string {
+	return hex.EncodeToString(c.hash.Sum(nil))
 }
@@ -1,8 +1,12 @@
 package parser
 
 import (
+	"context"
+	"encoding/json"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -33,14 +37,14 @@ func TestLoadCacheWhenFileMissing(t *testing.T) {
 }
 
 func TestSaveAndLoadCache(t *testing.T) {
-    // Create one fresh temp directory dedicated to this test.
-    tmpDir, err := os.MkdirTemp("", "pml-cache-test-SaveAndLoad-*")
-    if err != nil {
-        t.Fatal(err)
-    }
-    defer os.RemoveAll(tmpDir)
-
-    cachePath := filepath.Join(tmpDir, "cache.json")
+	// Create one fresh temp directory dedicated to this test.
+	tmpDir, err := os.MkdirTemp("", "pml-cache-test-SaveAndLoad-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	cachePath := filepath.Join(tmpDir, "cache.json")
 	parser := NewParser(&mockLLM{response: "Test response"}, tmpDir, tmpDir, tmpDir)
 	parser.cacheFile = cachePath
 
@@ -179,3 +183,408 @@ What is 2+2?
 		t.Error("No block results cached")
 	}
 }
+
+func TestSaveCacheMergesConcurrentWriters(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "pml-cache-test-Merge-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	cachePath := filepath.Join(tmpDir, "cache.json")
+	older := time.Now().Add(-time.Hour)
+	newer := time.Now()
+
+	// Two parsers, e.g. the watcher and a manual run, loaded the same empty cache
+	parser1 := NewParser(&mockLLM{response: "Test response"}, tmpDir, tmpDir, tmpDir)
+	parser1.cacheFile = cachePath
+	parser2 := NewParser(&mockLLM{response: "Test response"}, tmpDir, tmpDir, tmpDir)
+	parser2.cacheFile = cachePath
+
+	parser1.cache["only1.pml"] = CacheEntry{
+		Checksum: "file1",
+		ModTime:  newer,
+		Blocks:   map[string]BlockCache{"a": {Checksum: "a", Result: "A", ModTime: newer}},
+	}
+	parser1.cache["shared.pml"] = CacheEntry{
+		Checksum: "shared",
+		ModTime:  newer,
+		Blocks: map[string]BlockCache{
+			"x": {Checksum: "x", Result: "new X", ModTime: newer},
+			"y": {Checksum: "y", Result: "Y", ModTime: newer},
+		},
+	}
+	parser2.cache["only2.pml"] = CacheEntry{
+		Checksum: "file2",
+		ModTime:  newer,
+		Blocks:   map[string]BlockCache{"b": {Checksum: "b", Result: "B", ModTime: newer}},
+	}
+	parser2.cache["shared.pml"] = CacheEntry{
+		Checksum: "shared",
+		ModTime:  older,
+		Blocks: map[string]BlockCache{
+			"x": {Checksum: "x", Result: "old X", ModTime: older},
+			"z": {Checksum: "z", Result: "Z", ModTime: newer},
+		},
+	}
+
+	if err := parser1.saveCache(); err != nil {
+		t.Fatalf("saveCache failed: %v", err)
+	}
+	if err := parser2.saveCache(); err != nil {
+		t.Fatalf("saveCache failed: %v", err)
+	}
+
+	parser3 := NewParser(&mockLLM{response: "Test response"}, tmpDir, tmpDir, tmpDir)
+	parser3.cacheFile = cachePath
+	parser3.loadCache()
+
+	for _, path := range []string{"only1.pml", "only2.pml", "shared.pml"} {
+		if _, ok := parser3.cache[path]; !ok {
+			t.Errorf("Expected %s to survive both writes", path)
+		}
+	}
+	shared := parser3.cache["shared.pml"].Blocks
+	if len(shared) != 3 {
+		t.Errorf("Expected the union of shared blocks, got %v", shared)
+	}
+	if shared["x"].Result != "new X" {
+		t.Errorf("Expected the newer block result to win, got %q", shared["x"].Result)
+	}
+
+	if _, err := os.Stat(cachePath + ".lock"); !os.IsNotExist(err) {
+		t.Error("Expected the cache lock to be released")
+	}
+}
+
+func TestCacheListGetRemove(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "pml-cache-test-API-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	cachePath := filepath.Join(tmpDir, "cache.json")
+	now := time.Now()
+
+	writer := NewParser(&mockLLM{response: "Test response"}, tmpDir, tmpDir, tmpDir)
+	writer.cacheFile = cachePath
+	writer.cache["keep.pml"] = CacheEntry{
+		Checksum: "keep",
+		ModTime:  now,
+		Blocks:   map[string]BlockCache{"a": {Checksum: "a", Result: "A", ModTime: now}},
+	}
+	writer.cache["drop.pml"] = CacheEntry{
+		Checksum: "drop",
+		ModTime:  now,
+		Blocks: map[string]BlockCache{
+			"b": {Checksum: "b", Result: "B", ModTime: now},
+			"c": {Checksum: "c", Result: "C", ModTime: now},
+		},
+	}
+	if err := writer.saveCache(); err != nil {
+		t.Fatalf("saveCache failed: %v", err)
+	}
+
+	// A separate parser, like the CLI, sees what's on disk
+	admin := NewParser(&mockLLM{response: "Test response"}, tmpDir, tmpDir, tmpDir)
+	admin.cacheFile = cachePath
+
+	entries, err := admin.CachedEntries()
+	if err != nil {
+		t.Fatalf("CachedEntries failed: %v", err)
+	}
+	if len(entries) != 2 || len(entries["drop.pml"].Blocks) != 2 {
+		t.Errorf("Expected 2 entries with drop.pml having 2 blocks, got %v", entries)
+	}
+
+	entry, ok, err := admin.CachedEntry("keep.pml")
+	if err != nil || !ok {
+		t.Fatalf("Expected keep.pml to be cached, got ok=%v err=%v", ok, err)
+	}
+	if entry.Blocks["a"].Result != "A" {
+		t.Errorf("Expected cached result A, got %q", entry.Blocks["a"].Result)
+	}
+
+	removed, err := admin.RemoveCacheEntry("drop.pml")
+	if err != nil || !removed {
+		t.Fatalf("Expected drop.pml to be removed, got removed=%v err=%v", removed, err)
+	}
+	if removed, _ := admin.RemoveCacheEntry("missing.pml"); removed {
+		t.Error("Expected removing an unknown file to report false")
+	}
+
+	// Saving from a parser that never loaded the entry doesn't bring it back
+	if err := admin.saveCache(); err != nil {
+		t.Fatalf("saveCache failed: %v", err)
+	}
+	if _, ok, _ := admin.CachedEntry("drop.pml"); ok {
+		t.Error("Expected drop.pml to stay removed")
+	}
+	if _, ok, _ := admin.CachedEntry("keep.pml"); !ok {
+		t.Error("Expected keep.pml to survive the removal")
+	}
+}
+
+func TestMigrateIndexBasedCacheKeys(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "pml-cache-test-Migrate-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	content := ":ask\nFirst question\n:--\n\n:ask\nSecond question\n:--\n"
+	srcFile := filepath.Join(tmpDir, "legacy.pml")
+	if err := os.WriteFile(srcFile, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// A cache written by the old index-keyed implementation
+	now := time.Now()
+	legacy := map[string]CacheEntry{
+		srcFile: {
+			Checksum: (&Parser{}).calculateChecksum(content),
+			ModTime:  now,
+			Blocks: map[string]BlockCache{
+				"legacy.pml_block_0": {Result: "Cached first", ModTime: now},
+				"legacy.pml_block_1": {Result: "Cached second", ModTime: now},
+				"legacy.pml_block_7": {Result: "Gone", ModTime: now},
+			},
+		},
+	}
+	data, err := json.Marshal(legacy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(tmpDir, ".pml"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(tmpDir, ".pml", "cache.json"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var calls int32
+	parser := NewParser(&mockLLM{
+		response: "Fresh answer",
+		Delay:    10 * time.Millisecond,
+		callback: func() { atomic.AddInt32(&calls, 1) },
+	}, tmpDir, filepath.Join(tmpDir, "compiled"), filepath.Join(tmpDir, "results"))
+
+	blocks, err := parser.parseBlocks(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry := parser.cache[srcFile]
+	if len(entry.Blocks) != 2 {
+		t.Fatalf("Expected the 2 matching results to be migrated, got %v", entry.Blocks)
+	}
+	for i, block := range blocks {
+		if _, ok := entry.Blocks[parser.calculateBlockChecksum(block)]; !ok {
+			t.Errorf("Expected block %d to be keyed by its checksum", i)
+		}
+	}
+
+	if err := parser.ProcessFile(context.Background(), srcFile); err != nil {
+		t.Fatalf("ProcessFile failed: %v", err)
+	}
+	if got := atomic.LoadInt32(&calls); got != 0 {
+		t.Errorf("Expected migrated results to hit the cache, got %d LLM calls", got)
+	}
+
+	// The cached answers are written to result files and linked
+	updated, err := os.ReadFile(srcFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"Cached first", "Cached second"} {
+		found := false
+		for _, line := range strings.Split(string(updated), "\n") {
+			link, ok := parseResultLink(line)
+			if !ok {
+				continue
+			}
+			if _, answer, err := readResult(parser.ResolveResultLink(srcFile, link)); err == nil && answer == want {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("Expected a linked result with %q:\n%s", want, updated)
+		}
+	}
+}
+
+func TestReorderedBlocksHitCache(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "pml-cache-test-Reorder-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	first := ":ask\nFirst question\n:--\n"
+	second := ":ask\nSecond question\n:--\n"
+	srcFile := filepath.Join(tmpDir, "reorder.pml")
+
+	var calls int32
+	parser := NewParser(&mockLLM{
+		response: "Answer",
+		Delay:    10 * time.Millisecond,
+		callback: func() { atomic.AddInt32(&calls, 1) },
+	}, tmpDir, filepath.Join(tmpDir, "compiled"), filepath.Join(tmpDir, "results"))
+
+	if err := os.WriteFile(srcFile, []byte(first+"\n"+second), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := parser.ProcessFile(context.Background(), srcFile); err != nil {
+		t.Fatal(err)
+	}
+	if got := atomic.LoadInt32(&calls); got != 2 {
+		t.Fatalf("Expected 2 LLM calls, got %d", got)
+	}
+
+	// Swapping the blocks changes the file but not the blocks
+	if err := os.WriteFile(srcFile, []byte(second+"\n"+first), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := parser.ProcessFile(context.Background(), srcFile); err != nil {
+		t.Fatal(err)
+	}
+	if got := atomic.LoadInt32(&calls); got != 2 {
+		t.Errorf("Expected reordered blocks to hit the cache, got %d LLM calls", got)
+	}
+
+	// Cache hits link to the existing result files, not to the answer text
+	updated, err := os.ReadFile(srcFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range strings.Split(string(updated), "\n") {
+		if link, ok := parseResultLink(line); ok {
+			if _, err := os.Stat(parser.ResolveResultLink(srcFile, link)); err != nil {
+				t.Errorf("Expected link %s to point to a result file: %v", link, err)
+			}
+		}
+	}
+}
+
+// TestSaveCacheKeepsRemovedEntriesRemoved tests that saving doesn't bring back
+// the entries this process removed from the cache it loaded, while still
+// merging the ones other processes added
+func TestSaveCacheKeepsRemovedEntriesRemoved(t *testing.T) {
+	tmpDir := t.TempDir()
+	cachePath := filepath.Join(tmpDir, "cache.json")
+	now := time.Now()
+	block := func(checksum string) BlockCache {
+		return BlockCache{Checksum: checksum, Result: checksum, ModTime: now}
+	}
+
+	writer := NewParser(&mockLLM{response: "Test response"}, tmpDir, tmpDir, tmpDir)
+	writer.cacheFile = cachePath
+	writer.cache["a.pml"] = CacheEntry{Checksum: "a", ModTime: now, Blocks: map[string]BlockCache{"x": block("x"), "y": block("y")}}
+	writer.cache["b.pml"] = CacheEntry{Checksum: "b", ModTime: now, Blocks: map[string]BlockCache{"w": block("w")}}
+	if err := writer.saveCache(); err != nil {
+		t.Fatalf("saveCache failed: %v", err)
+	}
+
+	parser := NewParser(&mockLLM{response: "Test response"}, tmpDir, tmpDir, tmpDir)
+	parser.cacheFile = cachePath
+	parser.loadCache()
+	// Block y is pruned from its file and b.pml is dropped altogether
+	parser.cacheMu.Lock()
+	delete(parser.cache["a.pml"].Blocks, "y")
+	delete(parser.cache, "b.pml")
+	parser.cacheMu.Unlock()
+
+	// Meanwhile another process adds a block and a file
+	writer.cache["a.pml"].Blocks["z"] = block("z")
+	writer.cache["c.pml"] = CacheEntry{Checksum: "c", ModTime: now, Blocks: map[string]BlockCache{"v": block("v")}}
+	if err := writer.saveCache(); err != nil {
+		t.Fatalf("saveCache failed: %v", err)
+	}
+
+	if err := parser.saveCache(); err != nil {
+		t.Fatalf("saveCache failed: %v", err)
+	}
+	entries, err := parser.CachedEntries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := entries["a.pml"].Blocks
+	if _, ok := a["y"]; ok {
+		t.Error("Expected the pruned block to stay removed")
+	}
+	if _, ok := a["x"]; !ok {
+		t.Error("Expected the kept block to be saved")
+	}
+	if _, ok := a["z"]; !ok {
+		t.Error("Expected the block added by the other process to be merged")
+	}
+	if _, ok := entries["b.pml"]; ok {
+		t.Error("Expected the removed file to stay removed")
+	}
+	if _, ok := entries["c.pml"]; !ok {
+		t.Error("Expected the file added by the other process to be merged")
+	}
+}
+
+// TestLinkedResultsStayCached tests that the in-memory cache keeps the results of
+// blocks replaced by their links, and that processing an unchanged file doesn't
+// rewrite the cache file
+func TestLinkedResultsStayCached(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "pml-cache-test-Linked-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	block := ":ask\nWhat is PML?\n:--\n"
+	srcFile := filepath.Join(tmpDir, "linked.pml")
+
+	var calls int32
+	parser := NewParser(&mockLLM{
+		response: "Answer",
+		Delay:    10 * time.Millisecond,
+		callback: func() { atomic.AddInt32(&calls, 1) },
+	}, tmpDir, filepath.Join(tmpDir, "compiled"), filepath.Join(tmpDir, "results"))
+
+	if err := os.WriteFile(srcFile, []byte(block), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := parser.ProcessFile(context.Background(), srcFile); err != nil {
+		t.Fatal(err)
+	}
+
+	// Without the cache file, only the in-memory cache holds the result
+	if err := os.Remove(parser.cacheFile); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := parser.ProcessFile(context.Background(), srcFile); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := len(parser.cache[srcFile].Blocks); got != 1 {
+		t.Fatalf("Expected the linked block to stay cached, got %d cached blocks", got)
+	}
+
+	// Once the linked file is known, processing it again doesn't save the cache
+	if err := os.Remove(parser.cacheFile); err != nil {
+		t.Fatal(err)
+	}
+	if err := parser.ProcessFile(context.Background(), srcFile); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(parser.cacheFile); !os.IsNotExist(err) {
+		t.Errorf("Expected an unchanged file not to rewrite the cache file, got %v", err)
+	}
+
+	// Restoring the block answers it from the cache
+	if err := os.WriteFile(srcFile, []byte(block), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := parser.ProcessFile(context.Background(), srcFile); err != nil {
+		t.Fatal(err)
+	}
+	if got := atomic.LoadInt32(&calls); got != 1 {
+		t.Errorf("Expected 1 LLM call, got %d", got)
+	}
+}
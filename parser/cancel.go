@@ -0,0 +1,61 @@
+package parser
+
+import (
+	"context"
+	"path/filepath"
+	"slices"
+)
+
+// fileRun is a ProcessFile call in progress, canceled by CancelFile
+type fileRun struct {
+	cancel context.CancelFunc
+}
+
+// fileKey returns the key of path in the running files, so different
+// spellings of the same file cancel the same processing
+func fileKey(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		return abs
+	}
+	return filepath.Clean(path)
+}
+
+// startFileRun derives the context the file at path is processed with and
+// registers it for CancelFile. The returned function unregisters it.
+func (p *Parser) startFileRun(ctx context.Context, path string) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(ctx)
+	run := &fileRun{cancel: cancel}
+	key := fileKey(path)
+
+	p.fileRunsMu.Lock()
+	if p.fileRuns == nil {
+		p.fileRuns = make(map[string][]*fileRun)
+	}
+	p.fileRuns[key] = append(p.fileRuns[key], run)
+	p.fileRunsMu.Unlock()
+
+	return ctx, func() {
+		p.fileRunsMu.Lock()
+		runs := slices.DeleteFunc(p.fileRuns[key], func(r *fileRun) bool { return r == run })
+		if len(runs) == 0 {
+			delete(p.fileRuns, key)
+		} else {
+			p.fileRuns[key] = runs
+		}
+		p.fileRunsMu.Unlock()
+		cancel()
+	}
+}
+
+// CancelFile cancels the processing of the file at path, leaving other files
+// running. Its blocks stop waiting for the LLM and ProcessFile returns
+// context.Canceled. It reports whether the file was being processed.
+func (p *Parser) CancelFile(path string) bool {
+	p.fileRunsMu.Lock()
+	runs := p.fileRuns[fileKey(path)]
+	p.fileRunsMu.Unlock()
+	for _, run := range runs {
+		run.cancel()
+	}
+	return len(runs) > 0
+}
@@ -0,0 +1,105 @@
+package parser
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestCancelFile tests that canceling one file stops its blocks promptly
+// while other files keep processing
+func TestCancelFile(t *testing.T) {
+	tmpDir := t.TempDir()
+	slowFile := filepath.Join(tmpDir, "slow.pml")
+	otherFile := filepath.Join(tmpDir, "other.pml")
+	for _, path := range []string{slowFile, otherFile} {
+		if err := os.WriteFile(path, []byte(":ask\nTake your time\n:--\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	parser := NewParser(&mockLLM{response: "Answer", Delay: 2 * time.Second}, tmpDir, tmpDir, filepath.Join(tmpDir, "results"))
+	if parser.CancelFile(slowFile) {
+		t.Error("CancelFile() = true for a file that is not being processed")
+	}
+
+	slowErr := make(chan error, 1)
+	otherErr := make(chan error, 1)
+	go func() { slowErr <- parser.ProcessFile(context.Background(), slowFile) }()
+	go func() { otherErr <- parser.ProcessFile(context.Background(), otherFile) }()
+
+	// Wait for the file to be registered before canceling it
+	deadline := time.Now().Add(time.Second)
+	for !parser.CancelFile(slowFile) {
+		if time.Now().After(deadline) {
+			t.Fatal("File was never registered for cancellation")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	select {
+	case err := <-slowErr:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("ProcessFile() error = %v, want context.Canceled", err)
+		}
+	case <-time.After(500 * time.Millisecond):
+		t.Fatal("ProcessFile() did not return promptly after CancelFile")
+	}
+
+	if err := <-otherErr; err != nil {
+		t.Errorf("ProcessFile() of the other file error = %v", err)
+	}
+	if parser.CancelFile(otherFile) {
+		t.Error("CancelFile() = true after the file finished processing")
+	}
+}
+
+// stubbornLLM answers after a delay even when its context is done, like a
+// request already on its way
+type stubbornLLM struct {
+	started  chan struct{}
+	count    *int32
+	finished *int32
+}
+
+func (m stubbornLLM) Ask(ctx context.Context, prompt string) (string, error) {
+	atomic.AddInt32(m.count, 1)
+	m.started <- struct{}{}
+	time.Sleep(50 * time.Millisecond)
+	atomic.AddInt32(m.finished, 1)
+	return "Answer", nil
+}
+
+func (m stubbornLLM) Summarize(ctx context.Context, text string) (string, error) {
+	return "Summary", nil
+}
+
+// TestCancelFileWaitsForBlocks tests that a canceled file returns only once
+// the blocks already started are done, so nothing writes for it afterwards
+func TestCancelFileWaitsForBlocks(t *testing.T) {
+	tmpDir := t.TempDir()
+	srcFile := filepath.Join(tmpDir, "cancel.pml")
+	if err := os.WriteFile(srcFile, []byte(":ask\nFirst\n:--\n:ask\nSecond\n:--\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var count, finished int32
+	started := make(chan struct{}, 2)
+	parser := NewParser(stubbornLLM{started: started, count: &count, finished: &finished}, tmpDir, tmpDir, filepath.Join(tmpDir, "results"))
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() { errc <- parser.ProcessFile(ctx, srcFile) }()
+
+	<-started
+	cancel()
+	if err := <-errc; !errors.Is(err, context.Canceled) {
+		t.Fatalf("ProcessFile() error = %v, want context.Canceled", err)
+	}
+	if got, want := atomic.LoadInt32(&finished), atomic.LoadInt32(&count); got != want {
+		t.Errorf("Expected ProcessFile to wait for the started blocks, %d of %d finished", got, want)
+	}
+}
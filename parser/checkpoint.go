@@ -0,0 +1,114 @@
+package parser
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// checkpointInterval is the least time between checkpoint writes during a run
+const checkpointInterval = time.Second
+
+// SetCheckpoint makes ProcessAllFiles record the files it has completed in the
+// checkpoint file at path, so an interrupted run can be resumed. The file is
+// removed once a run completes. With resume, files the checkpoint lists as
+// completed are skipped unless they changed since. An empty path disables
+// checkpointing.
+func (p *Parser) SetCheckpoint(path string, resume bool) {
+	p.checkpointFile = path
+	p.resume = resume
+}
+
+// checkpoint tracks the files completed by a run of ProcessAllFiles
+type checkpoint struct {
+	mu        sync.Mutex
+	path      string
+	Files     map[string]time.Time `json:"files"` // Completed files and their modification time when completed
+	lastWrite time.Time
+}
+
+// loadCheckpoint returns the checkpoint of the current run, continuing the one on
+// disk when resuming
+func (p *Parser) loadCheckpoint() *checkpoint {
+	cp := &checkpoint{path: p.checkpointFile, Files: make(map[string]time.Time)}
+	if !p.resume {
+		return cp
+	}
+	data, err := os.ReadFile(cp.path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			p.debugf("Warning: failed to read checkpoint: %v\n", err)
+		}
+		return cp
+	}
+	if err := json.Unmarshal(data, cp); err != nil {
+		p.debugf("Warning: ignoring corrupt checkpoint %s: %v\n", cp.path, err)
+		cp.Files = make(map[string]time.Time)
+	}
+	if cp.Files == nil {
+		cp.Files = make(map[string]time.Time)
+	}
+	return cp
+}
+
+// pending returns the files not completed since they were last modified
+func (cp *checkpoint) pending(files []string) []string {
+	var remaining []string
+	for _, file := range files {
+		completed, ok := cp.Files[file]
+		if ok {
+			if info, err := os.Stat(file); err == nil && info.ModTime().Equal(completed) {
+				continue
+			}
+		}
+		remaining = append(remaining, file)
+	}
+	return remaining
+}
+
+// complete records a completed file, writing the checkpoint if the last write
+// was long enough ago
+func (cp *checkpoint) complete(file string, now time.Time) error {
+	info, err := os.Stat(file)
+	if err != nil {
+		return nil // Nothing to skip on resume
+	}
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	cp.Files[file] = info.ModTime()
+	if now.Sub(cp.lastWrite) < checkpointInterval {
+		return nil
+	}
+	cp.lastWrite = now
+	return cp.writeLocked()
+}
+
+// save writes the checkpoint
+func (cp *checkpoint) save() error {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	return cp.writeLocked()
+}
+
+func (cp *checkpoint) writeLocked() error {
+	data, err := json.MarshalIndent(cp, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal checkpoint: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(cp.path), 0755); err != nil {
+		return fmt.Errorf("failed to create checkpoint directory: %w", err)
+	}
+	// Write to a temporary file first so an interruption never leaves a partial checkpoint
+	tmp := cp.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("failed to write checkpoint: %w", err)
+	}
+	if err := os.Rename(tmp, cp.path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to write checkpoint: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+package parser
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// failingLLM fails prompts containing "fail" and counts all calls
+type failingLLM struct {
+	mockLLM
+	calls int32
+}
+
+func (f *failingLLM) Ask(ctx context.Context, prompt string) (string, error) {
+	atomic.AddInt32(&f.calls, 1)
+	if strings.Contains(prompt, "fail") {
+		return "", errors.New("request failed")
+	}
+	return f.mockLLM.Ask(ctx, prompt)
+}
+
+// TestProcessAllFilesResume tests that a resumed run skips the files an interrupted run completed
+func TestProcessAllFilesResume(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "pml-checkpoint-*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	checkpointFile := filepath.Join(tmpDir, ".pml", "checkpoint.json")
+	sources := map[string]string{
+		"a.pml": ":ask\nFirst question\n:--\n",
+		"b.pml": ":ask\nSecond question\n:--\n",
+		"c.pml": ":ask\nThis one will fail\n:--\n",
+	}
+	var files []string
+	for name, content := range sources {
+		path := filepath.Join(tmpDir, name)
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+		files = append(files, path)
+	}
+
+	// The first run is interrupted by a failing file
+	llm := &failingLLM{mockLLM: mockLLM{response: "Answer", Delay: 10 * time.Millisecond}}
+	p := NewParser(llm, tmpDir, filepath.Join(tmpDir, "compiled"), filepath.Join(tmpDir, "results"))
+	p.SetFailFast(false)
+	p.SetCheckpoint(checkpointFile, false)
+	if err := p.ProcessAllFiles(context.Background(), files); err == nil {
+		t.Fatal("Expected the first run to fail")
+	}
+	if _, err := os.Stat(checkpointFile); err != nil {
+		t.Fatalf("Expected a checkpoint after the interrupted run: %v", err)
+	}
+
+	// Make a completed file look unprocessed again without changing its
+	// modification time, so only the checkpoint can tell it was completed
+	aFile := filepath.Join(tmpDir, "a.pml")
+	info, err := os.Stat(aFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(aFile, []byte(sources["a.pml"]), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(aFile, info.ModTime(), info.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+	cFile := filepath.Join(tmpDir, "c.pml")
+	if err := os.WriteFile(cFile, []byte(":ask\nThird question\n:--\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// The resumed run only processes the file that didn't complete
+	llm = &failingLLM{mockLLM: mockLLM{response: "Answer", Delay: 10 * time.Millisecond}}
+	p = NewParser(llm, tmpDir, filepath.Join(tmpDir, "compiled"), filepath.Join(tmpDir, "results"))
+	p.SetFailFast(false)
+	p.SetCheckpoint(checkpointFile, true)
+	if err := p.ProcessAllFiles(context.Background(), files); err != nil {
+		t.Fatalf("Resumed run failed: %v", err)
+	}
+	if got := atomic.LoadInt32(&llm.calls); got != 1 {
+		t.Errorf("Expected 1 LLM call on resume, got %d", got)
+	}
+	content, err := os.ReadFile(aFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != sources["a.pml"] {
+		t.Errorf("Expected the completed file to be skipped, got:\n%s", content)
+	}
+	if content, err := os.ReadFile(cFile); err != nil || !strings.Contains(string(content), ":--(r/") {
+		t.Errorf("Expected the remaining file to be processed, got:\n%s", content)
+	}
+	if _, err := os.Stat(checkpointFile); !os.IsNotExist(err) {
+		t.Errorf("Expected the checkpoint to be removed after a complete run, got %v", err)
+	}
+}
@@ -0,0 +1,29 @@
+package parser
+
+import "time"
+
+// Clock provides the current time for timestamps in results and the cache
+type Clock interface {
+	Now() time.Time
+}
+
+// realClock is the Clock backed by time.Now
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+// SetClock sets the clock used for result and cache timestamps, e.g. a fixed
+// clock for reproducible output in tests. Lock timeouts always use real time.
+func (p *Parser) SetClock(clock Clock) {
+	p.clock = clock
+}
+
+// now returns the current time from the parser's clock
+func (p *Parser) now() time.Time {
+	if p.clock == nil {
+		return time.Now()
+	}
+	return p.clock.Now()
+}
@@ -0,0 +1,70 @@
+package parser
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fixedClock always returns the same time
+type fixedClock struct {
+	t time.Time
+}
+
+func (c fixedClock) Now() time.Time {
+	return c.t
+}
+
+// TestSetClock tests that result and cache timestamps come from the injected clock
+func TestSetClock(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "pml-clock-*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	fixed := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	p := NewParser(&mockLLM{response: "Paris", Delay: 10 * time.Millisecond}, tmpDir, filepath.Join(tmpDir, "compiled"), filepath.Join(tmpDir, "results"))
+	p.SetClock(fixedClock{fixed})
+
+	pmlFile := filepath.Join(tmpDir, "test.pml")
+	if err := os.WriteFile(pmlFile, []byte(":ask\nCapital of France?\n:--\n"), 0644); err != nil {
+		t.Fatalf("Failed to write test file: %v", err)
+	}
+	if err := p.ProcessFile(context.Background(), pmlFile); err != nil {
+		t.Fatalf("ProcessFile failed: %v", err)
+	}
+
+	processed, err := os.ReadFile(pmlFile)
+	if err != nil {
+		t.Fatalf("Failed to read processed file: %v", err)
+	}
+	link, ok := parseResultLink(strings.TrimSpace(string(processed)))
+	if !ok {
+		t.Fatalf("Expected a result link, got:\n%s", processed)
+	}
+	result, err := os.ReadFile(p.ResolveResultLink(pmlFile, link))
+	if err != nil {
+		t.Fatalf("Failed to read result file: %v", err)
+	}
+	if !strings.Contains(string(result), `"timestamp":"2024-03-01T12:00:00Z"`) {
+		t.Errorf("Expected the result timestamp to come from the clock, got:\n%s", result)
+	}
+
+	for _, cached := range p.cache[pmlFile].Blocks {
+		if !cached.ModTime.Equal(fixed) {
+			t.Errorf("Expected cache ModTime %v, got %v", fixed, cached.ModTime)
+		}
+	}
+
+	entries, err := p.ReadIndex()
+	if err != nil {
+		t.Fatalf("ReadIndex failed: %v", err)
+	}
+	if len(entries) != 1 || !entries[0].Timestamp.Equal(fixed) {
+		t.Errorf("Expected one index entry at %v, got %+v", fixed, entries)
+	}
+}
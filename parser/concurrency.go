@@ -2,65 +2,124 @@ package parser
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
 	"runtime"
 	"sync"
-	"time"
 )
 
-// ProcessAllFiles processes all PML files in the source directory concurrently
+// ProcessAllFiles processes all PML files in the source directory concurrently.
+// By default the first failing file cancels the rest; see SetFailFast. With a
+// checkpoint file set, completed files are recorded so an interrupted run can
+// be resumed; see SetCheckpoint. In transactional mode PML files are only
+// updated if every file succeeds; see SetTransactional.
 func (p *Parser) ProcessAllFiles(ctx context.Context, files []string) error {
 	if ctx == nil {
 		ctx = context.Background()
 	}
+	if p.transactional {
+		return p.processFilesTransaction(ctx, files)
+	}
+	if p.checkpointFile == "" {
+		return p.processFiles(ctx, files, nil)
+	}
+
+	cp := p.loadCheckpoint()
+	if p.resume {
+		pending := cp.pending(files)
+		p.debugf("Resuming: skipping %d completed files\n", len(files)-len(pending))
+		files = pending
+	}
+	err := p.processFiles(ctx, files, cp)
+	if err == nil {
+		// The run is complete; the next one starts from scratch
+		if rmErr := os.Remove(cp.path); rmErr != nil && !os.IsNotExist(rmErr) {
+			p.debugf("Warning: failed to remove checkpoint: %v\n", rmErr)
+		}
+		return nil
+	}
+	if saveErr := cp.save(); saveErr != nil {
+		p.debugf("Warning: failed to save checkpoint: %v\n", saveErr)
+	}
+	return err
+}
+
+// processFiles processes files concurrently, recording completed files in cp if not nil
+func (p *Parser) processFiles(ctx context.Context, files []string, cp *checkpoint) error {
 
 	var wg sync.WaitGroup
 	errChan := make(chan error, len(files))
-	semaphore := make(chan struct{}, runtime.NumCPU())
+	slots := p.newSlots(runtime.NumCPU())
 
 	// Create a new context that we can cancel
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
-	// Process files in batches to ensure cancellation can happen
+	// firstErr prefers the error of a failed file over the cancellation it caused
+	firstErr := func() error {
+		select {
+		case err := <-errChan:
+			return err
+		default:
+			return ctx.Err()
+		}
+	}
+
+	// Start files as slots free up; cancellation is observed before each file
+	// and, within files, before each block
 	for i := 0; i < len(files); i++ {
 		select {
 		case <-ctx.Done():
 			// Wait for running goroutines to finish
 			wg.Wait()
-			return ctx.Err()
+			return firstErr()
 		default:
+			if err := slots.Acquire(ctx); err != nil {
+				wg.Wait()
+				return firstErr()
+			}
 			wg.Add(1)
-			semaphore <- struct{}{} // Acquire semaphore
 			go func(f string) {
 				defer wg.Done()
-				defer func() { <-semaphore }() // Release semaphore
+				defer slots.Release()
 
-				// Add a delay to ensure cancellation can happen
-				select {
-				case <-ctx.Done():
-					errChan <- ctx.Err()
+				if err := ctx.Err(); err != nil {
+					errChan <- err
 					return
-				case <-time.After(50 * time.Millisecond):
-					// Continue processing after delay
 				}
-
-				select {
-				case <-ctx.Done():
-					errChan <- ctx.Err()
-					return
-				default:
-					if err := p.ProcessFile(ctx, f); err != nil {
+				if err := p.ProcessFile(ctx, f); err != nil {
+					errChan <- fmt.Errorf("processing file %s: %w", f, err)
+					if p.failFast {
 						cancel() // Cancel other goroutines if one fails
-						errChan <- fmt.Errorf("processing file %s: %w", f, err)
+					}
+				} else if cp != nil {
+					if err := cp.complete(f, p.now()); err != nil {
+						p.debugf("Warning: failed to save checkpoint: %v\n", err)
 					}
 				}
 			}(files[i])
 		}
 	}
 
+	if !p.failFast {
+		// Process every file, then report all failures together
+		wg.Wait()
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		close(errChan)
+		var errs []error
+		for err := range errChan {
+			errs = append(errs, err)
+		}
+		if len(errs) > 0 {
+			return fmt.Errorf("%d of %d files failed: %w", len(errs), len(files), errors.Join(errs...))
+		}
+		return nil
+	}
+
 	// Wait for completion or cancellation
 	done := make(chan struct{})
 	go func() {
@@ -72,27 +131,38 @@ func (p *Parser) ProcessAllFiles(ctx context.Context, files []string) error {
 	case <-ctx.Done():
 		// Wait for running goroutines to finish
 		wg.Wait()
-		return ctx.Err()
+		return firstErr()
 	case err := <-errChan:
+		// The failure cancels the other files; wait for them to stop so none
+		// writes after the run has returned
+		cancel()
+		<-done
 		return err
 	case <-done:
 		return nil
 	}
 }
 
-// findPMLFiles finds all PML files in the source directory
-func (p *Parser) findPMLFiles() ([]string, error) {
+// FindPMLFiles finds all PML files in the source directory. Files another one
+// includes are left out, as their blocks are processed with the including file.
+func (p *Parser) FindPMLFiles() ([]string, error) {
 	var files []string
 	err := filepath.Walk(p.sourcesDir, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
-		if !info.IsDir() && IsPMLFile(path) {
+		if info.IsDir() && path != p.sourcesDir && p.IsPrunedDir(info.Name()) {
+			return filepath.SkipDir
+		}
+		if !info.IsDir() && p.IsPMLFile(path) {
 			files = append(files, path)
 		}
 		return nil
 	})
-	return files, err
+	if err != nil {
+		return nil, err
+	}
+	return p.withoutIncluded(files), nil
 }
 
 // ensureDirectories creates necessary directories if they don't exist
@@ -4,8 +4,10 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"math/rand"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"testing"
@@ -60,9 +62,9 @@ func TestProcessAllFilesWithMixedContent(t *testing.T) {
 	}
 	dur := time.Since(start)
 
-	// We expect 3 LLM calls (one for each file)
-	if callCount != 3 {
-		t.Errorf("Expected 3 LLM calls, got %d", callCount)
+	// We expect 2 LLM calls (one for each :ask file); the :do block runs without the LLM
+	if callCount != 2 {
+		t.Errorf("Expected 2 LLM calls, got %d", callCount)
 	}
 
 	// If processing was sequential, it would take at least 300ms
@@ -168,3 +170,449 @@ func TestProcessAllFilesCancellation(t *testing.T) {
 		t.Error("Expected some files to be processed before cancellation")
 	}
 }
+
+// slowPromptLLM answers at once, except for prompts starting with "Slow",
+// which wait until their context is done
+type slowPromptLLM struct{}
+
+func (slowPromptLLM) Ask(ctx context.Context, prompt string) (string, error) {
+	if strings.HasPrefix(prompt, "Slow") {
+		<-ctx.Done()
+		return "", ctx.Err()
+	}
+	return "Answer", nil
+}
+
+func (slowPromptLLM) Summarize(ctx context.Context, text string) (string, error) {
+	return "Summary", nil
+}
+
+// TestProcessAllFilesTimeoutKeepsCompletedResults tests that a run past its
+// deadline returns the deadline error and keeps the answers completed before it
+func TestProcessAllFilesTimeoutKeepsCompletedResults(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	// Each file has a quick block and a block still running at the deadline
+	var files []string
+	for i := 0; i < 4; i++ {
+		f := filepath.Join(tmpDir, fmt.Sprintf("run%d.pml", i))
+		content := fmt.Sprintf(":ask\nQuick question %d\n:--\n\n:ask\nSlow question %d\n:--\n", i, i)
+		if err := os.WriteFile(f, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, f)
+	}
+
+	parser := NewParser(slowPromptLLM{}, tmpDir, filepath.Join(tmpDir, "compiled"), filepath.Join(tmpDir, "results"))
+	parser.SetForceProcess(true)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err := parser.ProcessAllFiles(ctx, files)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected deadline exceeded error, got: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Expected the run to stop at its deadline, took %v", elapsed)
+	}
+
+	completed := 0
+	for _, f := range files {
+		data, err := os.ReadFile(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		content := string(data)
+		if !strings.Contains(content, "Slow question") {
+			t.Errorf("Expected the unfinished block to stay in %s:\n%s", filepath.Base(f), content)
+		}
+		if strings.Contains(content, ":--(r/") && !strings.Contains(content, "Quick question") {
+			completed++
+		}
+	}
+	if completed == 0 {
+		t.Error("Expected the answers completed before the deadline to be linked")
+	}
+}
+
+// TestProcessAllFilesCancelsPromptly tests that canceling a run stops files
+// waiting on the LLM and files not yet started without delay
+func TestProcessAllFilesCancelsPromptly(t *testing.T) {
+	tmpDir := t.TempDir()
+	var files []string
+	for i := 0; i < 10; i++ {
+		f := filepath.Join(tmpDir, fmt.Sprintf("slow%d.pml", i))
+		if err := os.WriteFile(f, []byte(fmt.Sprintf(":ask\nSlow question %d\n:--\n", i)), 0644); err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, f)
+	}
+	parser := NewParser(slowPromptLLM{}, tmpDir, filepath.Join(tmpDir, "compiled"), filepath.Join(tmpDir, "results"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	start := time.Now()
+	err := parser.ProcessAllFiles(ctx, files)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected context.Canceled, got: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("Expected the run to stop promptly after cancellation, took %v", elapsed)
+	}
+}
+
+// BenchmarkProcessAllFiles measures processing files whose blocks are answered
+// at once, so any fixed per-file delay shows up directly
+func BenchmarkProcessAllFiles(b *testing.B) {
+	tmpDir := b.TempDir()
+	var files []string
+	for i := 0; i < 20; i++ {
+		files = append(files, filepath.Join(tmpDir, fmt.Sprintf("bench%d.pml", i)))
+	}
+	parser := NewParser(slowPromptLLM{}, tmpDir, filepath.Join(tmpDir, "compiled"), filepath.Join(tmpDir, "results"))
+	parser.SetForceProcess(true)
+
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		b.StopTimer()
+		for i, f := range files {
+			if err := os.WriteFile(f, []byte(fmt.Sprintf(":ask\nQuestion %d\n:--\n", i)), 0644); err != nil {
+				b.Fatal(err)
+			}
+		}
+		b.StartTimer()
+		// Files are run one at a time, as files running in parallel would hide
+		// a delay added to each of them
+		for _, f := range files {
+			start := time.Now()
+			if err := parser.ProcessAllFiles(context.Background(), []string{f}); err != nil {
+				b.Fatal(err)
+			}
+			if took := time.Since(start); took >= 50*time.Millisecond {
+				b.Fatalf("Expected no fixed per-file delay, took %v for %s", took, filepath.Base(f))
+			}
+		}
+	}
+}
+
+// writeMixedFailureFiles writes several valid PML files and one that fails to parse
+func writeMixedFailureFiles(t *testing.T, dir string) (files []string, bad string) {
+	t.Helper()
+	bad = filepath.Join(dir, "a_bad.pml")
+	if err := os.WriteFile(bad, []byte(":ask\nunterminated\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	files = append(files, bad)
+	for i := 0; i < 3; i++ {
+		f := filepath.Join(dir, fmt.Sprintf("good%d.pml", i))
+		if err := os.WriteFile(f, []byte(fmt.Sprintf(":ask\nQuestion %d\n:--\n", i)), 0644); err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, f)
+	}
+	return files, bad
+}
+
+// TestProcessAllFilesFailFast tests that by default the first failing file cancels the rest.
+func TestProcessAllFilesFailFast(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "pml-failfast-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	files, bad := writeMixedFailureFiles(t, tmpDir)
+	parser := NewParser(&mockLLM{
+		response: "Test response",
+		Delay:    2 * time.Second,
+	}, tmpDir, filepath.Join(tmpDir, "compiled"), filepath.Join(tmpDir, "results"))
+
+	start := time.Now()
+	err = parser.ProcessAllFiles(context.Background(), files)
+	if err == nil {
+		t.Fatal("Expected an error for the failing file")
+	}
+	if !strings.Contains(err.Error(), bad) {
+		t.Errorf("Expected the failing file's error, got: %v", err)
+	}
+	if time.Since(start) >= 2*time.Second {
+		t.Error("Expected the remaining files to be cancelled")
+	}
+	for _, f := range files[1:] {
+		data, err := os.ReadFile(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(string(data), ":--(r/") {
+			t.Errorf("Expected %s not to be processed after the failure", f)
+		}
+	}
+}
+
+// TestProcessAllFilesBestEffort tests that best-effort mode processes every file and reports all failures.
+func TestProcessAllFilesBestEffort(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "pml-besteffort-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	files, bad := writeMixedFailureFiles(t, tmpDir)
+	parser := NewParser(&mockLLM{
+		response: "Test response",
+		Delay:    10 * time.Millisecond,
+	}, tmpDir, filepath.Join(tmpDir, "compiled"), filepath.Join(tmpDir, "results"))
+	parser.SetFailFast(false)
+
+	err = parser.ProcessAllFiles(context.Background(), files)
+	if err == nil {
+		t.Fatal("Expected an aggregated error for the failing file")
+	}
+	if !strings.Contains(err.Error(), "1 of 4 files failed") || !strings.Contains(err.Error(), bad) {
+		t.Errorf("Expected an aggregated error naming %s, got: %v", bad, err)
+	}
+	for _, f := range files[1:] {
+		data, err := os.ReadFile(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(data), ":--(r/") {
+			t.Errorf("Expected %s to be processed despite the failure", f)
+		}
+	}
+}
+
+// TestResultNamesAreDeterministic tests that result names don't depend on the
+// order in which concurrently processed blocks complete.
+func TestResultNamesAreDeterministic(t *testing.T) {
+	run := func() string {
+		tmpDir, err := os.MkdirTemp("", "pml-names-*")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(tmpDir)
+
+		var files []string
+		for f := 0; f < 2; f++ {
+			var content strings.Builder
+			for b := 0; b < 5; b++ {
+				fmt.Fprintf(&content, ":ask\nQuestion %d of file %d\n:--\n\n", b, f)
+			}
+			path := filepath.Join(tmpDir, fmt.Sprintf("file%d.pml", f))
+			if err := os.WriteFile(path, []byte(content.String()), 0644); err != nil {
+				t.Fatal(err)
+			}
+			files = append(files, path)
+		}
+
+		parser := NewParser(&mockLLM{
+			Delay: 10 * time.Millisecond,
+			answer: func(prompt string) string {
+				// Vary completion order between runs
+				time.Sleep(time.Duration(rand.Intn(20)) * time.Millisecond)
+				return "Answer"
+			},
+		}, tmpDir, filepath.Join(tmpDir, "compiled"), filepath.Join(tmpDir, "results"))
+		if err := parser.ProcessAllFiles(context.Background(), files); err != nil {
+			t.Fatalf("ProcessAllFiles failed: %v", err)
+		}
+
+		// The links in each file, in order, capture both naming and placement
+		var links strings.Builder
+		for _, path := range files {
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, line := range strings.Split(string(data), "\n") {
+				if link, ok := parseResultLink(line); ok {
+					fmt.Fprintf(&links, "%s: %s\n", filepath.Base(path), link)
+				}
+			}
+		}
+		return links.String()
+	}
+
+	first := run()
+	if strings.Count(first, "\n") != 10 {
+		t.Fatalf("Expected 10 result links, got:\n%s", first)
+	}
+	for i := 0; i < 3; i++ {
+		if got := run(); got != first {
+			t.Fatalf("Result names differ between runs:\n%s\nvs:\n%s", first, got)
+		}
+	}
+}
+
+// modelTrackingLLM records the peak number of in-flight calls per model
+type modelTrackingLLM struct {
+	mu       sync.Mutex
+	inFlight map[string]int
+	peak     map[string]int
+	calls    map[string]int
+}
+
+func (m *modelTrackingLLM) Ask(ctx context.Context, prompt string) (string, error) {
+	return m.AskWithModel(ctx, "", prompt)
+}
+
+func (m *modelTrackingLLM) AskWithModel(ctx context.Context, model, prompt string) (string, error) {
+	m.mu.Lock()
+	m.inFlight[model]++
+	m.calls[model]++
+	if m.inFlight[model] > m.peak[model] {
+		m.peak[model] = m.inFlight[model]
+	}
+	m.mu.Unlock()
+
+	time.Sleep(30 * time.Millisecond)
+
+	m.mu.Lock()
+	m.inFlight[model]--
+	m.mu.Unlock()
+	return "Answer from " + model, nil
+}
+
+func (m *modelTrackingLLM) Summarize(ctx context.Context, text string) (string, error) {
+	return "Summary: " + text, nil
+}
+
+// TestLLMConcurrencyByModel tests that each model's in-flight calls are bounded independently.
+func TestLLMConcurrencyByModel(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "pml-model-conc-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	var content string
+	for i := 0; i < 4; i++ {
+		content += fmt.Sprintf(":ask model=cheap\nCheap question %d\n:--\n\n", i)
+		content += fmt.Sprintf(":ask model=premium\nPremium question %d\n:--\n\n", i)
+	}
+	srcFile := filepath.Join(tmpDir, "models.pml")
+	if err := os.WriteFile(srcFile, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	llm := &modelTrackingLLM{
+		inFlight: make(map[string]int),
+		peak:     make(map[string]int),
+		calls:    make(map[string]int),
+	}
+	parser := NewParser(llm, tmpDir, filepath.Join(tmpDir, "compiled"), filepath.Join(tmpDir, "results"))
+	parser.SetLLMConcurrencyByModel(map[string]int{"cheap": 3, "premium": 1})
+
+	if err := parser.ProcessFile(context.Background(), srcFile); err != nil {
+		t.Fatalf("ProcessFile failed: %v", err)
+	}
+
+	if llm.calls["cheap"] != 4 || llm.calls["premium"] != 4 {
+		t.Errorf("Expected 4 calls per model, got %v", llm.calls)
+	}
+	if llm.peak["premium"] > 1 {
+		t.Errorf("Expected at most 1 in-flight premium call, got %d", llm.peak["premium"])
+	}
+	if llm.peak["cheap"] > 3 {
+		t.Errorf("Expected at most 3 in-flight cheap calls, got %d", llm.peak["cheap"])
+	}
+	if llm.peak["cheap"] < 2 {
+		t.Errorf("Expected cheap calls to run concurrently, peak was %d", llm.peak["cheap"])
+	}
+}
+
+// TestFindPMLFilesPrunesDirectories tests that heavy directories are skipped when looking for PML files
+func TestFindPMLFilesPrunesDirectories(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "pml-prune-*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	files := []string{
+		"top.pml",
+		filepath.Join("docs", "nested.pml"),
+		filepath.Join("node_modules", "pkg", "ignored.pml"),
+		filepath.Join("build", "generated.pml"),
+	}
+	for _, file := range files {
+		path := filepath.Join(tmpDir, file)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("Failed to create directory: %v", err)
+		}
+		if err := os.WriteFile(path, []byte(":ask\nQuestion\n:--\n"), 0644); err != nil {
+			t.Fatalf("Failed to write %s: %v", file, err)
+		}
+	}
+
+	p := NewParser(&mockLLM{response: "Test response"}, tmpDir, filepath.Join(tmpDir, "compiled"), filepath.Join(tmpDir, "results"))
+	p.AddPruneDirs("build")
+
+	found, err := p.FindPMLFiles()
+	if err != nil {
+		t.Fatalf("FindPMLFiles failed: %v", err)
+	}
+	want := []string{filepath.Join(tmpDir, "docs", "nested.pml"), filepath.Join(tmpDir, "top.pml")}
+	if len(found) != len(want) {
+		t.Fatalf("Expected %v, got %v", want, found)
+	}
+	for i := range want {
+		if found[i] != want[i] {
+			t.Errorf("Expected %s, got %s", want[i], found[i])
+		}
+	}
+}
+
+// TestFindPMLFilesCustomExtensions tests that files with configured extensions are discovered and processed
+func TestFindPMLFilesCustomExtensions(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "pml-ext-*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	for _, file := range []string{"greeting.prompt", "notes.llm", "old.pml", "readme.txt"} {
+		if err := os.WriteFile(filepath.Join(tmpDir, file), []byte(":ask\nQuestion\n:--\n"), 0644); err != nil {
+			t.Fatalf("Failed to write %s: %v", file, err)
+		}
+	}
+
+	p := NewParser(&mockLLM{response: "Test response", Delay: 10 * time.Millisecond}, tmpDir, filepath.Join(tmpDir, "compiled"), filepath.Join(tmpDir, "results"))
+	p.SetExtensions([]string{".prompt", "llm"})
+
+	found, err := p.FindPMLFiles()
+	if err != nil {
+		t.Fatalf("FindPMLFiles failed: %v", err)
+	}
+	want := []string{filepath.Join(tmpDir, "greeting.prompt"), filepath.Join(tmpDir, "notes.llm")}
+	if len(found) != len(want) {
+		t.Fatalf("Expected %v, got %v", want, found)
+	}
+	for i := range want {
+		if found[i] != want[i] {
+			t.Errorf("Expected %s, got %s", want[i], found[i])
+		}
+	}
+
+	if err := p.ProcessAllFiles(context.Background(), found); err != nil {
+		t.Fatalf("ProcessAllFiles failed: %v", err)
+	}
+	for _, path := range want {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatalf("Failed to read %s: %v", path, err)
+		}
+		if !strings.Contains(string(content), ":--(r/") {
+			t.Errorf("Expected %s to be processed, got:\n%s", path, content)
+		}
+	}
+
+	if !p.IsPMLFile("archive.prompt.gz") || p.IsPMLFile("old.pml") {
+		t.Errorf("Expected IsPMLFile to follow the configured extensions")
+	}
+	p.SetExtensions(nil)
+	if !p.IsPMLFile("old.pml") {
+		t.Errorf("Expected an empty extension list to restore the default")
+	}
+}
@@ -0,0 +1,67 @@
+package parser
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestSetDiffOutput tests that a dry run prints the inserted result links and modifies no files
+func TestSetDiffOutput(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "pml-diff-*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	resultsDir := filepath.Join(tmpDir, "results")
+	p := NewParser(&mockLLM{response: "Paris", Delay: 10 * time.Millisecond}, tmpDir, filepath.Join(tmpDir, "compiled"), resultsDir)
+	var out bytes.Buffer
+	p.SetDiffOutput(&out)
+
+	pmlFile := filepath.Join(tmpDir, "test.pml")
+	content := "Intro\n\n:ask\nCapital of France?\n:--\n\nOutro\n"
+	if err := os.WriteFile(pmlFile, []byte(content), 0644); err != nil {
+		t.Fatalf("Failed to write test file: %v", err)
+	}
+	if err := p.ProcessFile(context.Background(), pmlFile); err != nil {
+		t.Fatalf("ProcessFile failed: %v", err)
+	}
+
+	diff := out.String()
+	for _, want := range []string{"--- " + pmlFile, "+++ " + pmlFile, "-:ask", "-Capital of France?", "+:--(r/", " Intro"} {
+		if !strings.Contains(diff, want) {
+			t.Errorf("Expected diff to contain %q, got:\n%s", want, diff)
+		}
+	}
+
+	after, err := os.ReadFile(pmlFile)
+	if err != nil {
+		t.Fatalf("Failed to read test file: %v", err)
+	}
+	if string(after) != content {
+		t.Errorf("Expected the file to be unchanged, got:\n%s", after)
+	}
+	if _, err := os.Stat(filepath.Join(tmpDir, ".pml", "results")); !os.IsNotExist(err) {
+		t.Errorf("Expected no results directory, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(tmpDir, ".pml", IndexFile)); !os.IsNotExist(err) {
+		t.Errorf("Expected no results index, got %v", err)
+	}
+}
+
+// TestUnifiedDiff tests hunk headers of a simple replacement
+func TestUnifiedDiff(t *testing.T) {
+	got := unifiedDiff("f.pml", "a\nb\nc\n", "a\nB\nc\n")
+	want := "--- f.pml\n+++ f.pml\n@@ -1,3 +1,3 @@\n a\n-b\n+B\n c\n"
+	if got != want {
+		t.Errorf("Unexpected diff:\n%s\nwant:\n%s", got, want)
+	}
+	if unifiedDiff("f.pml", "same", "same") != "" {
+		t.Error("Expected no diff for equal content")
+	}
+}
@@ -1,6 +1,8 @@
 package directives
 
 import (
+	"context"
+	"sort"
 	"strings"
 )
 
@@ -13,6 +15,13 @@ type Directive interface {
 	CanGenerateBlocks() bool
 }
 
+// Processor is implemented by directives that produce a block's result
+// themselves, such as :do, instead of sending the block to the LLM
+type Processor interface {
+	// Process returns the result of a block with the given content lines
+	Process(ctx context.Context, content []string) (string, error)
+}
+
 // BaseDirective provides common functionality for directives
 type BaseDirective struct {
 	name string
@@ -31,7 +40,7 @@ type DirectiveRegistry struct {
 	directives map[string]Directive
 }
 
-// NewDirectiveRegistry creates a new registry with default directives
+// NewDirectiveRegistry creates a new empty registry
 func NewDirectiveRegistry() *DirectiveRegistry {
 	r := &DirectiveRegistry{
 		directives: make(map[string]Directive),
@@ -39,6 +48,19 @@ func NewDirectiveRegistry() *DirectiveRegistry {
 	return r
 }
 
+// DefaultRegistry creates a registry with the built-in directives
+func DefaultRegistry() *DirectiveRegistry {
+	r := NewDirectiveRegistry()
+	r.Register(NewAskDirective())
+	r.Register(NewDoDirective())
+	r.Register(NewSummaryDirective())
+	r.Register(NewSummarizeDirective())
+	r.Register(NewEmbedDirective())
+	r.Register(NewInputDirective())
+	r.Register(NewIncludeDirective())
+	return r
+}
+
 // Register adds a new directive to the registry
 func (r *DirectiveRegistry) Register(d Directive) {
 	r.directives[d.Name()] = d
@@ -50,11 +72,12 @@ func (r *DirectiveRegistry) Get(name string) (Directive, bool) {
 	return d, ok
 }
 
-// List returns all registered directive names
+// List returns all registered directive names in sorted order
 func (r *DirectiveRegistry) List() []string {
 	var names []string
 	for name := range r.directives {
 		names = append(names, name)
 	}
+	sort.Strings(names)
 	return names
 }
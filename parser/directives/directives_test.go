@@ -62,3 +62,22 @@ func TestBaseDirective(t *testing.T) {
 		t.Error("Base directive should not generate blocks by default")
 	}
 }
+
+func TestDefaultRegistry(t *testing.T) {
+	registry := DefaultRegistry()
+
+	names := registry.List()
+	want := []string{":ask", ":do", ":embed", ":include", ":input", ":summarize", ":summary"}
+	if len(names) != len(want) {
+		t.Fatalf("Wrong directives, got %v, want %v", names, want)
+	}
+	for i := range want {
+		if names[i] != want[i] {
+			t.Errorf("Wrong directive at %d, got %s, want %s", i, names[i], want[i])
+		}
+	}
+
+	if d, ok := registry.Get(":do"); !ok || !d.CanGenerateBlocks() {
+		t.Error(":do should be registered and able to generate blocks")
+	}
+}
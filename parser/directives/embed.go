@@ -0,0 +1,18 @@
+package directives
+
+// EmbedDirective implements the :embed directive
+type EmbedDirective struct {
+	BaseDirective
+}
+
+// NewEmbedDirective creates a new embed directive
+func NewEmbedDirective() *EmbedDirective {
+	return &EmbedDirective{
+		BaseDirective: BaseDirective{name: ":embed"},
+	}
+}
+
+// CanGenerateBlocks implements Directive
+func (d *EmbedDirective) CanGenerateBlocks() bool {
+	return false
+}
@@ -0,0 +1,20 @@
+package directives
+
+// IncludeDirective implements the :include directive, which splices in the
+// blocks of another PML file
+type IncludeDirective struct {
+	BaseDirective
+}
+
+// NewIncludeDirective creates a new include directive
+func NewIncludeDirective() *IncludeDirective {
+	return &IncludeDirective{
+		BaseDirective: BaseDirective{name: ":include"},
+	}
+}
+
+// CanGenerateBlocks implements Directive: the included file's blocks are
+// processed as the including file's
+func (d *IncludeDirective) CanGenerateBlocks() bool {
+	return true
+}
@@ -0,0 +1,18 @@
+package directives
+
+// InputDirective implements the :input directive
+type InputDirective struct {
+	BaseDirective
+}
+
+// NewInputDirective creates a new input directive
+func NewInputDirective() *InputDirective {
+	return &InputDirective{
+		BaseDirective: BaseDirective{name: ":input"},
+	}
+}
+
+// CanGenerateBlocks implements Directive
+func (d *InputDirective) CanGenerateBlocks() bool {
+	return false
+}
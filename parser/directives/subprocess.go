@@ -0,0 +1,98 @@
+package directives
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+)
+
+// SubprocessRequest is written as JSON to the stdin of a subprocess directive's
+// command, once per block
+type SubprocessRequest struct {
+	Directive  string            `json:"directive"`            // Name of the directive, e.g. ":shout"
+	Content    []string          `json:"content"`              // Lines of the block between its directive line and :--
+	Attributes map[string]string `json:"attributes,omitempty"` // key=value attributes of the directive line
+}
+
+// SubprocessResponse is the JSON the command writes to its stdout. A non-empty
+// Error fails the block.
+type SubprocessResponse struct {
+	Result string `json:"result"`
+	Error  string `json:"error,omitempty"`
+}
+
+// SubprocessDirective is a directive handled out of process: each of its
+// blocks runs Command with a SubprocessRequest on stdin, and the block's result
+// is the SubprocessResponse the command prints on stdout
+type SubprocessDirective struct {
+	BaseDirective
+	Command []string // Program and its arguments
+}
+
+// NewSubprocessDirective creates a directive named name handled by command
+func NewSubprocessDirective(name string, command ...string) *SubprocessDirective {
+	return &SubprocessDirective{
+		BaseDirective: BaseDirective{name: name},
+		Command:       command,
+	}
+}
+
+// Process runs the directive's command on a block, returning its result
+func (d *SubprocessDirective) Process(ctx context.Context, content []string, attributes map[string]string) (string, error) {
+	if len(d.Command) == 0 {
+		return "", fmt.Errorf("directive %s has no command", d.Name())
+	}
+	request, err := json.Marshal(SubprocessRequest{Directive: d.Name(), Content: content, Attributes: attributes})
+	if err != nil {
+		return "", fmt.Errorf("failed to encode request for %s: %w", d.Name(), err)
+	}
+
+	cmd := exec.CommandContext(ctx, d.Command[0], d.Command[1:]...)
+	cmd.Stdin = bytes.NewReader(request)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", fmt.Errorf("directive %s failed: %w: %s", d.Name(), err, msg)
+		}
+		return "", fmt.Errorf("directive %s failed: %w", d.Name(), err)
+	}
+
+	var response SubprocessResponse
+	if err := json.Unmarshal(stdout.Bytes(), &response); err != nil {
+		return "", fmt.Errorf("directive %s returned an invalid response: %w", d.Name(), err)
+	}
+	if response.Error != "" {
+		return "", fmt.Errorf("directive %s: %s", d.Name(), response.Error)
+	}
+	return response.Result, nil
+}
+
+// ServeSubprocess implements the command side of a subprocess directive: it
+// reads a SubprocessRequest from r, calls handle with it and writes the
+// SubprocessResponse to w. An error from handle is reported in the response;
+// the returned error is only for requests that can't be read or answered.
+func ServeSubprocess(r io.Reader, w io.Writer, handle func(SubprocessRequest) (string, error)) error {
+	var request SubprocessRequest
+	if err := json.NewDecoder(r).Decode(&request); err != nil {
+		return fmt.Errorf("failed to read request: %w", err)
+	}
+	var response SubprocessResponse
+	if result, err := handle(request); err != nil {
+		response.Error = err.Error()
+	} else {
+		response.Result = result
+	}
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		return fmt.Errorf("failed to write response: %w", err)
+	}
+	return nil
+}
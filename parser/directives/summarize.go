@@ -0,0 +1,18 @@
+package directives
+
+// SummarizeDirective implements the :summarize directive
+type SummarizeDirective struct {
+	BaseDirective
+}
+
+// NewSummarizeDirective creates a new summarize directive
+func NewSummarizeDirective() *SummarizeDirective {
+	return &SummarizeDirective{
+		BaseDirective: BaseDirective{name: ":summarize"},
+	}
+}
+
+// CanGenerateBlocks implements Directive
+func (d *SummarizeDirective) CanGenerateBlocks() bool {
+	return false
+}
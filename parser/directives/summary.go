@@ -0,0 +1,18 @@
+package directives
+
+// SummaryDirective implements the :summary directive
+type SummaryDirective struct {
+	BaseDirective
+}
+
+// NewSummaryDirective creates a new summary directive
+func NewSummaryDirective() *SummaryDirective {
+	return &SummaryDirective{
+		BaseDirective: BaseDirective{name: ":summary"},
+	}
+}
+
+// CanGenerateBlocks implements Directive
+func (d *SummaryDirective) CanGenerateBlocks() bool {
+	return false
+}
@@ -0,0 +1,94 @@
+package parser
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// doctorMarker is printed by the trivial script used to check Python execution
+const doctorMarker = "PML-DOCTOR-OK"
+
+// DoctorCheck is the outcome of a single environment check
+type DoctorCheck struct {
+	Name     string
+	Err      error    // nil if the check passed
+	Hint     string   // How to fix a failed check
+	Warnings []string // What the check's Python script wrote to stderr, even if it passed
+}
+
+// CheckPythonEnvironment verifies that generated Python files can be executed:
+// the interpreter exists, a trivial script runs, and the directives module imports
+func (p *Parser) CheckPythonEnvironment(ctx context.Context) []DoctorCheck {
+	setup := p.pythonSetup()
+	var checks []DoctorCheck
+
+	// Interpreter
+	interpreter := DoctorCheck{Name: "Python interpreter"}
+	if _, err := exec.LookPath(setup.python); err != nil {
+		interpreter.Err = fmt.Errorf("%s not found: %w", setup.python, err)
+		interpreter.Hint = fmt.Sprintf("Install Python or create a virtual environment at %s", filepath.Join(setup.projectRoot, ".venv"))
+	}
+	checks = append(checks, interpreter)
+	if interpreter.Err != nil {
+		return checks
+	}
+
+	tmpDir, err := os.MkdirTemp("", "pml-doctor-*")
+	if err != nil {
+		return append(checks, DoctorCheck{Name: "Temporary directory", Err: err})
+	}
+	defer os.RemoveAll(tmpDir)
+
+	// Trivial script
+	run := DoctorCheck{Name: "Python execution"}
+	output, warnings, err := p.runDoctorScript(ctx, tmpDir, "run.py", fmt.Sprintf("print(%q)\n", doctorMarker))
+	run.Warnings = warnings
+	if err != nil {
+		run.Err = err
+		run.Hint = fmt.Sprintf("Check that %s runs; recreate the virtual environment if it is broken", setup.python)
+	} else if !strings.Contains(output, doctorMarker) {
+		run.Err = fmt.Errorf("unexpected output: %q", output)
+		run.Hint = fmt.Sprintf("Check that %s is a Python interpreter", setup.python)
+	}
+	checks = append(checks, run)
+	if run.Err != nil {
+		return checks
+	}
+
+	// Directives module
+	directives := DoctorCheck{Name: "Directives module"}
+	script := fmt.Sprintf("from src.pml.directives import process_ask, process_do\nprint(%q)\n", doctorMarker)
+	_, warnings, err = p.runDoctorScript(ctx, tmpDir, "directives.py", script)
+	directives.Warnings = warnings
+	if err != nil {
+		directives.Err = err
+		if errors.Is(err, ErrPythonImport) {
+			directives.Hint = fmt.Sprintf("Make sure %s exists and is on PYTHONPATH",
+				filepath.Join(setup.impl1Dir, "src", "pml", "directives"))
+		} else {
+			directives.Hint = "The directives module failed to load; fix the error above"
+		}
+	}
+	checks = append(checks, directives)
+
+	return checks
+}
+
+// runDoctorScript writes a script to dir and executes it with runPython,
+// returning its output and the warnings it wrote to stderr
+func (p *Parser) runDoctorScript(ctx context.Context, dir, name, script string) (string, []string, error) {
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte(script), 0644); err != nil {
+		return "", nil, fmt.Errorf("failed to write %s: %w", name, err)
+	}
+	lines, warnings, err := p.runPython(ctx, path)
+	if err != nil {
+		return "", nil, err
+	}
+	return strings.Join(lines, "\n"), warnings, nil
+}
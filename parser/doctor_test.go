@@ -0,0 +1,99 @@
+package parser
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newDoctorProject creates a project root laid out the way executePython expects
+// and returns a parser whose sources directory lives inside it
+func newDoctorProject(t *testing.T, withDirectives bool) (string, *Parser) {
+	t.Helper()
+	root := t.TempDir()
+	sourcesDir := filepath.Join(root, "impl1", "sources")
+	if err := os.MkdirAll(sourcesDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if withDirectives {
+		pkg := filepath.Join(root, "impl1", "src", "pml", "directives")
+		if err := os.MkdirAll(pkg, 0755); err != nil {
+			t.Fatal(err)
+		}
+		for _, dir := range []string{filepath.Join(root, "impl1", "src"), filepath.Join(root, "impl1", "src", "pml")} {
+			if err := os.WriteFile(filepath.Join(dir, "__init__.py"), nil, 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		code := "def process_ask(q):\n    return q\n\ndef process_do(a):\n    return a\n"
+		if err := os.WriteFile(filepath.Join(pkg, "__init__.py"), []byte(code), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return root, NewParser(&mockLLM{response: "Test response"}, sourcesDir, sourcesDir, filepath.Join(root, "results"))
+}
+
+// failedCheck returns the first failed check, if any
+func failedCheck(checks []DoctorCheck) *DoctorCheck {
+	for i := range checks {
+		if checks[i].Err != nil {
+			return &checks[i]
+		}
+	}
+	return nil
+}
+
+func TestCheckPythonEnvironment(t *testing.T) {
+	if _, err := exec.LookPath("python"); err != nil {
+		t.Skip("Skipping test: no system python")
+	}
+
+	t.Run("healthy", func(t *testing.T) {
+		_, parser := newDoctorProject(t, true)
+		checks := parser.CheckPythonEnvironment(context.Background())
+		if failed := failedCheck(checks); failed != nil {
+			t.Errorf("Expected all checks to pass, %s failed: %v", failed.Name, failed.Err)
+		}
+		if len(checks) != 3 {
+			t.Errorf("Expected 3 checks, got %d", len(checks))
+		}
+	})
+
+	t.Run("missing directives module", func(t *testing.T) {
+		_, parser := newDoctorProject(t, false)
+		failed := failedCheck(parser.CheckPythonEnvironment(context.Background()))
+		if failed == nil {
+			t.Fatal("Expected a failed check")
+		}
+		if failed.Name != "Directives module" {
+			t.Errorf("Expected the directives check to fail, got %s: %v", failed.Name, failed.Err)
+		}
+		if !strings.Contains(failed.Hint, filepath.Join("src", "pml", "directives")) {
+			t.Errorf("Expected hint to name the directives package, got %q", failed.Hint)
+		}
+	})
+
+	t.Run("broken venv", func(t *testing.T) {
+		root, parser := newDoctorProject(t, true)
+		venvBin := filepath.Join(root, ".venv", "bin")
+		if err := os.MkdirAll(venvBin, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(venvBin, "python"), []byte("#!/bin/sh\nexit 1\n"), 0755); err != nil {
+			t.Fatal(err)
+		}
+
+		failed := failedCheck(parser.CheckPythonEnvironment(context.Background()))
+		if failed == nil {
+			t.Fatal("Expected a failed check")
+		}
+		if failed.Name != "Python execution" {
+			t.Errorf("Expected the execution check to fail, got %s: %v", failed.Name, failed.Err)
+		}
+	})
+}
@@ -0,0 +1,25 @@
+package parser
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+)
+
+// embed returns the embedding vector of an :embed block's content as a JSON
+// array, which is stored and cached like any other block result
+func (p *Parser) embed(ctx context.Context, block Block) (string, error) {
+	embedder, ok := p.llm.(EmbeddingLLMClient)
+	if !ok {
+		return "", fmt.Errorf("%s blocks need an LLM client that supports embeddings", DirectiveEmbed)
+	}
+	vector, err := embedder.Embed(ctx, blockText(block))
+	if err != nil {
+		return "", fmt.Errorf("failed to process block: %w", err)
+	}
+	data, err := json.Marshal(vector)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode embedding: %w", err)
+	}
+	return string(data), nil
+}
@@ -0,0 +1,83 @@
+package parser
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// embeddingLLM is a mockLLM that also computes stub embeddings
+type embeddingLLM struct {
+	mockLLM
+	calls int32
+}
+
+func (m *embeddingLLM) Embed(ctx context.Context, text string) ([]float32, error) {
+	atomic.AddInt32(&m.calls, 1)
+	return []float32{float32(len(text)), 0.5, -1}, nil
+}
+
+// TestProcessFileEmbedBlock tests that an :embed block stores its embedding as
+// JSON in the result file and is cached
+func TestProcessFileEmbedBlock(t *testing.T) {
+	tmpDir := t.TempDir()
+	srcFile := filepath.Join(tmpDir, "embed.pml")
+	content := ":embed\nPML files mix prose and prompts\n:--\n"
+	if err := os.WriteFile(srcFile, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	llm := &embeddingLLM{mockLLM: mockLLM{response: "Answer", Delay: time.Millisecond}}
+	parser := NewParser(llm, tmpDir, tmpDir, filepath.Join(tmpDir, "results"))
+	if err := parser.ProcessFile(context.Background(), srcFile); err != nil {
+		t.Fatalf("ProcessFile() error = %v", err)
+	}
+
+	entries, err := os.ReadDir(parser.resultsDirFor(srcFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stored string
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), "embed_") {
+			data, err := os.ReadFile(filepath.Join(parser.resultsDirFor(srcFile), entry.Name()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			stored = string(data)
+		}
+	}
+	want, _ := json.Marshal([]float32{31, 0.5, -1})
+	if !strings.Contains(stored, string(want)) {
+		t.Errorf("Expected the result file to contain %s, got:\n%s", want, stored)
+	}
+
+	// The unchanged block is answered from the cache
+	if err := parser.ProcessFile(context.Background(), srcFile); err != nil {
+		t.Fatalf("ProcessFile() error = %v", err)
+	}
+	if got := atomic.LoadInt32(&llm.calls); got != 1 {
+		t.Errorf("Expected 1 Embed call, got %d", got)
+	}
+}
+
+// TestProcessFileEmbedUnsupported tests that :embed blocks fail clearly with a
+// client that can't compute embeddings
+func TestProcessFileEmbedUnsupported(t *testing.T) {
+	tmpDir := t.TempDir()
+	srcFile := filepath.Join(tmpDir, "embed.pml")
+	if err := os.WriteFile(srcFile, []byte(":embed\nSome text\n:--\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	parser := NewParser(&mockLLM{response: "Answer", Delay: time.Millisecond}, tmpDir, tmpDir, filepath.Join(tmpDir, "results"))
+	err := parser.ProcessFile(context.Background(), srcFile)
+	if err == nil || !strings.Contains(err.Error(), "supports embeddings") {
+		t.Errorf("Expected an error about embedding support, got %v", err)
+	}
+}
@@ -17,31 +17,60 @@ func IsEphemeral(path string) (bool, error) {
 	if fi.IsDir() {
 		return false, nil
 	}
+	jsonStr, found, err := readMetadataLine(path)
+	if err != nil || !found {
+		return false, err
+	}
+
+	var metadata map[string]interface{}
+	if err := json.Unmarshal([]byte(jsonStr), &metadata); err != nil {
+		return false, err
+	}
+	val, ok := metadata["is_ephemeral"]
+	if !ok {
+		return false, nil
+	}
+	isEph, isBool := val.(bool)
+	if !isBool {
+		return false, fmt.Errorf("is_ephemeral must be bool, but got: %v", val)
+	}
+	return isEph, nil
+}
+
+// readMetadataLine returns the JSON from a result file's "# metadata:" line
+func readMetadataLine(path string) (string, bool, error) {
 	content, err := os.ReadFile(path)
 	if err != nil {
-		return false, err
+		return "", false, err
 	}
 
 	lines := strings.Split(string(content), "\n")
 	for _, line := range lines {
-		if strings.HasPrefix(line, "# metadata:") {
-			var metadata map[string]interface{}
-			jsonStr := strings.TrimPrefix(line, "# metadata:")
-			if err := json.Unmarshal([]byte(jsonStr), &metadata); err != nil {
-				return false, err
-			}
-			val, ok := metadata["is_ephemeral"]
-			if !ok {
-				return false, nil
-			}
-			isEph, isBool := val.(bool)
-			if !isBool {
-				return false, fmt.Errorf("is_ephemeral must be bool, but got: %v", val)
-			}
-			return isEph, nil
+		if strings.HasPrefix(line, MetadataPrefix) {
+			return strings.TrimPrefix(line, MetadataPrefix), true, nil
 		}
 	}
-	return false, nil
+	return "", false, nil
+}
+
+// ResultSource returns the source file, block index and block checksum
+// recorded in a result file's metadata
+func (p *Parser) ResultSource(resultPath string) (ResultSource, error) {
+	var source ResultSource
+	jsonStr, found, err := readMetadataLine(resultPath)
+	if err != nil {
+		return source, err
+	}
+	if !found {
+		return source, fmt.Errorf("no metadata found in %s", resultPath)
+	}
+	if err := json.Unmarshal([]byte(jsonStr), &source); err != nil {
+		return source, fmt.Errorf("failed to parse metadata: %w", err)
+	}
+	if source.SourceFile == "" {
+		return source, fmt.Errorf("no source recorded in %s", resultPath)
+	}
+	return source, nil
 }
 
 // ListEphemeralBlocks lists all ephemeral blocks in the results directory
@@ -1,10 +1,12 @@
 package parser
 
 import (
+	"context"
 	"os"
 	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestIsEphemeral(t *testing.T) {
@@ -256,3 +258,62 @@ What is 2+2?
 		t.Error("No result file was created")
 	}
 }
+
+func TestResultSource(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "pml-result-source-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	parser := NewParser(&mockLLM{response: "4", Delay: 10 * time.Millisecond}, tmpDir, tmpDir, filepath.Join(tmpDir, "results"))
+
+	srcFile := filepath.Join(tmpDir, "source.pml")
+	if err := os.WriteFile(srcFile, []byte(":ask\nWhat is 1+1?\n:--\n\n:ask\nWhat is 2+2?\n:--\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	blocks, err := parser.parseBlocks(":ask\nWhat is 2+2?\n:--")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantChecksum := parser.calculateBlockChecksum(blocks[0])
+
+	if err := parser.ProcessFile(context.Background(), srcFile); err != nil {
+		t.Fatalf("ProcessFile failed: %v", err)
+	}
+
+	resultsDir := filepath.Join(tmpDir, ".pml", "results")
+	files, err := os.ReadDir(resultsDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	found := false
+	for _, f := range files {
+		source, err := parser.ResultSource(filepath.Join(resultsDir, f.Name()))
+		if err != nil {
+			t.Fatalf("ResultSource failed for %s: %v", f.Name(), err)
+		}
+		if source.SourceFile != srcFile {
+			t.Errorf("Expected source file %s, got %s", srcFile, source.SourceFile)
+		}
+		if source.BlockIndex == 1 {
+			found = true
+			if source.BlockChecksum != wantChecksum {
+				t.Errorf("Expected block checksum %s, got %s", wantChecksum, source.BlockChecksum)
+			}
+		}
+	}
+	if !found {
+		t.Error("Expected a result for block 1")
+	}
+
+	// Results without source metadata are reported as errors
+	legacy := filepath.Join(tmpDir, "legacy.pml")
+	if err := os.WriteFile(legacy, []byte(`# metadata:{"is_ephemeral":true}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := parser.ResultSource(legacy); err == nil {
+		t.Error("Expected error for result without source metadata")
+	}
+}
@@ -0,0 +1,75 @@
+package parser
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// ErrorMarkerPattern matches the line closing a block that failed, such as
+// `:--(e/"LLM request failed: timeout")`. The group is the quoted message.
+const ErrorMarkerPattern = `^\s*:--\(e/("(?:[^"\\]|\\.)*")\)\s*$`
+
+var errorMarker = regexp.MustCompile(ErrorMarkerPattern)
+
+// isBlockEnd reports whether a trimmed line closes a block: the end marker, or
+// the error marker left by a failed run
+func isBlockEnd(trimmedLine string) bool {
+	return trimmedLine == DirectiveEnd || errorMarker.MatchString(trimmedLine)
+}
+
+// errorMarkerLine returns the error marker line recording err
+func errorMarkerLine(err error) string {
+	return fmt.Sprintf(":--(e/%s)", strconv.Quote(err.Error()))
+}
+
+// parseErrorMarker returns the message of an error marker line
+func parseErrorMarker(line string) (string, bool) {
+	match := errorMarker.FindStringSubmatch(line)
+	if match == nil {
+		return "", false
+	}
+	message, err := strconv.Unquote(match[1])
+	if err != nil {
+		return "", false
+	}
+	return message, true
+}
+
+// markFailedBlock returns the source of a block with its closing line replaced
+// by an error marker for err. The block stays in the file, so the next run
+// processes it again and replaces it with a result link once it succeeds.
+func markFailedBlock(raw string, err error) string {
+	start := strings.LastIndex(raw, "\n") + 1
+	closing := raw[start:]
+	indent := closing[:len(closing)-len(strings.TrimLeft(closing, " \t"))]
+	marker := indent + errorMarkerLine(err)
+	if strings.HasSuffix(closing, "\r") {
+		marker += "\r"
+	}
+	return raw[:start] + marker
+}
+
+// marksFailedBlock reports whether a block that failed with err is marked in
+// its file instead of failing the whole file. Best-effort runs (see SetFailFast)
+// mark blocks, except when the run is cancelled or out of budget.
+func (p *Parser) marksFailedBlock(ctx context.Context, err error) bool {
+	return !p.failFast && ctx.Err() == nil && !errors.Is(err, ErrBudgetExceeded)
+}
+
+// blockErrors joins the errors of failed blocks, or returns nil if none failed
+func blockErrors(blockErrs []error) error {
+	var errs []error
+	for i, err := range blockErrs {
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to process block %d: %w", i, err))
+		}
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	return fmt.Errorf("multiple errors: %w", errors.Join(errs...))
+}
@@ -0,0 +1,114 @@
+package parser
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// ExpectAttribute is the directive line attribute holding a block's expected
+// answer, e.g. ":ask expect=Paris" or ":ask expect=/^\d+$/". A value wrapped in
+// slashes is a regular expression; anything else must appear in the answer.
+const ExpectAttribute = "expect"
+
+// ExpectationResult records whether a block's answer met its expectation
+type ExpectationResult struct {
+	SourceFile string
+	BlockIndex int
+	Expect     string // The expect attribute of the block
+	Answer     string
+	Passed     bool
+	Err        error // Set when the expectation itself is invalid
+}
+
+// ExpectationResults returns the expectations checked so far, ordered by file
+// and block
+func (p *Parser) ExpectationResults() []ExpectationResult {
+	p.expectMu.Lock()
+	defer p.expectMu.Unlock()
+	results := append([]ExpectationResult(nil), p.expectations...)
+	sort.SliceStable(results, func(i, j int) bool {
+		if results[i].SourceFile != results[j].SourceFile {
+			return results[i].SourceFile < results[j].SourceFile
+		}
+		return results[i].BlockIndex < results[j].BlockIndex
+	})
+	return results
+}
+
+// checkExpectations checks the answers of a file's processed blocks against
+// their expect attributes
+func (p *Parser) checkExpectations(path string, blocks []Block, resultFiles, answers []string) {
+	for i, block := range blocks {
+		if resultFiles[i] != "" {
+			p.checkExpectation(path, i, block, answers[i])
+		}
+	}
+}
+
+// checkLinkedExpectations checks the answers the file at path already links to
+// against the expect attributes recorded in their metadata, so blocks answered
+// by an earlier run are still tested. linked holds the link paths, without
+// their "r/" prefix.
+func (p *Parser) checkLinkedExpectations(path string, linked map[string]bool) {
+	for link := range linked {
+		resultPath := p.ResolveResultLink(path, link)
+		jsonStr, found, err := readMetadataLine(resultPath)
+		if err != nil || !found {
+			continue
+		}
+		var metadata struct {
+			ResultSource
+			Attributes map[string]string `json:"attributes"`
+		}
+		if err := json.Unmarshal([]byte(jsonStr), &metadata); err != nil {
+			continue
+		}
+		if _, ok := metadata.Attributes[ExpectAttribute]; !ok {
+			continue
+		}
+		block, answer, err := readResult(resultPath)
+		if err != nil {
+			p.debugf("Warning: failed to read %s to check its expectation: %v\n", resultPath, err)
+			continue
+		}
+		p.checkExpectation(path, metadata.BlockIndex, block, answer)
+	}
+}
+
+// checkExpectation checks the answer of the block at index i against its
+// expectation, if it has one
+func (p *Parser) checkExpectation(path string, i int, block Block, answer string) {
+	expect, ok := block.Attributes[ExpectAttribute]
+	if !ok {
+		return
+	}
+	passed, err := matchExpectation(expect, answer)
+	if !passed {
+		p.debugf("Warning: block %d of %s does not match expect=%s\n", i, path, expect)
+	}
+	p.expectMu.Lock()
+	p.expectations = append(p.expectations, ExpectationResult{
+		SourceFile: path,
+		BlockIndex: i,
+		Expect:     expect,
+		Answer:     answer,
+		Passed:     passed,
+		Err:        err,
+	})
+	p.expectMu.Unlock()
+}
+
+// matchExpectation reports whether answer meets expect
+func matchExpectation(expect, answer string) (bool, error) {
+	if len(expect) > 1 && strings.HasPrefix(expect, "/") && strings.HasSuffix(expect, "/") {
+		re, err := regexp.Compile(expect[1 : len(expect)-1])
+		if err != nil {
+			return false, fmt.Errorf("invalid expect pattern %s: %w", expect, err)
+		}
+		return re.MatchString(answer), nil
+	}
+	return strings.Contains(answer, expect), nil
+}
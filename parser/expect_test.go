@@ -0,0 +1,109 @@
+package parser
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestExpectations tests that block answers are checked against their expect attributes
+func TestExpectations(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "pml-expect-*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	mock := &mockLLM{Delay: 10 * time.Millisecond, answer: func(prompt string) string {
+		return "The capital is Paris."
+	}}
+	p := NewParser(mock, tmpDir, filepath.Join(tmpDir, "compiled"), filepath.Join(tmpDir, "results"))
+
+	pmlFile := filepath.Join(tmpDir, "test.pml")
+	content := ":ask expect=Paris\nCapital of France?\n:--\n\n" +
+		":ask expect=Berlin\nCapital of France again?\n:--\n\n" +
+		":ask expect=/^The\\s+capital/\nCapital of France once more?\n:--\n\n" +
+		":ask\nNo expectation here\n:--\n"
+	if err := os.WriteFile(pmlFile, []byte(content), 0644); err != nil {
+		t.Fatalf("Failed to write test file: %v", err)
+	}
+	if err := p.ProcessFile(context.Background(), pmlFile); err != nil {
+		t.Fatalf("ProcessFile failed: %v", err)
+	}
+
+	results := p.ExpectationResults()
+	if len(results) != 3 {
+		t.Fatalf("Expected 3 expectation results, got %d: %+v", len(results), results)
+	}
+	want := []struct {
+		index  int
+		passed bool
+	}{{0, true}, {1, false}, {2, true}}
+	for i, w := range want {
+		r := results[i]
+		if r.BlockIndex != w.index || r.Passed != w.passed || r.Err != nil {
+			t.Errorf("Result %d: expected block %d passed=%v, got %+v", i, w.index, w.passed, r)
+		}
+	}
+}
+
+// TestMatchExpectation tests substring and regular expression expectations
+func TestMatchExpectation(t *testing.T) {
+	tests := []struct {
+		expect  string
+		answer  string
+		want    bool
+		wantErr bool
+	}{
+		{"Paris", "It is Paris.", true, false},
+		{"Paris", "It is Lyon.", false, false},
+		{"/^\\d+$/", "42", true, false},
+		{"/^\\d+$/", "forty-two", false, false},
+		{"/", "a / b", true, false},
+		{"/[/", "anything", false, true},
+	}
+	for _, tt := range tests {
+		got, err := matchExpectation(tt.expect, tt.answer)
+		if got != tt.want || (err != nil) != tt.wantErr {
+			t.Errorf("matchExpectation(%q, %q) = %v, %v; want %v, error %v", tt.expect, tt.answer, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+// TestLinkedExpectations tests that the answers a file already links to are
+// checked against the expect attributes in their metadata, including values
+// with spaces
+func TestLinkedExpectations(t *testing.T) {
+	tmpDir := t.TempDir()
+	mock := &mockLLM{Delay: time.Millisecond, answer: func(prompt string) string {
+		return "The capital is Paris."
+	}}
+	pmlFile := filepath.Join(tmpDir, "test.pml")
+	content := ":ask expect=\"capital is Paris\"\nCapital of France?\n:--\n\n" +
+		":ask expect=Berlin\nCapital of France again?\n:--\n"
+	if err := os.WriteFile(pmlFile, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	p := NewParser(mock, tmpDir, filepath.Join(tmpDir, "compiled"), filepath.Join(tmpDir, "results"))
+	if err := p.ProcessFile(context.Background(), pmlFile); err != nil {
+		t.Fatalf("ProcessFile failed: %v", err)
+	}
+
+	// A later run finds only result links
+	p = NewParser(mock, tmpDir, filepath.Join(tmpDir, "compiled"), filepath.Join(tmpDir, "results"))
+	if err := p.ProcessFile(context.Background(), pmlFile); err != nil {
+		t.Fatalf("ProcessFile failed: %v", err)
+	}
+	results := p.ExpectationResults()
+	if len(results) != 2 {
+		t.Fatalf("Expected 2 expectation results, got %d: %+v", len(results), results)
+	}
+	if r := results[0]; r.BlockIndex != 0 || !r.Passed || r.Expect != "capital is Paris" {
+		t.Errorf("Expected block 0 to pass expect=capital is Paris, got %+v", r)
+	}
+	if r := results[1]; r.BlockIndex != 1 || r.Passed {
+		t.Errorf("Expected block 1 to fail, got %+v", r)
+	}
+}
@@ -0,0 +1,113 @@
+package parser
+
+import (
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// LineRange is an inclusive range of 1-based lines
+type LineRange struct {
+	Start int
+	End   int
+}
+
+// overlaps reports whether two line ranges share a line
+func (r LineRange) overlaps(other LineRange) bool {
+	return r.Start <= other.End && other.Start <= r.End
+}
+
+// changedLinesFunc returns the lines of a file that differ from a base version
+type changedLinesFunc func(path string) ([]LineRange, error)
+
+// SetOnlyChangedBlocks limits processing to blocks overlapping lines that differ
+// from the version of the file committed at git HEAD. Other blocks are left as
+// they are. Files git can't compare, e.g. untracked files or files outside a
+// repository, are processed in full.
+func (p *Parser) SetOnlyChangedBlocks(enabled bool) {
+	if enabled {
+		p.changedLines = gitChangedLines
+	} else {
+		p.changedLines = nil
+	}
+}
+
+// selectBlocks reports which blocks of a file are processed: those matching the
+// include tag filter and, with SetOnlyChangedBlocks, overlapping changed lines
+func (p *Parser) selectBlocks(path, content string, blocks []Block, includeTags []string) []bool {
+	selected := make([]bool, len(blocks))
+	for i := range blocks {
+		selected[i] = p.matchesTagFilter(blocks[i], includeTags)
+	}
+	if p.changedLines == nil {
+		return selected
+	}
+
+	changed, err := p.changedLines(path)
+	if err != nil {
+		p.debugf("Warning: processing all blocks of %s: %v\n", path, err)
+		return selected
+	}
+	for i, block := range blocks {
+		lines := LineRange{
+			Start: block.Line,
+			End:   strings.Count(content[:block.End], "\n") + 1,
+		}
+		overlapping := false
+		for _, r := range changed {
+			if r.overlaps(lines) {
+				overlapping = true
+				break
+			}
+		}
+		selected[i] = selected[i] && overlapping
+	}
+	return selected
+}
+
+// hunkHeader matches the new-file range of a unified diff hunk header
+var hunkHeader = regexp.MustCompile(`^@@ -\d+(?:,\d+)? \+(\d+)(?:,(\d+))? @@`)
+
+// gitChangedLines returns the lines of the file at path that differ from its
+// version at git HEAD
+func gitChangedLines(path string) ([]LineRange, error) {
+	dir, name := filepath.Split(path)
+	if dir == "" {
+		dir = "."
+	}
+	if out, err := exec.Command("git", "-C", dir, "ls-files", "--error-unmatch", "--", name).CombinedOutput(); err != nil {
+		first, _, _ := strings.Cut(strings.TrimSpace(string(out)), "\n")
+		return nil, fmt.Errorf("not tracked by git: %s", first)
+	}
+	out, err := exec.Command("git", "-C", dir, "diff", "--no-color", "--unified=0", "HEAD", "--", name).Output()
+	if err != nil {
+		return nil, fmt.Errorf("git diff failed: %w", err)
+	}
+	return parseChangedLines(string(out)), nil
+}
+
+// parseChangedLines returns the changed lines of the new file in a unified diff.
+// Pure deletions are reported as the line after which lines were removed.
+func parseChangedLines(diff string) []LineRange {
+	var ranges []LineRange
+	for _, line := range strings.Split(diff, "\n") {
+		match := hunkHeader.FindStringSubmatch(line)
+		if match == nil {
+			continue
+		}
+		start, _ := strconv.Atoi(match[1])
+		count := 1
+		if match[2] != "" {
+			count, _ = strconv.Atoi(match[2])
+		}
+		if count == 0 {
+			ranges = append(ranges, LineRange{Start: start, End: start})
+			continue
+		}
+		ranges = append(ranges, LineRange{Start: start, End: start + count - 1})
+	}
+	return ranges
+}
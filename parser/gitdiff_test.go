@@ -0,0 +1,107 @@
+package parser
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestOnlyChangedBlocks tests that only blocks overlapping changed lines are processed
+func TestOnlyChangedBlocks(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "pml-changed-*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	p := NewParser(&mockLLM{response: "Answer", Delay: 10 * time.Millisecond}, tmpDir, filepath.Join(tmpDir, "compiled"), filepath.Join(tmpDir, "results"))
+	p.changedLines = func(path string) ([]LineRange, error) {
+		// A change on line 6, inside the second block
+		return parseChangedLines("@@ -6 +6 @@\n-Old question\n+Second question\n"), nil
+	}
+
+	pmlFile := filepath.Join(tmpDir, "test.pml")
+	content := ":ask\nFirst question\n:--\n\n:ask\nSecond question\n:--\n\n:ask\nThird question\n:--\n"
+	if err := os.WriteFile(pmlFile, []byte(content), 0644); err != nil {
+		t.Fatalf("Failed to write test file: %v", err)
+	}
+	if err := p.ProcessFile(context.Background(), pmlFile); err != nil {
+		t.Fatalf("ProcessFile failed: %v", err)
+	}
+
+	processed, err := os.ReadFile(pmlFile)
+	if err != nil {
+		t.Fatalf("Failed to read processed file: %v", err)
+	}
+	got := string(processed)
+	if strings.Count(got, ":--(r/") != 1 || strings.Contains(got, "Second question") {
+		t.Errorf("Expected only the second block to be processed, got:\n%s", got)
+	}
+	if !strings.Contains(got, "First question") || !strings.Contains(got, "Third question") {
+		t.Errorf("Expected unchanged blocks to be left as they are, got:\n%s", got)
+	}
+}
+
+// TestOnlyChangedBlocksFallback tests that a file git can't compare is processed in full
+func TestOnlyChangedBlocksFallback(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "pml-changed-*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	p := NewParser(&mockLLM{response: "Answer", Delay: 10 * time.Millisecond}, tmpDir, filepath.Join(tmpDir, "compiled"), filepath.Join(tmpDir, "results"))
+	p.changedLines = func(path string) ([]LineRange, error) {
+		return nil, errors.New("not a git repository")
+	}
+
+	pmlFile := filepath.Join(tmpDir, "test.pml")
+	if err := os.WriteFile(pmlFile, []byte(":ask\nFirst question\n:--\n\n:ask\nSecond question\n:--\n"), 0644); err != nil {
+		t.Fatalf("Failed to write test file: %v", err)
+	}
+	if err := p.ProcessFile(context.Background(), pmlFile); err != nil {
+		t.Fatalf("ProcessFile failed: %v", err)
+	}
+
+	processed, err := os.ReadFile(pmlFile)
+	if err != nil {
+		t.Fatalf("Failed to read processed file: %v", err)
+	}
+	if got := strings.Count(string(processed), ":--(r/"); got != 2 {
+		t.Errorf("Expected both blocks to be processed, got %d links:\n%s", got, processed)
+	}
+}
+
+// TestParseChangedLines tests reading the changed lines of the new file from a unified diff
+func TestParseChangedLines(t *testing.T) {
+	diff := strings.Join([]string{
+		"diff --git a/test.pml b/test.pml",
+		"--- a/test.pml",
+		"+++ b/test.pml",
+		"@@ -2 +2 @@",
+		"-old",
+		"+new",
+		"@@ -5,0 +6,3 @@",
+		"+added",
+		"+added",
+		"+added",
+		"@@ -12,2 +14,0 @@",
+		"-removed",
+		"-removed",
+		"",
+	}, "\n")
+	want := []LineRange{{2, 2}, {6, 8}, {14, 14}}
+	got := parseChangedLines(diff)
+	if len(got) != len(want) {
+		t.Fatalf("Expected %v, got %v", want, got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("Range %d: expected %v, got %v", i, want[i], got[i])
+		}
+	}
+}
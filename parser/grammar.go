@@ -0,0 +1,61 @@
+package parser
+
+import (
+	"regexp"
+
+	"github.com/fireharp/pml/impl1/parser/directives"
+)
+
+// MetadataPrefix starts the metadata line of a result file
+const MetadataPrefix = "# metadata:"
+
+// ResultLinkPattern matches a result link line such as
+// ":--(r/ask_calm_river_block0_0.pml) Tokyo". The first group is the link path,
+// the second the optional summary label.
+const ResultLinkPattern = `^\s*:--\((r/[^)]*)\)\s*(.*)$`
+
+var resultLink = regexp.MustCompile(ResultLinkPattern)
+
+// GrammarSpec is a machine-readable description of the PML format, for editors
+// and validators
+type GrammarSpec struct {
+	Directives         []DirectiveSpec `json:"directives"`
+	BlockEnd           string          `json:"block_end"`            // Line closing a block
+	AttributeSyntax    string          `json:"attribute_syntax"`     // Form of attributes on the directive line
+	Attributes         []string        `json:"attributes"`           // Attributes with a built-in meaning
+	ResultLinkPattern  string          `json:"result_link_pattern"`  // Regular expression for result link lines
+	ErrorMarkerPattern string          `json:"error_marker_pattern"` // Regular expression for lines closing failed blocks
+	MetadataPrefix     string          `json:"metadata_prefix"`      // Start of the metadata line in result files
+	MetadataKeys       []string        `json:"metadata_keys"`        // Keys of the result file metadata JSON
+}
+
+// DirectiveSpec describes one directive in a GrammarSpec
+type DirectiveSpec struct {
+	Name              string `json:"name"`
+	CanGenerateBlocks bool   `json:"can_generate_blocks"`
+}
+
+// Grammar describes the PML format as understood by this parser
+func Grammar() GrammarSpec {
+	registry := directives.DefaultRegistry()
+	spec := GrammarSpec{
+		BlockEnd:           DirectiveEnd,
+		AttributeSyntax:    "key=value",
+		Attributes:         []string{"best_of", "expect", "format", "image", "locked", "model", "reducer", "tags", "ttl"},
+		ResultLinkPattern:  ResultLinkPattern,
+		ErrorMarkerPattern: ErrorMarkerPattern,
+		MetadataPrefix:     MetadataPrefix,
+		MetadataKeys: []string{
+			"is_ephemeral", "type", "summary", "source_file",
+			"block_index", "block_checksum", "block_line", "model", "attributes", "alternatives", "warnings", "language", "locked", "timestamp",
+		},
+	}
+	for _, name := range registry.List() {
+		d, _ := registry.Get(name)
+		spec.Directives = append(spec.Directives, DirectiveSpec{
+			Name:              name,
+			CanGenerateBlocks: d.CanGenerateBlocks(),
+		})
+	}
+	return spec
+}
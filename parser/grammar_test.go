@@ -0,0 +1,36 @@
+package parser
+
+import (
+	"regexp"
+	"testing"
+)
+
+// TestGrammar tests that the grammar lists the known directives and a working result link pattern
+func TestGrammar(t *testing.T) {
+	spec := Grammar()
+
+	names := make(map[string]bool)
+	for _, d := range spec.Directives {
+		names[d.Name] = true
+	}
+	for _, want := range []string{DirectiveAsk, DirectiveDo, DirectiveSummary} {
+		if !names[want] {
+			t.Errorf("Expected directive %s in grammar, got %v", want, spec.Directives)
+		}
+	}
+	if spec.BlockEnd != DirectiveEnd {
+		t.Errorf("Expected block end %q, got %q", DirectiveEnd, spec.BlockEnd)
+	}
+
+	pattern, err := regexp.Compile(spec.ResultLinkPattern)
+	if err != nil {
+		t.Fatalf("Result link pattern does not compile: %v", err)
+	}
+	match := pattern.FindStringSubmatch(":--(r/ask_calm_river_block0_0.pml) Tokyo")
+	if match == nil || match[1] != "r/ask_calm_river_block0_0.pml" || match[2] != "Tokyo" {
+		t.Errorf("Unexpected result link match: %q", match)
+	}
+	if pattern.MatchString(":--") {
+		t.Error("Expected a plain block end not to match the result link pattern")
+	}
+}
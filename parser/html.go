@@ -0,0 +1,170 @@
+package parser
+
+import (
+	"fmt"
+	"html"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// HTMLExt is appended to a PML file's path to name its rendered HTML
+const HTMLExt = ".html"
+
+// RenderHTML renders the question and answer of every processed block in the file at
+// path into a standalone HTML page next to it, returning the page's path.
+// Answers are taken from the result files linked from the file.
+func (p *Parser) RenderHTML(path string) (string, error) {
+	content, err := readSource(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read file: %w", err)
+	}
+
+	title := filepath.Base(path)
+	var body strings.Builder
+	sections := 0
+	for _, line := range strings.Split(string(content), "\n") {
+		link, ok := parseResultLink(line)
+		if !ok {
+			continue
+		}
+		resultPath := p.ResolveResultLink(path, link)
+		block, answer, err := readResult(resultPath)
+		if err != nil {
+			return "", fmt.Errorf("failed to read result %s: %w", resultPath, err)
+		}
+
+		sections++
+		body.WriteString(fmt.Sprintf("<section class=\"block %s\">\n", strings.TrimPrefix(block.Type, ":")))
+		body.WriteString(fmt.Sprintf("<h2>%s</h2>\n", html.EscapeString(block.Type)))
+		body.WriteString("<div class=\"question\">\n")
+		body.WriteString(fmt.Sprintf("<pre>%s</pre>\n", html.EscapeString(blockText(block))))
+		body.WriteString("</div>\n<div class=\"answer\">\n")
+		body.WriteString(renderMarkdown(answer))
+		body.WriteString("</div>\n</section>\n")
+	}
+	p.debugf("Rendered %d blocks of %s\n", sections, path)
+
+	page := fmt.Sprintf(htmlPage, html.EscapeString(title), html.EscapeString(title), body.String())
+	outPath := path + HTMLExt
+	if err := os.WriteFile(outPath, []byte(page), 0644); err != nil {
+		return "", fmt.Errorf("failed to write HTML: %w", err)
+	}
+	return outPath, nil
+}
+
+const htmlPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>%s</title>
+<style>
+body { font-family: sans-serif; max-width: 50em; margin: 2em auto; line-height: 1.5; }
+section { border-top: 1px solid #ddd; padding: 1em 0; }
+h2 { font-size: 0.9em; color: #888; margin: 0; }
+.question pre { font-weight: bold; white-space: pre-wrap; font-family: inherit; }
+pre code, code { background: #f4f4f4; }
+pre code { display: block; padding: 0.5em; overflow-x: auto; }
+</style>
+</head>
+<body>
+<h1>%s</h1>
+%s</body>
+</html>
+`
+
+var (
+	markdownHeading = regexp.MustCompile(`^(#{1,6})\s+(.*)$`)
+	markdownBullet  = regexp.MustCompile(`^\s*[-*+]\s+(.*)$`)
+	markdownOrdered = regexp.MustCompile(`^\s*\d+[.)]\s+(.*)$`)
+	markdownCode    = regexp.MustCompile("`([^`]+)`")
+	markdownBold    = regexp.MustCompile(`\*\*([^*]+)\*\*`)
+)
+
+// renderMarkdown renders the common subset of markdown found in LLM answers:
+// headings, fenced code, lists, paragraphs, inline code and bold text
+func renderMarkdown(text string) string {
+	var out strings.Builder
+	var paragraph []string
+	list := ""
+	inCode := false
+
+	flushParagraph := func() {
+		if len(paragraph) > 0 {
+			out.WriteString("<p>" + strings.Join(paragraph, "\n") + "</p>\n")
+			paragraph = nil
+		}
+	}
+	closeList := func() {
+		if list != "" {
+			out.WriteString("</" + list + ">\n")
+			list = ""
+		}
+	}
+	openList := func(tag string) {
+		if list != tag {
+			closeList()
+			out.WriteString("<" + tag + ">\n")
+			list = tag
+		}
+	}
+
+	for _, line := range strings.Split(text, "\n") {
+		if strings.HasPrefix(strings.TrimSpace(line), "```") {
+			if inCode {
+				out.WriteString("</code></pre>\n")
+			} else {
+				flushParagraph()
+				closeList()
+				out.WriteString("<pre><code>")
+			}
+			inCode = !inCode
+			continue
+		}
+		if inCode {
+			out.WriteString(html.EscapeString(line) + "\n")
+			continue
+		}
+
+		switch {
+		case strings.TrimSpace(line) == "":
+			flushParagraph()
+			closeList()
+		case markdownHeading.MatchString(line):
+			flushParagraph()
+			closeList()
+			m := markdownHeading.FindStringSubmatch(line)
+			level := len(m[1]) + 2 // h1 and h2 are used by the page itself
+			if level > 6 {
+				level = 6
+			}
+			out.WriteString(fmt.Sprintf("<h%d>%s</h%d>\n", level, renderInline(m[2]), level))
+		case markdownBullet.MatchString(line):
+			flushParagraph()
+			openList("ul")
+			out.WriteString("<li>" + renderInline(markdownBullet.FindStringSubmatch(line)[1]) + "</li>\n")
+		case markdownOrdered.MatchString(line):
+			flushParagraph()
+			openList("ol")
+			out.WriteString("<li>" + renderInline(markdownOrdered.FindStringSubmatch(line)[1]) + "</li>\n")
+		default:
+			closeList()
+			paragraph = append(paragraph, renderInline(line))
+		}
+	}
+
+	if inCode {
+		out.WriteString("</code></pre>\n")
+	}
+	flushParagraph()
+	closeList()
+	return out.String()
+}
+
+// renderInline escapes a line of text and renders inline code and bold spans
+func renderInline(text string) string {
+	text = html.EscapeString(text)
+	text = markdownCode.ReplaceAllString(text, "<code>$1</code>")
+	return markdownBold.ReplaceAllString(text, "<strong>$1</strong>")
+}
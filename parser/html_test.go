@@ -0,0 +1,73 @@
+package parser
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRenderHTML(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "pml-html-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	content := `:ask
+What is the capital of Japan?
+:--
+
+:ask
+List two <colors>
+:--
+`
+	srcFile := filepath.Join(tmpDir, "share.pml")
+	if err := os.WriteFile(srcFile, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	parser := NewParser(&mockLLM{
+		Delay: 10 * time.Millisecond,
+		answer: func(prompt string) string {
+			if strings.Contains(prompt, "Japan") {
+				return "The capital is **Tokyo**."
+			}
+			return "- red\n- blue"
+		},
+	}, tmpDir, filepath.Join(tmpDir, "compiled"), filepath.Join(tmpDir, "results"))
+
+	if err := parser.ProcessFile(context.Background(), srcFile); err != nil {
+		t.Fatalf("ProcessFile failed: %v", err)
+	}
+
+	outPath, err := parser.RenderHTML(srcFile)
+	if err != nil {
+		t.Fatalf("RenderHTML failed: %v", err)
+	}
+	if outPath != srcFile+HTMLExt {
+		t.Errorf("Expected HTML at %s, got %s", srcFile+HTMLExt, outPath)
+	}
+	data, err := os.ReadFile(outPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	page := string(data)
+
+	if got := strings.Count(page, "<section"); got != 2 {
+		t.Errorf("Expected a section per block, got %d:\n%s", got, page)
+	}
+	for _, want := range []string{
+		"What is the capital of Japan?",
+		"The capital is <strong>Tokyo</strong>.",
+		"List two &lt;colors&gt;",
+		"<li>red</li>",
+		"<li>blue</li>",
+	} {
+		if !strings.Contains(page, want) {
+			t.Errorf("Expected HTML to contain %q:\n%s", want, page)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package parser
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ImageAttribute attaches an image file to a block, e.g. ":ask image=diagram.png".
+// Relative paths are resolved against the directory of the PML file.
+const ImageAttribute = "image"
+
+// ErrImagesNotSupported is returned for blocks with an image when the LLM client
+// can't send images
+var ErrImagesNotSupported = errors.New("LLM client does not support images")
+
+// Image is a file attached to a block
+type Image struct {
+	Path     string // Resolved path of the image file
+	MIMEType string // Content type, e.g. "image/png"
+	Data     []byte
+}
+
+// checksum returns the hash of the image content, so changing the image
+// changes the block checksum
+func (img *Image) checksum() string {
+	hash := sha256.Sum256(img.Data)
+	return hex.EncodeToString(hash[:])
+}
+
+// attachImage reads the image referenced by the image attribute of the block at
+// index i, resolving it against dir, the directory of the PML file
+func attachImage(block *Block, i int, dir string) error {
+	path, ok := block.Attributes[ImageAttribute]
+	if !ok {
+		return nil
+	}
+	if path == "" {
+		return fmt.Errorf("block %d: image attribute is empty", i)
+	}
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(dir, path)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("block %d: failed to read image: %w", i, err)
+	}
+	mimeType := mime.TypeByExtension(strings.ToLower(filepath.Ext(path)))
+	if mimeType == "" {
+		mimeType = http.DetectContentType(data)
+	}
+	if !strings.HasPrefix(mimeType, "image/") {
+		return fmt.Errorf("block %d: %s is not an image (%s)", i, block.Attributes[ImageAttribute], mimeType)
+	}
+	block.Image = &Image{Path: path, MIMEType: mimeType, Data: data}
+	return nil
+}
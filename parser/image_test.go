@@ -0,0 +1,110 @@
+package parser
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// imageLLM records the images sent with prompts
+type imageLLM struct {
+	mu     sync.Mutex
+	images [][]byte
+	types  []string
+}
+
+func (m *imageLLM) Ask(ctx context.Context, prompt string) (string, error) {
+	return "Text answer", nil
+}
+
+func (m *imageLLM) AskWithImage(ctx context.Context, model, prompt string, image []byte, mimeType string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.images = append(m.images, image)
+	m.types = append(m.types, mimeType)
+	return "A diagram", nil
+}
+
+func (m *imageLLM) Summarize(ctx context.Context, text string) (string, error) {
+	return "Summary", nil
+}
+
+// TestProcessFileWithImage tests that a block's image is sent with its prompt
+// and that changing the image reprocesses the block
+func TestProcessFileWithImage(t *testing.T) {
+	tmpDir := t.TempDir()
+	imagePath := filepath.Join(tmpDir, "diagram.png")
+	if err := os.WriteFile(imagePath, []byte("first image"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	content := ":ask image=diagram.png\nWhat does this diagram show?\n:--\n"
+	srcFile := filepath.Join(tmpDir, "vision.pml")
+	if err := os.WriteFile(srcFile, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	llm := &imageLLM{}
+	parser := NewParser(llm, tmpDir, tmpDir, filepath.Join(tmpDir, "results"))
+	if err := parser.ProcessFile(context.Background(), srcFile); err != nil {
+		t.Fatalf("ProcessFile() error = %v", err)
+	}
+	if len(llm.images) != 1 || string(llm.images[0]) != "first image" || llm.types[0] != "image/png" {
+		t.Fatalf("Expected the image to be sent with the prompt, got %q (%v)", llm.images, llm.types)
+	}
+
+	blocks, err := parser.parseBlocks(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := attachImage(&blocks[0], 0, tmpDir); err != nil {
+		t.Fatal(err)
+	}
+	before := parser.calculateBlockChecksum(blocks[0])
+
+	// A new image changes the checksum, so the block is asked again
+	if err := os.WriteFile(imagePath, []byte("second image"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := attachImage(&blocks[0], 0, tmpDir); err != nil {
+		t.Fatal(err)
+	}
+	if parser.calculateBlockChecksum(blocks[0]) == before {
+		t.Error("Expected the image content to be part of the block checksum")
+	}
+	if err := os.WriteFile(srcFile, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := parser.ProcessFile(context.Background(), srcFile); err != nil {
+		t.Fatalf("ProcessFile() error = %v", err)
+	}
+	if len(llm.images) != 2 || string(llm.images[1]) != "second image" {
+		t.Errorf("Expected the changed image to be sent, got %q", llm.images)
+	}
+}
+
+// TestProcessFileImageErrors tests that images fail clearly when missing or not supported by the client
+func TestProcessFileImageErrors(t *testing.T) {
+	tmpDir := t.TempDir()
+	srcFile := filepath.Join(tmpDir, "vision.pml")
+	if err := os.WriteFile(srcFile, []byte(":ask image=missing.png\nDescribe it\n:--\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	parser := NewParser(&mockLLM{response: "Answer"}, tmpDir, tmpDir, filepath.Join(tmpDir, "results"))
+	if err := parser.ProcessFile(context.Background(), srcFile); err == nil {
+		t.Error("Expected an error for a missing image")
+	}
+
+	if err := os.WriteFile(filepath.Join(tmpDir, "photo.jpg"), []byte("jpeg"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(srcFile, []byte(":ask image=photo.jpg\nDescribe it\n:--\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	err := parser.ProcessFile(context.Background(), srcFile)
+	if !errors.Is(err, ErrImagesNotSupported) {
+		t.Errorf("Expected ErrImagesNotSupported, got %v", err)
+	}
+}
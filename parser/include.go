@@ -0,0 +1,213 @@
+package parser
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+)
+
+// ErrIncludeCycle is returned when a file includes itself, directly or through
+// the files it includes
+var ErrIncludeCycle = errors.New("include cycle")
+
+// includeRef is an ":include path" line of a file
+type includeRef struct {
+	Path  string // File to include, relative to the including file
+	Line  int    // 1-based line of the :include line
+	Start int    // Start position of the line
+	End   int    // End position of the line, without its newline
+}
+
+// includeTarget returns the file named by an ":include path" line, and whether
+// the line is one. The file is empty if the line names none.
+func includeTarget(line string) (string, bool) {
+	rest, ok := strings.CutPrefix(line, DirectiveInclude)
+	if !ok || (rest != "" && rest[0] != ' ' && rest[0] != '\t') {
+		return "", false
+	}
+	return strings.TrimSpace(rest), true
+}
+
+// parseIncluding parses the blocks of the file at path like parseBlocks, with
+// the blocks of the files it includes spliced in at their :include lines. It
+// also returns the content of the included files, in order, so the file's
+// checksum can cover them. chain holds the absolute paths of the files path is
+// included from, to detect cycles.
+func (p *Parser) parseIncluding(path, content string, chain []string) ([]Block, []string, error) {
+	var blocks []Block
+	var sources []string
+	scanner := p.newBlockScanner(strings.NewReader(p.blockSource(path, content)))
+	for {
+		item, err := scanner.next()
+		if err == io.EOF {
+			return blocks, sources, nil
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		if item.Block != nil {
+			blocks = append(blocks, *item.Block)
+		}
+		if item.Include == nil {
+			continue
+		}
+		included, includedSources, err := p.include(path, *item.Include, chain)
+		if err != nil {
+			return nil, nil, err
+		}
+		blocks = append(blocks, included...)
+		sources = append(sources, includedSources...)
+	}
+}
+
+// include reads and parses the file an :include line of the file at path names.
+// Its blocks are placed at the :include line, so the including file keeps the
+// line when its own blocks are replaced by their results.
+func (p *Parser) include(path string, ref includeRef, chain []string) ([]Block, []string, error) {
+	target := includePath(path, ref.Path)
+	abs, err := filepath.Abs(target)
+	if err != nil {
+		return nil, nil, fmt.Errorf("line %d: failed to include %s: %w", ref.Line, ref.Path, err)
+	}
+	for i, visited := range chain {
+		if visited == abs {
+			names := make([]string, 0, len(chain)-i+1)
+			for _, name := range chain[i:] {
+				names = append(names, filepath.Base(name))
+			}
+			names = append(names, filepath.Base(abs))
+			return nil, nil, fmt.Errorf("%w: %s", ErrIncludeCycle, strings.Join(names, " -> "))
+		}
+	}
+
+	content, err := p.loadSource(target)
+	if err != nil {
+		return nil, nil, fmt.Errorf("line %d: failed to include %s: %w", ref.Line, ref.Path, err)
+	}
+	blocks, sources, err := p.parseIncluding(target, string(content), append(chain[:len(chain):len(chain)], abs))
+	if err != nil {
+		if errors.Is(err, ErrIncludeCycle) {
+			return nil, nil, err
+		}
+		return nil, nil, fmt.Errorf("line %d: failed to include %s: %w", ref.Line, ref.Path, err)
+	}
+	for i := range blocks {
+		if blocks[i].Include == "" {
+			blocks[i].Include = target
+		}
+		blocks[i].Line = ref.Line
+		blocks[i].Start = ref.Start
+		blocks[i].End = ref.End
+	}
+	return blocks, append([]string{string(content)}, sources...), nil
+}
+
+// includePath returns the file an :include line of the file at path names
+func includePath(path, target string) string {
+	if filepath.IsAbs(target) {
+		return target
+	}
+	return filepath.Join(filepath.Dir(path), target)
+}
+
+// includeTargets returns the absolute paths of the files the :include lines of
+// the file at path name, up to the first syntax error
+func (p *Parser) includeTargets(path string) []string {
+	content, err := p.loadSource(path)
+	if err != nil {
+		return nil
+	}
+	var targets []string
+	scanner := p.newBlockScanner(strings.NewReader(p.blockSource(path, string(content))))
+	for {
+		item, err := scanner.next()
+		if err != nil {
+			return targets
+		}
+		if item.Include == nil {
+			continue
+		}
+		if abs, err := filepath.Abs(includePath(path, item.Include.Path)); err == nil {
+			targets = append(targets, abs)
+		}
+	}
+}
+
+// withoutIncluded returns files without the ones included by another of them,
+// directly or through the files it includes. Their blocks are answered with
+// the including file, so they're left as written rather than replaced by
+// result links the including file couldn't splice in.
+func (p *Parser) withoutIncluded(files []string) []string {
+	included := make(map[string]bool)
+	var pending []string
+	for _, file := range files {
+		pending = append(pending, p.includeTargets(file)...)
+	}
+	for len(pending) > 0 {
+		target := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		if included[target] {
+			continue
+		}
+		included[target] = true
+		pending = append(pending, p.includeTargets(target)...)
+	}
+	if len(included) == 0 {
+		return files
+	}
+
+	kept := make([]string, 0, len(files))
+	for _, file := range files {
+		abs, err := filepath.Abs(file)
+		if err == nil && included[abs] {
+			p.debugf("Skipping %s: it is included by another file\n", file)
+			continue
+		}
+		kept = append(kept, file)
+	}
+	return kept
+}
+
+// includeChain returns the chain parseIncluding starts with for the file at path
+func includeChain(path string) []string {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		abs = path
+	}
+	return []string{abs}
+}
+
+// blockDir returns the directory the paths in a block are relative to: that of
+// the file it was written in
+func blockDir(path string, block Block) string {
+	if block.Include != "" {
+		return filepath.Dir(block.Include)
+	}
+	return filepath.Dir(path)
+}
+
+// ownBlocks returns the blocks written in the file itself, without the ones it includes
+func ownBlocks(blocks []Block) []Block {
+	own := make([]Block, 0, len(blocks))
+	for _, block := range blocks {
+		if block.Include == "" {
+			own = append(own, block)
+		}
+	}
+	return own
+}
+
+// includingChecksum returns the checksum of a file's content followed by the
+// content of the files it includes, so the file counts as changed when one of
+// them does
+func includingChecksum(content string, included []string) string {
+	checksum := newFileChecksum()
+	for _, source := range append([]string{content}, included...) {
+		for _, line := range strings.Split(source, "\n") {
+			checksum.addLine(line)
+		}
+	}
+	return checksum.sum()
+}
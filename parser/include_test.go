@@ -0,0 +1,182 @@
+package parser
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestProcessFileInclude tests that the blocks of included files are spliced in
+// at the :include line and answered, while the line itself is kept
+func TestProcessFileInclude(t *testing.T) {
+	tmpDir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(tmpDir, "prompts"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	srcFile := filepath.Join(tmpDir, "main.pml")
+	files := map[string]string{
+		srcFile: ":ask\nFirst\n:--\n:include prompts/common.pml\n:ask\nLast\n:--\n",
+		filepath.Join(tmpDir, "prompts", "common.pml"): ":include nested.pml\n:ask\nMiddle\n:--\n",
+		filepath.Join(tmpDir, "prompts", "nested.pml"): ":ask\nNested\n:--\n",
+	}
+	for path, content := range files {
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	parser := NewParser(&mockLLM{answer: func(prompt string) string { return "Re: " + prompt }, Delay: time.Millisecond}, tmpDir, tmpDir, filepath.Join(tmpDir, "results"))
+	blocks, _, _, _, err := parser.prepareBlocks(srcFile, files[srcFile])
+	if err != nil {
+		t.Fatalf("prepareBlocks() error = %v", err)
+	}
+	var prompts []string
+	for _, block := range blocks {
+		prompts = append(prompts, strings.Join(block.Content, "\n"))
+	}
+	if got, want := strings.Join(prompts, ","), "First,Nested,Middle,Last"; got != want {
+		t.Errorf("Expected blocks %s, got %s", want, got)
+	}
+	if blocks[1].Include != filepath.Join(tmpDir, "prompts", "nested.pml") || blocks[2].Line != 4 {
+		t.Errorf("Expected included blocks at line 4 to record their file, got %+v", blocks[1:3])
+	}
+
+	if err := parser.ProcessFile(context.Background(), srcFile); err != nil {
+		t.Fatalf("ProcessFile() error = %v", err)
+	}
+	content, err := os.ReadFile(srcFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(content), ":include prompts/common.pml\n") {
+		t.Errorf("Expected the :include line to be kept, got:\n%s", content)
+	}
+	if n := strings.Count(string(content), ":--(r/"); n != 2 {
+		t.Errorf("Expected 2 result links for the file's own blocks, got %d:\n%s", n, content)
+	}
+	var answered []string
+	for _, data := range readTree(t, parser.resultsDirFor(srcFile)) {
+		answered = append(answered, data)
+	}
+	if all := strings.Join(answered, "\n"); !strings.Contains(all, "Re: Nested") || !strings.Contains(all, "Re: Middle") {
+		t.Errorf("Expected the included blocks to be answered, got %v", answered)
+	}
+}
+
+// TestIncludeCycle tests that files including each other fail with ErrIncludeCycle
+func TestIncludeCycle(t *testing.T) {
+	tmpDir := t.TempDir()
+	srcFile := filepath.Join(tmpDir, "a.pml")
+	if err := os.WriteFile(srcFile, []byte(":include b.pml\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(tmpDir, "b.pml"), []byte(":ask\nHi\n:--\n:include a.pml\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	parser := NewParser(&mockLLM{response: "Answer", Delay: time.Millisecond}, tmpDir, tmpDir, filepath.Join(tmpDir, "results"))
+	err := parser.ProcessFile(context.Background(), srcFile)
+	if !errors.Is(err, ErrIncludeCycle) {
+		t.Fatalf("Expected ErrIncludeCycle, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "a.pml -> b.pml -> a.pml") {
+		t.Errorf("Expected the cycle in the error, got %v", err)
+	}
+}
+
+// TestIncludeChecksum tests that the checksum of a file changes with the files
+// it includes, and equals calculateChecksum for files without includes
+func TestIncludeChecksum(t *testing.T) {
+	tmpDir := t.TempDir()
+	srcFile := filepath.Join(tmpDir, "main.pml")
+	common := filepath.Join(tmpDir, "common.pml")
+	content := ":include common.pml\n:ask\nQuestion\n:--\n"
+	if err := os.WriteFile(common, []byte(":ask\nOne\n:--\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	parser := NewParser(&mockLLM{response: "Answer", Delay: time.Millisecond}, tmpDir, tmpDir, filepath.Join(tmpDir, "results"))
+	checksum := func(content string) string {
+		t.Helper()
+		_, _, _, sum, err := parser.prepareBlocks(srcFile, content)
+		if err != nil {
+			t.Fatalf("prepareBlocks() error = %v", err)
+		}
+		return sum
+	}
+	before := checksum(content)
+	if err := os.WriteFile(common, []byte(":ask\nTwo\n:--\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if after := checksum(content); after == before {
+		t.Error("Expected the checksum to change with the included file")
+	}
+
+	plain := ":ask\nQuestion\n:--\n"
+	if got, want := checksum(plain), parser.calculateChecksum(plain); got != want {
+		t.Errorf("Expected checksum %s without includes, got %s", want, got)
+	}
+}
+
+// TestProcessAllFilesInclude tests that a run over all files leaves the files
+// others include as written, so every run answers the included blocks with
+// the including file
+func TestProcessAllFilesInclude(t *testing.T) {
+	tmpDir := t.TempDir()
+	mainFile := filepath.Join(tmpDir, "main.pml")
+	otherFile := filepath.Join(tmpDir, "other.pml")
+	nestedFile := filepath.Join(tmpDir, "nested.pml")
+	sources := map[string]string{
+		mainFile:   ":include other.pml\n:ask\nOwn\n:--\n",
+		otherFile:  ":include nested.pml\n:ask\nIncluded\n:--\n",
+		nestedFile: ":ask\nNested\n:--\n",
+	}
+	for path, content := range sources {
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	parser := NewParser(&mockLLM{answer: func(prompt string) string { return "Re: " + prompt }, Delay: time.Millisecond}, tmpDir, tmpDir, filepath.Join(tmpDir, "results"))
+	parser.SetForceProcess(true)
+	files, err := parser.FindPMLFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0] != mainFile {
+		t.Fatalf("Expected only %s to be found, got %v", mainFile, files)
+	}
+
+	for run := 1; run <= 2; run++ {
+		if err := parser.ProcessAllFiles(context.Background(), files); err != nil {
+			t.Fatalf("run %d: ProcessAllFiles() error = %v", run, err)
+		}
+		for _, path := range []string{otherFile, nestedFile} {
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != sources[path] {
+				t.Errorf("run %d: Expected %s to be left as written, got %q", run, filepath.Base(path), data)
+			}
+		}
+		blocks, _, _, _, err := parser.prepareBlocks(mainFile, sources[mainFile])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(blocks) != 3 {
+			t.Errorf("run %d: Expected main.pml to keep splicing in 3 blocks, got %d", run, len(blocks))
+		}
+	}
+	var answered []string
+	for _, data := range readTree(t, parser.resultsDirFor(mainFile)) {
+		answered = append(answered, data)
+	}
+	if all := strings.Join(answered, "\n"); !strings.Contains(all, "Re: Included") || !strings.Contains(all, "Re: Nested") {
+		t.Errorf("Expected the included blocks to be answered, got %v", answered)
+	}
+}
@@ -0,0 +1,229 @@
+package parser
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// IndexFile is the name of the workspace results index in the root .pml directory
+const IndexFile = "index.json"
+
+// IndexEntry describes one result in the workspace results index
+type IndexEntry struct {
+	SourceFile    string    `json:"source_file"`
+	BlockIndex    int       `json:"block_index"`
+	BlockChecksum string    `json:"block_checksum"`
+	BlockLine     int       `json:"block_line,omitempty"` // Line of the block in the source file when it was processed
+	ResultFile    string    `json:"result_file"`          // Path of the result file
+	Summary       string    `json:"summary"`
+	Timestamp     time.Time `json:"timestamp"`
+}
+
+// indexPath returns the path of the results index, next to the cache
+func (p *Parser) indexPath() string {
+	return filepath.Join(filepath.Dir(p.cacheFile), IndexFile)
+}
+
+// ReadIndex returns the entries of the workspace results index
+func (p *Parser) ReadIndex() ([]IndexEntry, error) {
+	var entries []IndexEntry
+	err := p.withIndexLock(func() error {
+		var err error
+		entries, err = p.readIndexFile()
+		return err
+	})
+	return entries, err
+}
+
+// RebuildIndex regenerates the results index from the result links in all PML files
+func (p *Parser) RebuildIndex() error {
+	files, err := p.FindPMLFiles()
+	if err != nil {
+		return fmt.Errorf("error finding PML files: %w", err)
+	}
+
+	var entries []IndexEntry
+	for _, file := range files {
+		content, err := readSource(file)
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", file, err)
+		}
+		for _, line := range strings.Split(string(content), "\n") {
+			link, ok := parseResultLink(line)
+			if !ok {
+				continue
+			}
+			resultPath := p.ResolveResultLink(file, link)
+			entry, err := readIndexEntry(resultPath)
+			if err != nil {
+				p.debugf("Skipping %s in index: %v\n", resultPath, err)
+				continue
+			}
+			entries = append(entries, entry)
+		}
+	}
+
+	return p.withIndexLock(func() error {
+		return p.writeIndexFile(entries)
+	})
+}
+
+// queueIndexEntry holds a result's index entry until flushIndex writes those of
+// its file together
+func (p *Parser) queueIndexEntry(entry IndexEntry) {
+	p.indexQueueMu.Lock()
+	defer p.indexQueueMu.Unlock()
+	if p.indexQueue == nil {
+		p.indexQueue = make(map[string][]IndexEntry)
+	}
+	p.indexQueue[entry.SourceFile] = append(p.indexQueue[entry.SourceFile], entry)
+}
+
+// flushIndex writes the queued index entries of the file at path, so the index
+// is rewritten once per file rather than once per block
+func (p *Parser) flushIndex(path string) {
+	p.indexQueueMu.Lock()
+	entries := p.indexQueue[path]
+	delete(p.indexQueue, path)
+	p.indexQueueMu.Unlock()
+	if len(entries) == 0 {
+		return
+	}
+	if err := p.updateIndex(path, entries); err != nil {
+		p.debugf("Warning: failed to update results index: %v\n", err)
+	}
+}
+
+// updateIndex adds the results of the file at path to the index, replacing any
+// entry for the same block. The file's entries whose result file no longer
+// exists are dropped.
+func (p *Parser) updateIndex(path string, updates []IndexEntry) error {
+	return p.withIndexLock(func() error {
+		entries, err := p.readIndexFile()
+		if err != nil {
+			// Start over rather than fail the file; RebuildIndex can recover the rest
+			p.debugf("Warning: replacing unreadable index: %v\n", err)
+			entries = nil
+		}
+
+		updated := make(map[string]bool, len(updates))
+		for _, entry := range updates {
+			updated[entry.BlockChecksum] = true
+		}
+		kept := entries[:0]
+		for _, existing := range entries {
+			if existing.SourceFile == path {
+				if updated[existing.BlockChecksum] {
+					continue
+				}
+				if _, err := os.Stat(existing.ResultFile); os.IsNotExist(err) {
+					continue
+				}
+			}
+			kept = append(kept, existing)
+		}
+		return p.writeIndexFile(append(kept, updates...))
+	})
+}
+
+// readIndexEntry builds an index entry from a result file's metadata
+func readIndexEntry(resultPath string) (IndexEntry, error) {
+	jsonStr, found, err := readMetadataLine(resultPath)
+	if err != nil {
+		return IndexEntry{}, err
+	}
+	if !found {
+		return IndexEntry{}, fmt.Errorf("no metadata found")
+	}
+	var metadata struct {
+		ResultSource
+		Summary   string    `json:"summary"`
+		Timestamp time.Time `json:"timestamp"`
+	}
+	if err := json.Unmarshal([]byte(jsonStr), &metadata); err != nil {
+		return IndexEntry{}, fmt.Errorf("failed to parse metadata: %w", err)
+	}
+	timestamp := metadata.Timestamp
+	if timestamp.IsZero() {
+		// Results written before timestamps were recorded
+		info, err := os.Stat(resultPath)
+		if err != nil {
+			return IndexEntry{}, err
+		}
+		timestamp = info.ModTime()
+	}
+	return IndexEntry{
+		SourceFile:    metadata.SourceFile,
+		BlockIndex:    metadata.BlockIndex,
+		BlockChecksum: metadata.BlockChecksum,
+		BlockLine:     metadata.BlockLine,
+		ResultFile:    resultPath,
+		Summary:       metadata.Summary,
+		Timestamp:     timestamp,
+	}, nil
+}
+
+// withIndexLock runs fn holding both the in-process and the cross-process index lock
+func (p *Parser) withIndexLock(fn func() error) error {
+	p.indexMu.Lock()
+	defer p.indexMu.Unlock()
+
+	if err := os.MkdirAll(filepath.Dir(p.indexPath()), 0755); err != nil {
+		return fmt.Errorf("error creating index directory: %w", err)
+	}
+	unlock, err := lockFile(p.indexPath() + ".lock")
+	if err != nil {
+		return fmt.Errorf("error locking index: %w", err)
+	}
+	defer unlock()
+
+	return fn()
+}
+
+// readIndexFile reads the index, returning no entries if it doesn't exist yet
+func (p *Parser) readIndexFile() ([]IndexEntry, error) {
+	data, err := os.ReadFile(p.indexPath())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading index: %w", err)
+	}
+	var entries []IndexEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("error parsing index: %w", err)
+	}
+	return entries, nil
+}
+
+// writeIndexFile replaces the index with entries, ordered by source file and block
+func (p *Parser) writeIndexFile(entries []IndexEntry) error {
+	sort.SliceStable(entries, func(i, j int) bool {
+		if entries[i].SourceFile != entries[j].SourceFile {
+			return entries[i].SourceFile < entries[j].SourceFile
+		}
+		return entries[i].BlockIndex < entries[j].BlockIndex
+	})
+	if entries == nil {
+		entries = []IndexEntry{}
+	}
+
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error marshaling index: %w", err)
+	}
+	tmpFile := p.indexPath() + ".tmp"
+	if err := os.WriteFile(tmpFile, data, 0644); err != nil {
+		return fmt.Errorf("error writing index: %w", err)
+	}
+	if err := os.Rename(tmpFile, p.indexPath()); err != nil {
+		os.Remove(tmpFile)
+		return fmt.Errorf("error writing index: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,166 @@
+package parser
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestResultsIndex(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "pml-index-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	// Several files processed concurrently all update the one index
+	var files []string
+	for f := 0; f < 3; f++ {
+		content := fmt.Sprintf(":ask\nFirst question of %d\n:--\n\n:ask\nSecond question of %d\n:--\n", f, f)
+		path := filepath.Join(tmpDir, fmt.Sprintf("file%d.pml", f))
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, path)
+	}
+
+	parser := NewParser(&mockLLM{response: "Answer", Delay: 10 * time.Millisecond}, tmpDir, filepath.Join(tmpDir, "compiled"), filepath.Join(tmpDir, "results"))
+	if err := parser.ProcessAllFiles(context.Background(), files); err != nil {
+		t.Fatalf("ProcessAllFiles failed: %v", err)
+	}
+
+	entries, err := parser.ReadIndex()
+	if err != nil {
+		t.Fatalf("ReadIndex failed: %v", err)
+	}
+	if len(entries) != 6 {
+		t.Fatalf("Expected an index entry per processed block, got %d: %+v", len(entries), entries)
+	}
+	for _, entry := range entries {
+		if entry.BlockChecksum == "" || entry.Summary == "" || entry.Timestamp.IsZero() {
+			t.Errorf("Incomplete index entry: %+v", entry)
+		}
+		if _, err := os.Stat(entry.ResultFile); err != nil {
+			t.Errorf("Index entry points to a missing result file: %v", err)
+		}
+	}
+	if entries[0].SourceFile != files[0] || entries[0].BlockIndex != 0 || entries[1].BlockIndex != 1 {
+		t.Errorf("Expected entries ordered by file and block, got %+v", entries[:2])
+	}
+
+	// Rebuilding from scratch finds the same results
+	if err := os.Remove(filepath.Join(tmpDir, ".pml", IndexFile)); err != nil {
+		t.Fatal(err)
+	}
+	if err := parser.RebuildIndex(); err != nil {
+		t.Fatalf("RebuildIndex failed: %v", err)
+	}
+	rebuilt, err := parser.ReadIndex()
+	if err != nil {
+		t.Fatalf("ReadIndex failed: %v", err)
+	}
+	if len(rebuilt) != len(entries) {
+		t.Fatalf("Expected %d entries after rebuild, got %d", len(entries), len(rebuilt))
+	}
+	for i := range rebuilt {
+		if rebuilt[i].ResultFile != entries[i].ResultFile || rebuilt[i].BlockChecksum != entries[i].BlockChecksum {
+			t.Errorf("Rebuilt entry %d differs: %+v vs %+v", i, rebuilt[i], entries[i])
+		}
+	}
+}
+
+// TestResultsRecordBlockLine tests that result metadata, the index and the cache record each block's line
+func TestResultsRecordBlockLine(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "pml-line-*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	p := NewParser(&mockLLM{response: "Answer", Delay: 10 * time.Millisecond}, tmpDir, filepath.Join(tmpDir, "compiled"), filepath.Join(tmpDir, "results"))
+	pmlFile := filepath.Join(tmpDir, "test.pml")
+	content := "# Notes\n\n:ask\nFirst question\n:--\n\nSome text\n\n:ask\nSecond\nquestion\n:--\n"
+	if err := os.WriteFile(pmlFile, []byte(content), 0644); err != nil {
+		t.Fatalf("Failed to write test file: %v", err)
+	}
+	if err := p.ProcessFile(context.Background(), pmlFile); err != nil {
+		t.Fatalf("ProcessFile failed: %v", err)
+	}
+
+	wantLines := map[int]int{0: 3, 1: 9} // Block index to line of its directive
+	entries, err := p.ReadIndex()
+	if err != nil {
+		t.Fatalf("ReadIndex failed: %v", err)
+	}
+	if len(entries) != len(wantLines) {
+		t.Fatalf("Expected %d index entries, got %d", len(wantLines), len(entries))
+	}
+	for _, entry := range entries {
+		if want := wantLines[entry.BlockIndex]; entry.BlockLine != want {
+			t.Errorf("Index entry for block %d: expected line %d, got %d", entry.BlockIndex, want, entry.BlockLine)
+		}
+		source, err := p.ResultSource(entry.ResultFile)
+		if err != nil {
+			t.Fatalf("ResultSource failed: %v", err)
+		}
+		if want := wantLines[source.BlockIndex]; source.BlockLine != want {
+			t.Errorf("Result metadata for block %d: expected line %d, got %d", source.BlockIndex, want, source.BlockLine)
+		}
+	}
+	for _, cached := range p.cache[pmlFile].Blocks {
+		if want := wantLines[cached.Index]; cached.Line != want {
+			t.Errorf("Cache entry for block %d: expected line %d, got %d", cached.Index, want, cached.Line)
+		}
+	}
+}
+
+// TestIndexDropsMissingResults tests that indexing a file's new results drops
+// its entries whose result files were deleted
+func TestIndexDropsMissingResults(t *testing.T) {
+	tmpDir := t.TempDir()
+	path := filepath.Join(tmpDir, "file.pml")
+	if err := os.WriteFile(path, []byte(":ask\nFirst question\n:--\n\n:ask\nSecond question\n:--\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	parser := NewParser(&mockLLM{response: "Answer", Delay: time.Millisecond}, tmpDir, filepath.Join(tmpDir, "compiled"), filepath.Join(tmpDir, "results"))
+	if err := parser.ProcessFile(context.Background(), path); err != nil {
+		t.Fatalf("ProcessFile failed: %v", err)
+	}
+	entries, err := parser.ReadIndex()
+	if err != nil {
+		t.Fatalf("ReadIndex failed: %v", err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("Expected 2 index entries, got %+v", entries)
+	}
+	if err := os.Remove(entries[0].ResultFile); err != nil {
+		t.Fatal(err)
+	}
+
+	// Another block is answered in the same file
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, append(content, "\n:ask\nThird question\n:--\n"...), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := parser.ProcessFile(context.Background(), path); err != nil {
+		t.Fatalf("ProcessFile failed: %v", err)
+	}
+	updated, err := parser.ReadIndex()
+	if err != nil {
+		t.Fatalf("ReadIndex failed: %v", err)
+	}
+	if len(updated) != 2 {
+		t.Fatalf("Expected the deleted result to be dropped and the new one added, got %+v", updated)
+	}
+	for _, entry := range updated {
+		if entry.ResultFile == entries[0].ResultFile {
+			t.Errorf("Expected no entry for the deleted result %s", entry.ResultFile)
+		}
+	}
+}
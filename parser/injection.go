@@ -0,0 +1,49 @@
+package parser
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// DefaultInjectionPatterns match text resembling attempts to override a
+// model's instructions, as found in content pasted or interpolated from
+// untrusted sources. They are a heuristic: matches may be harmless, and
+// injections can be phrased to avoid them.
+var DefaultInjectionPatterns = []string{
+	`(?i)\b(ignore|disregard|forget|override)\s+(all\s+)?(of\s+)?(the\s+|your\s+)?(previous|prior|above|earlier|preceding)\s+(instructions|prompts?|messages|rules|directions)`,
+	`(?i)\b(reveal|print|show|repeat|output)\s+(me\s+)?(your|the)\s+(system\s+prompt|initial\s+instructions|hidden\s+instructions)`,
+	`(?i)\bnew\s+(system\s+)?instructions\s*:`,
+	`(?i)^\s*(system|assistant)\s*:`,
+	`(?i)<\|?(im_start|im_end|system)\|?>|\[/?(INST|SYS)\]|<</?SYS>>`,
+	`(?i)\b(developer|jailbreak|DAN)\s+mode\b`,
+}
+
+// SetInjectionScan sets whether Validate warns about blocks whose content,
+// after environment variables and templates are expanded, matches
+// DefaultInjectionPatterns or one of the given regular expressions
+func (p *Parser) SetInjectionScan(enabled bool, patterns []string) error {
+	if !enabled {
+		p.injectionPatterns = nil
+		return nil
+	}
+	compiled := make([]*regexp.Regexp, 0, len(DefaultInjectionPatterns)+len(patterns))
+	for _, pattern := range append(append([]string(nil), DefaultInjectionPatterns...), patterns...) {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return fmt.Errorf("invalid injection pattern %q: %w", pattern, err)
+		}
+		compiled = append(compiled, re)
+	}
+	p.injectionPatterns = compiled
+	return nil
+}
+
+// injectionMatch returns the first text in line matching an injection pattern
+func (p *Parser) injectionMatch(line string) (string, bool) {
+	for _, pattern := range p.injectionPatterns {
+		if match := pattern.FindString(line); match != "" {
+			return match, true
+		}
+	}
+	return "", false
+}
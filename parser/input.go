@@ -0,0 +1,55 @@
+package parser
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+// ResultAwaitingInput is the answer reported for an :input block processed
+// without an input function. The block gets no result file and stays in the
+// file, so it is asked again on the next run.
+const ResultAwaitingInput = "awaiting input"
+
+// InputFunc returns the input given for an :input block, whose content is the
+// question shown to the user
+type InputFunc func(block Block) (string, error)
+
+// SetInputFunc sets the function answering :input blocks. Without one, :input
+// blocks are left in the file unanswered, reporting ResultAwaitingInput. Inputs
+// are never cached, so every run asks for them again.
+func (p *Parser) SetInputFunc(fn InputFunc) {
+	p.inputFunc = fn
+}
+
+// LineInput returns an InputFunc that writes an :input block's content to w as
+// the question and reads the answer, a line, from r. Blocks processed in
+// parallel ask one at a time.
+func LineInput(r io.Reader, w io.Writer) InputFunc {
+	var mu sync.Mutex
+	reader := bufio.NewReader(r)
+	return func(block Block) (string, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if _, err := fmt.Fprintf(w, "%s\n> ", blockText(block)); err != nil {
+			return "", err
+		}
+		line, err := reader.ReadString('\n')
+		if err != nil && !(errors.Is(err, io.EOF) && line != "") {
+			return "", err
+		}
+		return strings.TrimRight(line, "\r\n"), nil
+	}
+}
+
+// readInput answers an :input block with the input function
+func (p *Parser) readInput(block Block) (string, error) {
+	input, err := p.inputFunc(block)
+	if err != nil {
+		return "", fmt.Errorf("failed to read input: %w", err)
+	}
+	return input, nil
+}
@@ -0,0 +1,82 @@
+package parser
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestProcessFileInputAwaiting tests that :input blocks processed without an
+// input function are left in the file, with no result file or cache entry
+func TestProcessFileInputAwaiting(t *testing.T) {
+	tmpDir := t.TempDir()
+	srcFile := filepath.Join(tmpDir, "input.pml")
+	content := ":input\nWhat is your name?\n:--\n"
+	if err := os.WriteFile(srcFile, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	parser := NewParser(&mockLLM{response: "Answer", Delay: time.Millisecond}, tmpDir, tmpDir, filepath.Join(tmpDir, "results"))
+	var results []string
+	parser.SetResultSink(func(ctx context.Context, result BlockResult) error {
+		results = append(results, result.Result)
+		return nil
+	})
+	for i := 0; i < 2; i++ {
+		if err := parser.ProcessFile(context.Background(), srcFile); err != nil {
+			t.Fatalf("ProcessFile() error = %v", err)
+		}
+		processed, err := os.ReadFile(srcFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(processed) != content {
+			t.Fatalf("Expected the :input block to stay in the file, got:\n%s", processed)
+		}
+	}
+	if tree := readTree(t, parser.resultsDirFor(srcFile)); len(tree) != 0 {
+		t.Errorf("Expected no result files, got %v", tree)
+	}
+	if len(results) != 0 {
+		t.Errorf("Expected nothing to be handed to the result sink, got %q", results)
+	}
+	if len(parser.cache[srcFile].Blocks) != 0 {
+		t.Errorf("Expected :input blocks not to be cached, got %v", parser.cache[srcFile].Blocks)
+	}
+}
+
+// TestProcessFileInputInteractive tests that :input blocks are answered with
+// lines read by LineInput, and asked again on every run
+func TestProcessFileInputInteractive(t *testing.T) {
+	tmpDir := t.TempDir()
+	srcFile := filepath.Join(tmpDir, "input.pml")
+	content := ":input\nWhat is your name?\n:--\n"
+
+	var prompts bytes.Buffer
+	parser := NewParser(&mockLLM{response: "Answer", Delay: time.Millisecond}, tmpDir, tmpDir, filepath.Join(tmpDir, "results"))
+	parser.SetInputFunc(LineInput(strings.NewReader("Ada\nGrace\n"), &prompts))
+	var results []string
+	parser.SetResultSink(func(ctx context.Context, result BlockResult) error {
+		results = append(results, result.Result)
+		return nil
+	})
+
+	for i := 0; i < 2; i++ {
+		if err := os.WriteFile(srcFile, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := parser.ProcessFile(context.Background(), srcFile); err != nil {
+			t.Fatalf("ProcessFile() error = %v", err)
+		}
+	}
+	if strings.Join(results, ",") != "Ada,Grace" {
+		t.Errorf("Expected a fresh input on each run, got %v", results)
+	}
+	if got := prompts.String(); got != "What is your name?\n> What is your name?\n> " {
+		t.Errorf("Unexpected prompts %q", got)
+	}
+}
@@ -0,0 +1,100 @@
+package parser
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// ErrResultLocked is returned when reprocessing a block whose result is locked
+var ErrResultLocked = errors.New("result is locked")
+
+// LockResult locks the result of the block with the given checksum in the file
+// at path. A locked result is never sent to the LLM again, even when processing
+// is forced; its link and result file are left as they are. The lock is kept in
+// the cache and recorded as "locked" in the result file's metadata.
+func (p *Parser) LockResult(path, blockChecksum string) error {
+	content, err := readSource(path)
+	if err != nil {
+		return fmt.Errorf("failed to read file: %w", err)
+	}
+
+	lines := strings.Split(string(content), "\n")
+	i, resultPath, source, ok := p.findResultLink(path, lines, blockChecksum)
+	if !ok {
+		return fmt.Errorf("no result for block with checksum %s in %s", blockChecksum, path)
+	}
+	block, answer, err := readResult(resultPath)
+	if err != nil {
+		return fmt.Errorf("failed to read result %s: %w", resultPath, err)
+	}
+	if err := p.setResultMetadata(resultPath, "locked", true); err != nil {
+		return err
+	}
+
+	p.cacheMu.Lock()
+	entry, ok := p.cache[path]
+	if !ok {
+		entry = CacheEntry{Blocks: make(map[string]BlockCache)}
+	}
+	cached, ok := entry.Blocks[blockChecksum]
+	if !ok {
+		// The cache entry expired or was removed; restore it from the result file
+		link, _ := parseResultLink(lines[i])
+		cached = BlockCache{
+			Checksum:   blockChecksum,
+			Result:     answer,
+			ResultFile: strings.TrimPrefix(link, "r/"),
+			Index:      source.BlockIndex,
+			Line:       source.BlockLine,
+			Attributes: block.Attributes,
+			ModTime:    p.now(),
+		}
+	}
+	cached.Locked = true
+	entry.Blocks[blockChecksum] = cached
+	p.cache[path] = entry
+	p.cacheMu.Unlock()
+
+	return p.saveCache()
+}
+
+// isLocked reports whether the result of a block in the file at path is locked
+func (p *Parser) isLocked(path, blockChecksum string) bool {
+	p.cacheMu.RLock()
+	defer p.cacheMu.RUnlock()
+	return p.cache[path].Blocks[blockChecksum].Locked
+}
+
+// setResultMetadata sets a key in the metadata line of a result file
+func (p *Parser) setResultMetadata(resultPath, key string, value interface{}) error {
+	unlock := p.lockResultPath(resultPath)
+	defer unlock()
+
+	data, err := os.ReadFile(resultPath)
+	if err != nil {
+		return fmt.Errorf("failed to read result file: %w", err)
+	}
+	first, rest, _ := strings.Cut(string(data), "\n")
+	if !strings.HasPrefix(first, MetadataPrefix) {
+		return fmt.Errorf("no metadata found in %s", resultPath)
+	}
+
+	var metadata map[string]interface{}
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(first, MetadataPrefix)), &metadata); err != nil {
+		return fmt.Errorf("failed to parse metadata: %w", err)
+	}
+	metadata[key] = value
+	metadataJSON, err := json.Marshal(metadata)
+	if err != nil {
+		return fmt.Errorf("failed to marshal metadata: %w", err)
+	}
+
+	content := MetadataPrefix + string(metadataJSON) + "\n" + rest
+	if err := writeFileAtomic(resultPath, []byte(content)); err != nil {
+		return fmt.Errorf("failed to write result file: %w", err)
+	}
+	return nil
+}
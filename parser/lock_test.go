@@ -0,0 +1,82 @@
+package parser
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestLockResult tests that a locked block is never reprocessed, even when processing is forced
+func TestLockResult(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "pml-lock-*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	var calls int32
+	mock := &mockLLM{response: "Paris", Delay: 10 * time.Millisecond, callback: func() { atomic.AddInt32(&calls, 1) }}
+	p := NewParser(mock, tmpDir, filepath.Join(tmpDir, "compiled"), filepath.Join(tmpDir, "results"))
+
+	pmlFile := filepath.Join(tmpDir, "test.pml")
+	block := ":ask\nCapital of France?\n:--\n"
+	if err := os.WriteFile(pmlFile, []byte(block), 0644); err != nil {
+		t.Fatalf("Failed to write test file: %v", err)
+	}
+	if err := p.ProcessFile(context.Background(), pmlFile); err != nil {
+		t.Fatalf("ProcessFile failed: %v", err)
+	}
+
+	processed, err := os.ReadFile(pmlFile)
+	if err != nil {
+		t.Fatalf("Failed to read processed file: %v", err)
+	}
+	link, ok := parseResultLink(strings.TrimSpace(string(processed)))
+	if !ok {
+		t.Fatalf("Expected a result link, got:\n%s", processed)
+	}
+	resultPath := p.ResolveResultLink(pmlFile, link)
+	source, err := p.ResultSource(resultPath)
+	if err != nil {
+		t.Fatalf("ResultSource failed: %v", err)
+	}
+
+	if err := p.LockResult(pmlFile, source.BlockChecksum); err != nil {
+		t.Fatalf("LockResult failed: %v", err)
+	}
+	result, err := os.ReadFile(resultPath)
+	if err != nil {
+		t.Fatalf("Failed to read result file: %v", err)
+	}
+	if !strings.Contains(string(result), `"locked":true`) {
+		t.Errorf("Expected the result metadata to be locked, got:\n%s", result)
+	}
+
+	p.SetForceProcess(true)
+	if err := p.ReprocessBlock(context.Background(), pmlFile, source.BlockChecksum); !errors.Is(err, ErrResultLocked) {
+		t.Errorf("Expected ErrResultLocked from ReprocessBlock, got %v", err)
+	}
+
+	// The same block written again is answered from the locked result
+	if err := os.WriteFile(pmlFile, append(processed, []byte("\n"+block)...), 0644); err != nil {
+		t.Fatalf("Failed to write test file: %v", err)
+	}
+	if err := p.ProcessFile(context.Background(), pmlFile); err != nil {
+		t.Fatalf("ProcessFile failed: %v", err)
+	}
+	if calls != 1 {
+		t.Errorf("Expected the locked block not to be sent again, got %d LLM calls", calls)
+	}
+	after, err := os.ReadFile(resultPath)
+	if err != nil {
+		t.Fatalf("Failed to read result file: %v", err)
+	}
+	if string(after) != string(result) {
+		t.Errorf("Expected the locked result file to be untouched, got:\n%s", after)
+	}
+}
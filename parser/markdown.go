@@ -0,0 +1,102 @@
+package parser
+
+import (
+	"strings"
+)
+
+// MarkdownExtensions are the extensions of Markdown files whose ```pml fences
+// are processed when SetMarkdownFences is enabled
+var MarkdownExtensions = []string{".md", ".markdown"}
+
+// MarkdownFenceLanguage is the info string of the Markdown fences holding PML
+const MarkdownFenceLanguage = "pml"
+
+// SetMarkdownFences enables processing PML inside Markdown files. Markdown files
+// are found like PML files, but only the content of their ```pml fenced code
+// blocks is parsed; each block is replaced by its result link within the fence,
+// and the rest of the document is left untouched.
+func (p *Parser) SetMarkdownFences(enabled bool) {
+	p.markdownFences = enabled
+	if !enabled {
+		return
+	}
+	for _, ext := range MarkdownExtensions {
+		if !HasPMLExtension("file"+ext, p.extensions) {
+			p.extensions = append(p.extensions, ext)
+		}
+	}
+}
+
+// isMarkdownFile reports whether path is a Markdown file whose fences hold its PML
+func (p *Parser) isMarkdownFile(path string) bool {
+	return p.markdownFences && HasPMLExtension(path, MarkdownExtensions)
+}
+
+// blockSource returns the content blocks are parsed from for the file at path.
+// For Markdown files everything outside ```pml fences, including the fence
+// lines, is blanked out with spaces, so block offsets still index content.
+func (p *Parser) blockSource(path, content string) string {
+	if !p.isMarkdownFile(path) {
+		return content
+	}
+	return maskOutsideFences(content)
+}
+
+// maskOutsideFences replaces every character outside ```pml fences with a
+// space, keeping line breaks. Fences of other languages are skipped whole, so a
+// ```pml fence shown inside a ````markdown example isn't processed.
+func maskOutsideFences(content string) string {
+	var masked strings.Builder
+	masked.Grow(len(content))
+	var fence string // Opening marker of the fence we're in, e.g. "```"
+	inPML := false
+	for _, line := range strings.SplitAfter(content, "\n") {
+		marker, info := fenceLine(line)
+		switch {
+		case fence == "" && marker != "":
+			fence = marker
+			inPML = strings.EqualFold(firstWord(info), MarkdownFenceLanguage)
+		case fence != "" && marker != "" && info == "" && marker[0] == fence[0] && len(marker) >= len(fence):
+			fence = ""
+			inPML = false
+		case inPML:
+			masked.WriteString(line)
+			continue
+		}
+		masked.WriteString(blankLine(line))
+	}
+	return masked.String()
+}
+
+// fenceLine returns the fence marker (a run of at least three backticks or
+// tildes, indented up to three spaces) starting line, and the info string after it
+func fenceLine(line string) (marker, info string) {
+	trimmed := strings.TrimRight(line, "\r\n")
+	indent := len(trimmed) - len(strings.TrimLeft(trimmed, " "))
+	if indent > 3 {
+		return "", ""
+	}
+	trimmed = trimmed[indent:]
+	if trimmed == "" || (trimmed[0] != '`' && trimmed[0] != '~') {
+		return "", ""
+	}
+	n := len(trimmed) - len(strings.TrimLeft(trimmed, trimmed[:1]))
+	if n < 3 {
+		return "", ""
+	}
+	return trimmed[:n], strings.TrimSpace(trimmed[n:])
+}
+
+// firstWord returns the first space-separated word of s
+func firstWord(s string) string {
+	if fields := strings.Fields(s); len(fields) > 0 {
+		return fields[0]
+	}
+	return ""
+}
+
+// blankLine replaces the characters of line with spaces, keeping its line ending
+func blankLine(line string) string {
+	text := strings.TrimRight(line, "\r\n")
+	return strings.Repeat(" ", len(text)) + line[len(text):]
+}
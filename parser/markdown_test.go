@@ -0,0 +1,57 @@
+package parser
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// TestProcessMarkdownFences tests that only the ```pml fences of a Markdown
+// file are processed and the rest of the document is left untouched
+func TestProcessMarkdownFences(t *testing.T) {
+	tmpDir := t.TempDir()
+	intro := "# Guide\n\nWrite `:ask` on its own line to start a block:\n\n:ask\nNot a prompt\n:--\n\n```python\n:ask\nprint('not a prompt either')\n```\n\n"
+	outro := "\nThat's all.\n"
+	content := intro + "```pml\n:ask\nWhat is PML?\n:--\n```\n" + outro
+	srcFile := filepath.Join(tmpDir, "guide.md")
+	if err := os.WriteFile(srcFile, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var mu sync.Mutex
+	var prompts []string
+	parser := NewParser(&mockLLM{answer: func(prompt string) string {
+		mu.Lock()
+		defer mu.Unlock()
+		prompts = append(prompts, prompt)
+		return "A prompt language"
+	}}, tmpDir, tmpDir, filepath.Join(tmpDir, "results"))
+	parser.SetMarkdownFences(true)
+
+	if !parser.IsPMLFile(srcFile) {
+		t.Fatal("Expected Markdown files to be found in Markdown fence mode")
+	}
+	if err := parser.ProcessFile(context.Background(), srcFile); err != nil {
+		t.Fatalf("ProcessFile() error = %v", err)
+	}
+	if len(prompts) != 1 || prompts[0] != "What is PML?" {
+		t.Fatalf("Expected only the fenced block to be asked, got %q", prompts)
+	}
+
+	data, err := os.ReadFile(srcFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	updated := string(data)
+	if !strings.HasPrefix(updated, intro+"```pml\n:--(r/") || !strings.HasSuffix(updated, ")\n```\n"+outro) {
+		t.Errorf("Expected the result link inside the fence and the rest untouched, got:\n%s", updated)
+	}
+
+	// Without the mode, Markdown files aren't PML files
+	if NewParser(&mockLLM{}, tmpDir, tmpDir, filepath.Join(tmpDir, "results")).IsPMLFile(srcFile) {
+		t.Error("Expected Markdown files to be ignored by default")
+	}
+}
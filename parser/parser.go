@@ -5,25 +5,43 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
+
+	"github.com/fireharp/pml/impl1/parser/directives"
 )
 
+// DefaultPruneDirs are directories skipped when looking for PML files
+var DefaultPruneDirs = []string{"node_modules", ".git", "vendor", "__pycache__"}
+
+// DefaultExtensions are the file extensions recognized as PML files
+var DefaultExtensions = []string{".pml"}
+
 // NewParser creates a new PML parser with specified directories
 func NewParser(llm LLMClient, sourcesDir, compiledDir, resultsDir string) *Parser {
 	// Cache file is now stored in the .pml directory
 	pmlDir := filepath.Join(sourcesDir, ".pml")
 	cacheFile := filepath.Join(pmlDir, "cache.json")
 	p := &Parser{
-		llm:            llm,
-		sourcesDir:     sourcesDir,
-		compiledDir:    compiledDir, // Keep for compatibility, but will be same as sourcesDir
-		rootResultsDir: resultsDir,
-		cacheFile:      cacheFile,
-		cache:          make(map[string]CacheEntry),
-		debug:          os.Getenv("PML_DEBUG") == "1",
-		forceProcess:   false,
-		usedNames:      make(map[string]bool),
+		llm:              llm,
+		sourcesDir:       sourcesDir,
+		compiledDir:      compiledDir, // Keep for compatibility, but will be same as sourcesDir
+		rootResultsDir:   resultsDir,
+		cacheFile:        cacheFile,
+		cache:            make(map[string]CacheEntry),
+		debug:            os.Getenv("PML_DEBUG") == "1",
+		forceProcess:     false,
+		failFast:         true,
+		directives:       directives.DefaultRegistry(),
+		usedNames:        make(map[string]bool),
+		pruneDirs:        append([]string(nil), DefaultPruneDirs...),
+		extensions:       append([]string(nil), DefaultExtensions...),
+		maxBlocksPerFile: DefaultMaxBlocksPerFile,
+		nameAdjectives:   append([]string(nil), adjectives...),
+		nameNouns:        append([]string(nil), nouns...),
+		resultWriters:    make(chan struct{}, maxResultWriters),
+		redactEnvValues:  true,
 	}
 
 	// Ensure cache directory exists
@@ -38,6 +56,7 @@ func NewParser(llm LLMClient, sourcesDir, compiledDir, resultsDir string) *Parse
 		os.MkdirAll(p.rootResultsDir, 0755)
 	}
 	p.loadCache()
+	p.loadSharedCache()
 
 	return p
 }
@@ -45,7 +64,7 @@ func NewParser(llm LLMClient, sourcesDir, compiledDir, resultsDir string) *Parse
 // debugf prints debug messages if debug mode is enabled
 func (p *Parser) debugf(format string, args ...interface{}) {
 	if p.debug {
-		fmt.Printf(format, args...)
+		fmt.Print(p.redact(fmt.Sprintf(format, args...)))
 	}
 }
 
@@ -54,13 +73,194 @@ func (p *Parser) SetForceProcess(force bool) {
 	p.forceProcess = force
 }
 
-// IsPMLFile checks if a file is a PML file
+// SetDirectiveRegistry replaces the registry of directives the parser
+// understands. Blocks of a directive implementing directives.Processor, such as
+// :do in the default registry, get their result from its Process method; :ask,
+// :summary and :summarize blocks go to the LLM.
+func (p *Parser) SetDirectiveRegistry(registry *directives.DirectiveRegistry) {
+	p.directives = registry
+}
+
+// Directives returns the registry of directives the parser understands
+func (p *Parser) Directives() *directives.DirectiveRegistry {
+	return p.directives
+}
+
+// SetFailFast sets whether ProcessAllFiles cancels the remaining files when one fails
+// (the default) or processes every file and reports all failures together
+func (p *Parser) SetFailFast(failFast bool) {
+	p.failFast = failFast
+}
+
+// SetCentralResults sets whether results are written under the root results
+// directory, mirroring the sources tree, instead of next to each source file
+func (p *Parser) SetCentralResults(central bool) {
+	p.centralResults = central
+}
+
+// SetLLMConcurrencyByModel bounds the number of in-flight LLM calls per model name.
+// Models without a limit are only bounded by the per-file block concurrency.
+func (p *Parser) SetLLMConcurrencyByModel(limits map[string]int) {
+	p.modelLimits = make(map[string]chan struct{}, len(limits))
+	for model, limit := range limits {
+		if limit > 0 {
+			p.modelLimits[model] = make(chan struct{}, limit)
+		}
+	}
+}
+
+// SetApprovalFunc sets a function consulted before running :do blocks.
+// A block that is not approved is skipped and records ResultNotApproved.
+func (p *Parser) SetApprovalFunc(fn ApprovalFunc) {
+	p.approvalFunc = fn
+}
+
+// SetSystemPrompt sets the system prompt sent with every block of a directive,
+// e.g. a persona for all questions. Only :ask blocks are sent to the LLM with a
+// system prompt. An empty text removes it. The system prompt is part of the
+// block checksum, so changing it reprocesses the directive's blocks.
+func (p *Parser) SetSystemPrompt(directive, text string) error {
+	if directive != DirectiveAsk {
+		return fmt.Errorf("system prompts are only supported for %s, not %q", DirectiveAsk, directive)
+	}
+	if p.systemPrompts == nil {
+		p.systemPrompts = make(map[string]string)
+	}
+	if text == "" {
+		delete(p.systemPrompts, directive)
+		return nil
+	}
+	p.systemPrompts[directive] = text
+	return nil
+}
+
+// SetStrictDirectives sets whether a line outside blocks written like a
+// directive but unknown, such as ":note", is a syntax error (the default). When
+// not strict, such lines and the end marker closing them are kept as plain text.
+func (p *Parser) SetStrictDirectives(strict bool) {
+	p.laxDirectives = !strict
+}
+
+// SetStrictEOF sets whether a block still open at the end of the file is a
+// syntax error (the default). When not strict, the block is closed at the end of
+// the file with a warning, and its result link replaces it like any other block.
+func (p *Parser) SetStrictEOF(strict bool) {
+	p.closeAtEOF = !strict
+}
+
+// SetSummarizeLinks sets whether result links are labeled with a short summary of the answer
+func (p *Parser) SetSummarizeLinks(summarize bool) {
+	p.summarizeLinks = summarize
+}
+
+// SetSummaryStrategy sets how link summaries are produced when they are enabled
+// with SetSummarizeLinks. A nil strategy (the default) asks the LLM; the
+// built-in SummaryFirstLine and SummaryTruncated avoid the LLM call, as can a
+// custom function.
+func (p *Parser) SetSummaryStrategy(strategy SummaryStrategy) {
+	p.summaryStrategy = strategy
+}
+
+// SetBatchLinkSummaries sets whether link summaries for a file are produced by a
+// single LLM request instead of one Summarize call per block
+func (p *Parser) SetBatchLinkSummaries(batch bool) {
+	p.batchLinkSummaries = batch
+}
+
+// SetRefinePriorResults sets whether reprocessed or changed blocks that had a
+// previous answer send it along, asking the model to revise it
+func (p *Parser) SetRefinePriorResults(refine bool) {
+	p.refinePrior = refine
+}
+
+// SetTagFilter restricts processing to blocks tagged with one of include
+// (or all blocks if include is empty) and skips blocks tagged with any of exclude.
+// Filtered-out blocks are left untouched in the source file.
+func (p *Parser) SetTagFilter(include, exclude []string) {
+	p.includeTags = include
+	p.excludeTags = exclude
+}
+
+// SetCacheKeyAttributes sets which directive line attributes are part of the
+// block checksum, so changing one of them reprocesses the block. Other
+// attributes, like tags, can change without invalidating cached results.
+// The model attribute is always part of the checksum.
+func (p *Parser) SetCacheKeyAttributes(keys ...string) {
+	keys = append([]string(nil), keys...)
+	sort.Strings(keys)
+	p.cacheKeyAttributes = keys
+}
+
+// AddPruneDirs adds directory names to skip when looking for PML files
+func (p *Parser) AddPruneDirs(names ...string) {
+	p.pruneDirs = append(p.pruneDirs, names...)
+}
+
+// IsPrunedDir reports whether a directory with the given name is skipped when
+// looking for PML files
+func (p *Parser) IsPrunedDir(name string) bool {
+	for _, pruned := range p.pruneDirs {
+		if name == pruned {
+			return true
+		}
+	}
+	return false
+}
+
+// SetExtensions sets the file extensions recognized as PML files, e.g.
+// []string{".pml", ".prompt"}. A leading dot is added where missing; an empty
+// list restores DefaultExtensions.
+func (p *Parser) SetExtensions(exts []string) {
+	if len(exts) == 0 {
+		p.extensions = append([]string(nil), DefaultExtensions...)
+		return
+	}
+	p.extensions = nil
+	for _, ext := range exts {
+		if ext = strings.ToLower(strings.TrimSpace(ext)); ext == "" {
+			continue
+		}
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		p.extensions = append(p.extensions, ext)
+	}
+}
+
+// Extensions returns the file extensions recognized as PML files
+func (p *Parser) Extensions() []string {
+	return append([]string(nil), p.extensions...)
+}
+
+// IsPMLFile checks if a file has one of the parser's PML extensions, plain or
+// gzip-compressed (e.g. .pml.gz)
+func (p *Parser) IsPMLFile(path string) bool {
+	return HasPMLExtension(path, p.extensions)
+}
+
+// IsPMLFile checks if a file is a PML file with one of DefaultExtensions, plain
+// (.pml) or gzip-compressed (.pml.gz)
 func IsPMLFile(path string) bool {
+	return HasPMLExtension(path, DefaultExtensions)
+}
+
+// HasPMLExtension checks if a file has one of exts, plain or gzip-compressed.
+// Files in .pml/ directories and generated files are never PML files.
+func HasPMLExtension(path string, exts []string) bool {
 	// Skip files in .pml/ directory
 	if strings.Contains(path, "/.pml/") || strings.Contains(path, "\\.pml\\") {
 		return false
 	}
-	return strings.HasSuffix(strings.ToLower(path), ".pml")
+	if IsGeneratedFile(path, exts) {
+		return false
+	}
+	lower := strings.TrimSuffix(strings.ToLower(path), GzipExt)
+	for _, ext := range exts {
+		if strings.HasSuffix(lower, ext) {
+			return true
+		}
+	}
+	return false
 }
 
 // isLiteral checks if a string represents a literal value (number, boolean, null)
@@ -0,0 +1,51 @@
+package parser
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/fireharp/pml/impl1/parser/directives"
+)
+
+// RegisterPlugin adds a directive such as ":shout" handled by an external
+// command instead of the LLM. Each of its blocks runs command with a
+// directives.SubprocessRequest as JSON on stdin and takes its result from the
+// directives.SubprocessResponse printed on stdout. Plugins must be registered
+// before files are processed.
+func (p *Parser) RegisterPlugin(name string, command ...string) error {
+	if !strings.HasPrefix(name, ":") {
+		name = ":" + name
+	}
+	if !directiveName.MatchString(name) {
+		return fmt.Errorf("invalid plugin directive name %q", name)
+	}
+	if isBuiltinDirective(name) {
+		return fmt.Errorf("plugin can't replace the built-in directive %s", name)
+	}
+	if len(command) == 0 || command[0] == "" {
+		return fmt.Errorf("plugin directive %s has no command", name)
+	}
+	p.directives.Register(directives.NewSubprocessDirective(name, command...))
+	return nil
+}
+
+// pluginDirective returns the plugin registered for the directive name
+func (p *Parser) pluginDirective(name string) (*directives.SubprocessDirective, bool) {
+	d, ok := p.directives.Get(name)
+	if !ok {
+		return nil, false
+	}
+	plugin, ok := d.(*directives.SubprocessDirective)
+	return plugin, ok
+}
+
+// runPlugin returns the result of a block of a plugin directive from its command
+func (p *Parser) runPlugin(ctx context.Context, plugin *directives.SubprocessDirective, block Block) (string, error) {
+	p.debugf("Running plugin %s for block at line %d\n", block.Type, block.Line)
+	result, err := plugin.Process(ctx, block.Content, block.Attributes)
+	if err != nil {
+		return "", fmt.Errorf("failed to process block: %w", err)
+	}
+	return result, nil
+}
@@ -0,0 +1,138 @@
+package parser
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fireharp/pml/impl1/parser/directives"
+)
+
+// TestPluginHelperProcess is the fake plugin run by the tests below: it shouts
+// the block content back, or fails on blocks asking it to
+func TestPluginHelperProcess(t *testing.T) {
+	if os.Getenv("PML_TEST_PLUGIN") != "1" {
+		return
+	}
+	err := directives.ServeSubprocess(os.Stdin, os.Stdout, func(req directives.SubprocessRequest) (string, error) {
+		text := strings.Join(req.Content, "\n")
+		if text == "fail" {
+			return "", errors.New("asked to fail")
+		}
+		return req.Directive + " " + req.Attributes["prefix"] + strings.ToUpper(text), nil
+	})
+	if err != nil {
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+// registerTestPlugin registers the test binary as the plugin for name
+func registerTestPlugin(t *testing.T, parser *Parser, name string) {
+	t.Helper()
+	t.Setenv("PML_TEST_PLUGIN", "1")
+	if err := parser.RegisterPlugin(name, os.Args[0], "-test.run=^TestPluginHelperProcess$"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestProcessFilePluginDirective tests that blocks of a plugin directive are
+// answered by its subprocess instead of the LLM
+func TestProcessFilePluginDirective(t *testing.T) {
+	tmpDir := t.TempDir()
+	srcFile := filepath.Join(tmpDir, "plugin.pml")
+	content := ":shout prefix=>>\nhello there\n:--\n:ask\nQuestion\n:--\n"
+	if err := os.WriteFile(srcFile, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var prompts []string
+	parser := NewParser(&mockLLM{
+		Delay: time.Millisecond,
+		answer: func(prompt string) string {
+			prompts = append(prompts, prompt)
+			return "Answer"
+		},
+	}, tmpDir, tmpDir, filepath.Join(tmpDir, "results"))
+	registerTestPlugin(t, parser, "shout")
+
+	if err := parser.ProcessFile(context.Background(), srcFile); err != nil {
+		t.Fatalf("ProcessFile() error = %v", err)
+	}
+	if len(prompts) != 1 || prompts[0] != "Question" {
+		t.Errorf("Expected only the :ask block to reach the LLM, got %q", prompts)
+	}
+
+	data, err := os.ReadFile(srcFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected two result links, got:\n%s", data)
+	}
+	link, ok := parseResultLink(lines[0])
+	if !ok {
+		t.Fatalf("Expected a result link, got %q", lines[0])
+	}
+	result, err := os.ReadFile(parser.ResolveResultLink(srcFile, link))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(result), ":shout >>HELLO THERE") {
+		t.Errorf("Expected the plugin's answer in the result file:\n%s", result)
+	}
+}
+
+// TestProcessFilePluginError tests that an error reported by a plugin fails its block
+func TestProcessFilePluginError(t *testing.T) {
+	tmpDir := t.TempDir()
+	srcFile := filepath.Join(tmpDir, "plugin.pml")
+	if err := os.WriteFile(srcFile, []byte(":shout\nfail\n:--\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	parser := NewParser(&mockLLM{Delay: time.Millisecond}, tmpDir, tmpDir, filepath.Join(tmpDir, "results"))
+	registerTestPlugin(t, parser, ":shout")
+
+	err := parser.ProcessFile(context.Background(), srcFile)
+	if err == nil || !strings.Contains(err.Error(), "asked to fail") {
+		t.Errorf("Expected the plugin's error, got %v", err)
+	}
+}
+
+// TestRegisterPlugin tests the names and commands RegisterPlugin accepts
+func TestRegisterPlugin(t *testing.T) {
+	tmpDir := t.TempDir()
+	parser := NewParser(&mockLLM{}, tmpDir, tmpDir, filepath.Join(tmpDir, "results"))
+
+	if err := parser.RegisterPlugin("ask", "echo"); err == nil {
+		t.Error("Expected an error replacing :ask")
+	}
+	if err := parser.RegisterPlugin(":bad name", "echo"); err == nil {
+		t.Error("Expected an error for an invalid name")
+	}
+	if err := parser.RegisterPlugin(":shout"); err == nil {
+		t.Error("Expected an error for a missing command")
+	}
+	if err := parser.RegisterPlugin("shout", "echo"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := parser.Directives().Get(":shout"); !ok {
+		t.Error("Expected :shout to be listed with the directives")
+	}
+
+	// Without the plugin, :shout is an unknown directive
+	other := NewParser(&mockLLM{}, tmpDir, tmpDir, filepath.Join(tmpDir, "results"))
+	if _, err := other.parseBlocks(":shout\ntext\n:--\n"); err == nil {
+		t.Error("Expected :shout to be unknown without the plugin")
+	}
+	blocks, err := parser.parseBlocks(":shout\ntext\n:--\n")
+	if err != nil || len(blocks) != 1 || blocks[0].Type != ":shout" {
+		t.Errorf("Expected a :shout block, got %v, %v", blocks, err)
+	}
+}
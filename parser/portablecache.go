@@ -0,0 +1,153 @@
+package parser
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// PortableCacheVersion is the version of the format written by ExportCache
+const PortableCacheVersion = 1
+
+// PortableCache is the format written by ExportCache: block results keyed by
+// block checksum, independent of the files and paths they came from, so a cache
+// can be shared between machines and merged
+type PortableCache struct {
+	Version int                      `json:"version"`
+	Blocks  map[string]PortableBlock `json:"blocks"`
+}
+
+// PortableBlock is a block result in a PortableCache
+type PortableBlock struct {
+	Result     string            `json:"result"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+	ModTime    time.Time         `json:"mod_time"`
+}
+
+// sharedCacheFile returns the path of the imported block results, next to the cache file
+func (p *Parser) sharedCacheFile() string {
+	return filepath.Join(filepath.Dir(p.cacheFile), "shared_cache.json")
+}
+
+// ExportCache writes every cached block result, including imported ones, to w
+// in the portable format read by ImportCache. A block cached for several files
+// is written once, with its newest result.
+func (p *Parser) ExportCache(w io.Writer) error {
+	export := PortableCache{Version: PortableCacheVersion, Blocks: make(map[string]PortableBlock)}
+	p.cacheMu.RLock()
+	for checksum, block := range p.sharedBlocks {
+		export.Blocks[checksum] = block
+	}
+	for _, entry := range p.cache {
+		for checksum, cached := range entry.Blocks {
+			addPortableBlock(export.Blocks, checksum, PortableBlock{
+				Result:     cached.Result,
+				Attributes: cached.Attributes,
+				ModTime:    cached.ModTime,
+			})
+		}
+	}
+	p.cacheMu.RUnlock()
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(export); err != nil {
+		return fmt.Errorf("failed to export cache: %w", err)
+	}
+	return nil
+}
+
+// ImportCache merges the block results exported by ExportCache from r into the
+// local cache. A block is then answered from the imported result when it isn't
+// cached for its own file, wherever the file is. The newer result of a block
+// wins; nothing already cached is removed.
+func (p *Parser) ImportCache(r io.Reader) error {
+	var imported PortableCache
+	if err := json.NewDecoder(r).Decode(&imported); err != nil {
+		return fmt.Errorf("failed to read exported cache: %w", err)
+	}
+	if imported.Version != PortableCacheVersion {
+		return fmt.Errorf("unsupported exported cache version %d (expected %d)", imported.Version, PortableCacheVersion)
+	}
+
+	return p.addSharedBlocks(imported.Blocks)
+}
+
+// addSharedBlocks merges blocks into the block results shared by all files and
+// saves them
+func (p *Parser) addSharedBlocks(blocks map[string]PortableBlock) error {
+	return p.withCacheLock(func() error {
+		// Keep blocks added by other processes since we loaded them
+		onDisk := p.readSharedCacheFile()
+
+		p.cacheMu.Lock()
+		for checksum, block := range onDisk {
+			addPortableBlock(p.sharedBlocks, checksum, block)
+		}
+		for checksum, block := range blocks {
+			addPortableBlock(p.sharedBlocks, checksum, block)
+		}
+		data, err := json.MarshalIndent(p.sharedBlocks, "", "  ")
+		p.cacheMu.Unlock()
+		if err != nil {
+			return fmt.Errorf("error marshaling shared cache: %w", err)
+		}
+		if err := writeFileAtomic(p.sharedCacheFile(), data); err != nil {
+			return fmt.Errorf("error writing shared cache: %w", err)
+		}
+		return nil
+	})
+}
+
+// loadSharedCache loads the imported block results. Like the cache, results
+// older than 24 hours are dropped.
+func (p *Parser) loadSharedCache() {
+	blocks := p.readSharedCacheFile()
+	p.cacheMu.Lock()
+	defer p.cacheMu.Unlock()
+	p.sharedBlocks = make(map[string]PortableBlock, len(blocks))
+	for checksum, block := range blocks {
+		if p.now().Sub(block.ModTime) <= 24*time.Hour {
+			p.sharedBlocks[checksum] = block
+		}
+	}
+}
+
+// readSharedCacheFile reads the imported block results on disk, returning nil
+// if they are missing or unreadable
+func (p *Parser) readSharedCacheFile() map[string]PortableBlock {
+	var blocks map[string]PortableBlock
+	if data, err := os.ReadFile(p.sharedCacheFile()); err == nil {
+		if err := json.Unmarshal(data, &blocks); err != nil {
+			p.debugf("Ignoring unreadable shared cache: %v\n", err)
+			blocks = nil
+		}
+	}
+	return blocks
+}
+
+// sharedResult returns the imported result of the block with checksum as a
+// cache entry without a result file, or nil if there is none or it is past the
+// block's ttl. The caller holds cacheMu.
+func (p *Parser) sharedResult(checksum string, attributes map[string]string) *BlockCache {
+	block, ok := p.sharedBlocks[checksum]
+	if !ok || p.expired(attributes, block.ModTime) {
+		return nil
+	}
+	return &BlockCache{
+		Checksum:   checksum,
+		Result:     block.Result,
+		Attributes: block.Attributes,
+		ModTime:    block.ModTime,
+	}
+}
+
+// addPortableBlock adds block to blocks unless a newer result for checksum is there
+func addPortableBlock(blocks map[string]PortableBlock, checksum string, block PortableBlock) {
+	if existing, ok := blocks[checksum]; !ok || block.ModTime.After(existing.ModTime) {
+		blocks[checksum] = block
+	}
+}
@@ -0,0 +1,85 @@
+package parser
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestExportImportCache tests that blocks cached by one parser are answered
+// from the exported cache by another, without LLM calls
+func TestExportImportCache(t *testing.T) {
+	writeFile := func(dir, name, content string) string {
+		t.Helper()
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	// A teammate's machine answers two blocks
+	teamDir := t.TempDir()
+	teamFile := writeFile(teamDir, "notes.pml", ":ask\nWhat is PML?\n:--\n\n:ask\nWhat is Go?\n:--\n")
+	team := NewParser(&mockLLM{response: "Shared answer", Delay: time.Millisecond}, teamDir, teamDir, filepath.Join(teamDir, "results"))
+	if err := team.ProcessFile(context.Background(), teamFile); err != nil {
+		t.Fatalf("ProcessFile() error = %v", err)
+	}
+	var exported bytes.Buffer
+	if err := team.ExportCache(&exported); err != nil {
+		t.Fatalf("ExportCache() error = %v", err)
+	}
+
+	// Another workspace shares one block, in a file with a different name
+	localDir := t.TempDir()
+	var calls int32
+	llm := &mockLLM{response: "Local answer", Delay: time.Millisecond, callback: func() { atomic.AddInt32(&calls, 1) }}
+	local := NewParser(llm, localDir, localDir, filepath.Join(localDir, "results"))
+	if err := local.ImportCache(bytes.NewReader(exported.Bytes())); err != nil {
+		t.Fatalf("ImportCache() error = %v", err)
+	}
+	localFile := writeFile(localDir, "other.pml", ":ask\nWhat is PML?\n:--\n\n:ask\nWhat is new?\n:--\n")
+	if err := local.ProcessFile(context.Background(), localFile); err != nil {
+		t.Fatalf("ProcessFile() error = %v", err)
+	}
+	if got := atomic.LoadInt32(&calls); got != 1 {
+		t.Errorf("Expected only the new block to reach the LLM, got %d calls", got)
+	}
+	results, err := os.ReadDir(filepath.Join(localDir, ".pml", "results"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var answers []string
+	for _, f := range results {
+		data, err := os.ReadFile(filepath.Join(localDir, ".pml", "results", f.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		answers = append(answers, string(data))
+	}
+	if joined := strings.Join(answers, "\n"); !strings.Contains(joined, "Shared answer") || !strings.Contains(joined, "Local answer") {
+		t.Errorf("Expected the imported and the new answer in the results, got:\n%s", joined)
+	}
+
+	// Imports are kept across runs and merged with later ones
+	atomic.StoreInt32(&calls, 0)
+	if err := NewParser(llm, localDir, localDir, filepath.Join(localDir, "results")).ImportCache(strings.NewReader(`{"version": 1, "blocks": {}}`)); err != nil {
+		t.Fatalf("ImportCache() error = %v", err)
+	}
+	next := NewParser(llm, localDir, localDir, filepath.Join(localDir, "results"))
+	if err := next.ProcessFile(context.Background(), writeFile(localDir, "again.pml", ":ask\nWhat is Go?\n:--\n")); err != nil {
+		t.Fatalf("ProcessFile() error = %v", err)
+	}
+	if got := atomic.LoadInt32(&calls); got != 0 {
+		t.Errorf("Expected the imported block to be answered from the cache, got %d calls", got)
+	}
+
+	if err := next.ImportCache(strings.NewReader(`{"version": 99, "blocks": {}}`)); err == nil {
+		t.Error("Expected an error for an unsupported version")
+	}
+}
@@ -0,0 +1,67 @@
+package parser
+
+import (
+	"fmt"
+	"strings"
+)
+
+// BlockPreview is the prompt a block would send to the LLM
+type BlockPreview struct {
+	Index   int
+	Type    string
+	Model   string // Model override, empty for the default model
+	Prompt  string
+	Tokens  int  // Prompt size as counted by the tokenizer or estimate
+	Cached  bool // The block has a cached result and would not be sent
+	Skipped bool // The block is filtered out by tags
+}
+
+// SummaryAnswersPlaceholder stands in for the answers a summary block aggregates,
+// which aren't known until the blocks before it have run
+const SummaryAnswersPlaceholder = "<answers of the preceding blocks>"
+
+// PreviewPrompts returns the fully resolved prompt of each block in the file at
+// path, exactly as ProcessFile would send it, without calling the LLM
+func (p *Parser) PreviewPrompts(path string) ([]BlockPreview, error) {
+	content, err := readSource(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file: %w", err)
+	}
+
+	blocks, _, includeTags, checksum, err := p.prepareBlocks(path, string(content))
+	if err != nil {
+		return nil, err
+	}
+
+	p.cacheMu.RLock()
+	entry, ok := p.cache[path]
+	p.cacheMu.RUnlock()
+	fileChanged := !ok || entry.Checksum != checksum
+
+	previews := make([]BlockPreview, 0, len(blocks))
+	for i, block := range blocks {
+		checksum := p.calculateBlockChecksum(block)
+		if ok && fileChanged && p.refinePrior {
+			block.Response = priorResult(entry, i, checksum)
+		}
+
+		var prompt string
+		if block.Type == DirectiveSummary {
+			prompt = strings.Join(append(append([]string{}, block.Content...), SummaryAnswersPlaceholder), "\n")
+		} else {
+			prompt = p.blockPrompt(block)
+		}
+
+		_, cached := entry.Blocks[checksum]
+		previews = append(previews, BlockPreview{
+			Index:   i,
+			Type:    block.Type,
+			Model:   block.Model,
+			Prompt:  prompt,
+			Tokens:  p.countTokens(block.Model, prompt),
+			Cached:  cached && !p.forceProcess,
+			Skipped: !p.matchesTagFilter(block, includeTags),
+		})
+	}
+	return previews, nil
+}
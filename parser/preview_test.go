@@ -0,0 +1,84 @@
+package parser
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPreviewPrompts(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "pml-preview-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	t.Setenv("PML_TEST_CUSTOMER", "Acme Corp")
+	content := `:ask model=gpt-4o
+Draft a renewal email for ${PML_TEST_CUSTOMER}.
+:--
+
+:summary
+Summarize:
+:--
+`
+	srcFile := filepath.Join(tmpDir, "preview.pml")
+	if err := os.WriteFile(srcFile, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var calls int32
+	parser := NewParser(&mockLLM{
+		response: "Answer",
+		Delay:    10 * time.Millisecond,
+		callback: func() { atomic.AddInt32(&calls, 1) },
+	}, tmpDir, filepath.Join(tmpDir, "compiled"), filepath.Join(tmpDir, "results"))
+	parser.SetEnvInterpolation(true)
+
+	previews, err := parser.PreviewPrompts(srcFile)
+	if err != nil {
+		t.Fatalf("PreviewPrompts failed: %v", err)
+	}
+	if got := atomic.LoadInt32(&calls); got != 0 {
+		t.Errorf("Expected no LLM calls, got %d", got)
+	}
+	if len(previews) != 2 {
+		t.Fatalf("Expected 2 previews, got %d", len(previews))
+	}
+
+	ask := previews[0]
+	if ask.Prompt != "Draft a renewal email for Acme Corp." {
+		t.Errorf("Expected the resolved prompt, got %q", ask.Prompt)
+	}
+	if ask.Model != "gpt-4o" || ask.Tokens == 0 || ask.Cached || ask.Skipped {
+		t.Errorf("Unexpected preview: %+v", ask)
+	}
+	if !strings.Contains(previews[1].Prompt, SummaryAnswersPlaceholder) {
+		t.Errorf("Expected the summary preview to mark where answers go, got %q", previews[1].Prompt)
+	}
+
+	// Blocks with a cached result are marked as not sent
+	if err := parser.ProcessFile(context.Background(), srcFile); err != nil {
+		t.Fatalf("ProcessFile failed: %v", err)
+	}
+	if err := os.WriteFile(srcFile, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	previews, err = parser.PreviewPrompts(srcFile)
+	if err != nil {
+		t.Fatalf("PreviewPrompts failed: %v", err)
+	}
+	if !previews[0].Cached {
+		t.Error("Expected the processed block to be previewed as cached")
+	}
+
+	// Unset variables are reported
+	os.Unsetenv("PML_TEST_CUSTOMER")
+	if _, err := parser.PreviewPrompts(srcFile); err == nil || !strings.Contains(err.Error(), "PML_TEST_CUSTOMER") {
+		t.Errorf("Expected an error naming the unset variable, got %v", err)
+	}
+}
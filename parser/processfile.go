@@ -3,16 +3,19 @@ package parser
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
 	"strings"
 	"sync"
 	"time"
+
+	"github.com/fireharp/pml/impl1/parser/directives"
 )
 
 // ProcessFile processes a single PML file (parse, generate .py, run blocks in parallel)
-func (p *Parser) ProcessFile(ctx context.Context, path string) error {
+func (p *Parser) ProcessFile(ctx context.Context, path string) (err error) {
 	if ctx == nil {
 		ctx = context.Background()
 	}
@@ -21,6 +24,11 @@ func (p *Parser) ProcessFile(ctx context.Context, path string) error {
 	if strings.Contains(path, ".pml/") {
 		return nil
 	}
+	// Never process output written beside a PML file, such as its .py translation
+	if IsGeneratedFile(path, p.extensions) {
+		p.debugf("Skipping generated file %s\n", path)
+		return nil
+	}
 
 	// Check if path is a directory
 	info, err := os.Stat(path)
@@ -31,36 +39,89 @@ func (p *Parser) ProcessFile(ctx context.Context, path string) error {
 		return nil
 	}
 
+	// CancelFile stops this file without affecting the others
+	ctx, finish := p.startFileRun(ctx, path)
+	defer finish()
+
+	// The file's results are indexed together, even if it fails part way
+	defer p.flushIndex(path)
+
+	// Time the file for Stats and the SLA
+	start := time.Now()
+	defer func() { err = p.recordFileStat(path, time.Since(start), err) }()
+
+	// Answers past their ttl are asked again before the other blocks
+	if p.diffOutput == nil {
+		if err := p.refreshExpiredResults(ctx, path); err != nil {
+			return err
+		}
+	}
+
+	// Very large files are processed without reading them into memory
+	if p.streams(info.Size()) {
+		if err := p.processFileStreaming(ctx, path); err != errNotStreamable {
+			return err
+		}
+	}
+
 	// Read file content with UTF-8 encoding
-	content, err := os.ReadFile(path)
+	content, err := p.loadSource(path)
 	if err != nil {
 		return fmt.Errorf("failed to read file: %w", err)
 	}
 
-	// Calculate file checksum for cache
-	fileChecksum := p.calculateChecksum(string(content))
-
-	// Parse blocks from content
-	blocks, err := p.parseBlocks(string(content))
+	// Parse blocks and resolve everything that shapes their prompts, along
+	// with the file checksum for the cache
+	blocks, settings, includeTags, fileChecksum, err := p.prepareBlocks(path, string(content))
 	if err != nil {
-		return fmt.Errorf("failed to parse blocks: %w", err)
+		return err
+	}
+	if err := p.checkBlockCount(len(blocks)); err != nil {
+		return err
+	}
+	if p.diffOutput == nil {
+		p.writePythonFile(path, string(content), ownBlocks(blocks))
+	}
+	if settings.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, settings.Timeout)
+		defer cancel()
 	}
 
 	// Create results directory if it doesn't exist
-	resultsDir := filepath.Join(filepath.Dir(path), ".pml", "results")
-	if err := os.MkdirAll(resultsDir, 0755); err != nil {
-		return fmt.Errorf("failed to create results directory: %w", err)
+	resultsDir := p.resultsDirFor(path)
+	if p.diffOutput == nil {
+		if err := os.MkdirAll(resultsDir, 0755); err != nil {
+			return fmt.Errorf("failed to create results directory: %w", err)
+		}
+	}
+
+	// Results already linked from the file
+	linked := make(map[string]bool)
+	for _, line := range strings.Split(string(content), "\n") {
+		addResultLink(linked, line)
 	}
 
 	// Initialize or update cache entry for the file
 	p.cacheMu.Lock()
 	entry, ok := p.cache[path]
 	if !ok || entry.Checksum != fileChecksum {
+		if ok && p.refinePrior {
+			// Changed blocks refine the answer previously given at the same position
+			for i := range blocks {
+				blocks[i].Response = priorResult(entry, i, p.calculateBlockChecksum(blocks[i]))
+			}
+		}
+		present := make(map[string]bool, len(blocks))
+		for _, block := range blocks {
+			present[p.calculateBlockChecksum(block)] = true
+		}
 		entry = CacheEntry{
 			Checksum: fileChecksum,
-			ModTime:  time.Now(),
-			Blocks:   make(map[string]BlockCache),
+			ModTime:  p.now(),
+			Blocks:   keptResults(entry, present, linked),
 		}
+		p.cacheDirty = true
 	}
 	p.cache[path] = entry
 	p.cacheMu.Unlock()
@@ -69,38 +130,79 @@ func (p *Parser) ProcessFile(ctx context.Context, path string) error {
 	var wg sync.WaitGroup
 	errChan := make(chan error, len(blocks))
 	resultFiles := make([]string, len(blocks))
+	answers := make([]string, len(blocks))
+	blockErrs := make([]error, len(blocks)) // Failures marked in the file
 	var resultsMu sync.Mutex
 
-	// Create a semaphore to limit concurrent goroutines
-	semaphore := make(chan struct{}, 10) // Process up to 10 blocks concurrently
+	// Limit concurrent goroutines
+	concurrency := 10 // Process up to 10 blocks concurrently unless configured
+	if settings.Concurrency > 0 {
+		concurrency = settings.Concurrency
+	}
+	slots := p.newSlots(concurrency)
+
+	// Name result files up front, in block order, so names don't depend on
+	// which block finishes first
+	selected := p.selectBlocks(path, string(content), blocks, includeTags)
+	names := make([]string, len(blocks))
+	for i := range blocks {
+		if selected[i] {
+			names[i] = p.generateUniqueResultName(filepath.Base(path), i, blocks[i].Type, resultsDir)
+		}
+	}
+
+	// Completed results are reported in block order
+	stream := p.newResultStream(path, blocks)
 
 	// Process blocks in order to maintain consistent result file names
 	for i := range blocks {
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		default:
-			wg.Add(1)
-			go func(i int) {
-				defer wg.Done()
-
-				// Acquire semaphore
-				semaphore <- struct{}{}
-				defer func() { <-semaphore }()
-
-				// Process block using processBlock function
-				resultFile, err := p.processBlock(ctx, blocks[i], i, path, filepath.Dir(path))
-				if err != nil {
-					errChan <- fmt.Errorf("failed to process block %d: %w", i, err)
+		if !selected[i] {
+			// Leave filtered-out blocks as they are
+			stream.skip(i)
+			continue
+		}
+		if blocks[i].Type == DirectiveSummary {
+			// Summaries run after the blocks they aggregate
+			continue
+		}
+		// Acquire a slot before starting the goroutine, so a file with many
+		// blocks doesn't start a goroutine for each of them at once
+		if err := slots.Acquire(ctx); err != nil {
+			if errors.Is(err, context.DeadlineExceeded) {
+				// Past the deadline, keep the blocks already started
+				break
+			}
+			// Blocks already started stop with ctx; wait for them so nothing
+			// writes for the file once it returns
+			wg.Wait()
+			return err
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			slot := &blockSlot{slots: slots}
+			defer slot.release()
+
+			// Process block using processBlock function
+			resultFile, answer, err := p.processBlock(withBlockSlot(ctx, slot), blocks[i], i, path, names[i], p.forceProcess)
+			stream.complete(i, answer, err)
+			if err != nil {
+				if p.marksFailedBlock(ctx, err) {
+					resultsMu.Lock()
+					blockErrs[i] = err
+					resultsMu.Unlock()
 					return
 				}
+				errChan <- fmt.Errorf("failed to process block %d: %w", i, err)
+				return
+			}
 
-				// Store result file
-				resultsMu.Lock()
-				resultFiles[i] = resultFile
-				resultsMu.Unlock()
-			}(i)
-		}
+			// Store result file
+			resultsMu.Lock()
+			resultFiles[i] = resultFile
+			answers[i] = answer
+			resultsMu.Unlock()
+		}(i)
 	}
 
 	// Wait for all blocks to be processed
@@ -114,129 +216,558 @@ func (p *Parser) ProcessFile(ctx context.Context, path string) error {
 	// Wait for completion or cancellation
 	select {
 	case <-ctx.Done():
-		return ctx.Err()
+		// Blocks stop with ctx; wait for them so nothing writes for the file
+		// once it returns
+		<-done
+		if !errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return ctx.Err()
+		}
+		// The results completed before the deadline are kept
 	case <-done:
-		// Check for errors
-		var errs []error
-		for err := range errChan {
-			errs = append(errs, err)
+	}
+
+	// Check for errors. stoppedErr is set when processing stopped early, but
+	// the results completed so far are still written.
+	var stoppedErr error
+	var errs []error
+	for err := range errChan {
+		if ctx.Err() != nil && errors.Is(err, context.DeadlineExceeded) {
+			continue // Blocks cut short by the deadline are left in the file
 		}
-		if len(errs) > 0 {
-			return fmt.Errorf("multiple errors: %v", errs)
+		errs = append(errs, err)
+	}
+	if len(errs) > 0 {
+		err := fmt.Errorf("multiple errors: %w", errors.Join(errs...))
+		if !errors.Is(err, ErrBudgetExceeded) {
+			return err
 		}
+		// Keep the results completed before the budget ran out
+		stoppedErr = err
+	}
+	if err := ctx.Err(); err != nil {
+		stoppedErr = errors.Join(stoppedErr, err)
 	}
 
+	// Process summary blocks in order, each aggregating the results before it
+	for i := range blocks {
+		if stoppedErr != nil {
+			break
+		}
+		if blocks[i].Type != DirectiveSummary || !selected[i] {
+			continue
+		}
+		resultFile, answer, err := p.processBlock(ctx, summaryInput(blocks[i], answers[:i]), i, path, names[i], p.forceProcess)
+		stream.complete(i, answer, err)
+		if err != nil {
+			if p.marksFailedBlock(ctx, err) {
+				blockErrs[i] = err
+				continue
+			}
+			return fmt.Errorf("failed to process block %d: %w", i, err)
+		}
+		resultFiles[i] = resultFile
+		answers[i] = answer
+	}
+
+	p.checkExpectations(path, blocks, resultFiles, answers)
+	p.checkLinkedExpectations(path, linked)
+
+	// Short labels shown next to each result link
+	labels := p.linkSummaries(ctx, path, answers, resultFiles)
+
 	// Update content with results
-	newContent := p.updateContentWithResults(blocks, string(content), resultFiles, resultsDir, filepath.Base(path))
+	newContent := p.updateContentWithResults(blocks, string(content), resultFiles, blockErrs, labels, resultsDir, filepath.Base(path))
+
+	// Failed blocks are reported once the file is written with their markers
+	failedErr := stoppedErr
+	if failed := blockErrors(blockErrs); failed != nil {
+		failedErr = errors.Join(stoppedErr, failed)
+	}
+
+	// In a dry run, show the change instead of making it
+	if p.diffOutput != nil {
+		if err := p.writeDiff(path, string(content), p.formatSource(newContent)); err != nil {
+			return fmt.Errorf("failed to write diff: %w", err)
+		}
+		return failedErr
+	}
 
 	// Write updated content back to file with UTF-8 encoding
-	if err := os.WriteFile(path, []byte(newContent), 0644); err != nil {
+	if err := p.saveSource(path, []byte(p.formatSource(newContent))); err != nil {
 		return fmt.Errorf("failed to write updated file: %w", err)
 	}
 
-	// Save cache to disk
-	if err := p.saveCache(); err != nil {
-		p.debugf("Warning: failed to save cache: %v\n", err)
+	// Save cache to disk; an unchanged file, e.g. on repeated watcher events,
+	// leaves the cache file alone
+	if p.cacheChanged() {
+		if err := p.saveCache(); err != nil {
+			p.debugf("Warning: failed to save cache: %v\n", err)
+		}
 	}
 
-	return nil
+	return failedErr
 }
 
-// processBlock processes a single block and returns its result
-func (p *Parser) processBlock(ctx context.Context, block Block, index int, plmPath string, localResultsDir string) (string, error) {
+// keptResults returns the cached results of a changed file that are still
+// needed. Results are keyed by block checksum, so blocks that were only moved
+// keep theirs; the results of blocks no longer in the file are dropped. A block
+// replaced by its result link is still in the file, so rewriting the file with
+// links doesn't empty its cache entry. present holds the checksums of the
+// file's blocks and linked the result files it links to.
+func keptResults(entry CacheEntry, present, linked map[string]bool) map[string]BlockCache {
+	kept := make(map[string]BlockCache)
+	for checksum, cached := range entry.Blocks {
+		if present[checksum] || (cached.ResultFile != "" && linked[cached.ResultFile]) {
+			kept[checksum] = cached
+		}
+	}
+	return kept
+}
+
+// addResultLink adds the result file linked from line, if any, to linked
+func addResultLink(linked map[string]bool, line string) {
+	if link, ok := parseResultLink(line); ok {
+		linked[strings.TrimPrefix(link, "r/")] = true
+	}
+}
+
+// prepareBlocks parses a file's blocks, splicing in those of the files it
+// includes, and resolves everything that shapes their prompts before anything
+// is checksummed: environment variables, templates, attached images and sidecar
+// settings. It also returns the file's settings, the include tag filter in
+// effect for it and its checksum, which covers the files it includes.
+func (p *Parser) prepareBlocks(path, content string) ([]Block, fileSettings, []string, string, error) {
+	blocks, included, err := p.parseIncluding(path, content, includeChain(path))
+	if err != nil {
+		return nil, fileSettings{}, nil, "", fmt.Errorf("failed to parse blocks: %w", err)
+	}
+	checksum := includingChecksum(content, included)
+
+	if err := p.expandEnv(blocks); err != nil {
+		return nil, fileSettings{}, nil, "", err
+	}
+	if err := p.renderTemplates(blocks); err != nil {
+		return nil, fileSettings{}, nil, "", err
+	}
+
+	// Apply directory configs (.pml.toml) and the file's foo.pml.toml sidecar
+	settings, err := p.loadSettings(path)
+	if err != nil {
+		return nil, fileSettings{}, nil, "", fmt.Errorf("failed to load settings for %s: %w", filepath.Base(path), err)
+	}
+	for i := range blocks {
+		if err := attachImage(&blocks[i], i, blockDir(path, blocks[i])); err != nil {
+			return nil, fileSettings{}, nil, "", err
+		}
+		if _, err := blockTTL(blocks[i].Attributes); err != nil {
+			return nil, fileSettings{}, nil, "", fmt.Errorf("block %d: %w", i, err)
+		}
+		if _, _, err := p.bestOf(blocks[i]); err != nil {
+			return nil, fileSettings{}, nil, "", fmt.Errorf("block %d: %w", i, err)
+		}
+	}
+	if settings.Model != "" {
+		for i := range blocks {
+			if blocks[i].Model == "" {
+				blocks[i].Model = settings.Model
+			}
+		}
+	}
+	includeTags := p.includeTags
+	if settings.Tags != nil {
+		includeTags = settings.Tags
+	}
+	return blocks, settings, includeTags, checksum, nil
+}
+
+// summaryInput returns a copy of a :summary block whose content is followed by
+// the results of the preceding blocks, so the checksum changes with its inputs
+func summaryInput(block Block, answers []string) Block {
+	content := append([]string{}, block.Content...)
+	for _, answer := range answers {
+		if answer != "" {
+			content = append(content, answer)
+		}
+	}
+	block.Content = content
+	return block
+}
+
+// processBlock processes a single block and returns its result file and answer.
+// resultFile names the result file; if empty a name is generated. With force,
+// the block is answered again even if its result is cached.
+func (p *Parser) processBlock(ctx context.Context, block Block, index int, plmPath string, resultFile string, force bool) (string, string, error) {
 	if err := ctx.Err(); err != nil {
-		return "", err
+		return "", "", err
 	}
 
 	// Calculate block checksum for caching
 	blockChecksum := p.calculateBlockChecksum(block)
 
-	// Check cache for this block using checksum as key
-	if !p.forceProcess {
-		p.cacheMu.Lock()
-		entry, ok := p.cache[plmPath]
-		if ok {
-			if blockCache, ok := entry.Blocks[blockChecksum]; ok {
-				p.cacheMu.Unlock()
-				return blockCache.Result, nil
-			}
+	// Check cache for this block using checksum as key; locked results are
+	// used even when processing is forced or past their ttl. Blocks not cached
+	// for this file may have a result imported with ImportCache. Inputs vary
+	// from run to run, so :input blocks are never cached.
+	cacheable := block.Type != DirectiveInput
+	var cached, previous *BlockCache
+	p.cacheMu.Lock()
+	if blockCache, ok := p.cache[plmPath].Blocks[blockChecksum]; ok && cacheable {
+		previous = &blockCache
+		if blockCache.Locked || block.Attributes["locked"] == "true" ||
+			(!force && !p.expired(block.Attributes, blockCache.ModTime)) {
+			cached = &blockCache
+		}
+	} else if !force && cacheable {
+		cached = p.sharedResult(blockChecksum, block.Attributes)
+	}
+	p.cacheMu.Unlock()
+	if cached != nil && cached.ResultFile != "" {
+		if _, err := os.Stat(p.ResolveResultLink(plmPath, cached.ResultFile)); err == nil {
+			return cached.ResultFile, cached.Result, nil
 		}
-		p.cacheMu.Unlock()
 	}
 
 	// Process the block based on its type
-	var result string
+	var result, language string
+	var alternatives, warnings []string
+	approved := true
 	var err error
-	switch block.Type {
-	case DirectiveAsk, DirectiveDo:
-		result, err = p.llm.Ask(ctx, strings.Join(block.Content, "\n"))
-	default:
-		return "", fmt.Errorf("unknown block type: %s", block.Type)
+	if cached != nil {
+		// The result file is gone, or the entry predates result_file; rewrite it from the cache
+		result = cached.Result
+	} else if p.strictCache && cacheable {
+		return "", "", fmt.Errorf("%w for block %d (checksum %s)", ErrCacheMiss, index, blockChecksum)
+	} else if approved, err = p.approveBlock(block); err != nil {
+		// Side-effecting blocks need approval before they run
+		return "", "", fmt.Errorf("failed to approve block: %w", err)
+	} else if !approved {
+		result = ResultNotApproved
+	} else if block.Type == DirectiveInput && p.inputFunc == nil {
+		// Without a result file the block stays in the file, to be asked again
+		// on a later run
+		return "", ResultAwaitingInput, nil
+	} else if block.Type == DirectiveDo && p.executeDo {
+		if result, warnings, err = p.runDoBlock(ctx, block, index, plmPath); err != nil {
+			return "", "", err
+		}
+	} else if result, alternatives, err = p.runBlock(ctx, block); err != nil {
+		return "", "", err
+	} else {
+		result, language = p.unfence(result)
 	}
 
-	if err != nil {
-		return "", fmt.Errorf("failed to process block: %w", err)
+	// An answer asked again and identical to the previous one keeps its result
+	// file and link, so nothing changes on disk
+	if cached == nil && approved {
+		if link, ok := p.unchangedResult(plmPath, block, previous, result); ok {
+			if err := p.sendResult(ctx, BlockResult{FilePath: plmPath, BlockIdx: index, Block: block, Result: result, Warnings: warnings}); err != nil {
+				return "", "", err
+			}
+			return link, result, nil
+		}
 	}
 
 	// Create results directory if it doesn't exist
-	resultsDir := filepath.Join(localResultsDir, ".pml", "results")
-	if err := os.MkdirAll(resultsDir, 0755); err != nil {
-		return "", fmt.Errorf("failed to create results directory: %w", err)
+	resultsDir := p.resultsDirFor(plmPath)
+	if p.diffOutput == nil {
+		if err := os.MkdirAll(resultsDir, 0755); err != nil {
+			return "", "", fmt.Errorf("failed to create results directory: %w", err)
+		}
 	}
 
-	// Generate a unique result file name
-	resultFile := p.generateUniqueResultName(filepath.Base(plmPath), index, block.Type, resultsDir)
+	// Generate a unique result file name unless one was assigned
+	if resultFile == "" {
+		resultFile = p.generateUniqueResultName(filepath.Base(plmPath), index, block.Type, resultsDir)
+	}
+
+	// A dry run only needs the link the result would get
+	if p.diffOutput != nil {
+		return p.resultLinkPath(plmPath, resultFile), result, nil
+	}
 
 	// Create summary for the result
 	summary := fmt.Sprintf("Result for block %d from %s", index, filepath.Base(plmPath))
 
 	// Write the result to a file with proper format
-	err = p.writeResult(block, result, resultFile, resultsDir, summary)
+	source := ResultSource{
+		SourceFile:    plmPath,
+		BlockIndex:    index,
+		BlockChecksum: blockChecksum,
+		BlockLine:     block.Line,
+	}
+	err = p.writeResult(block, result, alternatives, warnings, resultFile, resultsDir, summary, source, language)
 	if err != nil {
-		return "", fmt.Errorf("failed to write result: %w", err)
+		return "", "", fmt.Errorf("failed to write result: %w", err)
 	}
 
-	// Update cache entry for this block
-	p.cacheMu.Lock()
-	entry, ok := p.cache[plmPath]
-	if !ok {
-		entry = CacheEntry{
-			Blocks: make(map[string]BlockCache),
+	// Hand new answers to the result sink before they are cached
+	if cached == nil && approved {
+		if err := p.sendResult(ctx, BlockResult{FilePath: plmPath, BlockIdx: index, Block: block, Result: result, Warnings: warnings}); err != nil {
+			return "", "", err
 		}
 	}
-	entry.Blocks[blockChecksum] = BlockCache{
-		Checksum: blockChecksum,
-		Result:   result,
-		ModTime:  time.Now(),
+
+	// Record the result in the workspace index once the file is done; a stale
+	// index can be rebuilt
+	p.queueIndexEntry(IndexEntry{
+		SourceFile:    plmPath,
+		BlockIndex:    index,
+		BlockChecksum: blockChecksum,
+		BlockLine:     block.Line,
+		ResultFile:    filepath.Join(resultsDir, resultFile),
+		Summary:       summary,
+		Timestamp:     p.now(),
+	})
+
+	// Update cache entry for this block; skipped blocks are not cached so
+	// they run once approved
+	link := p.resultLinkPath(plmPath, resultFile)
+	if approved && cacheable {
+		p.cacheMu.Lock()
+		entry, ok := p.cache[plmPath]
+		if !ok {
+			entry = CacheEntry{
+				Blocks: make(map[string]BlockCache),
+			}
+		}
+		entry.Blocks[blockChecksum] = BlockCache{
+			Checksum:   blockChecksum,
+			Result:     p.redact(result), // Like result files, the cache never holds secrets
+			ResultFile: link,
+			Index:      index,
+			Line:       block.Line,
+			Attributes: block.Attributes,
+			Locked:     (cached != nil && cached.Locked) || block.Attributes["locked"] == "true",
+			ModTime:    p.now(),
+		}
+		if cached != nil {
+			// The result is unchanged, so is its link label
+			blockCache := entry.Blocks[blockChecksum]
+			blockCache.Summary = cached.Summary
+			entry.Blocks[blockChecksum] = blockCache
+		}
+		p.cache[plmPath] = entry
+		p.cacheDirty = true
+		p.cacheMu.Unlock()
 	}
-	p.cache[plmPath] = entry
-	p.cacheMu.Unlock()
 
-	return resultFile, nil
+	return link, result, nil
+}
+
+// blockPrompt builds the prompt sent for a block. When refining is enabled and the
+// block has a prior answer, the model is asked to revise it rather than start fresh.
+func (p *Parser) blockPrompt(block Block) string {
+	prompt := blockText(block)
+	if !p.refinePrior || block.Response == "" {
+		return prompt
+	}
+	return fmt.Sprintf("%s\n\nPrevious answer:\n%s\n\nRevise the previous answer given the updated question.", prompt, block.Response)
 }
 
-// writeResult writes a block's result to a file
-func (p *Parser) writeResult(block Block, result string, resultFile string, localResultsDir string, summary string) error {
+// priorResult returns the most recent cached result for the block at index whose
+// checksum differs from checksum, or "" if there is none
+func priorResult(entry CacheEntry, index int, checksum string) string {
+	var prior BlockCache
+	for _, cached := range entry.Blocks {
+		if cached.Index != index || cached.Checksum == checksum {
+			continue
+		}
+		if cached.ModTime.After(prior.ModTime) {
+			prior = cached
+		}
+	}
+	return prior.Result
+}
+
+// approveBlock consults the approval function for side-effecting directives.
+// Other blocks, and all blocks when no approval function is set, are approved.
+func (p *Parser) approveBlock(block Block) (bool, error) {
+	if p.approvalFunc == nil || block.Type != DirectiveDo {
+		return true, nil
+	}
+	return p.approvalFunc(block)
+}
+
+// runBlock sends a block's prompt to the LLM, within the prompt size and token
+// budget limits. For a best-of-N block it also returns all the answers the
+// result was chosen from.
+func (p *Parser) runBlock(ctx context.Context, block Block) (string, []string, error) {
+	var prompt string
+	switch block.Type {
+	case DirectiveAsk:
+		prompt = p.blockPrompt(block)
+	case DirectiveSummary, DirectiveSummarize:
+		prompt = blockText(block)
+	case DirectiveEmbed:
+		result, err := p.embed(ctx, block)
+		return result, nil, err
+	case DirectiveInput:
+		result, err := p.readInput(block)
+		return result, nil, err
+	default:
+		if plugin, ok := p.pluginDirective(block.Type); ok {
+			result, err := p.runPlugin(ctx, plugin, block)
+			return result, nil, err
+		}
+		if processor, ok := p.directiveProcessor(block.Type); ok {
+			result, err := processor.Process(ctx, block.Content)
+			if err != nil {
+				return "", nil, fmt.Errorf("failed to process block: %w", err)
+			}
+			return result, nil, nil
+		}
+		return "", nil, fmt.Errorf("unknown block type: %s", block.Type)
+	}
+
+	if err := p.checkPromptSize(block.Model, prompt); err != nil {
+		return "", nil, err
+	}
+
+	if block.Type == DirectiveAsk {
+		n, reducer, err := p.bestOf(block)
+		if err != nil {
+			return "", nil, err
+		}
+		if n > 1 {
+			result, answers, err := p.askBestOf(ctx, block.Model, p.systemPrompts[block.Type], prompt, block.Image, n, reducer)
+			if err != nil {
+				return "", nil, fmt.Errorf("failed to process block: %w", err)
+			}
+			return result, answers, nil
+		}
+	}
+
+	// Reserve the prompt's tokens before sending so concurrent blocks can't overspend
+	if err := p.reserveTokens(block.Model, prompt); err != nil {
+		return "", nil, err
+	}
+
+	var result string
+	var err error
+	if block.Type == DirectiveSummary || block.Type == DirectiveSummarize {
+		result, err = p.llm.Summarize(ctx, prompt)
+	} else {
+		result, err = p.ask(ctx, block.Model, p.systemPrompts[block.Type], prompt, block.Image)
+	}
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to process block: %w", err)
+	}
+	p.recordTokens(block.Model, result)
+	return result, nil, nil
+}
+
+// directiveProcessor returns the registered directive named name if it
+// produces block results itself
+func (p *Parser) directiveProcessor(name string) (directives.Processor, bool) {
+	if p.directives == nil {
+		return nil, false
+	}
+	d, ok := p.directives.Get(name)
+	if !ok {
+		return nil, false
+	}
+	processor, ok := d.(directives.Processor)
+	return processor, ok
+}
+
+// ask sends a prompt, with the system prompt and the block's image if any, to
+// the LLM, honoring the block's model override and the per-model concurrency
+// limit. Clients that can't send a system prompt get it ahead of the prompt.
+func (p *Parser) ask(ctx context.Context, model, system, prompt string, image *Image) (string, error) {
+	if sem, ok := p.modelLimits[model]; ok {
+		select {
+		case sem <- struct{}{}:
+			defer func() { <-sem }()
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+	}
+
+	if system != "" {
+		if client, ok := p.llm.(SystemLLMClient); ok && image == nil {
+			return client.AskWithSystem(ctx, model, system, prompt)
+		}
+		prompt = system + "\n\n" + prompt
+	}
+	if image != nil {
+		client, ok := p.llm.(ImageLLMClient)
+		if !ok {
+			return "", ErrImagesNotSupported
+		}
+		return client.AskWithImage(ctx, model, prompt, image.Data, image.MIMEType)
+	}
+	if model != "" {
+		if client, ok := p.llm.(ModelLLMClient); ok {
+			return client.AskWithModel(ctx, model, prompt)
+		}
+		p.debugf("Warning: LLM client does not support model overrides, ignoring model %s\n", model)
+	}
+	return p.llm.Ask(ctx, prompt)
+}
+
+// writeResult writes a block's result to a file. alternatives are the answers a
+// best-of-N result was chosen from; warnings are what a :do block's Python
+// wrote to stderr; language is that of the code fence stripped from the
+// result, if any.
+func (p *Parser) writeResult(block Block, result string, alternatives, warnings []string, resultFile string, localResultsDir string, summary string, source ResultSource, language string) error {
 	// Format the result with metadata and content
 	metadata := map[string]interface{}{
-		"is_ephemeral": true,
-		"type":         block.Type,
-		"summary":      summary,
+		"is_ephemeral":   true,
+		"type":           block.Type,
+		"summary":        summary,
+		"source_file":    source.SourceFile,
+		"block_index":    source.BlockIndex,
+		"block_checksum": source.BlockChecksum,
+		"timestamp":      p.now().UTC().Format(time.RFC3339),
+	}
+	if source.BlockLine > 0 {
+		metadata["block_line"] = source.BlockLine
+	}
+	if block.Model != "" {
+		metadata["model"] = block.Model
+	}
+	if len(block.Attributes) > 0 {
+		metadata["attributes"] = block.Attributes
+	}
+	if len(alternatives) > 0 {
+		redacted := make([]string, len(alternatives))
+		for i, alternative := range alternatives {
+			redacted[i] = p.redact(alternative)
+		}
+		metadata["alternatives"] = redacted
+	}
+	if len(warnings) > 0 {
+		redacted := make([]string, len(warnings))
+		for i, warning := range warnings {
+			redacted[i] = p.redact(warning)
+		}
+		metadata["warnings"] = redacted
+	}
+	if language != "" {
+		metadata["language"] = language
 	}
 	metadataJSON, err := json.Marshal(metadata)
 	if err != nil {
 		return fmt.Errorf("failed to marshal metadata: %w", err)
 	}
 
-	// Format the content with UTF-8 encoding preserved
-	content := fmt.Sprintf("# metadata:%s\n\nQuestion:\n%s\n\nAnswer:\n%s\n",
-		string(metadataJSON),
-		strings.Join(block.Content, "\n"),
-		result)
+	// A format attribute forces how the answer is stored
+	if format, ok := block.Attributes[FormatAttribute]; ok {
+		if result, err = p.formatResult(result, format); err != nil {
+			return err
+		}
+	}
+
+	// Format the content with UTF-8 encoding preserved; secrets are redacted
+	// from the stored question and answer
+	content := fmt.Sprintf("%s%s\n\nQuestion:\n%s\n\nAnswer:\n%s\n",
+		MetadataPrefix, string(metadataJSON),
+		p.redact(blockText(block)),
+		p.redact(result))
 
 	// Write the result file with UTF-8 encoding
 	resultPath := filepath.Join(localResultsDir, resultFile)
-	err = os.WriteFile(resultPath, []byte(content), 0644)
+	err = p.writeResultFile(resultPath, []byte(content))
 	if err != nil {
 		return fmt.Errorf("failed to write result file: %w", err)
 	}
@@ -245,8 +776,9 @@ func (p *Parser) writeResult(block Block, result string, resultFile string, loca
 }
 
 // updateContentWithResults updates the original content by generating result files
-// for each block and embedding a result link in place of the block.
-func (p *Parser) updateContentWithResults(blocks []Block, content string, resultFiles []string, localResultsDir string, sourceFile string) string {
+// for each block and embedding a result link in place of the block. Blocks that
+// failed, per blockErrs, are kept with an error marker instead.
+func (p *Parser) updateContentWithResults(blocks []Block, content string, resultFiles []string, blockErrs []error, labels []string, localResultsDir string, sourceFile string) string {
 	if len(blocks) == 0 {
 		return content
 	}
@@ -255,21 +787,37 @@ func (p *Parser) updateContentWithResults(blocks []Block, content string, result
 	lastPos := 0
 
 	for i, block := range blocks {
+		// Included blocks are answered, but the :include line is kept
+		if block.Include != "" {
+			if i < len(blockErrs) && blockErrs[i] != nil {
+				p.debugf("Warning: block %d, included from %s, failed: %v\n", i, block.Include, blockErrs[i])
+			}
+			continue
+		}
+
 		// Write content before this block
 		newContent.WriteString(content[lastPos:block.Start])
 
-		// Insert a link in the original .pml
-		// Include the full path relative to the source file
-		relPath := resultFiles[i]
-		if strings.HasPrefix(relPath, "--(r/") {
-			relPath = strings.TrimPrefix(relPath, "--(r/")
-			relPath = strings.TrimSuffix(relPath, ")")
+		// Failed blocks are kept with an error marker
+		if i < len(blockErrs) && blockErrs[i] != nil {
+			newContent.WriteString(markFailedBlock(content[block.Start:block.End], blockErrs[i]))
+			lastPos = block.End
+			continue
 		}
-		if strings.HasPrefix(relPath, ":--(r/") {
-			relPath = strings.TrimPrefix(relPath, ":--(r/")
-			relPath = strings.TrimSuffix(relPath, ")")
+
+		// Blocks without a result (e.g. filtered out by tags) are kept verbatim
+		if resultFiles[i] == "" {
+			newContent.WriteString(content[block.Start:block.End])
+			lastPos = block.End
+			continue
+		}
+
+		// Insert a link in the original .pml
+		label := ""
+		if i < len(labels) {
+			label = labels[i]
 		}
-		newContent.WriteString(fmt.Sprintf(":--(r/%s)", relPath))
+		newContent.WriteString(resultLinkLine(resultFiles[i], label))
 
 		lastPos = block.End
 	}
@@ -281,3 +829,23 @@ func (p *Parser) updateContentWithResults(blocks []Block, content string, result
 
 	return newContent.String()
 }
+
+// resultLinkLine returns the link line replacing a processed block, labeled
+// with label if it isn't empty
+func resultLinkLine(resultFile, label string) string {
+	// Include the full path relative to the source file
+	relPath := resultFile
+	if strings.HasPrefix(relPath, "--(r/") {
+		relPath = strings.TrimPrefix(relPath, "--(r/")
+		relPath = strings.TrimSuffix(relPath, ")")
+	}
+	if strings.HasPrefix(relPath, ":--(r/") {
+		relPath = strings.TrimPrefix(relPath, ":--(r/")
+		relPath = strings.TrimSuffix(relPath, ")")
+	}
+	line := fmt.Sprintf(":--(r/%s)", relPath)
+	if label != "" {
+		line += " " + label
+	}
+	return line
+}
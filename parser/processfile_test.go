@@ -2,11 +2,17 @@ package parser
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"github.com/fireharp/pml/impl1/parser/directives"
 )
 
 // TestProcessFileUnknownBlock tests that an unknown block directive returns an error.
@@ -317,3 +323,762 @@ Question %d
 		t.Errorf("Expected 100 result files, got %d", resultCount)
 	}
 }
+
+// TestProcessFileWithTagFilter tests that only blocks matching the tag filter are processed
+func TestProcessFileWithTagFilter(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "pml-tags-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	content := `:ask tags=smoke,fast
+Smoke question
+:--
+
+:ask tags=slow
+Slow question
+:--
+
+:ask tags=smoke,slow
+Excluded question
+:--
+
+:ask
+Untagged question
+:--
+`
+	srcFile := filepath.Join(tmpDir, "tags.pml")
+	if err := os.WriteFile(srcFile, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var callCount int32
+	parser := NewParser(&mockLLM{
+		response: "Test response",
+		Delay:    10 * time.Millisecond,
+		callback: func() { atomic.AddInt32(&callCount, 1) },
+	}, tmpDir, filepath.Join(tmpDir, "compiled"), filepath.Join(tmpDir, "results"))
+	parser.SetTagFilter([]string{"smoke"}, []string{"slow"})
+
+	if err := parser.ProcessFile(context.Background(), srcFile); err != nil {
+		t.Fatalf("ProcessFile failed: %v", err)
+	}
+
+	if got := atomic.LoadInt32(&callCount); got != 1 {
+		t.Errorf("Expected 1 LLM call, got %d", got)
+	}
+
+	processed, err := os.ReadFile(srcFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := string(processed)
+	if strings.Contains(got, "Smoke question") {
+		t.Error("Expected the smoke block to be replaced by a result link")
+	}
+	for _, kept := range []string{":ask tags=slow\nSlow question\n:--", ":ask tags=smoke,slow\nExcluded question\n:--", ":ask\nUntagged question\n:--"} {
+		if !strings.Contains(got, kept) {
+			t.Errorf("Expected filtered-out block to be left untouched: %q\nGot:\n%s", kept, got)
+		}
+	}
+}
+
+// TestTagsDoNotAffectChecksum tests that tags are not part of the block checksum
+func TestTagsDoNotAffectChecksum(t *testing.T) {
+	parser := NewParser(&mockLLM{response: "Test response"}, "sources", "compiled", "results")
+	blocks, err := parser.parseBlocks(":ask tags=smoke\nQuestion\n:--\n:ask\nQuestion\n:--")
+	if err != nil {
+		t.Fatalf("parseBlocks failed: %v", err)
+	}
+	if len(blocks) != 2 {
+		t.Fatalf("Expected 2 blocks, got %d", len(blocks))
+	}
+	if len(blocks[0].Tags) != 1 || blocks[0].Tags[0] != "smoke" {
+		t.Errorf("Expected tags [smoke], got %v", blocks[0].Tags)
+	}
+	if parser.calculateBlockChecksum(blocks[0]) != parser.calculateBlockChecksum(blocks[1]) {
+		t.Error("Expected tags not to affect the block checksum")
+	}
+}
+
+// TestProcessFileWithSummary tests that a :summary block aggregates the preceding results
+func TestProcessFileWithSummary(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "pml-summary-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	content := `:ask
+What is the capital of France?
+:--
+
+:ask
+What is the capital of Japan?
+:--
+
+:summary
+:--
+`
+	srcFile := filepath.Join(tmpDir, "summary.pml")
+	if err := os.WriteFile(srcFile, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	parser := NewParser(&mockLLM{
+		Delay: 10 * time.Millisecond,
+		answer: func(prompt string) string {
+			if strings.Contains(prompt, "France") {
+				return "Paris"
+			}
+			return "Tokyo"
+		},
+	}, tmpDir, filepath.Join(tmpDir, "compiled"), filepath.Join(tmpDir, "results"))
+
+	if err := parser.ProcessFile(context.Background(), srcFile); err != nil {
+		t.Fatalf("ProcessFile failed: %v", err)
+	}
+
+	resultsDir := filepath.Join(tmpDir, ".pml", "results")
+	files, err := os.ReadDir(resultsDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var summary string
+	for _, f := range files {
+		if strings.HasPrefix(f.Name(), "summary_") {
+			data, err := os.ReadFile(filepath.Join(resultsDir, f.Name()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			summary = string(data)
+		}
+	}
+	if summary == "" {
+		t.Fatal("Expected a summary result file")
+	}
+
+	answer := summary[strings.Index(summary, "Answer:"):]
+	if !strings.Contains(answer, "Paris") || !strings.Contains(answer, "Tokyo") {
+		t.Errorf("Expected summary to reflect both answers, got:\n%s", answer)
+	}
+}
+
+// TestProcessFileWithApproval tests that rejected :do blocks are skipped
+func TestProcessFileWithApproval(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "pml-approval-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	content := `:do
+Delete the staging database
+:--
+
+:do
+Send the weekly report
+:--
+
+:ask
+What is 2+2?
+:--
+`
+	srcFile := filepath.Join(tmpDir, "approval.pml")
+	if err := os.WriteFile(srcFile, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var mu sync.Mutex
+	var prompts []string
+	parser := NewParser(&mockLLM{
+		Delay: 10 * time.Millisecond,
+		answer: func(prompt string) string {
+			mu.Lock()
+			prompts = append(prompts, prompt)
+			mu.Unlock()
+			return "Done"
+		},
+	}, tmpDir, filepath.Join(tmpDir, "compiled"), filepath.Join(tmpDir, "results"))
+
+	var approvals int32
+	parser.SetApprovalFunc(func(block Block) (bool, error) {
+		atomic.AddInt32(&approvals, 1)
+		return !strings.Contains(strings.Join(block.Content, "\n"), "Delete"), nil
+	})
+
+	if err := parser.ProcessFile(context.Background(), srcFile); err != nil {
+		t.Fatalf("ProcessFile failed: %v", err)
+	}
+
+	if got := atomic.LoadInt32(&approvals); got != 2 {
+		t.Errorf("Expected approval to be consulted for 2 :do blocks, got %d", got)
+	}
+	// :do blocks run without the LLM
+	if len(prompts) != 1 || prompts[0] != "What is 2+2?" {
+		t.Fatalf("Expected only the :ask block to call the LLM, got %v", prompts)
+	}
+
+	// The rejected block records a skipped result
+	resultsDir := filepath.Join(tmpDir, ".pml", "results")
+	files, err := os.ReadDir(resultsDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	foundSkipped, foundExecuted := false, false
+	for _, f := range files {
+		data, err := os.ReadFile(filepath.Join(resultsDir, f.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(string(data), "Delete the staging database") && strings.Contains(string(data), ResultNotApproved) {
+			foundSkipped = true
+		}
+		if strings.Contains(string(data), "Executed action: Send the weekly report") {
+			foundExecuted = true
+		}
+		if strings.Contains(string(data), "Executed action: Delete") {
+			t.Error("Expected the rejected block not to run")
+		}
+	}
+	if !foundSkipped {
+		t.Error("Expected a skipped result for the rejected block")
+	}
+	if !foundExecuted {
+		t.Error("Expected the approved :do block to be executed")
+	}
+}
+
+func TestProcessFileBudget(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "pml-budget-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	content := `:ask
+What is 2+2?
+:--
+
+:ask
+What is 3+3?
+:--
+
+:ask
+What is 4+4?
+:--
+`
+	srcFile := filepath.Join(tmpDir, "budget.pml")
+	if err := os.WriteFile(srcFile, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var calls int32
+	parser := NewParser(&mockLLM{
+		Delay: 10 * time.Millisecond,
+		answer: func(prompt string) string {
+			atomic.AddInt32(&calls, 1)
+			return "Answer"
+		},
+	}, tmpDir, filepath.Join(tmpDir, "compiled"), filepath.Join(tmpDir, "results"))
+
+	// The first prompt alone uses up the budget
+	parser.SetBudget(1)
+
+	err = parser.ProcessFile(context.Background(), srcFile)
+	if !errors.Is(err, ErrBudgetExceeded) {
+		t.Fatalf("Expected ErrBudgetExceeded, got %v", err)
+	}
+	if got := atomic.LoadInt32(&calls); got != 1 {
+		t.Errorf("Expected processing to halt after 1 LLM call, got %d", got)
+	}
+	if parser.TokensUsed() == 0 {
+		t.Error("Expected token usage to be recorded")
+	}
+
+	// The completed result is linked and the remaining blocks are kept
+	data, err := os.ReadFile(srcFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	updated := string(data)
+	if got := strings.Count(updated, ":--(r/"); got != 1 {
+		t.Errorf("Expected 1 result link, got %d:\n%s", got, updated)
+	}
+	if got := strings.Count(updated, ":ask\n"); got != 2 {
+		t.Errorf("Expected the 2 unprocessed blocks to remain, got %d:\n%s", got, updated)
+	}
+}
+
+// TestUpdateContentWithResultsUsesOffsets tests that links replace exactly the
+// span of each block, even when the same text appears elsewhere in the file.
+func TestUpdateContentWithResultsUsesOffsets(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "pml-offsets-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	content := `Intro mentions What is 2+2? in prose.
+
+:ask
+What is 2+2?
+:--
+
+Between the blocks.
+
+:ask
+What is 2+2?
+:--
+Outro.
+`
+	parser := NewParser(&mockLLM{response: "Test response"}, tmpDir, tmpDir, tmpDir)
+	blocks, err := parser.parseBlocks(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(blocks) != 2 {
+		t.Fatalf("Expected 2 blocks, got %d", len(blocks))
+	}
+
+	// Only the second block has a result
+	updated := parser.updateContentWithResults(blocks, content, []string{"", "ask_calm_river_block1_0.pml"}, nil, nil, tmpDir, "test.pml")
+
+	expected := `Intro mentions What is 2+2? in prose.
+
+:ask
+What is 2+2?
+:--
+
+Between the blocks.
+
+:--(r/ask_calm_river_block1_0.pml)
+Outro.
+`
+	if updated != expected {
+		t.Errorf("Unexpected content:\n%s\nwant:\n%s", updated, expected)
+	}
+}
+
+// TestCacheKeyedByBlockChecksum tests that block results are cached under the block checksum
+func TestCacheKeyedByBlockChecksum(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "pml-cachekeys-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	content := ":ask\nFirst question\n:--\n\n:do model=gpt-4o\nSecond task\n:--\n"
+	srcFile := filepath.Join(tmpDir, "keys.pml")
+	if err := os.WriteFile(srcFile, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	parser := NewParser(&mockLLM{response: "Test response", Delay: 10 * time.Millisecond}, tmpDir, filepath.Join(tmpDir, "compiled"), filepath.Join(tmpDir, "results"))
+	blocks, err := parser.parseBlocks(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := parser.ProcessFile(context.Background(), srcFile); err != nil {
+		t.Fatalf("ProcessFile failed: %v", err)
+	}
+
+	entry := parser.cache[srcFile]
+	if len(entry.Blocks) != len(blocks) {
+		t.Fatalf("Expected %d cached blocks, got %v", len(blocks), entry.Blocks)
+	}
+	for i, block := range blocks {
+		checksum := parser.calculateBlockChecksum(block)
+		cached, ok := entry.Blocks[checksum]
+		if !ok {
+			t.Errorf("Expected block %d to be cached under its checksum %s, got keys %v", i, checksum, entry.Blocks)
+			continue
+		}
+		if cached.Checksum != checksum || cached.Index != i {
+			t.Errorf("Unexpected cache entry for block %d: %+v", i, cached)
+		}
+	}
+}
+
+// TestProcessFileEmitPythonWriteFailure tests that a .py file that can't be written doesn't stop processing
+func TestProcessFileEmitPythonWriteFailure(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "pml-emitpython-*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	p := NewParser(&mockLLM{response: "Paris", Delay: 10 * time.Millisecond}, tmpDir, filepath.Join(tmpDir, "compiled"), filepath.Join(tmpDir, "results"))
+	p.SetEmitPython(true)
+
+	pmlFile := filepath.Join(tmpDir, "test.pml")
+	if err := os.WriteFile(pmlFile, []byte(":ask\nCapital of France?\n:--\n"), 0644); err != nil {
+		t.Fatalf("Failed to write test file: %v", err)
+	}
+	// A directory in place of test.pml.py makes the write fail
+	if err := os.Mkdir(pmlFile+".py", 0755); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+
+	if err := p.ProcessFile(context.Background(), pmlFile); err != nil {
+		t.Fatalf("ProcessFile failed: %v", err)
+	}
+
+	content, err := os.ReadFile(pmlFile)
+	if err != nil {
+		t.Fatalf("Failed to read processed file: %v", err)
+	}
+	if strings.Contains(string(content), ":ask") {
+		t.Errorf("Expected the :ask block to be processed, got:\n%s", content)
+	}
+}
+
+// TestProcessFileRegeneratesStalePython tests that an edited .py file is overwritten with the regenerated translation
+func TestProcessFileRegeneratesStalePython(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "pml-stalepython-*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	p := NewParser(&mockLLM{response: "Paris", Delay: 10 * time.Millisecond}, tmpDir, filepath.Join(tmpDir, "compiled"), filepath.Join(tmpDir, "results"))
+	p.SetEmitPython(true)
+
+	pmlFile := filepath.Join(tmpDir, "test.pml")
+	if err := os.WriteFile(pmlFile, []byte(":ask\nCapital of France?\n:--\n"), 0644); err != nil {
+		t.Fatalf("Failed to write test file: %v", err)
+	}
+	if err := p.ProcessFile(context.Background(), pmlFile); err != nil {
+		t.Fatalf("ProcessFile failed: %v", err)
+	}
+	if _, err := os.Stat(pmlFile + ".py"); err != nil {
+		t.Fatalf("Expected the .py file to be written: %v", err)
+	}
+
+	if err := os.WriteFile(pmlFile+".py", []byte("print('edited by hand')\n"), 0644); err != nil {
+		t.Fatalf("Failed to edit .py file: %v", err)
+	}
+	if err := p.ProcessFile(context.Background(), pmlFile); err != nil {
+		t.Fatalf("ProcessFile failed: %v", err)
+	}
+
+	regenerated, err := os.ReadFile(pmlFile + ".py")
+	if err != nil {
+		t.Fatalf("Failed to read .py file: %v", err)
+	}
+	if strings.Contains(string(regenerated), "edited by hand") || !strings.Contains(string(regenerated), "from src.pml.directives import") {
+		t.Errorf("Expected the stale .py file to be regenerated, got:\n%s", regenerated)
+	}
+}
+
+// TestProcessFileNormalizedPromptsHitCache tests that prompts differing in punctuation share a cached result when normalized
+func TestProcessFileNormalizedPromptsHitCache(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "pml-normalize-*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	var calls int32
+	mock := &mockLLM{response: "Paris", Delay: 10 * time.Millisecond, callback: func() { atomic.AddInt32(&calls, 1) }}
+	p := NewParser(mock, tmpDir, filepath.Join(tmpDir, "compiled"), filepath.Join(tmpDir, "results"))
+	p.SetPromptNormalization(PromptNormalization{StripTrailingPunctuation: true})
+
+	pmlFile := filepath.Join(tmpDir, "test.pml")
+	for _, question := range []string{"Capital of France?", "Capital of France"} {
+		if err := os.WriteFile(pmlFile, []byte(":ask\n"+question+"\n:--\n"), 0644); err != nil {
+			t.Fatalf("Failed to write test file: %v", err)
+		}
+		if err := p.ProcessFile(context.Background(), pmlFile); err != nil {
+			t.Fatalf("ProcessFile failed: %v", err)
+		}
+	}
+
+	if calls != 1 {
+		t.Errorf("Expected the second prompt to hit the cache, got %d LLM calls", calls)
+	}
+}
+
+// TestProcessFileMaxBlocks tests that a file with more blocks than the limit is rejected before any block is processed.
+func TestProcessFileMaxBlocks(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "pml-maxblocks-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	var content strings.Builder
+	for i := 0; i < 5; i++ {
+		fmt.Fprintf(&content, ":ask\nQuestion %d\n:--\n\n", i)
+	}
+	srcFile := filepath.Join(tmpDir, "huge.pml")
+	if err := os.WriteFile(srcFile, []byte(content.String()), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var calls int32
+	parser := NewParser(&mockLLM{
+		response: "Answer",
+		Delay:    10 * time.Millisecond,
+		callback: func() { atomic.AddInt32(&calls, 1) },
+	}, tmpDir, filepath.Join(tmpDir, "compiled"), filepath.Join(tmpDir, "results"))
+	parser.SetMaxBlocksPerFile(3)
+
+	err = parser.ProcessFile(context.Background(), srcFile)
+	if !errors.Is(err, ErrTooManyBlocks) {
+		t.Fatalf("Expected ErrTooManyBlocks, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "file has 5 blocks, exceeds limit 3") {
+		t.Errorf("Unexpected error message: %v", err)
+	}
+	if got := atomic.LoadInt32(&calls); got != 0 {
+		t.Errorf("Expected no LLM calls, got %d", got)
+	}
+	if data, _ := os.ReadFile(srcFile); string(data) != content.String() {
+		t.Error("Expected the file to be left unchanged")
+	}
+
+	// Files within the limit are processed
+	parser.SetMaxBlocksPerFile(5)
+	if err := parser.ProcessFile(context.Background(), srcFile); err != nil {
+		t.Fatalf("ProcessFile() error = %v", err)
+	}
+	if got := atomic.LoadInt32(&calls); got != 5 {
+		t.Errorf("Expected 5 LLM calls, got %d", got)
+	}
+}
+
+// TestProcessFileMarksFailedBlocks tests that a failed block is closed by an
+// error marker in best-effort mode and that a successful rerun replaces it.
+func TestProcessFileMarksFailedBlocks(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "pml-errmarker-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	content := "Intro\n\n:ask\nWhat is 2+2?\n:--\n\nOutro\n"
+	srcFile := filepath.Join(tmpDir, "failing.pml")
+	if err := os.WriteFile(srcFile, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	llm := &mockLLM{response: "4", Delay: 10 * time.Millisecond, err: errors.New("LLM request failed: timeout")}
+	parser := NewParser(llm, tmpDir, filepath.Join(tmpDir, "compiled"), filepath.Join(tmpDir, "results"))
+	parser.SetFailFast(false)
+
+	if err := parser.ProcessFile(context.Background(), srcFile); err == nil || !strings.Contains(err.Error(), "timeout") {
+		t.Fatalf("Expected the block failure to be reported, got %v", err)
+	}
+	data, err := os.ReadFile(srcFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "Intro\n\n:ask\nWhat is 2+2?\n:--(e/\"failed to process block: LLM request failed: timeout\")\n\nOutro\n"
+	if string(data) != expected {
+		t.Fatalf("Expected an error marker:\n%q\ngot:\n%q", expected, string(data))
+	}
+
+	issues, err := parser.Validate(srcFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(issues) != 1 || issues[0].Line != 5 || !strings.Contains(issues[0].Message, "LLM request failed: timeout") {
+		t.Errorf("Expected Validate to report the failed block, got %v", issues)
+	}
+
+	// Once the LLM works again, the marker is replaced by a result link
+	llm.err = nil
+	if err := parser.ProcessFile(context.Background(), srcFile); err != nil {
+		t.Fatalf("ProcessFile() error = %v", err)
+	}
+	data, err = os.ReadFile(srcFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	updated := string(data)
+	if strings.Contains(updated, ":--(e/") || strings.Count(updated, ":--(r/") != 1 {
+		t.Errorf("Expected the error marker to be replaced by a result link:\n%s", updated)
+	}
+}
+
+// TestProcessFilePreservesIndentation tests that the prompt and the stored
+// question keep a block's indentation and blank lines verbatim
+func TestProcessFilePreservesIndentation(t *testing.T) {
+	code := "Fix this function:\n\n    def total(items):\n\tfor item in items:\n\n\t    yield item.price  \n  # done"
+	for name, newline := range map[string]string{"lf": "\n", "crlf": "\r\n"} {
+		t.Run(name, func(t *testing.T) {
+			tmpDir := t.TempDir()
+			content := strings.ReplaceAll(":ask\n"+code+"\n:--\n", "\n", newline)
+			srcFile := filepath.Join(tmpDir, "indent.pml")
+			if err := os.WriteFile(srcFile, []byte(content), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			var prompt string
+			parser := NewParser(&mockLLM{
+				Delay: time.Millisecond,
+				answer: func(p string) string {
+					prompt = p
+					return "Fixed"
+				},
+			}, tmpDir, tmpDir, filepath.Join(tmpDir, "results"))
+			if err := parser.ProcessFile(context.Background(), srcFile); err != nil {
+				t.Fatalf("ProcessFile() error = %v", err)
+			}
+			if prompt != code {
+				t.Errorf("Expected the prompt to keep the content verbatim:\n%q\ngot:\n%q", code, prompt)
+			}
+
+			data, err := os.ReadFile(srcFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			link, ok := parseResultLink(strings.TrimSpace(string(data)))
+			if !ok {
+				t.Fatalf("Expected a result link, got %q", data)
+			}
+			result, err := os.ReadFile(parser.ResolveResultLink(srcFile, link))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(string(result), "\nQuestion:\n"+code+"\n\nAnswer:\n") {
+				t.Errorf("Expected the result file to store the question verbatim, got:\n%s", result)
+			}
+		})
+	}
+}
+
+// TestProcessFileClosesBlockAtEOF tests that a block left open at the end of
+// the file is processed and replaced by its result link when not strict
+func TestProcessFileClosesBlockAtEOF(t *testing.T) {
+	tmpDir := t.TempDir()
+	srcFile := filepath.Join(tmpDir, "open.pml")
+	if err := os.WriteFile(srcFile, []byte("Intro\n\n:ask\nWhat is 2+2?\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	parser := NewParser(&mockLLM{response: "4", Delay: time.Millisecond}, tmpDir, tmpDir, filepath.Join(tmpDir, "results"))
+	if err := parser.ProcessFile(context.Background(), srcFile); err == nil {
+		t.Fatal("Expected an error for a block left open by default")
+	}
+
+	parser.SetStrictEOF(false)
+	issues, err := parser.Validate(srcFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(issues) != 1 || issues[0].Severity != SeverityWarning || issues[0].Line != 3 {
+		t.Errorf("Expected a warning for the block left open, got %v", issues)
+	}
+	if err := parser.ProcessFile(context.Background(), srcFile); err != nil {
+		t.Fatalf("ProcessFile() error = %v", err)
+	}
+	data, err := os.ReadFile(srcFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	updated := string(data)
+	if !strings.HasPrefix(updated, "Intro\n\n:--(r/") || strings.Contains(updated, "What is 2+2?") {
+		t.Errorf("Expected the block to be replaced by its result link, got %q", updated)
+	}
+}
+
+// upperDirective is a processing directive upper-casing its blocks
+type upperDirective struct{}
+
+func (upperDirective) Name() string            { return ":upper" }
+func (upperDirective) CanGenerateBlocks() bool { return false }
+
+func (upperDirective) Process(ctx context.Context, content []string) (string, error) {
+	return strings.ToUpper(strings.Join(content, "\n")), nil
+}
+
+// TestProcessFileDirectiveRegistry tests that blocks of registered processing
+// directives are run by the directive instead of the LLM
+func TestProcessFileDirectiveRegistry(t *testing.T) {
+	tmpDir := t.TempDir()
+	srcFile := filepath.Join(tmpDir, "registry.pml")
+	content := ":do\nDeploy the site\n:--\n\n:upper\nquiet please\n:--\n"
+	if err := os.WriteFile(srcFile, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var calls int32
+	parser := NewParser(&mockLLM{response: "Answer", Delay: time.Millisecond, callback: func() { atomic.AddInt32(&calls, 1) }},
+		tmpDir, tmpDir, filepath.Join(tmpDir, "results"))
+	registry := directives.DefaultRegistry()
+	registry.Register(upperDirective{})
+	parser.SetDirectiveRegistry(registry)
+
+	var mu sync.Mutex
+	results := make(map[string]string)
+	parser.SetResultSink(func(ctx context.Context, result BlockResult) error {
+		mu.Lock()
+		defer mu.Unlock()
+		results[result.Block.Type] = result.Result
+		return nil
+	})
+	if err := parser.ProcessFile(context.Background(), srcFile); err != nil {
+		t.Fatalf("ProcessFile() error = %v", err)
+	}
+	if got := atomic.LoadInt32(&calls); got != 0 {
+		t.Errorf("Expected no LLM calls, got %d", got)
+	}
+	if got := results[DirectiveDo]; got != "Executed action: Deploy the site" {
+		t.Errorf("Unexpected :do result %q", got)
+	}
+	if got := results[":upper"]; got != "QUIET PLEASE" {
+		t.Errorf("Unexpected :upper result %q", got)
+	}
+}
+
+// TestProcessFileSummarizeBlock tests that :summarize blocks are summarized
+// instead of asked, and are linked and cached like :ask blocks
+func TestProcessFileSummarizeBlock(t *testing.T) {
+	tmpDir := t.TempDir()
+	srcFile := filepath.Join(tmpDir, "summarize.pml")
+	content := ":summarize\nRevenue grew 12% this quarter\n:--\n"
+	if err := os.WriteFile(srcFile, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var calls int32
+	parser := NewParser(&mockLLM{
+		Delay:    time.Millisecond,
+		callback: func() { atomic.AddInt32(&calls, 1) },
+		answer: func(prompt string) string {
+			t.Errorf("Expected no Ask call, got %q", prompt)
+			return ""
+		},
+	}, tmpDir, tmpDir, filepath.Join(tmpDir, "results"))
+	var result string
+	parser.SetResultSink(func(ctx context.Context, r BlockResult) error {
+		result = r.Result
+		return nil
+	})
+
+	if err := parser.ProcessFile(context.Background(), srcFile); err != nil {
+		t.Fatalf("ProcessFile() error = %v", err)
+	}
+	if result != "Summary: Revenue grew 12% this quarter" {
+		t.Errorf("Unexpected result %q", result)
+	}
+	data, err := os.ReadFile(srcFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), ":--(r/summarize_") {
+		t.Errorf("Expected a link to the result file:\n%s", data)
+	}
+
+	// The unchanged block is answered from the cache
+	if err := parser.ProcessFile(context.Background(), srcFile); err != nil {
+		t.Fatalf("ProcessFile() error = %v", err)
+	}
+	if got := atomic.LoadInt32(&calls); got != 1 {
+		t.Errorf("Expected 1 Summarize call, got %d", got)
+	}
+}
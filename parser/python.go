@@ -1,18 +1,217 @@
 package parser
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
 	"strings"
+	"sync"
 )
 
-// executePython executes a Python file and returns its output
+// Errors returned by executePython for common failures, so callers can tell a
+// missing dependency or broken generated code apart from other failures
+var (
+	ErrPythonImport = errors.New("python import failed")
+	ErrPythonSyntax = errors.New("python syntax error")
+)
+
+// pythonFileLine matches the location lines of a Python traceback
+var pythonFileLine = regexp.MustCompile(`File "([^"]+)", line (\d+)`)
+
+// pythonSetup describes how generated Python files are executed
+type pythonSetup struct {
+	python      string // Interpreter path or command name
+	projectRoot string // Directory containing impl1, src and .venv
+	impl1Dir    string
+	srcDir      string
+	env         []string // Environment with PYTHONPATH extended
+}
+
+// executePython executes a Python file and returns its output. What a
+// successful run writes to stderr is only logged as debug warnings; callers
+// that keep warnings, like :do blocks and CheckPythonEnvironment, use runPython.
 func (p *Parser) executePython(ctx context.Context, pyPath string) ([]string, error) {
+	lines, warnings, err := p.runPython(ctx, pyPath)
+	for _, warning := range warnings {
+		p.debugf("Warning: %s: %s\n", filepath.Base(pyPath), warning)
+	}
+	return lines, err
+}
+
+// runPython executes a Python file and returns the lines of its stdout and,
+// separately, those of its stderr, such as deprecation notices, so warnings of
+// a successful run don't end up in its output
+func (p *Parser) runPython(ctx context.Context, pyPath string) (lines, warnings []string, err error) {
+	setup := p.pythonSetup()
+
+	if p.debug {
+		p.debugf("Executing Python with:\n")
+		p.debugf("  Path: %s\n", pyPath)
+		p.debugf("  Python: %s\n", setup.python)
+		p.debugf("  Project Root: %s\n", setup.projectRoot)
+		p.debugf("  Impl1 Dir: %s\n", setup.impl1Dir)
+		p.debugf("  Src Dir: %s\n", setup.srcDir)
+		for _, e := range setup.env {
+			if strings.HasPrefix(e, "PYTHONPATH=") {
+				p.debugf("  %s\n", e)
+			}
+		}
+	}
+
+	cmd := exec.CommandContext(ctx, setup.python, pyPath)
+	cmd.Env = setup.env
+
+	// Capture stdout and stderr separately, and both in order for failures
+	var stdout, stderr, combinedBuf bytes.Buffer
+	combined := &lockedWriter{w: &combinedBuf}
+	cmd.Stdout = io.MultiWriter(&stdout, combined)
+	cmd.Stderr = io.MultiWriter(&stderr, combined)
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil, nil, context.DeadlineExceeded
+		}
+		output := combinedBuf.String()
+		if typed := classifyPythonError(output); typed != nil {
+			p.debugf("Python output:\n%s\n", output)
+			return nil, nil, typed
+		}
+		return nil, nil, fmt.Errorf("failed to execute Python: %w\nOutput: %s", err, output)
+	}
+
+	// Split output into lines
+	lines = strings.Split(strings.TrimSpace(stdout.String()), "\n")
+	if text := strings.TrimSpace(stderr.String()); text != "" {
+		warnings = strings.Split(text, "\n")
+	}
+	return lines, warnings, nil
+}
+
+// lockedWriter serializes writes to w, which stdout and stderr are copied to
+// from separate goroutines
+type lockedWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// Write implements io.Writer
+func (l *lockedWriter) Write(b []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.w.Write(b)
+}
+
+// SetExecuteDo sets whether :do blocks are run as Python instead of by their
+// directive. The block's content is the script; its output is the result and
+// what it writes to stderr is kept as the block's warnings.
+func (p *Parser) SetExecuteDo(execute bool) {
+	p.executeDo = execute
+}
+
+// runDoBlock runs a :do block's content as Python from a file beside the PML
+// file (foo.pml.block_0.py), removed afterwards. What a successful run writes
+// to stderr is returned as warnings rather than mixed into the result.
+func (p *Parser) runDoBlock(ctx context.Context, block Block, index int, plmPath string) (string, []string, error) {
+	pyPath := fmt.Sprintf("%s.block_%d%s", plmPath, index, PythonExt)
+	if err := os.WriteFile(pyPath, []byte(strings.Join(block.Content, "\n")+"\n"), 0644); err != nil {
+		return "", nil, fmt.Errorf("failed to write %s: %w", pyPath, err)
+	}
+	defer os.Remove(pyPath)
+
+	lines, warnings, err := p.runPython(ctx, pyPath)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to run block %d: %w", index, err)
+	}
+	for _, warning := range warnings {
+		p.debugf("Warning: block %d of %s: %s\n", index, plmPath, warning)
+	}
+	return strings.Join(lines, "\n"), warnings, nil
+}
+
+// PythonExt is appended to a PML file's path to name its Python translation
+const PythonExt = ".py"
+
+// blockPythonFile matches the per-block Python files written beside a PML file
+var blockPythonFile = regexp.MustCompile(`\.block_\d+\.py$`)
+
+// IsGeneratedFile reports whether path is output written beside a PML file
+// rather than a source: the Python translation (foo.pml.py), a block's Python
+// file (foo.pml.block_0.py) or the rendered HTML (foo.pml.html). exts are the
+// PML extensions in use; the default ones are always included. Generated files
+// are never processed, whatever extensions are configured, so writing them
+// can't trigger processing of its own output.
+func IsGeneratedFile(path string, exts []string) bool {
+	lower := strings.ToLower(path)
+	if blockPythonFile.MatchString(lower) {
+		return true
+	}
+	for _, suffix := range []string{PythonExt, HTMLExt} {
+		if !strings.HasSuffix(lower, suffix) {
+			continue
+		}
+		source := strings.TrimSuffix(lower, suffix)
+		for _, ext := range append(append([]string(nil), DefaultExtensions...), exts...) {
+			if strings.HasSuffix(source, ext) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// SetEmitPython sets whether ProcessFile writes the Python translation of each
+// file next to it (foo.pml.py). The file is only an artifact for running blocks
+// from Python; failing to write it is logged and doesn't stop LLM processing.
+func (p *Parser) SetEmitPython(emit bool) {
+	p.emitPython = emit
+}
+
+// writePythonFile writes the Python translation of a PML file when emitting is
+// enabled. An existing file that doesn't match the translation, because it was
+// edited or the .pml changed, is regenerated.
+func (p *Parser) writePythonFile(path, content string, blocks []Block) {
+	if !p.emitPython {
+		return
+	}
+	pyPath := path + PythonExt
+	generated := p.replaceBlocksInContent(content, blocks)
+	existing, err := os.ReadFile(pyPath)
+	if err == nil {
+		if string(existing) == generated {
+			return
+		}
+		p.debugf("Regenerating stale %s\n", pyPath)
+	}
+	if err := os.WriteFile(pyPath, []byte(generated), 0644); err != nil {
+		p.debugf("Warning: failed to write %s, continuing without it: %v\n", pyPath, err)
+	}
+}
+
+// ProjectRootEnv overrides the project root containing src and .venv used to run Python
+const ProjectRootEnv = "PML_PROJECT_ROOT"
+
+// SetProjectRoot sets the directory containing src, impl1 and .venv used to run
+// generated Python, overriding $PML_PROJECT_ROOT. By default it is two levels
+// above the sources directory.
+func (p *Parser) SetProjectRoot(dir string) {
+	p.projectRoot = dir
+}
+
+// pythonSetup resolves the interpreter and environment used by executePython
+func (p *Parser) pythonSetup() pythonSetup {
 	// Get project root directory (where impl1 directory is)
-	projectRoot := filepath.Dir(filepath.Dir(p.sourcesDir)) // Go up two levels
+	projectRoot := p.projectRoot
+	if projectRoot == "" {
+		projectRoot = os.Getenv(ProjectRootEnv)
+	}
+	if projectRoot == "" {
+		projectRoot = filepath.Dir(filepath.Dir(p.sourcesDir)) // Go up two levels
+	}
 
 	// Add both impl1 and src directories to PYTHONPATH
 	env := os.Environ()
@@ -38,33 +237,31 @@ func (p *Parser) executePython(ctx context.Context, pyPath string) ([]string, er
 		python = venvPython
 	}
 
-	if p.debug {
-		p.debugf("Executing Python with:\n")
-		p.debugf("  Path: %s\n", pyPath)
-		p.debugf("  Python: %s\n", python)
-		p.debugf("  Project Root: %s\n", projectRoot)
-		p.debugf("  Impl1 Dir: %s\n", impl1Dir)
-		p.debugf("  Src Dir: %s\n", srcDir)
-		for _, e := range env {
-			if strings.HasPrefix(e, "PYTHONPATH=") {
-				p.debugf("  %s\n", e)
-			}
-		}
+	return pythonSetup{
+		python:      python,
+		projectRoot: projectRoot,
+		impl1Dir:    impl1Dir,
+		srcDir:      srcDir,
+		env:         env,
 	}
+}
 
-	cmd := exec.CommandContext(ctx, python, pyPath)
-	cmd.Env = env
+// classifyPythonError turns the output of a failed Python run into ErrPythonImport or
+// ErrPythonSyntax with the final line of the traceback, or nil for other failures
+func classifyPythonError(output string) error {
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	last := strings.TrimSpace(lines[len(lines)-1])
 
-	// Capture both stdout and stderr
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		if ctx.Err() == context.DeadlineExceeded {
-			return nil, context.DeadlineExceeded
+	switch {
+	case strings.HasPrefix(last, "ModuleNotFoundError:"), strings.HasPrefix(last, "ImportError:"):
+		return fmt.Errorf("%w: %s", ErrPythonImport, last)
+	case strings.HasPrefix(last, "SyntaxError:"), strings.HasPrefix(last, "IndentationError:"), strings.HasPrefix(last, "TabError:"):
+		// Point at the offending line, which Python reports last
+		if m := pythonFileLine.FindAllStringSubmatch(output, -1); len(m) > 0 {
+			loc := m[len(m)-1]
+			return fmt.Errorf("%w: %s (%s:%s)", ErrPythonSyntax, last, filepath.Base(loc[1]), loc[2])
 		}
-		return nil, fmt.Errorf("failed to execute Python: %w\nOutput: %s", err, string(output))
+		return fmt.Errorf("%w: %s", ErrPythonSyntax, last)
 	}
-
-	// Split output into lines
-	lines := strings.Split(strings.TrimSpace(string(output)), "\n")
-	return lines, nil
+	return nil
 }
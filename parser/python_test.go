@@ -2,9 +2,12 @@ package parser
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -145,6 +148,7 @@ func TestExecutePythonErrors(t *testing.T) {
 		content  string
 		wantErr  bool
 		errMatch string
+		wantIs   error // Typed error expected, if any
 	}{
 		{
 			name: "syntax error",
@@ -154,6 +158,7 @@ if True
 `,
 			wantErr:  true,
 			errMatch: "SyntaxError",
+			wantIs:   ErrPythonSyntax,
 		},
 		{
 			name: "import error",
@@ -162,6 +167,7 @@ import non_existent_module
 `,
 			wantErr:  true,
 			errMatch: "ModuleNotFoundError",
+			wantIs:   ErrPythonImport,
 		},
 		{
 			name: "runtime error",
@@ -192,6 +198,17 @@ cause_error()
 				} else if !strings.Contains(err.Error(), tc.errMatch) {
 					t.Errorf("Expected error containing %q, got %v", tc.errMatch, err)
 				}
+				if err != nil && tc.wantIs != nil {
+					if !errors.Is(err, tc.wantIs) {
+						t.Errorf("Expected %v, got %v", tc.wantIs, err)
+					}
+					if strings.Contains(err.Error(), "Traceback") {
+						t.Errorf("Expected a concise error without the traceback, got %v", err)
+					}
+				}
+				if err != nil && tc.wantIs == nil && (errors.Is(err, ErrPythonImport) || errors.Is(err, ErrPythonSyntax)) {
+					t.Errorf("Expected an untyped error, got %v", err)
+				}
 			} else if err != nil {
 				t.Errorf("Unexpected error: %v", err)
 			}
@@ -232,3 +249,207 @@ print("Done")
 		t.Errorf("Expected deadline exceeded or killed error, got: %v", err)
 	}
 }
+
+// TestExecutePythonWarnings tests that stderr of a successful run is returned
+// as warnings, apart from the output
+func TestExecutePythonWarnings(t *testing.T) {
+	tmpDir := t.TempDir()
+	content := `
+import sys
+import warnings
+warnings.warn("old_api is deprecated", DeprecationWarning)
+sys.stderr.write("note: using defaults\n")
+print("result")
+`
+	testFile := filepath.Join(tmpDir, "warn_test.py")
+	if err := os.WriteFile(testFile, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	parser := NewParser(&mockLLM{response: "Test response"}, tmpDir, filepath.Join(tmpDir, "compiled"), filepath.Join(tmpDir, "results"))
+	lines, warnings, err := parser.runPython(context.Background(), testFile)
+	if err != nil {
+		t.Fatalf("runPython error: %v", err)
+	}
+	if len(lines) != 1 || lines[0] != "result" {
+		t.Errorf("Expected only the script's output, got %q", lines)
+	}
+	joined := strings.Join(warnings, "\n")
+	if !strings.Contains(joined, "DeprecationWarning: old_api is deprecated") || !strings.Contains(joined, "note: using defaults") {
+		t.Errorf("Expected the stderr warnings, got %q", warnings)
+	}
+
+	lines, err = parser.executePython(context.Background(), testFile)
+	if err != nil || len(lines) != 1 || lines[0] != "result" {
+		t.Errorf("Expected executePython to leave warnings out of the output, got %q, %v", lines, err)
+	}
+}
+
+// TestExecuteDoWarnings ensures a :do block run as Python keeps its stderr
+// warnings out of the result, in the result metadata and the sink's BlockResult
+func TestExecuteDoWarnings(t *testing.T) {
+	tmpDir := t.TempDir()
+	content := ":do\nimport sys\nsys.stderr.write(\"warning: old_api is deprecated\\n\")\nprint(\"done\")\n:--\n"
+	srcFile := filepath.Join(tmpDir, "warn.pml")
+	if err := os.WriteFile(srcFile, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var received []BlockResult
+	parser := NewParser(&mockLLM{response: "Test response"}, tmpDir, filepath.Join(tmpDir, "compiled"), filepath.Join(tmpDir, "results"))
+	parser.SetExecuteDo(true)
+	parser.SetResultSink(func(ctx context.Context, result BlockResult) error {
+		received = append(received, result)
+		return nil
+	})
+	if err := parser.ProcessFile(context.Background(), srcFile); err != nil {
+		t.Fatalf("ProcessFile() error = %v", err)
+	}
+
+	if len(received) != 1 || received[0].Result != "done" {
+		t.Fatalf("Expected the script's output as the result, got %+v", received)
+	}
+	if want := []string{"warning: old_api is deprecated"}; strings.Join(received[0].Warnings, "|") != strings.Join(want, "|") {
+		t.Errorf("Expected warnings %q, got %q", want, received[0].Warnings)
+	}
+	if _, err := os.Stat(srcFile + ".block_0.py"); !os.IsNotExist(err) {
+		t.Errorf("Expected the block's Python file to be removed, got %v", err)
+	}
+
+	updated, err := os.ReadFile(srcFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	link, ok := parseResultLink(strings.TrimSpace(string(updated)))
+	if !ok {
+		t.Fatalf("Expected a result link, got:\n%s", updated)
+	}
+	metadataJSON, _, err := readMetadataLine(parser.ResolveResultLink(srcFile, link))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var metadata struct {
+		Warnings []string `json:"warnings"`
+	}
+	if err := json.Unmarshal([]byte(metadataJSON), &metadata); err != nil {
+		t.Fatal(err)
+	}
+	if len(metadata.Warnings) != 1 || metadata.Warnings[0] != "warning: old_api is deprecated" {
+		t.Errorf("Expected the warning in the result metadata, got %q", metadata.Warnings)
+	}
+}
+
+// TestProjectRootOverride ensures PML_PROJECT_ROOT and SetProjectRoot decide where the venv and PYTHONPATH come from
+func TestProjectRootOverride(t *testing.T) {
+	root, err := os.MkdirTemp("", "pml-root-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	venvPython := filepath.Join(root, ".venv", "bin", "python")
+	if err := os.MkdirAll(filepath.Dir(venvPython), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(venvPython, []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv(ProjectRootEnv, root)
+	sourcesDir := filepath.Join(root, "deeply", "nested", "a", "b", "sources")
+	parser := NewParser(&mockLLM{}, sourcesDir, sourcesDir, filepath.Join(root, "results"))
+
+	setup := parser.pythonSetup()
+	if setup.projectRoot != root {
+		t.Errorf("Expected project root %s, got %s", root, setup.projectRoot)
+	}
+	if setup.python != venvPython {
+		t.Errorf("Expected venv Python %s, got %s", venvPython, setup.python)
+	}
+	wantPath := filepath.Join(root, "src")
+	found := false
+	for _, e := range setup.env {
+		if strings.HasPrefix(e, "PYTHONPATH=") && strings.Contains(e, wantPath) {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("Expected PYTHONPATH to include %s", wantPath)
+	}
+
+	// The setter takes precedence over the environment
+	other := filepath.Join(root, "other")
+	parser.SetProjectRoot(other)
+	if setup := parser.pythonSetup(); setup.projectRoot != other || setup.python != "python" {
+		t.Errorf("Expected project root %s with system Python, got %s and %s", other, setup.projectRoot, setup.python)
+	}
+}
+
+// TestGeneratedPythonIsNeverProcessed tests that a generated .py file is never
+// treated as a source, even when .py is a configured PML extension
+func TestGeneratedPythonIsNeverProcessed(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "pml-generated-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	srcFile := filepath.Join(tmpDir, "example.pml")
+	if err := os.WriteFile(srcFile, []byte(":ask\nWhat is 2+2?\n:--\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	script := filepath.Join(tmpDir, "script.py")
+	if err := os.WriteFile(script, []byte(":ask\nWhat is 3+3?\n:--\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	blockFile := filepath.Join(tmpDir, "example.pml.block_0.py")
+	if err := os.WriteFile(blockFile, []byte(":ask\nWhat is 4+4?\n:--\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var calls int32
+	parser := NewParser(&mockLLM{
+		response: "4",
+		Delay:    10 * time.Millisecond,
+		callback: func() { atomic.AddInt32(&calls, 1) },
+	}, tmpDir, filepath.Join(tmpDir, "compiled"), filepath.Join(tmpDir, "results"))
+	parser.SetExtensions([]string{".pml", ".py"})
+	parser.SetEmitPython(true)
+
+	if err := parser.ProcessFile(context.Background(), srcFile); err != nil {
+		t.Fatalf("ProcessFile() error = %v", err)
+	}
+	pyFile := srcFile + PythonExt
+	if _, err := os.Stat(pyFile); err != nil {
+		t.Fatalf("Expected %s to be written: %v", pyFile, err)
+	}
+
+	found, err := parser.FindPMLFiles()
+	if err != nil {
+		t.Fatalf("FindPMLFiles() error = %v", err)
+	}
+	want := []string{srcFile, script}
+	if len(found) != len(want) {
+		t.Fatalf("Expected %v, got %v", want, found)
+	}
+	for i := range want {
+		if found[i] != want[i] {
+			t.Errorf("Expected %s, got %s", want[i], found[i])
+		}
+	}
+
+	// Processing a generated file directly is a no-op
+	calls = 0
+	for _, path := range []string{pyFile, blockFile} {
+		before, _ := os.ReadFile(path)
+		if err := parser.ProcessFile(context.Background(), path); err != nil {
+			t.Fatalf("ProcessFile(%s) error = %v", path, err)
+		}
+		if after, _ := os.ReadFile(path); string(after) != string(before) {
+			t.Errorf("Expected %s to be left unchanged", path)
+		}
+	}
+	if got := atomic.LoadInt32(&calls); got != 0 {
+		t.Errorf("Expected no LLM calls for generated files, got %d", got)
+	}
+}
@@ -0,0 +1,86 @@
+package parser
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// RedactedText replaces secrets in result files and logs
+const RedactedText = "[REDACTED]"
+
+// minRedactedValueLen is the length below which values aren't redacted, so
+// short values such as "1" or "dev" don't mangle every result
+const minRedactedValueLen = 4
+
+// SetRedactPatterns sets regular expressions whose matches are replaced by
+// [REDACTED] in result files, the cache and debug logs, e.g.
+// `sk-[A-Za-z0-9]+`. Prompts are sent to the LLM unredacted. Since a result
+// file keeps the redacted question, reprocessing it with ReprocessBlock sends
+// the redacted text.
+func (p *Parser) SetRedactPatterns(patterns []string) error {
+	compiled := make([]*regexp.Regexp, 0, len(patterns))
+	for _, pattern := range patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return fmt.Errorf("invalid redact pattern %q: %w", pattern, err)
+		}
+		compiled = append(compiled, re)
+	}
+	p.redactMu.Lock()
+	p.redactPatterns = compiled
+	p.redactMu.Unlock()
+	return nil
+}
+
+// AddRedactedValues adds known secrets to replace by [REDACTED] in result
+// files, the cache and debug logs. Values shorter than four characters are
+// ignored.
+func (p *Parser) AddRedactedValues(values ...string) {
+	p.redactMu.Lock()
+	defer p.redactMu.Unlock()
+	for _, value := range values {
+		if len(value) < minRedactedValueLen {
+			continue
+		}
+		if p.redactedValues == nil {
+			p.redactedValues = make(map[string]bool)
+		}
+		p.redactedValues[value] = true
+	}
+}
+
+// SetRedactEnvValues sets whether the values of environment variables
+// interpolated into blocks are redacted from result files, the cache and debug
+// logs (the default)
+func (p *Parser) SetRedactEnvValues(redact bool) {
+	p.redactEnvValues = redact
+}
+
+// redact replaces the known secrets and the matches of the redact patterns in text
+func (p *Parser) redact(text string) string {
+	p.redactMu.RLock()
+	defer p.redactMu.RUnlock()
+	if len(p.redactedValues) == 0 && len(p.redactPatterns) == 0 {
+		return text
+	}
+	// Longer values first, so a secret containing another is redacted whole
+	values := make([]string, 0, len(p.redactedValues))
+	for value := range p.redactedValues {
+		values = append(values, value)
+	}
+	sort.Slice(values, func(i, j int) bool {
+		if len(values[i]) != len(values[j]) {
+			return len(values[i]) > len(values[j])
+		}
+		return values[i] < values[j]
+	})
+	for _, value := range values {
+		text = strings.ReplaceAll(text, value, RedactedText)
+	}
+	for _, re := range p.redactPatterns {
+		text = re.ReplaceAllString(text, RedactedText)
+	}
+	return text
+}
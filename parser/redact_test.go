@@ -0,0 +1,90 @@
+package parser
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestRedactSecrets tests that interpolated secrets and pattern matches are
+// masked in result files and the cache while the LLM still receives them
+func TestRedactSecrets(t *testing.T) {
+	tmpDir := t.TempDir()
+	t.Setenv("PML_TEST_API_TOKEN", "tok-5f3a9c1e")
+	srcFile := filepath.Join(tmpDir, "secret.pml")
+	content := ":ask\nCall the API with token ${PML_TEST_API_TOKEN} and key sk-abc123\n:--\n"
+	if err := os.WriteFile(srcFile, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var prompt string
+	parser := NewParser(&mockLLM{
+		Delay: time.Millisecond,
+		answer: func(p string) string {
+			prompt = p
+			return "Sent tok-5f3a9c1e with sk-abc123"
+		},
+	}, tmpDir, tmpDir, filepath.Join(tmpDir, "results"))
+	parser.SetEnvInterpolation(true)
+	if err := parser.SetRedactPatterns([]string{`sk-[a-z0-9]+`}); err != nil {
+		t.Fatal(err)
+	}
+	if err := parser.ProcessFile(context.Background(), srcFile); err != nil {
+		t.Fatalf("ProcessFile() error = %v", err)
+	}
+
+	if prompt != "Call the API with token tok-5f3a9c1e and key sk-abc123" {
+		t.Errorf("Expected the LLM to receive the secrets, got %q", prompt)
+	}
+	data, err := os.ReadFile(srcFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	link, ok := parseResultLink(strings.TrimSpace(string(data)))
+	if !ok {
+		t.Fatalf("Expected a result link, got %q", data)
+	}
+	result, err := os.ReadFile(parser.ResolveResultLink(srcFile, link))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored := string(result)
+	if strings.Contains(stored, "tok-5f3a9c1e") || strings.Contains(stored, "sk-abc123") {
+		t.Errorf("Expected the secrets to be redacted from the result file:\n%s", stored)
+	}
+	if !strings.Contains(stored, "token [REDACTED] and key [REDACTED]") || !strings.Contains(stored, "Sent [REDACTED] with [REDACTED]") {
+		t.Errorf("Expected redaction markers in the result file:\n%s", stored)
+	}
+
+	// The cache, and what is exported from it, is redacted too
+	if cached := parser.cache[srcFile].Blocks; len(cached) != 1 {
+		t.Fatalf("Expected one cached block, got %v", cached)
+	}
+	for _, cached := range parser.cache[srcFile].Blocks {
+		if cached.Result != "Sent [REDACTED] with [REDACTED]" {
+			t.Errorf("Expected the cached result to be redacted, got %q", cached.Result)
+		}
+	}
+	var exported strings.Builder
+	if err := parser.ExportCache(&exported); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(exported.String(), "tok-5f3a9c1e") || strings.Contains(exported.String(), "sk-abc123") {
+		t.Errorf("Expected the secrets to be redacted from the exported cache:\n%s", exported.String())
+	}
+
+	// Redacting environment values can be turned off
+	off := NewParser(&mockLLM{}, tmpDir, tmpDir, filepath.Join(tmpDir, "results"))
+	off.SetRedactEnvValues(false)
+	off.SetEnvInterpolation(true)
+	blocks, _, _, _, err := off.prepareBlocks(srcFile, content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := off.redact(blockText(blocks[0])); !strings.Contains(got, "tok-5f3a9c1e") {
+		t.Errorf("Expected no redaction when disabled, got %q", got)
+	}
+}
@@ -0,0 +1,143 @@
+package parser
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// ReprocessBlock invalidates the cached result of the block with the given checksum,
+// reruns just that block and replaces its result link in the file in place
+func (p *Parser) ReprocessBlock(ctx context.Context, path string, blockChecksum string) error {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	defer p.flushIndex(path)
+
+	content, err := p.loadSource(path)
+	if err != nil {
+		return fmt.Errorf("failed to read file: %w", err)
+	}
+
+	if p.isLocked(path, blockChecksum) {
+		return fmt.Errorf("block with checksum %s in %s: %w", blockChecksum, path, ErrResultLocked)
+	}
+
+	lines := strings.Split(string(content), "\n")
+	i, resultPath, source, ok := p.findResultLink(path, lines, blockChecksum)
+	if !ok {
+		return fmt.Errorf("no result for block with checksum %s in %s", blockChecksum, path)
+	}
+
+	block, _, err := readResult(resultPath)
+	if err != nil {
+		return fmt.Errorf("failed to read block from %s: %w", resultPath, err)
+	}
+
+	// The block now sits at its link
+	block.Line = i + 1
+
+	// The block is sent to the LLM again despite its cached result
+	p.cacheMu.Lock()
+	if entry, ok := p.cache[path]; ok {
+		block.Response = entry.Blocks[blockChecksum].Result
+	}
+	p.cacheMu.Unlock()
+
+	resultFile, _, err := p.processBlock(ctx, block, source.BlockIndex, path, "", true)
+	if err != nil {
+		return fmt.Errorf("failed to reprocess block %d: %w", source.BlockIndex, err)
+	}
+	if link, ok := parseResultLink(lines[i]); ok && strings.TrimPrefix(link, "r/") == resultFile {
+		// The same answer came back; the file is left as it was
+		return nil
+	}
+
+	// Keep the link's indentation; any old label no longer matches the answer
+	line := lines[i]
+	indent := line[:len(line)-len(strings.TrimLeft(line, " \t"))]
+	lines[i] = fmt.Sprintf("%s:--(r/%s)", indent, resultFile)
+	if err := p.saveSource(path, []byte(p.formatSource(strings.Join(lines, "\n")))); err != nil {
+		return fmt.Errorf("failed to write updated file: %w", err)
+	}
+
+	if err := p.saveCache(); err != nil {
+		p.debugf("Warning: failed to save cache: %v\n", err)
+	}
+	return nil
+}
+
+// findResultLink returns the line index, result path and source of the result
+// link for the block with the given checksum among the lines of the file at path
+func (p *Parser) findResultLink(path string, lines []string, blockChecksum string) (int, string, ResultSource, bool) {
+	for i, line := range lines {
+		link, ok := parseResultLink(line)
+		if !ok {
+			continue
+		}
+		resultPath := p.ResolveResultLink(path, link)
+		source, err := p.ResultSource(resultPath)
+		if err != nil || source.BlockChecksum != blockChecksum {
+			continue
+		}
+		return i, resultPath, source, true
+	}
+	return 0, "", ResultSource{}, false
+}
+
+// parseResultLink returns the link path (including the "r/" prefix) of a ":--(r/...)" line
+func parseResultLink(line string) (string, bool) {
+	match := resultLink.FindStringSubmatch(line)
+	if match == nil {
+		return "", false
+	}
+	return match[1], true
+}
+
+// readResult reconstructs the block a result file was generated from, along with its answer
+func readResult(resultPath string) (Block, string, error) {
+	data, err := os.ReadFile(resultPath)
+	if err != nil {
+		return Block{}, "", err
+	}
+	content := string(data)
+
+	jsonStr, found, err := readMetadataLine(resultPath)
+	if err != nil {
+		return Block{}, "", err
+	}
+	if !found {
+		return Block{}, "", fmt.Errorf("no metadata found")
+	}
+	var metadata struct {
+		Type       string            `json:"type"`
+		Model      string            `json:"model"`
+		Attributes map[string]string `json:"attributes"`
+	}
+	if err := json.Unmarshal([]byte(jsonStr), &metadata); err != nil {
+		return Block{}, "", fmt.Errorf("failed to parse metadata: %w", err)
+	}
+
+	// The answer follows the first marker after the question, so an answer
+	// quoting the marker is kept whole
+	start := strings.Index(content, "\nQuestion:\n")
+	if start == -1 {
+		return Block{}, "", fmt.Errorf("no question found")
+	}
+	end := strings.Index(content[start:], "\n\nAnswer:\n")
+	if end == -1 {
+		return Block{}, "", fmt.Errorf("no question found")
+	}
+	end += start
+	question := content[start+len("\nQuestion:\n") : end]
+	answer := strings.TrimSuffix(content[end+len("\n\nAnswer:\n"):], "\n")
+
+	return Block{
+		Type:       metadata.Type,
+		Model:      metadata.Model,
+		Attributes: metadata.Attributes,
+		Content:    strings.Split(question, "\n"),
+	}, answer, nil
+}
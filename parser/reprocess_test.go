@@ -0,0 +1,168 @@
+package parser
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReprocessBlock(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "pml-reprocess-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	llm := &mockLLM{response: "First answer", Delay: 10 * time.Millisecond}
+	parser := NewParser(llm, tmpDir, tmpDir, filepath.Join(tmpDir, "results"))
+
+	content := ":ask\nWhat is 2+2?\n:--\n\n:ask\nWhat is 3+3?\n:--\n"
+	srcFile := filepath.Join(tmpDir, "reprocess.pml")
+	if err := os.WriteFile(srcFile, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	blocks, err := parser.parseBlocks(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := parser.calculateBlockChecksum(blocks[1])
+
+	if err := parser.ProcessFile(context.Background(), srcFile); err != nil {
+		t.Fatalf("ProcessFile failed: %v", err)
+	}
+	before, err := os.ReadFile(srcFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	beforeLines := strings.Split(string(before), "\n")
+
+	// The result is cached, so only an explicit reprocess reaches the LLM
+	if _, ok := parser.cache[srcFile].Blocks[target]; !ok {
+		t.Fatal("Expected the block result to be cached")
+	}
+
+	llm.response = "Second answer"
+	if err := parser.ReprocessBlock(context.Background(), srcFile, target); err != nil {
+		t.Fatalf("ReprocessBlock failed: %v", err)
+	}
+
+	after, err := os.ReadFile(srcFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	afterLines := strings.Split(string(after), "\n")
+	if len(afterLines) != len(beforeLines) {
+		t.Fatalf("Expected the same number of lines, got %d vs %d", len(afterLines), len(beforeLines))
+	}
+
+	var changed []int
+	for i := range afterLines {
+		if afterLines[i] != beforeLines[i] {
+			changed = append(changed, i)
+		}
+	}
+	if len(changed) != 1 {
+		t.Fatalf("Expected exactly one link to change, got %d:\n%s", len(changed), after)
+	}
+
+	link, ok := parseResultLink(afterLines[changed[0]])
+	if !ok {
+		t.Fatalf("Expected a result link, got %q", afterLines[changed[0]])
+	}
+	result, err := os.ReadFile(parser.ResolveResultLink(srcFile, link))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(result), "What is 3+3?") || !strings.Contains(string(result), "Second answer") {
+		t.Errorf("Expected the new result for the reprocessed block, got:\n%s", result)
+	}
+	if got := parser.cache[srcFile].Blocks[target].Result; got != "Second answer" {
+		t.Errorf("Expected cache to hold the new answer, got %q", got)
+	}
+
+	if err := parser.ReprocessBlock(context.Background(), srcFile, "unknown"); err == nil {
+		t.Error("Expected error for unknown checksum")
+	}
+}
+
+func TestReprocessBlockRefinesPriorResult(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "pml-refine-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	var prompts []string
+	llm := &mockLLM{
+		Delay: 10 * time.Millisecond,
+		answer: func(prompt string) string {
+			prompts = append(prompts, prompt)
+			return fmt.Sprintf("Answer %d", len(prompts))
+		},
+	}
+	parser := NewParser(llm, tmpDir, tmpDir, filepath.Join(tmpDir, "results"))
+	parser.SetRefinePriorResults(true)
+
+	content := ":ask\nList three colors\n:--\n"
+	srcFile := filepath.Join(tmpDir, "refine.pml")
+	if err := os.WriteFile(srcFile, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := parser.ProcessFile(context.Background(), srcFile); err != nil {
+		t.Fatalf("ProcessFile failed: %v", err)
+	}
+	if strings.Contains(prompts[0], "Previous answer") {
+		t.Errorf("Expected no prior answer on first run, got %q", prompts[0])
+	}
+
+	// Reprocessing sends the cached answer along
+	blocks, err := parser.parseBlocks(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := parser.ReprocessBlock(context.Background(), srcFile, parser.calculateBlockChecksum(blocks[0])); err != nil {
+		t.Fatalf("ReprocessBlock failed: %v", err)
+	}
+	if len(prompts) != 2 || !strings.Contains(prompts[1], "Previous answer:\nAnswer 1") {
+		t.Errorf("Expected the prior result in the reprocess prompt, got %q", prompts)
+	}
+
+	// A changed block at the same position refines the latest answer
+	if err := os.WriteFile(srcFile, []byte(":ask\nList four colors\n:--\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := parser.ProcessFile(context.Background(), srcFile); err != nil {
+		t.Fatalf("ProcessFile failed: %v", err)
+	}
+	if len(prompts) != 3 || !strings.Contains(prompts[2], "List four colors") || !strings.Contains(prompts[2], "Previous answer:\nAnswer 2") {
+		t.Errorf("Expected the changed block to refine the prior result, got %q", prompts)
+	}
+}
+
+// TestReadResultAnswerWithMarker tests that an answer containing the answer
+// marker is read back whole
+func TestReadResultAnswerWithMarker(t *testing.T) {
+	tmpDir := t.TempDir()
+	resultPath := filepath.Join(tmpDir, "ask_result.pml")
+	answer := "Results are stored as:\n\nAnswer:\nthe answer"
+	content := "# metadata:" + `{"type":":ask"}` + "\n\nQuestion:\nHow are results stored?\n\nAnswer:\n" + answer + "\n"
+	if err := os.WriteFile(resultPath, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	block, got, err := readResult(resultPath)
+	if err != nil {
+		t.Fatalf("readResult failed: %v", err)
+	}
+	if got != answer {
+		t.Errorf("Expected answer %q, got %q", answer, got)
+	}
+	if strings.Join(block.Content, "\n") != "How are results stored?" {
+		t.Errorf("Expected the question, got %q", block.Content)
+	}
+}
@@ -1,15 +1,50 @@
 package parser
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
 	"os"
 	"path/filepath"
-	"sync"
+	"regexp"
+	"strconv"
+	"strings"
 )
 
-// generateUniqueResultName generates a friendly name for a result file that is guaranteed to be unique
-var uniqueNameCounters sync.Map // maps "sourceFile_blockIndex_blockType" (string) to int
+// SetNameWordlists replaces the adjectives and nouns result file names are made
+// of, e.g. with a project's own vocabulary. Both lists must contain at least one
+// word, and words must not be blank.
+func (p *Parser) SetNameWordlists(adjectives, nouns []string) error {
+	if err := checkWordlist("adjective", adjectives); err != nil {
+		return err
+	}
+	if err := checkWordlist("noun", nouns); err != nil {
+		return err
+	}
+	p.usedNamesMu.Lock()
+	defer p.usedNamesMu.Unlock()
+	p.nameAdjectives = append([]string(nil), adjectives...)
+	p.nameNouns = append([]string(nil), nouns...)
+	return nil
+}
 
+// checkWordlist fails if a name wordlist is empty or contains a blank word
+func checkWordlist(kind string, words []string) error {
+	if len(words) == 0 {
+		return fmt.Errorf("%s list is empty", kind)
+	}
+	for i, word := range words {
+		if strings.TrimSpace(word) == "" {
+			return fmt.Errorf("%s %d is blank", kind, i+1)
+		}
+	}
+	return nil
+}
+
+// generateUniqueResultName generates a friendly name for a result file that is guaranteed to be unique.
+// The name depends only on the block and on names already taken, so the same input
+// gets the same names as long as names are generated in the same order.
 func (p *Parser) generateUniqueResultName(sourceFile string, blockIndex int, blockType string, localResultsDir string) string {
 	p.usedNamesMu.Lock()
 	defer p.usedNamesMu.Unlock()
@@ -19,23 +54,16 @@ func (p *Parser) generateUniqueResultName(sourceFile string, blockIndex int, blo
 		p.usedNames = make(map[string]bool)
 	}
 
-	key := fmt.Sprintf("%s_%d_%s", sourceFile, blockIndex, blockType)
-	var counter int
-	if cnt, ok := uniqueNameCounters.Load(key); ok {
-		counter = cnt.(int)
-	} else {
-		counter = 0
-	}
-
+	counter := 0
 	var resultName string
 	for {
 		// Compute a hash index from the source file for variation.
 		hash := 0
 		for _, c := range sourceFile {
-			hash = (hash*31 + int(c)) % len(nouns)
+			hash = (hash*31 + int(c)) % len(p.nameNouns)
 		}
-		adjIndex := (blockIndex + hash + counter) % len(adjectives)
-		nounIndex := ((blockIndex + hash + counter) * 7) % len(nouns)
+		adjIndex := (blockIndex + hash + counter) % len(p.nameAdjectives)
+		nounIndex := ((blockIndex + hash + counter) * 7) % len(p.nameNouns)
 
 		prefix := ""
 		switch blockType {
@@ -43,12 +71,20 @@ func (p *Parser) generateUniqueResultName(sourceFile string, blockIndex int, blo
 			prefix = "ask_"
 		case DirectiveDo:
 			prefix = "do_"
+		case DirectiveSummary:
+			prefix = "summary_"
+		case DirectiveSummarize:
+			prefix = "summarize_"
+		case DirectiveEmbed:
+			prefix = "embed_"
+		case DirectiveInput:
+			prefix = "input_"
 		default:
 			prefix = "result_"
 		}
 
 		// Ensure consistent naming by using a deterministic pattern
-		resultName = fmt.Sprintf("%s%s_%s_block%d_%d.pml", prefix, adjectives[adjIndex], nouns[nounIndex], blockIndex, counter)
+		resultName = fmt.Sprintf("%s%s_%s_block%d_%d.pml", prefix, p.nameAdjectives[adjIndex], p.nameNouns[nounIndex], blockIndex, counter)
 
 		// Check both in-memory and on disk for uniqueness
 		if _, exists := p.usedNames[resultName]; exists {
@@ -62,20 +98,326 @@ func (p *Parser) generateUniqueResultName(sourceFile string, blockIndex int, blo
 			continue
 		}
 
-		// Mark as used and update counter
+		// Mark as used
 		p.usedNames[resultName] = true
-		uniqueNameCounters.Store(key, counter+1)
 		break
 	}
 	return resultName
 }
 
-// formatResult formats a result value as valid PML
-func (p *Parser) formatResult(result string) string {
-	// If it looks like a number, boolean, or null, keep it as is
-	if p.isLiteral(result) {
-		return result
+// resultsDirFor returns the directory where results for a source file are written.
+// By default this is a .pml/results directory next to the file; in central mode
+// sourcesDir/a/b/foo.pml maps to rootResultsDir/a/b/foo.
+func (p *Parser) resultsDirFor(sourcePath string) string {
+	if !p.centralResults {
+		return filepath.Join(filepath.Dir(sourcePath), ".pml", "results")
+	}
+	rel, err := filepath.Rel(p.sourcesDir, sourcePath)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		// Files outside the sources directory are keyed by name only
+		rel = filepath.Base(sourcePath)
+	}
+	rel = strings.TrimSuffix(rel, GzipExt)
+	return filepath.Join(p.rootResultsDir, strings.TrimSuffix(rel, filepath.Ext(rel)))
+}
+
+// resultLinkPath returns the path embedded in a ":--(r/...)" link for a result file.
+// In central mode the link is relative to rootResultsDir so it stays unambiguous.
+func (p *Parser) resultLinkPath(sourcePath, resultFile string) string {
+	if !p.centralResults {
+		return resultFile
+	}
+	rel, err := filepath.Rel(p.rootResultsDir, filepath.Join(p.resultsDirFor(sourcePath), resultFile))
+	if err != nil {
+		return resultFile
+	}
+	return filepath.ToSlash(rel)
+}
+
+// ResolveResultLink returns the filesystem path of the result referenced by a
+// link path (the part after "r/") in the given source file
+func (p *Parser) ResolveResultLink(sourcePath, link string) string {
+	link = strings.TrimPrefix(link, "r/")
+	if !p.centralResults {
+		return filepath.Join(p.resultsDirFor(sourcePath), filepath.FromSlash(link))
+	}
+	return filepath.Join(p.rootResultsDir, filepath.FromSlash(link))
+}
+
+// linkSummaries returns a short label for each block's result link of the file
+// at path, or nil when link summaries are disabled. In batch mode all answers
+// are titled by a single LLM request, falling back to one Summarize call per
+// block if the reply can't be parsed. Summaries are cached with the block
+// results, so unchanged results aren't summarized again.
+func (p *Parser) linkSummaries(ctx context.Context, path string, answers []string, resultFiles []string) []string {
+	if !p.summarizeLinks {
+		return nil
+	}
+
+	labels := make([]string, len(answers))
+	var indices []int
+	for i := range answers {
+		if resultFiles[i] == "" || answers[i] == "" {
+			continue
+		}
+		if p.summaryStrategy == nil {
+			if label := p.cachedLinkSummary(path, resultFiles[i], answers[i]); label != "" {
+				labels[i] = label
+				continue
+			}
+		}
+		indices = append(indices, i)
+	}
+	if len(indices) == 0 {
+		return labels
+	}
+
+	if p.summaryStrategy != nil {
+		for _, i := range indices {
+			labels[i] = linkLabel(p.summaryStrategy(answers[i]))
+		}
+		return labels
+	}
+	if p.strictCache {
+		// Strict mode doesn't call the LLM, so results without a cached label get none
+		return labels
+	}
+
+	if p.batchLinkSummaries && len(indices) > 1 {
+		titles, err := p.batchSummaries(ctx, answers, indices)
+		if err == nil {
+			for n, i := range indices {
+				labels[i] = linkLabel(titles[n])
+				p.cacheLinkSummary(path, resultFiles[i], answers[i], labels[i])
+			}
+			return labels
+		}
+		p.debugf("Warning: batch link summary failed, summarizing per block: %v\n", err)
+	}
+
+	for _, i := range indices {
+		summary, err := p.llm.Summarize(ctx, answers[i])
+		if err != nil {
+			p.debugf("Warning: failed to summarize result for block %d: %v\n", i, err)
+			continue
+		}
+		labels[i] = linkLabel(summary)
+		p.cacheLinkSummary(path, resultFiles[i], answers[i], labels[i])
+	}
+	return labels
+}
+
+// cachedLinkSummary returns the cached link label of the result linked as link
+// in the file at path, or "" if the result wasn't summarized
+func (p *Parser) cachedLinkSummary(path, link, answer string) string {
+	answer = p.redact(answer) // Cached results are redacted
+	p.cacheMu.RLock()
+	defer p.cacheMu.RUnlock()
+	for _, cached := range p.cache[path].Blocks {
+		if cached.ResultFile == link && cached.Result == answer {
+			return cached.Summary
+		}
+	}
+	return ""
+}
+
+// cacheLinkSummary records the link label of the result linked as link in the
+// file at path
+func (p *Parser) cacheLinkSummary(path, link, answer, label string) {
+	if label == "" {
+		return
+	}
+	answer = p.redact(answer) // Cached results are redacted
+	p.cacheMu.Lock()
+	defer p.cacheMu.Unlock()
+	entry, ok := p.cache[path]
+	if !ok {
+		return
+	}
+	for checksum, cached := range entry.Blocks {
+		if cached.ResultFile == link && cached.Result == answer && cached.Summary != label {
+			cached.Summary = label
+			entry.Blocks[checksum] = cached
+			p.cacheDirty = true
+		}
+	}
+}
+
+// batchLinePattern matches a numbered title line such as "2. Tokyo"
+var batchLinePattern = regexp.MustCompile(`^\s*(\d+)[.):]\s*(.+)$`)
+
+// batchSummaries asks the LLM to title all selected answers in one request and
+// returns the titles in the order of indices
+func (p *Parser) batchSummaries(ctx context.Context, answers []string, indices []int) ([]string, error) {
+	var prompt strings.Builder
+	prompt.WriteString("Give a title of at most 5 words for each of the following answers. ")
+	prompt.WriteString("Reply with exactly one line per answer in the form \"<number>. <title>\" and nothing else.\n")
+	for n, i := range indices {
+		fmt.Fprintf(&prompt, "\n%d. %s\n", n+1, answers[i])
+	}
+
+	resp, err := p.llm.Ask(ctx, prompt.String())
+	if err != nil {
+		return nil, err
+	}
+
+	titles := make([]string, len(indices))
+	for _, line := range strings.Split(resp, "\n") {
+		m := batchLinePattern.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		n, err := strconv.Atoi(m[1])
+		if err != nil || n < 1 || n > len(indices) {
+			continue
+		}
+		titles[n-1] = singleLine(m[2])
+	}
+	for n, title := range titles {
+		if title == "" {
+			return nil, fmt.Errorf("no title for answer %d in batch response", n+1)
+		}
+	}
+	return titles, nil
+}
+
+// SummaryStrategy labels a result link from the block's answer without the LLM
+type SummaryStrategy func(result string) string
+
+// maxLinkSummary is the longest link label, in characters, whether it comes from
+// the LLM or a built-in strategy
+const maxLinkSummary = 60
+
+// SummaryTruncated labels a link with the start of the answer
+func SummaryTruncated(result string) string {
+	return linkLabel(result)
+}
+
+// SummaryFirstLine labels a link with the first non-empty line of the answer
+func SummaryFirstLine(result string) string {
+	for _, line := range strings.Split(result, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			return truncateSummary(line)
+		}
+	}
+	return ""
+}
+
+// ParseSummaryStrategy returns the strategy named "llm", "first-line" or "none".
+// The llm strategy is nil, meaning link summaries come from the LLM.
+func ParseSummaryStrategy(name string) (SummaryStrategy, error) {
+	switch name {
+	case "llm", "":
+		return nil, nil
+	case "first-line":
+		return SummaryFirstLine, nil
+	case "none":
+		return SummaryTruncated, nil
+	default:
+		return nil, fmt.Errorf("unknown summary strategy %q (want llm, first-line or none)", name)
+	}
+}
+
+// truncateSummary shortens a summary to maxLinkSummary runes
+func truncateSummary(s string) string {
+	runes := []rune(s)
+	if len(runes) <= maxLinkSummary {
+		return s
+	}
+	return strings.TrimSpace(string(runes[:maxLinkSummary-3])) + "..."
+}
+
+// linkLabel turns a summary into a link label: a single line of at most
+// maxLinkSummary characters
+func linkLabel(summary string) string {
+	return truncateSummary(singleLine(summary))
+}
+
+// singleLine collapses a summary onto one line so it fits after a link
+func singleLine(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
+
+// FormatAttribute is the directive line attribute forcing how a block's answer
+// is stored in its result file, e.g. ":ask format=json"
+const FormatAttribute = "format"
+
+// Storage forms of a block's answer
+const (
+	FormatJSON = "json" // Validated and pretty-printed JSON
+	FormatText = "text" // Always a quoted and escaped string
+	FormatRaw  = "raw"  // Verbatim
+)
+
+// formatResult formats a result value as valid PML in the given format. Without
+// a format, numbers, booleans and null are kept as they are and anything else is
+// quoted.
+func (p *Parser) formatResult(result, format string) (string, error) {
+	switch format {
+	case "":
+		// If it looks like a number, boolean, or null, keep it as is
+		if p.isLiteral(result) {
+			return result, nil
+		}
+		// Otherwise treat as string and properly escape
+		return p.formatString(result), nil
+	case FormatRaw:
+		return result, nil
+	case FormatText:
+		return p.formatString(result), nil
+	case FormatJSON:
+		var pretty bytes.Buffer
+		if err := json.Indent(&pretty, []byte(stripCodeFence(result)), "", "  "); err != nil {
+			return "", fmt.Errorf("answer is not valid JSON: %w", err)
+		}
+		return pretty.String(), nil
+	}
+	return "", fmt.Errorf("unknown format %q (want json, text or raw)", format)
+}
+
+// stripCodeFence removes a Markdown code fence around an answer, such as
+// ```json ... ```, which models often add to JSON
+func stripCodeFence(s string) string {
+	body, _, _ := splitCodeFence(s)
+	return body
+}
+
+// splitCodeFence returns the content of a single Markdown code fence around an
+// answer and the fence's language, e.g. "json", if any. ok is false, and the
+// answer returned trimmed, when it isn't fenced.
+func splitCodeFence(s string) (body, language string, ok bool) {
+	trimmed := strings.TrimSpace(s)
+	if !strings.HasPrefix(trimmed, "```") || !strings.HasSuffix(trimmed, "```") || len(trimmed) < 6 {
+		return trimmed, "", false
+	}
+	s = strings.TrimSuffix(trimmed[3:], "```")
+	if newline := strings.Index(s, "\n"); newline >= 0 {
+		language = strings.TrimSpace(s[:newline])
+		s = s[newline+1:] // Drop the language tag
+	}
+	if strings.Contains(s, "```") {
+		// Several fenced blocks with prose between them
+		return trimmed, "", false
+	}
+	return strings.TrimSpace(s), language, true
+}
+
+// SetStripCodeFences sets whether a single Markdown code fence around an answer,
+// such as ```json ... ```, is removed before the answer is stored and cached.
+// The fence's language is kept in the result file metadata as "language".
+func (p *Parser) SetStripCodeFences(strip bool) {
+	p.stripFences = strip
+}
+
+// unfence returns an answer without its surrounding code fence and the fence's
+// language when code fences are stripped, or the answer unchanged otherwise
+func (p *Parser) unfence(result string) (string, string) {
+	if !p.stripFences {
+		return result, ""
+	}
+	body, language, ok := splitCodeFence(result)
+	if !ok {
+		return result, ""
 	}
-	// Otherwise treat as string and properly escape
-	return p.formatString(result)
+	return body, language
 }
@@ -1,10 +1,14 @@
 package parser
 
 import (
+	"context"
+	"fmt"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestGenerateUniqueResultName(t *testing.T) {
@@ -37,6 +41,43 @@ func TestGenerateUniqueResultName(t *testing.T) {
 	}
 }
 
+// TestNameWordlists tests that result names are drawn from custom wordlists
+func TestNameWordlists(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "pml-wordlists-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	parser := NewParser(&mockLLM{response: "Test response"}, tmpDir, tmpDir, tmpDir)
+	if err := parser.SetNameWordlists(nil, []string{"otter"}); err == nil {
+		t.Error("Expected an error for an empty adjective list")
+	}
+	if err := parser.SetNameWordlists([]string{"rusty"}, []string{}); err == nil {
+		t.Error("Expected an error for an empty noun list")
+	}
+	if err := parser.SetNameWordlists([]string{"rusty", " "}, []string{"otter"}); err == nil {
+		t.Error("Expected an error for a blank adjective")
+	}
+	if err := parser.SetNameWordlists([]string{"rusty", "shiny"}, []string{"otter", "anvil"}); err != nil {
+		t.Fatalf("SetNameWordlists() error = %v", err)
+	}
+
+	for i := 0; i < 4; i++ {
+		name := parser.generateUniqueResultName("mySourceFile.pml", i, ":ask", tmpDir)
+		parts := strings.Split(strings.TrimPrefix(name, "ask_"), "_")
+		if len(parts) < 2 {
+			t.Fatalf("Unexpected name %s", name)
+		}
+		if parts[0] != "rusty" && parts[0] != "shiny" {
+			t.Errorf("Expected a custom adjective in %s", name)
+		}
+		if parts[1] != "otter" && parts[1] != "anvil" {
+			t.Errorf("Expected a custom noun in %s", name)
+		}
+	}
+}
+
 func TestFormatResult(t *testing.T) {
 	tmpDir, err := os.MkdirTemp("", "pml-results-test-*")
 	if err != nil {
@@ -79,7 +120,10 @@ func TestFormatResult(t *testing.T) {
 
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
-			got := parser.formatResult(tc.input)
+			got, err := parser.formatResult(tc.input, "")
+			if err != nil {
+				t.Fatalf("formatResult(%q) error = %v", tc.input, err)
+			}
 			if got != tc.expected {
 				t.Errorf("formatResult(%q) = %q, want %q", tc.input, got, tc.expected)
 			}
@@ -87,6 +131,85 @@ func TestFormatResult(t *testing.T) {
 	}
 }
 
+// TestFormatResultModes tests that a format overrides the literal heuristic
+func TestFormatResultModes(t *testing.T) {
+	parser := NewParser(&mockLLM{response: "Test response"}, "sources", "compiled", "results")
+
+	testCases := []struct {
+		name     string
+		format   string
+		input    string
+		expected string
+		wantErr  bool
+	}{
+		{name: "raw string", format: FormatRaw, input: "Hello \"World\"\n", expected: "Hello \"World\"\n"},
+		{name: "raw json", format: FormatRaw, input: `{"key":"value"}`, expected: `{"key":"value"}`},
+		{name: "text number", format: FormatText, input: "123", expected: `"123"`},
+		{name: "text multiline", format: FormatText, input: "Hello\nWorld", expected: `"Hello\nWorld"`},
+		{name: "json object", format: FormatJSON, input: `{"key":"value","list":[1,2]}`, expected: "{\n  \"key\": \"value\",\n  \"list\": [\n    1,\n    2\n  ]\n}"},
+		{name: "json number", format: FormatJSON, input: "123", expected: "123"},
+		{name: "json in code fence", format: FormatJSON, input: "```json\n{\"key\": true}\n```", expected: "{\n  \"key\": true\n}"},
+		{name: "invalid json", format: FormatJSON, input: "not json", wantErr: true},
+		{name: "unknown format", format: "yaml", input: "key: value", wantErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := parser.formatResult(tc.input, tc.format)
+			if tc.wantErr {
+				if err == nil {
+					t.Errorf("formatResult(%q, %q) = %q, want an error", tc.input, tc.format, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("formatResult(%q, %q) error = %v", tc.input, tc.format, err)
+			}
+			if got != tc.expected {
+				t.Errorf("formatResult(%q, %q) = %q, want %q", tc.input, tc.format, got, tc.expected)
+			}
+		})
+	}
+}
+
+// TestWriteResultFormat tests that the format attribute decides how the answer is stored
+func TestWriteResultFormat(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "pml-results-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	parser := NewParser(&mockLLM{response: "Test response"}, tmpDir, tmpDir, tmpDir)
+	for format, want := range map[string]string{
+		"":         "Answer:\n42\n",
+		FormatRaw:  "Answer:\n42\n",
+		FormatText: "Answer:\n\"42\"\n",
+		FormatJSON: "Answer:\n42\n",
+	} {
+		block := Block{Type: DirectiveAsk, Content: []string{"What is 6*7?"}}
+		if format != "" {
+			block.Attributes = map[string]string{FormatAttribute: format}
+		}
+		resultFile := "result_" + format + ".pml"
+		if err := parser.writeResult(block, "42", nil, nil, resultFile, tmpDir, "Test summary", ResultSource{}, ""); err != nil {
+			t.Fatalf("writeResult(format=%s) failed: %v", format, err)
+		}
+		content, err := os.ReadFile(filepath.Join(tmpDir, resultFile))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasSuffix(string(content), want) {
+			t.Errorf("format=%s: expected the file to end with %q, got:\n%s", format, want, content)
+		}
+	}
+
+	block := Block{Type: DirectiveAsk, Content: []string{"Give me JSON"}, Attributes: map[string]string{FormatAttribute: FormatJSON}}
+	if err := parser.writeResult(block, "not json", nil, nil, "invalid.pml", tmpDir, "Test summary", ResultSource{}, ""); err == nil {
+		t.Error("Expected an error for an answer that is not valid JSON")
+	}
+}
+
 func TestWriteResult(t *testing.T) {
 	tmpDir, err := os.MkdirTemp("", "pml-results-*")
 	if err != nil {
@@ -104,7 +227,7 @@ func TestWriteResult(t *testing.T) {
 	resultFile := "test_result.pml"
 	summary := "Test summary"
 
-	err = parser.writeResult(block, result, resultFile, tmpDir, summary)
+	err = parser.writeResult(block, result, nil, nil, resultFile, tmpDir, summary, ResultSource{}, "")
 	if err != nil {
 		t.Fatalf("writeResult failed: %v", err)
 	}
@@ -241,3 +364,326 @@ Q3
 		seen[f] = true
 	}
 }
+
+func TestCentralResultsLayout(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "pml-results-central-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	sourcesDir := filepath.Join(tmpDir, "sources")
+	resultsRoot := filepath.Join(tmpDir, "results")
+	nestedDir := filepath.Join(sourcesDir, "a", "b")
+	if err := os.MkdirAll(nestedDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	parser := NewParser(&mockLLM{response: "Test response", Delay: 10 * time.Millisecond}, sourcesDir, sourcesDir, resultsRoot)
+	parser.SetCentralResults(true)
+
+	srcFile := filepath.Join(nestedDir, "foo.pml")
+	if err := os.WriteFile(srcFile, []byte(":ask\nWhat is 2+2?\n:--"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := parser.ProcessFile(context.Background(), srcFile); err != nil {
+		t.Fatal(err)
+	}
+
+	// Results mirror the sources tree under the results root
+	files, err := os.ReadDir(filepath.Join(resultsRoot, "a", "b", "foo"))
+	if err != nil {
+		t.Fatalf("Expected mirrored results directory: %v", err)
+	}
+	if len(files) != 1 {
+		t.Fatalf("Expected 1 result file, got %d", len(files))
+	}
+
+	// Nothing is written next to the source file
+	if _, err := os.Stat(filepath.Join(nestedDir, ".pml", "results")); !os.IsNotExist(err) {
+		t.Error("Expected no local .pml/results directory in central mode")
+	}
+
+	processed, err := os.ReadFile(srcFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	contentStr := string(processed)
+	linkStart := strings.Index(contentStr, ":--(r/")
+	if linkStart == -1 {
+		t.Fatal("Processed file missing result link")
+	}
+	link := strings.TrimSuffix(strings.TrimPrefix(contentStr[linkStart:], ":--("), ")")
+
+	wantLink := "r/a/b/foo/" + files[0].Name()
+	if link != wantLink {
+		t.Errorf("Expected link %q, got %q", wantLink, link)
+	}
+
+	resolved := parser.ResolveResultLink(srcFile, link)
+	if resolved != filepath.Join(resultsRoot, "a", "b", "foo", files[0].Name()) {
+		t.Errorf("Link resolved to unexpected path %s", resolved)
+	}
+	if _, err := os.Stat(resolved); err != nil {
+		t.Errorf("Resolved result file does not exist: %v", err)
+	}
+}
+
+func TestBatchLinkSummaries(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "pml-link-summaries-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	var asks, batches, summarizes int32
+	llm := &mockLLM{
+		Delay: 10 * time.Millisecond,
+		answer: func(prompt string) string {
+			if strings.Contains(prompt, "one line per answer") {
+				atomic.AddInt32(&batches, 1)
+				return "1. Paris\n2. Tokyo\n3. Rome"
+			}
+			atomic.AddInt32(&asks, 1)
+			switch {
+			case strings.Contains(prompt, "France"):
+				return "The capital of France is Paris."
+			case strings.Contains(prompt, "Japan"):
+				return "The capital of Japan is Tokyo."
+			default:
+				return "The capital of Italy is Rome."
+			}
+		},
+	}
+	summarizing := &summarizeCounter{mockLLM: llm, count: &summarizes}
+
+	parser := NewParser(summarizing, tmpDir, tmpDir, filepath.Join(tmpDir, "results"))
+	parser.SetSummarizeLinks(true)
+	parser.SetBatchLinkSummaries(true)
+
+	srcFile := filepath.Join(tmpDir, "capitals.pml")
+	content := ":ask\nCapital of France?\n:--\n\n:ask\nCapital of Japan?\n:--\n\n:ask\nCapital of Italy?\n:--\n"
+	if err := os.WriteFile(srcFile, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := parser.ProcessFile(context.Background(), srcFile); err != nil {
+		t.Fatalf("ProcessFile failed: %v", err)
+	}
+
+	if asks != 3 || batches != 1 || summarizes != 0 {
+		t.Errorf("Expected 3 asks, 1 batch request and no Summarize calls, got %d, %d, %d", asks, batches, summarizes)
+	}
+
+	processed, err := os.ReadFile(srcFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var labels []string
+	for _, line := range strings.Split(string(processed), "\n") {
+		if strings.HasPrefix(line, ":--(r/") {
+			labels = append(labels, strings.TrimSpace(line[strings.Index(line, ")")+1:]))
+		}
+	}
+	want := []string{"Paris", "Tokyo", "Rome"}
+	if strings.Join(labels, ",") != strings.Join(want, ",") {
+		t.Errorf("Expected link labels %v, got %v", want, labels)
+	}
+}
+
+func TestBatchLinkSummariesFallback(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "pml-link-summaries-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	var summarizes int32
+	llm := &mockLLM{
+		Delay: 10 * time.Millisecond,
+		answer: func(prompt string) string {
+			if strings.Contains(prompt, "one line per answer") {
+				return "I cannot do that"
+			}
+			return "Answer"
+		},
+	}
+	parser := NewParser(&summarizeCounter{mockLLM: llm, count: &summarizes}, tmpDir, tmpDir, filepath.Join(tmpDir, "results"))
+	parser.SetSummarizeLinks(true)
+	parser.SetBatchLinkSummaries(true)
+
+	srcFile := filepath.Join(tmpDir, "fallback.pml")
+	if err := os.WriteFile(srcFile, []byte(":ask\nQ1\n:--\n:ask\nQ2\n:--\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := parser.ProcessFile(context.Background(), srcFile); err != nil {
+		t.Fatalf("ProcessFile failed: %v", err)
+	}
+	if summarizes != 2 {
+		t.Errorf("Expected fallback to 2 Summarize calls, got %d", summarizes)
+	}
+}
+
+// summarizeCounter counts Summarize calls made through the wrapped mock
+type summarizeCounter struct {
+	*mockLLM
+	count *int32
+}
+
+func (s *summarizeCounter) Summarize(ctx context.Context, text string) (string, error) {
+	atomic.AddInt32(s.count, 1)
+	return s.mockLLM.Summarize(ctx, text)
+}
+
+func TestSummaryStrategies(t *testing.T) {
+	tests := []struct {
+		name     string
+		strategy SummaryStrategy
+		want     []string
+	}{
+		{"first-line", SummaryFirstLine, []string{"Paris", "Tokyo"}},
+		{"custom", func(result string) string { return strings.ToUpper(strings.Fields(result)[0]) }, []string{"PARIS", "TOKYO"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpDir, err := os.MkdirTemp("", "pml-summary-strategy-*")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(tmpDir)
+
+			var summarizes int32
+			llm := &mockLLM{
+				Delay: 10 * time.Millisecond,
+				answer: func(prompt string) string {
+					if strings.Contains(prompt, "France") {
+						return "Paris\n\nThe capital of France is Paris."
+					}
+					return "Tokyo\n\nThe capital of Japan is Tokyo."
+				},
+			}
+			parser := NewParser(&summarizeCounter{mockLLM: llm, count: &summarizes}, tmpDir, tmpDir, filepath.Join(tmpDir, "results"))
+			parser.SetSummarizeLinks(true)
+			parser.SetSummaryStrategy(tt.strategy)
+
+			srcFile := filepath.Join(tmpDir, "capitals.pml")
+			content := ":ask\nCapital of France?\n:--\n\n:ask\nCapital of Japan?\n:--\n"
+			if err := os.WriteFile(srcFile, []byte(content), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := parser.ProcessFile(context.Background(), srcFile); err != nil {
+				t.Fatalf("ProcessFile failed: %v", err)
+			}
+
+			if summarizes != 0 {
+				t.Errorf("Expected no Summarize calls, got %d", summarizes)
+			}
+			processed, err := os.ReadFile(srcFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var labels []string
+			for _, line := range strings.Split(string(processed), "\n") {
+				if strings.HasPrefix(line, ":--(r/") {
+					labels = append(labels, strings.TrimSpace(line[strings.Index(line, ")")+1:]))
+				}
+			}
+			if strings.Join(labels, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("Expected link labels %v, got %v", tt.want, labels)
+			}
+		})
+	}
+}
+
+// TestLinkSummariesCached tests that link labels are truncated and cached with
+// the results, so unchanged results aren't summarized again
+func TestLinkSummariesCached(t *testing.T) {
+	tmpDir := t.TempDir()
+	answer := strings.Repeat("A very long answer. ", 20)
+	var summarizes int32
+	newParser := func() *Parser {
+		llm := &mockLLM{response: answer, Delay: time.Millisecond}
+		parser := NewParser(&summarizeCounter{mockLLM: llm, count: &summarizes}, tmpDir, tmpDir, filepath.Join(tmpDir, "results"))
+		parser.SetSummarizeLinks(true)
+		return parser
+	}
+
+	srcFile := filepath.Join(tmpDir, "long.pml")
+	if err := os.WriteFile(srcFile, []byte(":ask\nExplain it at length\n:--\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	parser := newParser()
+	if err := parser.ProcessFile(context.Background(), srcFile); err != nil {
+		t.Fatalf("ProcessFile failed: %v", err)
+	}
+	processed, err := os.ReadFile(srcFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	line := strings.TrimSpace(string(processed))
+	label := strings.TrimSpace(line[strings.Index(line, ")")+1:])
+	if !strings.HasPrefix(label, "Summary: A very long answer.") || !strings.HasSuffix(label, "...") || len([]rune(label)) > maxLinkSummary {
+		t.Errorf("Expected a truncated summary label, got %q", label)
+	}
+
+	// Processing again, in this parser or a new one, reuses the cached label
+	if err := parser.ProcessFile(context.Background(), srcFile); err != nil {
+		t.Fatalf("ProcessFile failed: %v", err)
+	}
+	if err := newParser().ProcessFile(context.Background(), srcFile); err != nil {
+		t.Fatalf("ProcessFile failed: %v", err)
+	}
+	if got := atomic.LoadInt32(&summarizes); got != 1 {
+		t.Errorf("Expected 1 Summarize call, got %d", got)
+	}
+	reprocessed, err := os.ReadFile(srcFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(reprocessed) != string(processed) {
+		t.Errorf("Expected the same link label, got:\n%s\nwant:\n%s", reprocessed, processed)
+	}
+}
+
+// TestStripCodeFences tests that a code fence around an answer is removed
+// before storing it only when enabled
+func TestStripCodeFences(t *testing.T) {
+	fenced := "```json\n{\"city\": \"Paris\"}\n```"
+	for _, strip := range []bool{true, false} {
+		t.Run(fmt.Sprintf("strip=%v", strip), func(t *testing.T) {
+			tmpDir := t.TempDir()
+			srcFile := filepath.Join(tmpDir, "fenced.pml")
+			if err := os.WriteFile(srcFile, []byte(":ask\nCapital of France as JSON\n:--\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			parser := NewParser(&mockLLM{response: fenced, Delay: time.Millisecond}, tmpDir, tmpDir, filepath.Join(tmpDir, "results"))
+			parser.SetStripCodeFences(strip)
+			var result string
+			parser.SetResultSink(func(ctx context.Context, r BlockResult) error {
+				result = r.Result
+				return nil
+			})
+			if err := parser.ProcessFile(context.Background(), srcFile); err != nil {
+				t.Fatalf("ProcessFile() error = %v", err)
+			}
+
+			want := fenced
+			if strip {
+				want = `{"city": "Paris"}`
+			}
+			if result != want {
+				t.Errorf("Expected the result %q, got %q", want, result)
+			}
+			for name, data := range readTree(t, parser.resultsDirFor(srcFile)) {
+				if !strings.HasSuffix(data, "Answer:\n"+want+"\n") {
+					t.Errorf("Expected %s to store %q, got:\n%s", name, want, data)
+				}
+				if strip != strings.Contains(data, `"language":"json"`) {
+					t.Errorf("Expected the fence language in the metadata only when stripping, got:\n%s", data)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,61 @@
+package parser
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// maxResultWriters bounds the result files written at once, so a burst of
+// concurrent blocks can't exhaust file descriptors
+const maxResultWriters = 16
+
+// lockResultPath serializes access to the result file at path within the
+// process and bounds the number of result files written at once. The returned
+// function releases it.
+func (p *Parser) lockResultPath(path string) func() {
+	mu, _ := p.resultLocks.LoadOrStore(path, &sync.Mutex{})
+	mu.(*sync.Mutex).Lock()
+	p.resultWriters <- struct{}{}
+	return func() {
+		<-p.resultWriters
+		mu.(*sync.Mutex).Unlock()
+	}
+}
+
+// writeResultFile replaces the result file at path with content. Writes to the
+// same path are serialized, and the content is renamed into place so readers
+// never see a partly written file.
+func (p *Parser) writeResultFile(path string, content []byte) error {
+	unlock := p.lockResultPath(path)
+	defer unlock()
+	return writeFileAtomic(path, content)
+}
+
+// writeFileAtomic writes content to a temporary file next to path and renames it over path
+func writeFileAtomic(path string, content []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("failed to replace %s: %w", filepath.Base(path), err)
+	}
+	return nil
+}
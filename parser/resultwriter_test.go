@@ -0,0 +1,82 @@
+package parser
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// TestWriteResultFileConcurrent tests that concurrent writes of the same result
+// file never leave it torn and that concurrent metadata updates are not lost.
+// Run with -race to check the synchronization.
+func TestWriteResultFileConcurrent(t *testing.T) {
+	tmpDir := t.TempDir()
+	parser := NewParser(&mockLLM{}, tmpDir, tmpDir, filepath.Join(tmpDir, "results"))
+	path := filepath.Join(tmpDir, "result.pml")
+
+	const writers = 50
+	contents := make(map[string]bool, writers)
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		content := fmt.Sprintf("%s{\"writer\":%d}\n\n%s\n", MetadataPrefix, i, strings.Repeat(fmt.Sprintf("answer %d ", i), 2000))
+		contents[content] = true
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := parser.writeResultFile(path, []byte(content)); err != nil {
+				t.Errorf("writeResultFile failed: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !contents[string(data)] {
+		t.Fatalf("Expected the content of one complete write, got %d bytes starting %q", len(data), string(data[:60]))
+	}
+
+	// Each update reads and rewrites the file; none may overwrite another's key
+	var updates sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		updates.Add(1)
+		go func(i int) {
+			defer updates.Done()
+			if err := parser.setResultMetadata(path, fmt.Sprintf("key%d", i), i); err != nil {
+				t.Errorf("setResultMetadata failed: %v", err)
+			}
+		}(i)
+	}
+	updates.Wait()
+
+	jsonStr, found, err := readMetadataLine(path)
+	if err != nil || !found {
+		t.Fatalf("Expected metadata, got %v", err)
+	}
+	var metadata map[string]interface{}
+	if err := json.Unmarshal([]byte(jsonStr), &metadata); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < writers; i++ {
+		if _, ok := metadata[fmt.Sprintf("key%d", i)]; !ok {
+			t.Errorf("Lost the metadata update of writer %d", i)
+		}
+	}
+
+	// No temporary files are left behind
+	entries, err := os.ReadDir(tmpDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if strings.HasSuffix(entry.Name(), ".tmp") {
+			t.Errorf("Temporary file left behind: %s", entry.Name())
+		}
+	}
+}
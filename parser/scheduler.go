@@ -0,0 +1,86 @@
+package parser
+
+import (
+	"context"
+	"sync"
+)
+
+// Scheduler controls how much work runs at once. ProcessFile asks it for the
+// slots its blocks run in and ProcessAllFiles for the slots its files run in,
+// so tests can substitute a deterministic scheduler and observe parallelism
+// without relying on timing.
+type Scheduler interface {
+	// NewSlots returns a pool allowing n holders at once
+	NewSlots(n int) Slots
+}
+
+// Slots is a pool of execution slots
+type Slots interface {
+	// Acquire waits for a free slot, or returns the error of a done context
+	Acquire(ctx context.Context) error
+	// Release frees a slot taken by Acquire
+	Release()
+}
+
+// chanScheduler is the Scheduler backed by buffered channels
+type chanScheduler struct{}
+
+func (chanScheduler) NewSlots(n int) Slots {
+	return make(chanSlots, n)
+}
+
+// chanSlots is a semaphore holding one element per slot in use
+type chanSlots chan struct{}
+
+func (s chanSlots) Acquire(ctx context.Context) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case s <- struct{}{}:
+		return nil
+	}
+}
+
+func (s chanSlots) Release() {
+	<-s
+}
+
+// SetScheduler sets the scheduler limiting concurrent blocks and files. The
+// default uses channel semaphores.
+func (p *Parser) SetScheduler(scheduler Scheduler) {
+	p.scheduler = scheduler
+}
+
+// newSlots returns a pool of n slots from the parser's scheduler
+func (p *Parser) newSlots(n int) Slots {
+	if p.scheduler == nil {
+		return chanScheduler{}.NewSlots(n)
+	}
+	return p.scheduler.NewSlots(n)
+}
+
+// blockSlot is the slot a block is processed in. A best-of-N block gives it up
+// while its requests run, each in a slot of the same pool, so they count
+// against the file's concurrency without waiting on the block's own slot.
+type blockSlot struct {
+	slots Slots
+	once  sync.Once
+}
+
+// release frees the block's slot, once however often it is called
+func (s *blockSlot) release() {
+	s.once.Do(s.slots.Release)
+}
+
+type blockSlotKey struct{}
+
+// withBlockSlot returns a context carrying the slot of the block processed with it
+func withBlockSlot(ctx context.Context, slot *blockSlot) context.Context {
+	return context.WithValue(ctx, blockSlotKey{}, slot)
+}
+
+// blockSlotFrom returns the slot of the block processed with ctx, or nil
+func blockSlotFrom(ctx context.Context) *blockSlot {
+	slot, _ := ctx.Value(blockSlotKey{}).(*blockSlot)
+	return slot
+}
@@ -0,0 +1,144 @@
+package parser
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeScheduler hands out slots that record how many are held at once, and
+// signal when an Acquire has to wait for a free slot
+type fakeScheduler struct {
+	slots *fakeSlots
+}
+
+func (s *fakeScheduler) NewSlots(n int) Slots {
+	s.slots = &fakeSlots{tokens: make(chan struct{}, n), blocked: make(chan struct{}, 1)}
+	return s.slots
+}
+
+type fakeSlots struct {
+	tokens   chan struct{}
+	blocked  chan struct{} // Receives when an Acquire finds no free slot
+	mu       sync.Mutex
+	held     int
+	maxHeld  int
+	acquired int
+}
+
+func (s *fakeSlots) Acquire(ctx context.Context) error {
+	select {
+	case s.tokens <- struct{}{}:
+	default:
+		select {
+		case s.blocked <- struct{}{}:
+		default:
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case s.tokens <- struct{}{}:
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.held++
+	s.acquired++
+	if s.held > s.maxHeld {
+		s.maxHeld = s.held
+	}
+	return nil
+}
+
+func (s *fakeSlots) Release() {
+	s.mu.Lock()
+	s.held--
+	s.mu.Unlock()
+	<-s.tokens
+}
+
+func (s *fakeSlots) counts() (held, maxHeld, acquired int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.held, s.maxHeld, s.acquired
+}
+
+// gateLLM reports each call on started and answers once gate is closed
+type gateLLM struct {
+	mockLLM
+	started chan struct{}
+	gate    chan struct{}
+}
+
+func (g *gateLLM) Ask(ctx context.Context, prompt string) (string, error) {
+	g.started <- struct{}{}
+	select {
+	case <-ctx.Done():
+		return "", ctx.Err()
+	case <-g.gate:
+		return "Answer", nil
+	}
+}
+
+// TestSchedulerLimitsBlocks tests that a file's blocks run in the slots of the
+// parser's scheduler, never more at once than its concurrency setting
+func TestSchedulerLimitsBlocks(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "pml-scheduler-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	const blocks = 5
+	var content strings.Builder
+	for i := 0; i < blocks; i++ {
+		fmt.Fprintf(&content, ":ask\nQuestion %d\n:--\n", i)
+	}
+	srcFile := filepath.Join(tmpDir, "test.pml")
+	if err := os.WriteFile(srcFile, []byte(content.String()), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(srcFile+SidecarExt, []byte("concurrency = 2\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	llm := &gateLLM{started: make(chan struct{}, blocks), gate: make(chan struct{})}
+	scheduler := &fakeScheduler{}
+	parser := NewParser(llm, tmpDir, filepath.Join(tmpDir, "compiled"), filepath.Join(tmpDir, "results"))
+	parser.SetScheduler(scheduler)
+
+	done := make(chan error, 1)
+	go func() { done <- parser.ProcessFile(context.Background(), srcFile) }()
+
+	// Two blocks are asked while the third waits for a slot
+	<-llm.started
+	<-llm.started
+	<-scheduler.slots.blocked
+	if held, _, _ := scheduler.slots.counts(); held != 2 {
+		t.Errorf("Expected 2 slots held, got %d", held)
+	}
+	select {
+	case <-llm.started:
+		t.Error("Expected the third block to wait for a slot")
+	default:
+	}
+
+	close(llm.gate)
+	if err := <-done; err != nil {
+		t.Fatalf("ProcessFile() error = %v", err)
+	}
+	held, maxHeld, acquired := scheduler.slots.counts()
+	if maxHeld != 2 {
+		t.Errorf("Expected at most 2 blocks at once, got %d", maxHeld)
+	}
+	if acquired != blocks {
+		t.Errorf("Expected %d slots acquired, got %d", blocks, acquired)
+	}
+	if held != 0 {
+		t.Errorf("Expected all slots released, got %d held", held)
+	}
+}
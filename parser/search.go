@@ -0,0 +1,95 @@
+package parser
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// searchSnippetRunes is the length of the text around a match shown in a SearchResult
+const searchSnippetRunes = 80
+
+// SearchResult is a result in the results index whose file matches a search
+type SearchResult struct {
+	IndexEntry
+	Line    int    // 1-based line of the first match in the result file
+	Snippet string // Text around the first match
+}
+
+// SearchPattern compiles a search query: a case-insensitive substring, or a
+// regular expression when isRegex is set
+func SearchPattern(query string, isRegex bool) (*regexp.Regexp, error) {
+	if !isRegex {
+		query = "(?i)" + regexp.QuoteMeta(query)
+	}
+	pattern, err := regexp.Compile(query)
+	if err != nil {
+		return nil, fmt.Errorf("invalid search pattern: %w", err)
+	}
+	return pattern, nil
+}
+
+// SearchResults returns the results in the results index whose question or
+// answer matches pattern, in index order. Result files that can't be read are
+// skipped; RebuildIndex brings a stale index up to date.
+func (p *Parser) SearchResults(pattern *regexp.Regexp) ([]SearchResult, error) {
+	entries, err := p.ReadIndex()
+	if err != nil {
+		return nil, err
+	}
+
+	var matches []SearchResult
+	for _, entry := range entries {
+		content, err := os.ReadFile(entry.ResultFile)
+		if err != nil {
+			p.debugf("Skipping %s in search: %v\n", entry.ResultFile, err)
+			continue
+		}
+		for i, line := range strings.Split(string(content), "\n") {
+			if strings.HasPrefix(line, MetadataPrefix) {
+				continue
+			}
+			loc := pattern.FindStringIndex(line)
+			if loc == nil {
+				continue
+			}
+			matches = append(matches, SearchResult{
+				IndexEntry: entry,
+				Line:       i + 1,
+				Snippet:    searchSnippet(line, loc[0], loc[1]),
+			})
+			break
+		}
+	}
+	return matches, nil
+}
+
+// searchSnippet returns the part of line around the match from start to end,
+// with "..." marking text left out
+func searchSnippet(line string, start, end int) string {
+	runes := []rune(line)
+	if len(runes) <= searchSnippetRunes {
+		return strings.TrimSpace(line)
+	}
+	// Center the window on the match, counted in runes
+	matchStart := len([]rune(line[:start]))
+	matchEnd := len([]rune(line[:end]))
+	from := matchStart - (searchSnippetRunes-(matchEnd-matchStart))/2
+	if from < 0 {
+		from = 0
+	}
+	to := from + searchSnippetRunes
+	if to > len(runes) {
+		to = len(runes)
+		from = max(0, to-searchSnippetRunes)
+	}
+	snippet := strings.TrimSpace(string(runes[from:to]))
+	if from > 0 {
+		snippet = "..." + snippet
+	}
+	if to < len(runes) {
+		snippet += "..."
+	}
+	return snippet
+}
@@ -0,0 +1,94 @@
+package parser
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestSearchResults tests that a search returns the results whose question or answer matches
+func TestSearchResults(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "pml-search-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	answers := map[string]string{
+		"What is the capital of France?": "The capital of France is Paris.",
+		"What is the capital of Japan?":  "Tokyo is the capital of Japan.",
+		"How tall is Mount Everest?":     "About 8849 metres.",
+	}
+	files := map[string]string{
+		"geo.pml":      ":ask\nWhat is the capital of France?\n:--\n\n:ask\nHow tall is Mount Everest?\n:--\n",
+		"japan.pml":    ":ask\nWhat is the capital of Japan?\n:--\n",
+		"mountain.pml": ":ask\nHow tall is Mount Everest?\n:--\n",
+	}
+	var paths []string
+	for name, content := range files {
+		path := filepath.Join(tmpDir, name)
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, path)
+	}
+
+	parser := NewParser(&mockLLM{
+		Delay:  10 * time.Millisecond,
+		answer: func(prompt string) string { return answers[strings.TrimSpace(prompt)] },
+	}, tmpDir, filepath.Join(tmpDir, "compiled"), filepath.Join(tmpDir, "results"))
+	if err := parser.ProcessAllFiles(context.Background(), paths); err != nil {
+		t.Fatalf("ProcessAllFiles failed: %v", err)
+	}
+
+	tests := []struct {
+		query   string
+		isRegex bool
+		want    []string // Source files of the expected results, in index order
+	}{
+		{"PARIS", false, []string{"geo.pml"}},
+		{"capital of", false, []string{"geo.pml", "japan.pml"}},
+		{"everest", false, []string{"geo.pml", "mountain.pml"}},
+		{`\d{4} metres`, true, []string{"geo.pml", "mountain.pml"}},
+		{"Berlin", false, nil},
+	}
+	for _, tt := range tests {
+		pattern, err := SearchPattern(tt.query, tt.isRegex)
+		if err != nil {
+			t.Fatalf("SearchPattern(%q) failed: %v", tt.query, err)
+		}
+		results, err := parser.SearchResults(pattern)
+		if err != nil {
+			t.Fatalf("SearchResults(%q) failed: %v", tt.query, err)
+		}
+		var got []string
+		for _, result := range results {
+			got = append(got, filepath.Base(result.SourceFile))
+			if !pattern.MatchString(result.Snippet) || result.Line == 0 {
+				t.Errorf("Search %q: snippet %q at line %d doesn't show the match", tt.query, result.Snippet, result.Line)
+			}
+		}
+		if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("Search %q: expected results from %v, got %v", tt.query, tt.want, got)
+		}
+	}
+
+	if _, err := SearchPattern("(", true); err == nil {
+		t.Error("Expected an error for an invalid regular expression")
+	}
+}
+
+func TestSearchSnippet(t *testing.T) {
+	line := strings.Repeat("a", 100) + "needle" + strings.Repeat("b", 100)
+	start := strings.Index(line, "needle")
+	snippet := searchSnippet(line, start, start+len("needle"))
+	if !strings.HasPrefix(snippet, "...") || !strings.HasSuffix(snippet, "...") || !strings.Contains(snippet, "needle") {
+		t.Errorf("Expected a shortened snippet around the match, got %q", snippet)
+	}
+	if got := searchSnippet("  short line ", 2, 7); got != "short line" {
+		t.Errorf("Expected short lines whole, got %q", got)
+	}
+}
@@ -0,0 +1,263 @@
+package parser
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SidecarExt is appended to a PML file's path to find its settings sidecar (foo.pml.toml)
+const SidecarExt = ".toml"
+
+// DirConfigName is the settings file applying to all PML files in its directory
+// and below. Settings cascade like .editorconfig: a directory's config overrides
+// those of its parents, and a file's sidecar overrides them all.
+const DirConfigName = ".pml" + SidecarExt
+
+// EnvNameEnv selects the [env.<name>] section of settings files, e.g. PML_ENV=prod
+const EnvNameEnv = "PML_ENV"
+
+// fileSettings holds per-file overrides loaded from a sidecar
+type fileSettings struct {
+	Model       string        // Model for blocks without their own model= attribute
+	Timeout     time.Duration // Limit on processing the whole file
+	Tags        []string      // Replaces the parser's include tag filter when set
+	Concurrency int           // Blocks of the file processed at once (default if 0)
+	Temperature *float32      // Sampling temperature of the run; only read from the sources directory config
+}
+
+// merge returns s with the settings set in override replacing its own
+func (s fileSettings) merge(override fileSettings) fileSettings {
+	if override.Model != "" {
+		s.Model = override.Model
+	}
+	if override.Timeout > 0 {
+		s.Timeout = override.Timeout
+	}
+	if override.Tags != nil {
+		s.Tags = override.Tags
+	}
+	if override.Concurrency > 0 {
+		s.Concurrency = override.Concurrency
+	}
+	if override.Temperature != nil {
+		s.Temperature = override.Temperature
+	}
+	return s
+}
+
+// loadSettings resolves the settings of a PML file: the directory configs from
+// the sources directory down to the file's directory, then the file's sidecar.
+// Files outside the sources directory only use the config of their own directory.
+func (p *Parser) loadSettings(path string) (fileSettings, error) {
+	// Directories from the file's up to the sources directory
+	dir := filepath.Dir(path)
+	dirs := []string{dir}
+	root, rootErr := filepath.Abs(p.sourcesDir)
+	current, err := filepath.Abs(dir)
+	if rootErr == nil && err == nil {
+		if rel, err := filepath.Rel(root, current); err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			for current != root {
+				current = filepath.Dir(current)
+				dirs = append(dirs, current)
+			}
+		}
+	}
+
+	env := p.envName()
+	var settings fileSettings
+	for i := len(dirs) - 1; i >= 0; i-- {
+		configPath := filepath.Join(dirs[i], DirConfigName)
+		dirSettings, err := readSettings(configPath, "config", env)
+		if err != nil {
+			return settings, fmt.Errorf("%s: %w", configPath, err)
+		}
+		if dirSettings.Temperature != nil && !p.isSourcesDir(dirs[i]) {
+			return settings, fmt.Errorf("%s: %w", configPath, errRunTemperature)
+		}
+		settings = settings.merge(dirSettings)
+	}
+	sidecar, err := loadSidecar(path, env)
+	if err != nil {
+		return settings, err
+	}
+	if sidecar.Temperature != nil {
+		return settings, fmt.Errorf("%s: %w", path+SidecarExt, errRunTemperature)
+	}
+	return settings.merge(sidecar), nil
+}
+
+// errRunTemperature rejects a temperature set for some files only: the LLM
+// client is created with one temperature for the whole run
+var errRunTemperature = errors.New("temperature can only be set in the config of the sources directory")
+
+// isSourcesDir reports whether dir is the sources directory
+func (p *Parser) isSourcesDir(dir string) bool {
+	root, err := filepath.Abs(p.sourcesDir)
+	if err != nil {
+		return false
+	}
+	abs, err := filepath.Abs(dir)
+	return err == nil && abs == root
+}
+
+// Temperature returns the sampling temperature the config of the sources
+// directory sets for the selected environment, or nil if it sets none. The
+// LLM client is created with it, so it applies to every block of the run.
+func (p *Parser) Temperature() (*float32, error) {
+	configPath := filepath.Join(p.sourcesDir, DirConfigName)
+	settings, err := readSettings(configPath, "config", p.envName())
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", configPath, err)
+	}
+	return settings.Temperature, nil
+}
+
+// SetEnv selects the environment, such as "dev" or "prod", whose [env.<name>]
+// sections of settings files apply, overriding $PML_ENV
+func (p *Parser) SetEnv(env string) {
+	p.env = env
+}
+
+// envName returns the environment selecting settings file sections, if any
+func (p *Parser) envName() string {
+	if p.env != "" {
+		return p.env
+	}
+	return os.Getenv(EnvNameEnv)
+}
+
+// loadSidecar reads the settings sidecar of a PML file, applying the [env.<name>]
+// section of env. A missing sidecar yields empty settings. Only "key = value"
+// lines and [env.<name>] headers are supported, with string, integer and string
+// array values.
+func loadSidecar(path, env string) (fileSettings, error) {
+	return readSettings(path+SidecarExt, "sidecar", env)
+}
+
+// readSettings reads a settings file, a sidecar or a directory config. Settings
+// under an [env.<name>] header only apply when env is that name, and override
+// the file's top-level settings wherever they appear. A missing file yields
+// empty settings.
+func readSettings(path, kind, env string) (fileSettings, error) {
+	var settings, envSettings fileSettings
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return settings, nil
+		}
+		return settings, fmt.Errorf("failed to open %s: %w", kind, err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	lineNum := 0
+	target := &settings
+	var discarded fileSettings // Settings of other environments, only checked
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			name, ok := strings.CutPrefix(strings.TrimSpace(line[1:len(line)-1]), "env.")
+			if !ok || name == "" {
+				return settings, fmt.Errorf("%s line %d: unknown section %s, expected [env.<name>]", kind, lineNum, line)
+			}
+			if name == env {
+				target = &envSettings
+			} else {
+				discarded = fileSettings{}
+				target = &discarded
+			}
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return settings, fmt.Errorf("%s line %d: expected key = value", kind, lineNum)
+		}
+		key = strings.TrimSpace(key)
+		value = strings.TrimSpace(value)
+
+		switch key {
+		case "model":
+			target.Model, err = parseTOMLString(value)
+		case "timeout":
+			target.Timeout, err = parseTOMLDuration(value)
+		case "tags":
+			target.Tags, err = parseTOMLStringArray(value)
+		case "concurrency":
+			target.Concurrency, err = strconv.Atoi(value)
+			if err == nil && target.Concurrency < 1 {
+				err = fmt.Errorf("concurrency must be at least 1")
+			}
+		case "temperature":
+			var temperature float64
+			temperature, err = strconv.ParseFloat(value, 32)
+			if err == nil && (temperature < 0 || temperature > 2) {
+				err = fmt.Errorf("temperature must be between 0 and 2")
+			}
+			t := float32(temperature)
+			target.Temperature = &t
+		default:
+			err = fmt.Errorf("unknown setting %q", key)
+		}
+		if err != nil {
+			return settings, fmt.Errorf("%s line %d: %w", kind, lineNum, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return settings, fmt.Errorf("failed to read %s: %w", kind, err)
+	}
+	return settings.merge(envSettings), nil
+}
+
+// parseTOMLString parses a basic or literal TOML string
+func parseTOMLString(value string) (string, error) {
+	if len(value) >= 2 && value[0] == '\'' && value[len(value)-1] == '\'' {
+		return value[1 : len(value)-1], nil
+	}
+	s, err := strconv.Unquote(value)
+	if err != nil || !strings.HasPrefix(value, `"`) {
+		return "", fmt.Errorf("invalid string %s", value)
+	}
+	return s, nil
+}
+
+// parseTOMLDuration parses a duration string such as "30s", or a number of seconds
+func parseTOMLDuration(value string) (time.Duration, error) {
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(seconds) * time.Second, nil
+	}
+	s, err := parseTOMLString(value)
+	if err != nil {
+		return 0, err
+	}
+	return time.ParseDuration(s)
+}
+
+// parseTOMLStringArray parses a single-line array of strings
+func parseTOMLStringArray(value string) ([]string, error) {
+	if !strings.HasPrefix(value, "[") || !strings.HasSuffix(value, "]") {
+		return nil, fmt.Errorf("invalid array %s", value)
+	}
+	items := []string{}
+	for _, item := range strings.Split(value[1:len(value)-1], ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		s, err := parseTOMLString(item)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, s)
+	}
+	return items, nil
+}
@@ -0,0 +1,260 @@
+package parser
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSidecarOverridesModel(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "pml-sidecar-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	overridden := filepath.Join(tmpDir, "overridden.pml")
+	plain := filepath.Join(tmpDir, "plain.pml")
+	for _, f := range []string{overridden, plain} {
+		if err := os.WriteFile(f, []byte(":ask\nWhat is 2+2?\n:--\n\n:ask model=pinned\nWhat is 3+3?\n:--\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sidecar := "# Settings for overridden.pml\nmodel = \"premium\"\ntimeout = \"5s\"\n"
+	if err := os.WriteFile(overridden+SidecarExt, []byte(sidecar), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	llm := &modelTrackingLLM{
+		inFlight: make(map[string]int),
+		peak:     make(map[string]int),
+		calls:    make(map[string]int),
+	}
+	parser := NewParser(llm, tmpDir, tmpDir, filepath.Join(tmpDir, "results"))
+
+	if err := parser.ProcessFile(context.Background(), overridden); err != nil {
+		t.Fatalf("ProcessFile failed: %v", err)
+	}
+	if llm.calls["premium"] != 1 || llm.calls["pinned"] != 1 || llm.calls[""] != 0 {
+		t.Errorf("Expected the sidecar model for unpinned blocks only, got %v", llm.calls)
+	}
+
+	if err := parser.ProcessFile(context.Background(), plain); err != nil {
+		t.Fatalf("ProcessFile failed: %v", err)
+	}
+	if llm.calls["premium"] != 1 || llm.calls[""] != 1 || llm.calls["pinned"] != 2 {
+		t.Errorf("Expected the sidecar not to apply to other files, got %v", llm.calls)
+	}
+}
+
+func TestLoadSidecar(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "pml-sidecar-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	path := filepath.Join(tmpDir, "file.pml")
+
+	// No sidecar means no overrides
+	settings, err := loadSidecar(path, "")
+	if err != nil {
+		t.Fatalf("loadSidecar failed: %v", err)
+	}
+	if settings.Model != "" || settings.Timeout != 0 || settings.Tags != nil {
+		t.Errorf("Expected empty settings, got %+v", settings)
+	}
+
+	content := "model = 'gpt-4o'\ntimeout = 90\ntags = [\"smoke\", \"fast\"]\n"
+	if err := os.WriteFile(path+SidecarExt, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	settings, err = loadSidecar(path, "")
+	if err != nil {
+		t.Fatalf("loadSidecar failed: %v", err)
+	}
+	if settings.Model != "gpt-4o" || settings.Timeout != 90*time.Second || len(settings.Tags) != 2 || settings.Tags[1] != "fast" {
+		t.Errorf("Unexpected settings: %+v", settings)
+	}
+
+	if err := os.WriteFile(path+SidecarExt, []byte("retries = 3\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadSidecar(path, ""); err == nil {
+		t.Error("Expected error for unknown setting")
+	}
+}
+
+// TestDirectoryConfigInheritance tests that directory configs cascade down to the files beneath them
+func TestDirectoryConfigInheritance(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "pml-dirconfig-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	pkgDir := filepath.Join(tmpDir, "packages", "billing")
+	if err := os.MkdirAll(pkgDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	rootConfig := "model = \"root-model\"\ntimeout = \"30s\"\ntags = [\"smoke\"]\n"
+	if err := os.WriteFile(filepath.Join(tmpDir, DirConfigName), []byte(rootConfig), 0644); err != nil {
+		t.Fatal(err)
+	}
+	pkgConfig := "model = \"billing-model\"\nconcurrency = 1\n"
+	if err := os.WriteFile(filepath.Join(pkgDir, DirConfigName), []byte(pkgConfig), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	content := ":ask tags=smoke\nFirst\n:--\n\n:ask tags=smoke\nSecond\n:--\n\n:ask tags=smoke\nThird\n:--\n\n:ask\nUntagged\n:--\n"
+	rootFile := filepath.Join(tmpDir, "root.pml")
+	pkgFile := filepath.Join(pkgDir, "invoice.pml")
+	for _, f := range []string{rootFile, pkgFile} {
+		if err := os.WriteFile(f, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	llm := &modelTrackingLLM{
+		inFlight: make(map[string]int),
+		peak:     make(map[string]int),
+		calls:    make(map[string]int),
+	}
+	parser := NewParser(llm, tmpDir, tmpDir, filepath.Join(tmpDir, "results"))
+
+	settings, err := parser.loadSettings(pkgFile)
+	if err != nil {
+		t.Fatalf("loadSettings failed: %v", err)
+	}
+	if settings.Model != "billing-model" || settings.Timeout != 30*time.Second || settings.Concurrency != 1 ||
+		len(settings.Tags) != 1 || settings.Tags[0] != "smoke" {
+		t.Errorf("Expected merged settings, got %+v", settings)
+	}
+
+	for _, f := range []string{rootFile, pkgFile} {
+		if err := parser.ProcessFile(context.Background(), f); err != nil {
+			t.Fatalf("ProcessFile(%s) failed: %v", f, err)
+		}
+	}
+	if llm.calls["root-model"] != 3 || llm.calls["billing-model"] != 3 || llm.calls[""] != 0 {
+		t.Errorf("Expected each file to use its nearest config's model and inherited tags, got %v", llm.calls)
+	}
+	if llm.peak["billing-model"] != 1 {
+		t.Errorf("Expected the package concurrency of 1, got a peak of %d", llm.peak["billing-model"])
+	}
+	if llm.peak["root-model"] < 2 {
+		t.Errorf("Expected the root file to keep the default concurrency, got a peak of %d", llm.peak["root-model"])
+	}
+}
+
+// TestEnvSettings tests that PML_ENV and SetEnv select the [env.<name>] section of settings files
+func TestEnvSettings(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "pml-envconfig-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	config := `model = "base-model"
+concurrency = 2
+
+[env.dev]
+model = "cheap-model"
+
+[env.prod]
+model = "strong-model"
+concurrency = 8
+`
+	if err := os.WriteFile(filepath.Join(tmpDir, DirConfigName), []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(tmpDir, "file.pml")
+	if err := os.WriteFile(path, []byte(":ask\nQuestion\n:--\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	llm := &modelTrackingLLM{
+		inFlight: make(map[string]int),
+		peak:     make(map[string]int),
+		calls:    make(map[string]int),
+	}
+	parser := NewParser(llm, tmpDir, tmpDir, filepath.Join(tmpDir, "results"))
+
+	tests := []struct {
+		env         string
+		model       string
+		concurrency int
+	}{
+		{"", "base-model", 2},
+		{"dev", "cheap-model", 2},
+		{"prod", "strong-model", 8},
+		{"staging", "base-model", 2},
+	}
+	for _, tt := range tests {
+		t.Setenv(EnvNameEnv, tt.env)
+		settings, err := parser.loadSettings(path)
+		if err != nil {
+			t.Fatalf("loadSettings(%q) failed: %v", tt.env, err)
+		}
+		if settings.Model != tt.model || settings.Concurrency != tt.concurrency {
+			t.Errorf("PML_ENV=%q: expected model %s and concurrency %d, got %+v", tt.env, tt.model, tt.concurrency, settings)
+		}
+	}
+
+	// SetEnv overrides PML_ENV
+	t.Setenv(EnvNameEnv, "dev")
+	parser.SetEnv("prod")
+	if err := parser.ProcessFile(context.Background(), path); err != nil {
+		t.Fatalf("ProcessFile failed: %v", err)
+	}
+	if llm.calls["strong-model"] != 1 || llm.calls["cheap-model"] != 0 {
+		t.Errorf("Expected the prod model to be used, got %v", llm.calls)
+	}
+
+	if err := os.WriteFile(path+SidecarExt, []byte("[profile.prod]\nmodel = \"x\"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := parser.loadSettings(path); err == nil {
+		t.Error("Expected error for unknown section")
+	}
+}
+
+// TestTemperatureSettings tests that the sources directory config sets the
+// temperature of the run for the selected environment, and that other settings
+// files can't set one
+func TestTemperatureSettings(t *testing.T) {
+	tmpDir := t.TempDir()
+	config := "temperature = 0.7\n\n[env.dev]\ntemperature = 0\n"
+	if err := os.WriteFile(filepath.Join(tmpDir, DirConfigName), []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	parser := NewParser(&mockLLM{response: "Answer"}, tmpDir, tmpDir, filepath.Join(tmpDir, "results"))
+
+	for env, want := range map[string]float32{"": 0.7, "dev": 0, "prod": 0.7} {
+		parser.SetEnv(env)
+		temperature, err := parser.Temperature()
+		if err != nil {
+			t.Fatalf("Temperature() with env %q failed: %v", env, err)
+		}
+		if temperature == nil || *temperature != want {
+			t.Errorf("Expected env %q to select temperature %v, got %v", env, want, temperature)
+		}
+	}
+
+	path := filepath.Join(tmpDir, "file.pml")
+	if err := os.WriteFile(path+SidecarExt, []byte("temperature = 1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := parser.loadSettings(path); !errors.Is(err, errRunTemperature) {
+		t.Errorf("Expected a sidecar temperature to be rejected, got %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(tmpDir, DirConfigName), []byte("temperature = 3\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := parser.Temperature(); err == nil {
+		t.Error("Expected a temperature above 2 to be rejected")
+	}
+}
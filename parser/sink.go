@@ -0,0 +1,39 @@
+package parser
+
+import (
+	"context"
+	"fmt"
+)
+
+// ResultSink receives the result of each block answered by the LLM, e.g. to
+// post it to a webhook or store it in a database. It may be called
+// concurrently for blocks processed at the same time.
+type ResultSink func(ctx context.Context, result BlockResult) error
+
+// SetResultSink sets a function called after each block is answered and its
+// result file written. Cached results and blocks that were not approved are not
+// sent. Sink errors are logged in debug mode and the block still succeeds,
+// unless SetFailOnSinkError is set.
+func (p *Parser) SetResultSink(sink ResultSink) {
+	p.resultSink = sink
+}
+
+// SetFailOnSinkError sets whether a result sink error fails its block. The
+// result is then not cached, so the block is answered and sent again next run.
+func (p *Parser) SetFailOnSinkError(fail bool) {
+	p.failOnSinkError = fail
+}
+
+// sendResult passes a new block result to the result sink, if one is set
+func (p *Parser) sendResult(ctx context.Context, result BlockResult) error {
+	if p.resultSink == nil {
+		return nil
+	}
+	if err := p.resultSink(ctx, result); err != nil {
+		if p.failOnSinkError {
+			return fmt.Errorf("result sink failed: %w", err)
+		}
+		p.debugf("Warning: result sink failed for block %d of %s: %v\n", result.BlockIdx, result.FilePath, err)
+	}
+	return nil
+}
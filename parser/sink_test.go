@@ -0,0 +1,90 @@
+package parser
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestResultSink tests that the sink receives one call per answered block
+func TestResultSink(t *testing.T) {
+	tmpDir := t.TempDir()
+	content := ":ask\nFirst\n:--\n\n:ask\nSecond\n:--\n\n:do\nThird\n:--\n"
+	srcFile := filepath.Join(tmpDir, "sink.pml")
+	if err := os.WriteFile(srcFile, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var mu sync.Mutex
+	var received []BlockResult
+	parser := NewParser(&mockLLM{
+		Delay:  10 * time.Millisecond,
+		answer: func(prompt string) string { return "Answer to " + strings.TrimSpace(prompt) },
+	}, tmpDir, tmpDir, filepath.Join(tmpDir, "results"))
+	parser.SetResultSink(func(ctx context.Context, result BlockResult) error {
+		mu.Lock()
+		defer mu.Unlock()
+		received = append(received, result)
+		return nil
+	})
+
+	if err := parser.ProcessFile(context.Background(), srcFile); err != nil {
+		t.Fatalf("ProcessFile() error = %v", err)
+	}
+	if len(received) != 3 {
+		t.Fatalf("Expected one sink call per block, got %d", len(received))
+	}
+	sort.Slice(received, func(i, j int) bool { return received[i].BlockIdx < received[j].BlockIdx })
+	for i, want := range []string{"Answer to First", "Answer to Second", "Executed action: Third"} {
+		if received[i].BlockIdx != i || received[i].Result != want || received[i].FilePath != srcFile {
+			t.Errorf("Unexpected sink call %d: %+v", i, received[i])
+		}
+	}
+
+	// Cached results are not sent again
+	if err := os.WriteFile(srcFile, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := parser.ProcessFile(context.Background(), srcFile); err != nil {
+		t.Fatalf("ProcessFile() error = %v", err)
+	}
+	if len(received) != 3 {
+		t.Errorf("Expected no sink calls for cached results, got %d calls", len(received))
+	}
+}
+
+// TestResultSinkErrors tests that sink errors only fail blocks when configured to
+func TestResultSinkErrors(t *testing.T) {
+	tmpDir := t.TempDir()
+	content := ":ask\nQuestion\n:--\n"
+	srcFile := filepath.Join(tmpDir, "sink.pml")
+	if err := os.WriteFile(srcFile, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	parser := NewParser(&mockLLM{response: "Answer", Delay: 10 * time.Millisecond}, tmpDir, tmpDir, filepath.Join(tmpDir, "results"))
+	errWebhook := errors.New("webhook unavailable")
+	parser.SetResultSink(func(ctx context.Context, result BlockResult) error { return errWebhook })
+
+	if err := parser.ProcessFile(context.Background(), srcFile); err != nil {
+		t.Fatalf("Expected sink errors not to fail the block, got %v", err)
+	}
+
+	if err := os.WriteFile(srcFile, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	parser.SetForceProcess(true)
+	parser.SetFailOnSinkError(true)
+	if err := parser.ProcessFile(context.Background(), srcFile); !errors.Is(err, errWebhook) {
+		t.Fatalf("Expected the sink error to fail the block, got %v", err)
+	}
+	if data, _ := os.ReadFile(srcFile); string(data) != content {
+		t.Errorf("Expected the failed block to be left in the file, got:\n%s", data)
+	}
+}
@@ -0,0 +1,85 @@
+package parser
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// FileStat records how long ProcessFile took on a file
+type FileStat struct {
+	Path     string
+	Duration time.Duration // Wall-clock time, including waiting for the LLM
+	OverSLA  bool          // Duration exceeded the SLA set with SetFileSLA
+}
+
+// Stats summarizes the files processed by a Parser
+type Stats struct {
+	Files []FileStat // The last processing of each file, sorted by path
+}
+
+// SLAError is returned by ProcessFile for a file that took longer than the SLA
+// when SetFileSLA is set to fail. The file's results are still written.
+type SLAError struct {
+	FileStat
+	Threshold time.Duration
+}
+
+func (e *SLAError) Error() string {
+	return fmt.Sprintf("%s took %s to process, exceeding the SLA of %s", e.Path, e.Duration.Round(time.Millisecond), e.Threshold)
+}
+
+// SetFileSLA sets the longest a file may take to process. A slower file is
+// reported with a warning, see SetSLAWarning, and when fail is set ProcessFile
+// returns an *SLAError for it. A threshold of 0 disables the SLA.
+func (p *Parser) SetFileSLA(threshold time.Duration, fail bool) {
+	p.fileSLA = threshold
+	p.failOnSLA = fail
+}
+
+// SetSLAWarning sets a function called with each file that exceeds the SLA
+// set with SetFileSLA. Without one, the warning is only logged in debug mode.
+// It may be called concurrently for files processed at the same time.
+func (p *Parser) SetSLAWarning(warn func(FileStat)) {
+	p.slaWarning = warn
+}
+
+// Stats returns how long each file processed so far took
+func (p *Parser) Stats() Stats {
+	p.statsMu.Lock()
+	defer p.statsMu.Unlock()
+	stats := Stats{Files: make([]FileStat, 0, len(p.fileStats))}
+	for _, stat := range p.fileStats {
+		stats.Files = append(stats.Files, stat)
+	}
+	sort.Slice(stats.Files, func(i, j int) bool { return stats.Files[i].Path < stats.Files[j].Path })
+	return stats
+}
+
+// recordFileStat records that processing the file at path took duration and
+// enforces the SLA, returning err or the *SLAError failing the file
+func (p *Parser) recordFileStat(path string, duration time.Duration, err error) error {
+	stat := FileStat{
+		Path:     path,
+		Duration: duration,
+		OverSLA:  p.fileSLA > 0 && duration > p.fileSLA,
+	}
+	p.statsMu.Lock()
+	if p.fileStats == nil {
+		p.fileStats = make(map[string]FileStat)
+	}
+	p.fileStats[path] = stat
+	p.statsMu.Unlock()
+
+	if !stat.OverSLA {
+		return err
+	}
+	p.debugf("Warning: %s took %s to process, exceeding the SLA of %s\n", path, duration.Round(time.Millisecond), p.fileSLA)
+	if p.slaWarning != nil {
+		p.slaWarning(stat)
+	}
+	if p.failOnSLA && err == nil {
+		return &SLAError{FileStat: stat, Threshold: p.fileSLA}
+	}
+	return err
+}
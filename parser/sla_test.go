@@ -0,0 +1,84 @@
+package parser
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestFileSLA tests that only the file taking longer than the SLA is warned
+// about and, when the SLA is enforced, fails
+func TestFileSLA(t *testing.T) {
+	for _, fail := range []bool{false, true} {
+		tmpDir := t.TempDir()
+		fastFile := filepath.Join(tmpDir, "fast.pml")
+		slowFile := filepath.Join(tmpDir, "slow.pml")
+		if err := os.WriteFile(fastFile, []byte(":ask\nFast\n:--\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(slowFile, []byte(":ask\nSlow\n:--\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		parser := NewParser(&mockLLM{
+			Delay: time.Millisecond,
+			answer: func(prompt string) string {
+				if prompt == "Slow" {
+					time.Sleep(300 * time.Millisecond)
+				}
+				return "Answer"
+			},
+		}, tmpDir, tmpDir, filepath.Join(tmpDir, "results"))
+		parser.SetFileSLA(150*time.Millisecond, fail)
+		var mu sync.Mutex
+		var warned []string
+		parser.SetSLAWarning(func(stat FileStat) {
+			mu.Lock()
+			defer mu.Unlock()
+			warned = append(warned, stat.Path)
+		})
+
+		if err := parser.ProcessFile(context.Background(), fastFile); err != nil {
+			t.Fatalf("ProcessFile(fast) error = %v", err)
+		}
+		err := parser.ProcessFile(context.Background(), slowFile)
+		var slaErr *SLAError
+		if fail {
+			if !errors.As(err, &slaErr) || slaErr.Path != slowFile || slaErr.Threshold != 150*time.Millisecond {
+				t.Errorf("Expected an SLAError for the slow file, got %v", err)
+			}
+		} else if err != nil {
+			t.Errorf("Expected only a warning without enforcement, got %v", err)
+		}
+
+		if len(warned) != 1 || warned[0] != slowFile {
+			t.Errorf("Expected a warning for the slow file only, got %v", warned)
+		}
+
+		stats := parser.Stats()
+		if len(stats.Files) != 2 {
+			t.Fatalf("Expected stats for two files, got %+v", stats.Files)
+		}
+		fast, slow := stats.Files[0], stats.Files[1]
+		if fast.Path != fastFile || fast.OverSLA || fast.Duration >= 150*time.Millisecond {
+			t.Errorf("Unexpected stat for the fast file: %+v", fast)
+		}
+		if slow.Path != slowFile || !slow.OverSLA || slow.Duration < 300*time.Millisecond {
+			t.Errorf("Unexpected stat for the slow file: %+v", slow)
+		}
+
+		// The slow file's answer is written even when it fails the SLA
+		data, err := os.ReadFile(slowFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := parseResultLink(strings.TrimSpace(string(data))); !ok {
+			t.Errorf("Expected the slow file to be answered, got %q", data)
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package parser
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// GzipExt marks a gzip-compressed PML file (foo.pml.gz or foo.prompt.gz)
+const GzipExt = ".gz"
+
+// isGzipSource reports whether a PML file is stored gzip-compressed
+func isGzipSource(path string) bool {
+	return strings.HasSuffix(strings.ToLower(path), GzipExt)
+}
+
+// readSource reads a PML file, decompressing .pml.gz files
+func readSource(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil || !isGzipSource(path) {
+		return data, err
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress %s: %w", path, err)
+	}
+	defer zr.Close()
+	content, err := io.ReadAll(zr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress %s: %w", path, err)
+	}
+	return content, nil
+}
+
+// writeSource writes a PML file, compressing .pml.gz files
+func writeSource(path string, content []byte) error {
+	if !isGzipSource(path) {
+		return os.WriteFile(path, content, 0644)
+	}
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(content); err != nil {
+		return fmt.Errorf("failed to compress %s: %w", path, err)
+	}
+	if err := zw.Close(); err != nil {
+		return fmt.Errorf("failed to compress %s: %w", path, err)
+	}
+	return os.WriteFile(path, buf.Bytes(), 0644)
+}
+
+// openSource opens a PML file for reading, decompressing .pml.gz files
+func openSource(path string) (io.ReadCloser, error) {
+	f, err := os.Open(path)
+	if err != nil || !isGzipSource(path) {
+		return f, err
+	}
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to decompress %s: %w", path, err)
+	}
+	return &gzipSource{Reader: zr, file: f}, nil
+}
+
+// gzipSource closes both the decompressor and the file under it
+type gzipSource struct {
+	*gzip.Reader
+	file *os.File
+}
+
+func (s *gzipSource) Close() error {
+	s.Reader.Close()
+	return s.file.Close()
+}
+
+// sourceWriter writes a new version of a PML file to a temporary file beside it,
+// which replaces the file on commit, so readers never see a partial file
+type sourceWriter struct {
+	path string
+	tmp  *os.File
+	buf  *bufio.Writer
+	zw   *gzip.Writer
+	io.Writer
+}
+
+// createSource starts writing a new version of the PML file at path,
+// compressing .pml.gz files
+func createSource(path string) (*sourceWriter, error) {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return nil, err
+	}
+	w := &sourceWriter{path: path, tmp: tmp, buf: bufio.NewWriter(tmp)}
+	w.Writer = w.buf
+	if isGzipSource(path) {
+		w.zw = gzip.NewWriter(w.buf)
+		w.Writer = w.zw
+	}
+	return w, nil
+}
+
+// commit replaces the PML file with what was written, keeping its permissions
+func (w *sourceWriter) commit() error {
+	if err := w.finish(); err != nil {
+		return err
+	}
+	return os.Rename(w.tmp.Name(), w.path)
+}
+
+// finish completes the temporary file, with the PML file's permissions, ready
+// to be renamed over it
+func (w *sourceWriter) finish() error {
+	if w.zw != nil {
+		if err := w.zw.Close(); err != nil {
+			return fmt.Errorf("failed to compress %s: %w", w.path, err)
+		}
+	}
+	if err := w.buf.Flush(); err != nil {
+		return err
+	}
+	if err := w.tmp.Close(); err != nil {
+		return err
+	}
+	mode := os.FileMode(0644)
+	if info, err := os.Stat(w.path); err == nil {
+		mode = info.Mode().Perm()
+	}
+	return os.Chmod(w.tmp.Name(), mode)
+}
+
+// abort discards what was written; it does nothing after a commit
+func (w *sourceWriter) abort() {
+	w.tmp.Close()
+	os.Remove(w.tmp.Name())
+}
+
+// NewlineMode controls the trailing newline of rewritten PML files
+type NewlineMode int
+
+const (
+	// NewlinePreserve keeps the file's original trailing newlines
+	NewlinePreserve NewlineMode = iota
+	// NewlineEnsureOne ends the file with exactly one newline
+	NewlineEnsureOne
+)
+
+// SetTrailingNewline sets how the end of rewritten PML files is formatted.
+// The default, NewlinePreserve, leaves it as it was.
+func (p *Parser) SetTrailingNewline(mode NewlineMode) {
+	p.newlineMode = mode
+}
+
+// formatSource applies the trailing newline mode to rewritten file content
+func (p *Parser) formatSource(content string) string {
+	if p.newlineMode != NewlineEnsureOne {
+		return content
+	}
+	newline := "\n"
+	if strings.Contains(content, "\r\n") {
+		newline = "\r\n"
+	}
+	return strings.TrimRight(content, "\r\n") + newline
+}
+
+// newlineWriter applies NewlineEnsureOne to content written in pieces, holding
+// back newlines until it is known whether more content follows them
+type newlineWriter struct {
+	w       io.Writer
+	pending []byte // Newlines not yet written
+	crlf    bool   // The content uses \r\n line endings
+	last    byte   // Last byte written
+}
+
+func (n *newlineWriter) Write(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	if (n.last == '\r' && b[0] == '\n') || bytes.Contains(b, []byte("\r\n")) {
+		n.crlf = true
+	}
+	n.last = b[len(b)-1]
+
+	trimmed := bytes.TrimRight(b, "\r\n")
+	if len(trimmed) == 0 {
+		n.pending = append(n.pending, b...)
+		return len(b), nil
+	}
+	if _, err := n.w.Write(n.pending); err != nil {
+		return 0, err
+	}
+	if _, err := n.w.Write(trimmed); err != nil {
+		return 0, err
+	}
+	n.pending = append(n.pending[:0], b[len(trimmed):]...)
+	return len(b), nil
+}
+
+// close ends the content with exactly one newline
+func (n *newlineWriter) close() error {
+	newline := "\n"
+	if n.crlf {
+		newline = "\r\n"
+	}
+	_, err := io.WriteString(n.w, newline)
+	return err
+}
@@ -0,0 +1,96 @@
+package parser
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestProcessFileGzip tests that a .pml.gz file is found, processed and written back compressed
+func TestProcessFileGzip(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "pml-gzip-*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	p := NewParser(&mockLLM{response: "Paris", Delay: 10 * time.Millisecond}, tmpDir, filepath.Join(tmpDir, "compiled"), filepath.Join(tmpDir, "results"))
+
+	gzFile := filepath.Join(tmpDir, "archive.pml.gz")
+	content := ":ask\nCapital of France?\n:--\n"
+	if err := writeSource(gzFile, []byte(content)); err != nil {
+		t.Fatalf("Failed to write gzip file: %v", err)
+	}
+
+	files, err := p.FindPMLFiles()
+	if err != nil {
+		t.Fatalf("FindPMLFiles failed: %v", err)
+	}
+	if len(files) != 1 || files[0] != gzFile {
+		t.Fatalf("Expected to find %s, got %v", gzFile, files)
+	}
+
+	if err := p.ProcessFile(context.Background(), gzFile); err != nil {
+		t.Fatalf("ProcessFile failed: %v", err)
+	}
+
+	processed, err := readSource(gzFile)
+	if err != nil {
+		t.Fatalf("Expected the processed file to still be gzip-compressed: %v", err)
+	}
+	if !strings.Contains(string(processed), ":--(r/") || strings.Contains(string(processed), ":ask") {
+		t.Errorf("Expected the block to be replaced by a result link, got:\n%s", processed)
+	}
+
+	// The checksum is taken from the decompressed content
+	if got, want := p.cache[gzFile].Checksum, p.calculateChecksum(content); got != want {
+		t.Errorf("Expected cache checksum %s of the decompressed content, got %s", want, got)
+	}
+}
+
+// TestTrailingNewline tests that rewritten files keep their ending by default and can be normalized
+func TestTrailingNewline(t *testing.T) {
+	tests := []struct {
+		name    string
+		mode    NewlineMode
+		content string
+		suffix  string
+	}{
+		{"preserve one", NewlinePreserve, ":ask\nQuestion\n:--\n", ")\n"},
+		{"preserve none", NewlinePreserve, ":ask\nQuestion\n:--", ")"},
+		{"ensure from none", NewlineEnsureOne, ":ask\nQuestion\n:--", ")\n"},
+		{"ensure from many", NewlineEnsureOne, ":ask\nQuestion\n:--\n\n\n", ")\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpDir, err := os.MkdirTemp("", "pml-newline-*")
+			if err != nil {
+				t.Fatalf("Failed to create temp dir: %v", err)
+			}
+			defer os.RemoveAll(tmpDir)
+
+			p := NewParser(&mockLLM{response: "Answer", Delay: 10 * time.Millisecond}, tmpDir, filepath.Join(tmpDir, "compiled"), filepath.Join(tmpDir, "results"))
+			p.SetTrailingNewline(tt.mode)
+
+			pmlFile := filepath.Join(tmpDir, "test.pml")
+			if err := os.WriteFile(pmlFile, []byte(tt.content), 0644); err != nil {
+				t.Fatalf("Failed to write test file: %v", err)
+			}
+			if err := p.ProcessFile(context.Background(), pmlFile); err != nil {
+				t.Fatalf("ProcessFile failed: %v", err)
+			}
+
+			processed, err := os.ReadFile(pmlFile)
+			if err != nil {
+				t.Fatalf("Failed to read processed file: %v", err)
+			}
+			if !strings.HasSuffix(string(processed), tt.suffix) {
+				t.Errorf("Expected the file to end with %q, got %q", tt.suffix, processed)
+			}
+		})
+	}
+}
@@ -0,0 +1,81 @@
+package parser
+
+import "sync"
+
+// SetResultCallback sets a function called with each block's result as blocks
+// of a file complete. Blocks still run concurrently, but results are released
+// in block order, so a consumer can render a file top to bottom. Blocks
+// filtered out by tags are not reported. The callback is never called
+// concurrently for the same file.
+func (p *Parser) SetResultCallback(fn func(BlockResult)) {
+	p.resultCallback = fn
+}
+
+// resultStream buffers the block results of one file and releases them in block order
+type resultStream struct {
+	mu      sync.Mutex
+	fn      func(BlockResult)
+	path    string
+	blocks  []Block
+	pending []*BlockResult
+	skipped []bool
+	next    int // Index of the next block to release
+}
+
+// newResultStream returns a stream for the blocks of the file at path, or nil
+// when no result callback is set
+func (p *Parser) newResultStream(path string, blocks []Block) *resultStream {
+	if p.resultCallback == nil {
+		return nil
+	}
+	return &resultStream{
+		fn:      p.resultCallback,
+		path:    path,
+		blocks:  blocks,
+		pending: make([]*BlockResult, len(blocks)),
+		skipped: make([]bool, len(blocks)),
+	}
+}
+
+// complete records the result of block i and releases every result now in order
+func (s *resultStream) complete(i int, result string, err error) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pending[i] = &BlockResult{
+		FilePath: s.path,
+		BlockIdx: i,
+		Block:    s.blocks[i],
+		Result:   result,
+		Err:      err,
+	}
+	s.flush()
+}
+
+// skip marks block i as not processed, so later results aren't held back by it
+func (s *resultStream) skip(i int) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.skipped[i] = true
+	s.flush()
+}
+
+// flush releases the completed results at the front of the stream
+func (s *resultStream) flush() {
+	for s.next < len(s.blocks) {
+		switch {
+		case s.skipped[s.next]:
+		case s.pending[s.next] != nil:
+			s.fn(*s.pending[s.next])
+			s.pending[s.next] = nil
+		default:
+			return
+		}
+		s.next++
+	}
+}
@@ -0,0 +1,74 @@
+package parser
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// slowFirstLLM answers "Block N" prompts, taking longer for earlier blocks
+type slowFirstLLM struct {
+	mu        sync.Mutex
+	completed []string
+}
+
+func (s *slowFirstLLM) Ask(ctx context.Context, prompt string) (string, error) {
+	var n int
+	fmt.Sscanf(prompt, "Block %d", &n)
+	time.Sleep(time.Duration(4-n) * 30 * time.Millisecond)
+	s.mu.Lock()
+	s.completed = append(s.completed, prompt)
+	s.mu.Unlock()
+	return "Answer to " + prompt, nil
+}
+
+func (s *slowFirstLLM) Summarize(ctx context.Context, text string) (string, error) {
+	return "Summary", nil
+}
+
+// TestSetResultCallback tests that results are delivered in block order despite out-of-order completion
+func TestSetResultCallback(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "pml-stream-*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	llm := &slowFirstLLM{}
+	p := NewParser(llm, tmpDir, filepath.Join(tmpDir, "compiled"), filepath.Join(tmpDir, "results"))
+
+	var delivered []int
+	p.SetResultCallback(func(r BlockResult) {
+		if r.Err != nil {
+			t.Errorf("Unexpected error for block %d: %v", r.BlockIdx, r.Err)
+		}
+		if want := fmt.Sprintf("Answer to Block %d", r.BlockIdx); r.Result != want {
+			t.Errorf("Expected result %q, got %q", want, r.Result)
+		}
+		delivered = append(delivered, r.BlockIdx)
+	})
+
+	var content strings.Builder
+	for i := 0; i < 4; i++ {
+		fmt.Fprintf(&content, ":ask\nBlock %d\n:--\n\n", i)
+	}
+	pmlFile := filepath.Join(tmpDir, "test.pml")
+	if err := os.WriteFile(pmlFile, []byte(content.String()), 0644); err != nil {
+		t.Fatalf("Failed to write test file: %v", err)
+	}
+	if err := p.ProcessFile(context.Background(), pmlFile); err != nil {
+		t.Fatalf("ProcessFile failed: %v", err)
+	}
+
+	if llm.completed[0] == "Block 0" {
+		t.Fatalf("Expected blocks to complete out of order, got %v", llm.completed)
+	}
+	if fmt.Sprint(delivered) != "[0 1 2 3]" {
+		t.Errorf("Expected results in block order, got %v", delivered)
+	}
+}
@@ -0,0 +1,382 @@
+package parser
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// SetStreamingThreshold makes ProcessFile stream files of at least size bytes:
+// the file is read, its blocks processed and its new version written
+// incrementally, so memory use is bounded by the block concurrency rather than
+// the file size. Files with :summary blocks or :include lines, dry runs
+// (-diff), -emit-python, -only-changed-blocks and transactional runs need the
+// whole file and are processed in memory as usual. With -summarize-links, links
+// are labeled one by one rather than in a batch. Zero, the default, disables
+// streaming.
+func (p *Parser) SetStreamingThreshold(size int64) {
+	p.streamThreshold = size
+}
+
+// errNotStreamable makes ProcessFile fall back to processing a file in memory
+var errNotStreamable = errors.New("file can't be streamed")
+
+// streams reports whether a file of the given size is processed by streaming
+func (p *Parser) streams(size int64) bool {
+	return p.streamThreshold > 0 && size >= p.streamThreshold &&
+		p.diffOutput == nil && !p.emitPython && p.changedLines == nil && p.currentTxn() == nil
+}
+
+// streamScan is what a first pass over a streamed file finds out before any
+// block is processed
+type streamScan struct {
+	checksum   string          // File checksum, as calculateChecksum computes it
+	blocks     int             // Number of blocks
+	hasSummary bool            // The file has :summary blocks
+	hasInclude bool            // The file has :include lines
+	present    map[string]bool // Checksums of the file's blocks
+	linked     map[string]bool // Result files the file links to
+}
+
+// prepareStreamBlock resolves what shapes the prompt of the block at index i,
+// as prepareBlocks does for a whole file
+func (p *Parser) prepareStreamBlock(block *Block, i int, dir string, settings fileSettings) error {
+	if p.envInterpolation {
+		if err := p.expandBlockEnv(block, i); err != nil {
+			return err
+		}
+	}
+	if p.templateValues != nil {
+		if err := p.renderBlockTemplate(block, i); err != nil {
+			return err
+		}
+	}
+	if err := attachImage(block, i, dir); err != nil {
+		return err
+	}
+	if _, err := blockTTL(block.Attributes); err != nil {
+		return fmt.Errorf("block %d: %w", i, err)
+	}
+	if _, _, err := p.bestOf(*block); err != nil {
+		return fmt.Errorf("block %d: %w", i, err)
+	}
+	if block.Model == "" {
+		block.Model = settings.Model
+	}
+	return nil
+}
+
+// scanStream reads a file once without keeping it, checking its syntax and
+// collecting what is needed before processing starts
+func (p *Parser) scanStream(path string, settings fileSettings) (*streamScan, error) {
+	src, err := openSource(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file: %w", err)
+	}
+	defer src.Close()
+
+	scan := &streamScan{present: make(map[string]bool), linked: make(map[string]bool)}
+	checksum := newFileChecksum()
+	scanner := p.newBlockScanner(src)
+	scanner.onLine = func(line string) {
+		checksum.addLine(line)
+		addResultLink(scan.linked, line)
+	}
+	for {
+		item, err := scanner.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			var syntaxErr *SyntaxError
+			if errors.As(err, &syntaxErr) {
+				return nil, fmt.Errorf("failed to parse blocks: %w", err)
+			}
+			return nil, fmt.Errorf("failed to read file: %w", err)
+		}
+		if item.Include != nil {
+			scan.hasInclude = true
+		}
+		if item.Block == nil {
+			continue
+		}
+		block := *item.Block
+		if err := p.prepareStreamBlock(&block, scan.blocks, filepath.Dir(path), settings); err != nil {
+			return nil, err
+		}
+		scan.present[p.calculateBlockChecksum(block)] = true
+		scan.hasSummary = scan.hasSummary || block.Type == DirectiveSummary
+		scan.blocks++
+	}
+	scan.checksum = checksum.sum()
+	return scan, nil
+}
+
+// streamItem is a piece of a streamed file on its way to the new version: text
+// outside blocks, or a block being processed
+type streamItem struct {
+	text   string
+	index  int
+	block  Block
+	raw    string        // The block's source, written back if it gets no result
+	done   chan struct{} // Closed once the block is processed; nil for text
+	link   string
+	answer string
+	err    error
+}
+
+// processFileStreaming processes a file in two passes over it: the first
+// checks it and updates its cache entry, the second processes blocks
+// concurrently while writing the new version in order. It returns
+// errNotStreamable for files that must be processed in memory.
+func (p *Parser) processFileStreaming(ctx context.Context, path string) error {
+	if p.isMarkdownFile(path) {
+		p.debugf("Processing %s in memory: only its ```pml fences hold blocks\n", path)
+		return errNotStreamable
+	}
+	settings, err := p.loadSettings(path)
+	if err != nil {
+		return fmt.Errorf("failed to load settings for %s: %w", filepath.Base(path), err)
+	}
+	includeTags := p.includeTags
+	if settings.Tags != nil {
+		includeTags = settings.Tags
+	}
+
+	scan, err := p.scanStream(path, settings)
+	if err != nil {
+		return err
+	}
+	if scan.hasSummary {
+		p.debugf("Processing %s in memory: :summary blocks need the results before them\n", path)
+		return errNotStreamable
+	}
+	if scan.hasInclude {
+		p.debugf("Processing %s in memory: it includes other files\n", path)
+		return errNotStreamable
+	}
+	if err := p.checkBlockCount(scan.blocks); err != nil {
+		return err
+	}
+	if settings.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, settings.Timeout)
+		defer cancel()
+	}
+
+	resultsDir := p.resultsDirFor(path)
+	if err := os.MkdirAll(resultsDir, 0755); err != nil {
+		return fmt.Errorf("failed to create results directory: %w", err)
+	}
+
+	// Initialize or update cache entry for the file
+	var previous CacheEntry // Entry of a changed file, for refining prior answers
+	p.cacheMu.Lock()
+	entry, ok := p.cache[path]
+	if !ok || entry.Checksum != scan.checksum {
+		if ok && p.refinePrior {
+			previous = entry
+		}
+		entry = CacheEntry{
+			Checksum: scan.checksum,
+			ModTime:  p.now(),
+			Blocks:   keptResults(entry, scan.present, scan.linked),
+		}
+		p.cacheDirty = true
+	}
+	p.cache[path] = entry
+	p.cacheMu.Unlock()
+
+	src, err := openSource(path)
+	if err != nil {
+		return fmt.Errorf("failed to read file: %w", err)
+	}
+	defer src.Close()
+	out, err := createSource(path)
+	if err != nil {
+		return fmt.Errorf("failed to write updated file: %w", err)
+	}
+	defer out.abort()
+	var w io.Writer = out
+	var newlines *newlineWriter
+	if p.newlineMode == NewlineEnsureOne {
+		newlines = &newlineWriter{w: out}
+		w = newlines
+	}
+
+	concurrency := 10 // Process up to 10 blocks concurrently unless configured
+	if settings.Concurrency > 0 {
+		concurrency = settings.Concurrency
+	}
+
+	// Blocks are read and started ahead of the writer only as far as the
+	// concurrency allows, which bounds the memory used
+	blockCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	slots := p.newSlots(concurrency)
+	queue := make(chan *streamItem, concurrency)
+	readErr := make(chan error, 1)
+	go func() {
+		defer close(queue)
+		readErr <- p.readStream(blockCtx, src, path, settings, includeTags, resultsDir, previous, slots, queue)
+	}()
+
+	var budgetErrs []error
+	var blockErrs []error // Failures marked in the file
+	var failed error
+	for item := range queue {
+		if item.done != nil {
+			<-item.done
+		}
+		if failed != nil {
+			continue // Wait for the blocks already started
+		}
+		if item.err != nil && p.marksFailedBlock(ctx, item.err) {
+			if p.resultCallback != nil {
+				p.resultCallback(BlockResult{FilePath: path, BlockIdx: item.index, Block: item.block, Err: item.err})
+			}
+			blockErrs = append(blockErrs, fmt.Errorf("failed to process block %d: %w", item.index, item.err))
+			if _, err := io.WriteString(w, markFailedBlock(item.raw, item.err)); err != nil {
+				failed = fmt.Errorf("failed to write updated file: %w", err)
+				cancel()
+			}
+			continue
+		}
+		if failed = p.writeStreamItem(ctx, w, path, item); failed != nil {
+			if errors.Is(failed, ErrBudgetExceeded) {
+				// Keep the results completed before the budget ran out
+				budgetErrs = append(budgetErrs, failed)
+				if _, err := io.WriteString(w, item.raw); err != nil {
+					failed = fmt.Errorf("failed to write updated file: %w", err)
+				} else {
+					failed = nil
+				}
+			}
+			if failed != nil {
+				cancel()
+			}
+		}
+	}
+	if err := <-readErr; err != nil && failed == nil {
+		failed = err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if failed != nil {
+		return failed
+	}
+
+	if newlines != nil {
+		if err := newlines.close(); err != nil {
+			return fmt.Errorf("failed to write updated file: %w", err)
+		}
+	}
+	if err := out.commit(); err != nil {
+		return fmt.Errorf("failed to write updated file: %w", err)
+	}
+	p.checkLinkedExpectations(path, scan.linked)
+
+	// Save cache to disk; an unchanged file leaves the cache file alone
+	if p.cacheChanged() {
+		if err := p.saveCache(); err != nil {
+			p.debugf("Warning: failed to save cache: %v\n", err)
+		}
+	}
+
+	if errs := append(budgetErrs, blockErrs...); len(errs) > 0 {
+		return fmt.Errorf("multiple errors: %w", errors.Join(errs...))
+	}
+	return nil
+}
+
+// readStream reads the pieces of a file, starts processing each selected block
+// and queues the pieces in file order
+func (p *Parser) readStream(ctx context.Context, src io.Reader, path string, settings fileSettings, includeTags []string, resultsDir string, previous CacheEntry, slots Slots, queue chan<- *streamItem) error {
+	scanner := p.newBlockScanner(src)
+	scanner.keepText = true
+	scanner.keepRaw = true
+	for index := 0; ; {
+		piece, err := scanner.next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to parse blocks: %w", err)
+		}
+
+		item := &streamItem{text: piece.Text}
+		if piece.Block != nil {
+			item = &streamItem{index: index, block: *piece.Block, raw: piece.Raw, done: make(chan struct{})}
+			index++
+			if err := p.prepareStreamBlock(&item.block, item.index, filepath.Dir(path), settings); err != nil {
+				return err
+			}
+			if previous.Blocks != nil {
+				// Changed blocks refine the answer previously given at the same position
+				item.block.Response = priorResult(previous, item.index, p.calculateBlockChecksum(item.block))
+			}
+
+			if !p.matchesTagFilter(item.block, includeTags) {
+				// Leave filtered-out blocks as they are
+				close(item.done)
+			} else {
+				// Names are generated in block order, as for a file processed in memory
+				name := p.generateUniqueResultName(filepath.Base(path), item.index, item.block.Type, resultsDir)
+				if err := slots.Acquire(ctx); err != nil {
+					return err
+				}
+				go func(item *streamItem, name string) {
+					defer close(item.done)
+					slot := &blockSlot{slots: slots}
+					defer slot.release()
+					item.link, item.answer, item.err = p.processBlock(withBlockSlot(ctx, slot), item.block, item.index, path, name, p.forceProcess)
+				}(item, name)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			if item.done != nil {
+				<-item.done
+			}
+			return ctx.Err()
+		case queue <- item:
+		}
+	}
+}
+
+// writeStreamItem writes a piece of a streamed file to its new version,
+// replacing processed blocks by their result link
+func (p *Parser) writeStreamItem(ctx context.Context, w io.Writer, path string, item *streamItem) error {
+	write := func(s string) error {
+		if _, err := io.WriteString(w, s); err != nil {
+			return fmt.Errorf("failed to write updated file: %w", err)
+		}
+		return nil
+	}
+	if item.done == nil {
+		return write(item.text)
+	}
+	if item.link == "" && item.err == nil {
+		// Blocks without a result (e.g. filtered out by tags) are kept verbatim
+		return write(item.raw)
+	}
+
+	if p.resultCallback != nil {
+		p.resultCallback(BlockResult{FilePath: path, BlockIdx: item.index, Block: item.block, Result: item.answer, Err: item.err})
+	}
+	if item.err != nil {
+		return fmt.Errorf("failed to process block %d: %w", item.index, item.err)
+	}
+	p.checkExpectation(path, item.index, item.block, item.answer)
+
+	label := ""
+	if labels := p.linkSummaries(ctx, path, []string{item.answer}, []string{item.link}); len(labels) > 0 {
+		label = labels[0]
+	}
+	return write(resultLinkLine(item.link, label))
+}
@@ -0,0 +1,188 @@
+package parser
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// echoLLM answers each prompt with its first word, without delay
+type echoLLM struct {
+	mockLLM
+}
+
+func (*echoLLM) Ask(ctx context.Context, prompt string) (string, error) {
+	return "Answer to " + strings.Fields(prompt)[0], nil
+}
+
+// processWithThreshold processes a file with the given content in a new
+// workspace and returns the rewritten file and its result files, with the
+// workspace path replaced by "WS"
+func processWithThreshold(t testing.TB, name, content string, threshold int64, configure func(*Parser)) (string, map[string]string) {
+	t.Helper()
+	tmpDir, err := os.MkdirTemp("", "pml-streaming-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	srcFile := filepath.Join(tmpDir, name)
+	if err := writeSource(srcFile, []byte(content)); err != nil {
+		t.Fatal(err)
+	}
+	parser := NewParser(&echoLLM{}, tmpDir, filepath.Join(tmpDir, "compiled"), filepath.Join(tmpDir, "results"))
+	parser.SetClock(fixedClock{t: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)})
+	parser.SetStreamingThreshold(threshold)
+	if configure != nil {
+		configure(parser)
+	}
+	if err := parser.ProcessFile(context.Background(), srcFile); err != nil {
+		t.Fatalf("ProcessFile() error = %v", err)
+	}
+
+	rewritten, err := readSource(srcFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	results := make(map[string]string)
+	resultsDir := parser.resultsDirFor(srcFile)
+	entries, err := os.ReadDir(resultsDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		data, err := os.ReadFile(filepath.Join(resultsDir, entry.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		results[entry.Name()] = strings.ReplaceAll(string(data), tmpDir, "WS")
+	}
+	return string(rewritten), results
+}
+
+// TestStreamingMatchesInMemory tests that streaming a file gives the same file
+// and results as processing it in memory
+func TestStreamingMatchesInMemory(t *testing.T) {
+	content := "# Questions\n\n:ask\nFirst question\n\n:--\nText between blocks\n" +
+		":ask tags=skip\nSkipped question\n:--\n\n" +
+		":--(r/ask_calm_river_block9_0.pml) Earlier result\n" +
+		"  :ask model=gpt-4o\n  Indented question ¿qué?\n  :--  \n\n" +
+		":do\nDo something\n:--"
+	tests := []struct {
+		name      string
+		file      string
+		content   string
+		configure func(*Parser)
+	}{
+		{"plain", "test.pml", content, nil},
+		{"crlf", "test.pml", strings.ReplaceAll(content, "\n", "\r\n") + "\r\n\r\n", nil},
+		{"tag filter", "test.pml", content, func(p *Parser) { p.SetTagFilter(nil, []string{"skip"}) }},
+		{"final newline", "test.pml", content + "\n\n\n", func(p *Parser) { p.SetTrailingNewline(NewlineEnsureOne) }},
+		{"final newline crlf", "test.pml", strings.ReplaceAll(content, "\n", "\r\n"), func(p *Parser) { p.SetTrailingNewline(NewlineEnsureOne) }},
+		{"gzip", "test.pml.gz", content, nil},
+		{"no blocks", "test.pml", "Just some notes\n", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			want, wantResults := processWithThreshold(t, tt.file, tt.content, 0, tt.configure)
+			got, gotResults := processWithThreshold(t, tt.file, tt.content, 1, tt.configure)
+			if got != want {
+				t.Errorf("Streamed file differs:\ngot:\n%q\nwant:\n%q", got, want)
+			}
+			if len(gotResults) != len(wantResults) {
+				t.Fatalf("Expected %d result files, got %d", len(wantResults), len(gotResults))
+			}
+			for name, result := range wantResults {
+				if gotResults[name] != result {
+					t.Errorf("Result %s differs:\ngot:\n%s\nwant:\n%s", name, gotResults[name], result)
+				}
+			}
+		})
+	}
+}
+
+// TestStreamingChecksFileFirst tests that a streamed file with a syntax error
+// or too many blocks is rejected before any block is processed
+func TestStreamingChecksFileFirst(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "pml-streaming-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	var calls int32
+	parser := NewParser(&mockLLM{
+		response: "Answer",
+		Delay:    10 * time.Millisecond,
+		callback: func() { atomic.AddInt32(&calls, 1) },
+	}, tmpDir, filepath.Join(tmpDir, "compiled"), filepath.Join(tmpDir, "results"))
+	parser.SetStreamingThreshold(1)
+	parser.SetMaxBlocksPerFile(2)
+
+	for name, content := range map[string]string{
+		"unclosed.pml": ":ask\nFirst\n:--\n:ask\nNever closed\n",
+		"many.pml":     ":ask\nOne\n:--\n:ask\nTwo\n:--\n:ask\nThree\n:--\n",
+	} {
+		srcFile := filepath.Join(tmpDir, name)
+		if err := os.WriteFile(srcFile, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := parser.ProcessFile(context.Background(), srcFile); err == nil {
+			t.Errorf("Expected an error for %s", name)
+		}
+		if data, _ := os.ReadFile(srcFile); string(data) != content {
+			t.Errorf("Expected %s to be left unchanged", name)
+		}
+	}
+	if got := atomic.LoadInt32(&calls); got != 0 {
+		t.Errorf("Expected no LLM calls, got %d", got)
+	}
+}
+
+// TestStreamingFallsBackForSummaries tests that a file with :summary blocks is
+// processed in memory even above the streaming threshold
+func TestStreamingFallsBackForSummaries(t *testing.T) {
+	content := ":ask\nFirst question\n:--\n:summary\nSummarize\n:--\n"
+	want, _ := processWithThreshold(t, "test.pml", content, 0, nil)
+	got, _ := processWithThreshold(t, "test.pml", content, 1, nil)
+	if got != want {
+		t.Errorf("Expected the same file as in memory, got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+// largeFile returns a PML file with n blocks tagged "bench", separated by text
+func largeFile(n int) string {
+	var content strings.Builder
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(&content, "Notes on question %d\n\n:ask tags=bench\nQuestion %d\n%s\n:--\n\n", i, i, strings.Repeat("context ", 100))
+	}
+	return content.String()
+}
+
+// BenchmarkProcessFile compares reading, parsing and rewriting a large file in
+// memory and by streaming. The blocks are filtered out, so the LLM, result files
+// and the index don't dominate the time.
+func BenchmarkProcessFile(b *testing.B) {
+	content := largeFile(5000)
+	skipBlocks := func(p *Parser) { p.SetTagFilter(nil, []string{"bench"}) }
+	for _, bm := range []struct {
+		name      string
+		threshold int64
+	}{
+		{"in-memory", 0},
+		{"streaming", 1},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(content)))
+			for i := 0; i < b.N; i++ {
+				processWithThreshold(b, "large.pml", content, bm.threshold, skipBlocks)
+			}
+		})
+	}
+}
@@ -0,0 +1,16 @@
+package parser
+
+import "errors"
+
+// ErrCacheMiss is returned in strict cache mode for a block without a cached result
+var ErrCacheMiss = errors.New("cache miss in strict mode")
+
+// SetStrictCache sets whether blocks must be answered from the cache. In strict
+// mode a block without a cached result fails with ErrCacheMiss instead of being
+// run, so nothing calls the LLM; fill the cache beforehand, e.g. with WarmCache
+// or ImportCache. :input blocks, which are never cached, are exempt. With
+// SetSummarizeLinks, links only get labels that are cached or come from a
+// SummaryStrategy.
+func (p *Parser) SetStrictCache(strict bool) {
+	p.strictCache = strict
+}
@@ -0,0 +1,61 @@
+package parser
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestStrictCache tests that strict cache mode answers cached blocks and fails
+// blocks without a cached result, never calling the LLM
+func TestStrictCache(t *testing.T) {
+	tmpDir := t.TempDir()
+	srcFile := filepath.Join(tmpDir, "strict.pml")
+	content := ":ask\nWhat is 2+2?\n:--\n"
+	if err := os.WriteFile(srcFile, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Fill the cache
+	warm := NewParser(&mockLLM{response: "4", Delay: time.Millisecond}, tmpDir, tmpDir, filepath.Join(tmpDir, "results"))
+	if err := warm.ProcessFile(context.Background(), srcFile); err != nil {
+		t.Fatalf("ProcessFile() error = %v", err)
+	}
+
+	var calls int32
+	parser := NewParser(&mockLLM{response: "4", Delay: time.Millisecond, callback: func() { atomic.AddInt32(&calls, 1) }},
+		tmpDir, tmpDir, filepath.Join(tmpDir, "results"))
+	parser.SetStrictCache(true)
+	parser.SetSummarizeLinks(true)
+
+	// A hit is answered from the cache, without summarizing its link label
+	if err := os.WriteFile(srcFile, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := parser.ProcessFile(context.Background(), srcFile); err != nil {
+		t.Errorf("Expected a cached block to succeed in strict mode, got %v", err)
+	}
+	if processed, err := os.ReadFile(srcFile); err != nil || !strings.HasSuffix(strings.TrimSpace(string(processed)), ")") {
+		t.Errorf("Expected an unlabeled result link, got %q (%v)", processed, err)
+	}
+
+	// A miss fails
+	if err := os.WriteFile(srcFile, []byte(":ask\nWhat is 3+3?\n:--\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	err := parser.ProcessFile(context.Background(), srcFile)
+	if !errors.Is(err, ErrCacheMiss) {
+		t.Errorf("Expected ErrCacheMiss for an uncached block, got %v", err)
+	}
+	if _, err := parser.AskBlock(context.Background(), Block{Type: DirectiveAsk, Content: []string{"What is 5+5?"}}); !errors.Is(err, ErrCacheMiss) {
+		t.Errorf("Expected ErrCacheMiss from AskBlock, got %v", err)
+	}
+	if got := atomic.LoadInt32(&calls); got != 0 {
+		t.Errorf("Expected no LLM calls in strict mode, got %d", got)
+	}
+}
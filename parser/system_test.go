@@ -0,0 +1,94 @@
+package parser
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// systemLLM records the system prompt sent with each prompt
+type systemLLM struct {
+	mu      sync.Mutex
+	systems map[string]string // Prompt to its system prompt
+}
+
+func (m *systemLLM) Ask(ctx context.Context, prompt string) (string, error) {
+	return m.AskWithSystem(ctx, "", "", prompt)
+}
+
+func (m *systemLLM) AskWithSystem(ctx context.Context, model, system, prompt string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.systems[strings.TrimSpace(prompt)] = system
+	return "Answer", nil
+}
+
+func (m *systemLLM) Summarize(ctx context.Context, text string) (string, error) {
+	return "Summary", nil
+}
+
+// TestSystemPromptsPerDirective tests that :ask blocks are sent with their
+// system prompt, that changing it reprocesses them, and that only :ask takes one
+func TestSystemPromptsPerDirective(t *testing.T) {
+	tmpDir := t.TempDir()
+	content := ":ask\nWhat is a monad?\n:--\n\n:do\nList the files\n:--\n"
+	srcFile := filepath.Join(tmpDir, "system.pml")
+	if err := os.WriteFile(srcFile, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	llm := &systemLLM{systems: make(map[string]string)}
+	parser := NewParser(llm, tmpDir, tmpDir, filepath.Join(tmpDir, "results"))
+	if err := parser.SetSystemPrompt(DirectiveAsk, "You are a patient teacher."); err != nil {
+		t.Fatal(err)
+	}
+	for _, directive := range []string{DirectiveDo, DirectiveSummary} {
+		if err := parser.SetSystemPrompt(directive, "Be brief."); err == nil {
+			t.Errorf("Expected an error for %s, which has no system prompt", directive)
+		}
+	}
+
+	blocks, err := parser.parseBlocks(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := parser.calculateBlockChecksum(blocks[0])
+
+	if err := parser.ProcessFile(context.Background(), srcFile); err != nil {
+		t.Fatalf("ProcessFile() error = %v", err)
+	}
+	if got := llm.systems["What is a monad?"]; got != "You are a patient teacher." {
+		t.Errorf("Expected the :ask system prompt, got %q", got)
+	}
+	if _, ok := llm.systems["List the files"]; ok {
+		t.Error("Expected the :do block not to be sent to the LLM")
+	}
+
+	if err := parser.SetSystemPrompt(DirectiveAsk, "You are a terse expert."); err != nil {
+		t.Fatal(err)
+	}
+	if parser.calculateBlockChecksum(blocks[0]) == before {
+		t.Error("Expected the system prompt to be part of the block checksum")
+	}
+}
+
+// TestSystemPromptFallback tests that clients without system prompt support get it ahead of the prompt
+func TestSystemPromptFallback(t *testing.T) {
+	var prompts []string
+	parser := NewParser(&mockLLM{answer: func(prompt string) string {
+		prompts = append(prompts, prompt)
+		return "Answer"
+	}, Delay: 1}, t.TempDir(), "", "")
+	if err := parser.SetSystemPrompt(DirectiveAsk, "Answer in French."); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := parser.AskBlock(context.Background(), Block{Type: DirectiveAsk, Content: []string{"Hello?"}}); err != nil {
+		t.Fatal(err)
+	}
+	if len(prompts) != 1 || prompts[0] != "Answer in French.\n\nHello?" {
+		t.Errorf("Expected the system prompt ahead of the prompt, got %q", prompts)
+	}
+}
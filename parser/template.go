@@ -0,0 +1,154 @@
+package parser
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// SetTemplateValues enables prompt templates: block content is rendered as a
+// text/template (e.g. "Write to {{.Customer}}") with values before it is sent
+// to the LLM. Referencing a value that isn't supplied is an error. Since the
+// rendered content is checksummed, changing a value reprocesses the blocks
+// that use it.
+func (p *Parser) SetTemplateValues(values map[string]interface{}) {
+	p.templateValues = values
+}
+
+// SetEnvInterpolation enables replacing ${NAME} in block content with the value
+// of the environment variable NAME. Only the braced form is expanded, so shell
+// snippets like $1 are left alone. Referencing an unset variable is an error.
+func (p *Parser) SetEnvInterpolation(enabled bool) {
+	p.envInterpolation = enabled
+}
+
+// envReference matches ${NAME} references to environment variables
+var envReference = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// expandEnv replaces environment variable references in the content of each block
+func (p *Parser) expandEnv(blocks []Block) error {
+	if !p.envInterpolation {
+		return nil
+	}
+	for i := range blocks {
+		if err := p.expandBlockEnv(&blocks[i], i); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// expandBlockEnv replaces environment variable references in the content of the
+// block at index i. The values used are redacted from results and logs unless
+// disabled with SetRedactEnvValues.
+func (p *Parser) expandBlockEnv(block *Block, i int) error {
+	for j, line := range block.Content {
+		var missing string
+		block.Content[j] = envReference.ReplaceAllStringFunc(line, func(ref string) string {
+			name := envReference.FindStringSubmatch(ref)[1]
+			value, ok := os.LookupEnv(name)
+			if !ok && missing == "" {
+				missing = name
+			}
+			if p.redactEnvValues {
+				p.AddRedactedValues(value)
+			}
+			return value
+		})
+		if missing != "" {
+			return fmt.Errorf("block %d: environment variable %s is not set", i, missing)
+		}
+	}
+	return nil
+}
+
+// LoadTemplateValues reads template values from a JSON file, or from a YAML
+// file (.yaml or .yml) of flat "key: value" lines
+func LoadTemplateValues(path string) (map[string]interface{}, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read values file: %w", err)
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		return parseYAMLValues(data)
+	default:
+		var values map[string]interface{}
+		if err := json.Unmarshal(data, &values); err != nil {
+			return nil, fmt.Errorf("failed to parse values file: %w", err)
+		}
+		return values, nil
+	}
+}
+
+// parseYAMLValues parses flat "key: value" YAML with optionally quoted scalars
+func parseYAMLValues(data []byte) (map[string]interface{}, error) {
+	values := make(map[string]interface{})
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || line == "---" {
+			continue
+		}
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			return nil, fmt.Errorf("values line %d: expected key: value", lineNum)
+		}
+		value = strings.TrimSpace(value)
+		if len(value) >= 2 && value[0] == '\'' && value[len(value)-1] == '\'' {
+			value = value[1 : len(value)-1]
+		} else if strings.HasPrefix(value, `"`) {
+			unquoted, err := strconv.Unquote(value)
+			if err != nil {
+				return nil, fmt.Errorf("values line %d: invalid string %s", lineNum, value)
+			}
+			value = unquoted
+		}
+		values[strings.TrimSpace(key)] = value
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read values file: %w", err)
+	}
+	return values, nil
+}
+
+// renderTemplates renders the content of each block with the template values
+func (p *Parser) renderTemplates(blocks []Block) error {
+	if p.templateValues == nil {
+		return nil
+	}
+	for i := range blocks {
+		if err := p.renderBlockTemplate(&blocks[i], i); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// renderBlockTemplate renders the content of the block at index i with the template values
+func (p *Parser) renderBlockTemplate(block *Block, i int) error {
+	content := strings.Join(block.Content, "\n")
+	if !strings.Contains(content, "{{") {
+		return nil
+	}
+	tmpl, err := template.New(fmt.Sprintf("block %d", i)).Option("missingkey=error").Parse(content)
+	if err != nil {
+		return fmt.Errorf("invalid template in block %d: %w", i, err)
+	}
+	var rendered strings.Builder
+	if err := tmpl.Execute(&rendered, p.templateValues); err != nil {
+		return fmt.Errorf("failed to render block %d: %w", i, err)
+	}
+	block.Content = strings.Split(rendered.String(), "\n")
+	return nil
+}
@@ -0,0 +1,103 @@
+package parser
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPromptTemplates(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "pml-template-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	content := ":ask\nWrite a welcome email to {{.Customer}} about {{.Product}}.\n:--\n"
+	srcFile := filepath.Join(tmpDir, "template.pml")
+
+	var mu sync.Mutex
+	var prompts []string
+	parser := NewParser(&mockLLM{
+		Delay: 10 * time.Millisecond,
+		answer: func(prompt string) string {
+			mu.Lock()
+			prompts = append(prompts, prompt)
+			mu.Unlock()
+			return "Dear customer"
+		},
+	}, tmpDir, filepath.Join(tmpDir, "compiled"), filepath.Join(tmpDir, "results"))
+
+	valuesFile := filepath.Join(tmpDir, "values.yaml")
+	if err := os.WriteFile(valuesFile, []byte("Customer: Acme Corp\nProduct: \"PML Pro\"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	values, err := LoadTemplateValues(valuesFile)
+	if err != nil {
+		t.Fatalf("LoadTemplateValues failed: %v", err)
+	}
+	parser.SetTemplateValues(values)
+
+	process := func() {
+		t.Helper()
+		if err := os.WriteFile(srcFile, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := parser.ProcessFile(context.Background(), srcFile); err != nil {
+			t.Fatalf("ProcessFile failed: %v", err)
+		}
+	}
+
+	process()
+	if len(prompts) != 1 || prompts[0] != "Write a welcome email to Acme Corp about PML Pro." {
+		t.Fatalf("Expected the rendered prompt, got %q", prompts)
+	}
+
+	// Same values hit the cache
+	process()
+	if len(prompts) != 1 {
+		t.Errorf("Expected unchanged values to be cached, got %d calls", len(prompts))
+	}
+
+	// Different values reprocess
+	parser.SetTemplateValues(map[string]interface{}{"Customer": "Globex", "Product": "PML Pro"})
+	process()
+	if len(prompts) != 2 || !strings.Contains(prompts[1], "Globex") {
+		t.Errorf("Expected changed values to reprocess, got %q", prompts)
+	}
+
+	// Missing values are an error
+	parser.SetTemplateValues(map[string]interface{}{"Customer": "Globex"})
+	if err := os.WriteFile(srcFile, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := parser.ProcessFile(context.Background(), srcFile); err == nil || !strings.Contains(err.Error(), "Product") {
+		t.Errorf("Expected an error naming the missing value, got %v", err)
+	}
+}
+
+// TestExpandEnv tests that ${NAME} references are replaced by environment
+// variables only when enabled, and that unset variables are an error
+func TestExpandEnv(t *testing.T) {
+	t.Setenv("PML_TEST_TOPIC", "tides")
+	parser := NewParser(&mockLLM{response: "Answer"}, "", "", "")
+
+	blocks := []Block{{Type: DirectiveAsk, Content: []string{"Explain ${PML_TEST_TOPIC} and $1"}}}
+	if err := parser.expandEnv(blocks); err != nil || blocks[0].Content[0] != "Explain ${PML_TEST_TOPIC} and $1" {
+		t.Fatalf("Expected no expansion by default, got %q, %v", blocks[0].Content[0], err)
+	}
+
+	parser.SetEnvInterpolation(true)
+	if err := parser.expandEnv(blocks); err != nil || blocks[0].Content[0] != "Explain tides and $1" {
+		t.Fatalf("Expected the variable to be expanded, got %q, %v", blocks[0].Content[0], err)
+	}
+
+	blocks = []Block{{Type: DirectiveAsk, Content: []string{"${PML_TEST_UNSET_VARIABLE}"}}}
+	if err := parser.expandEnv(blocks); err == nil || !strings.Contains(err.Error(), "PML_TEST_UNSET_VARIABLE") {
+		t.Errorf("Expected an error naming the unset variable, got %v", err)
+	}
+}
@@ -10,7 +10,8 @@ type mockLLM struct {
 	response string
 	err      error
 	callback func()
-	Delay    time.Duration // configurable delay for Ask
+	Delay    time.Duration       // configurable delay for Ask
+	answer   func(string) string // optional per-prompt response for Ask
 }
 
 func (m *mockLLM) Ask(ctx context.Context, prompt string) (string, error) {
@@ -20,7 +21,7 @@ func (m *mockLLM) Ask(ctx context.Context, prompt string) (string, error) {
 	// Use m.Delay if provided; otherwise, default to 300ms.
 	totalDelay := m.Delay
 	if totalDelay == 0 {
-		totalDelay = 300 * time.Millisecond  // Longer default delay for cancellation test
+		totalDelay = 300 * time.Millisecond // Longer default delay for cancellation test
 	}
 	interval := 10 * time.Millisecond
 	elapsed := time.Duration(0)
@@ -33,6 +34,9 @@ func (m *mockLLM) Ask(ctx context.Context, prompt string) (string, error) {
 			elapsed += interval
 		}
 	}
+	if m.answer != nil {
+		return m.answer(prompt), m.err
+	}
 	return m.response, m.err
 }
 
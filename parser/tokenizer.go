@@ -0,0 +1,50 @@
+package parser
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrPromptTooLarge is returned when a block's prompt exceeds the configured size limit
+var ErrPromptTooLarge = errors.New("prompt too large")
+
+// Tokenizer counts the tokens a model would see for a piece of text
+type Tokenizer interface {
+	CountTokens(model, text string) int
+}
+
+// SetTokenizer sets the tokenizer used by the prompt size limit and the token budget.
+// Without one, token counts are estimated at four characters per token.
+func (p *Parser) SetTokenizer(tokenizer Tokenizer) {
+	p.tokenizer = tokenizer
+}
+
+// SetMaxPromptTokens rejects blocks whose prompt is larger than maxTokens
+// before they are sent to the LLM. Zero disables the limit.
+func (p *Parser) SetMaxPromptTokens(maxTokens int) {
+	p.maxPromptTokens = maxTokens
+}
+
+// countTokens counts the tokens in text using the tokenizer, falling back to an estimate
+func (p *Parser) countTokens(model, text string) int {
+	if p.tokenizer != nil {
+		return p.tokenizer.CountTokens(model, text)
+	}
+	return estimateTokens(text)
+}
+
+// checkPromptSize fails if prompt exceeds the prompt size limit
+func (p *Parser) checkPromptSize(model, prompt string) error {
+	if p.maxPromptTokens <= 0 {
+		return nil
+	}
+	if tokens := p.countTokens(model, prompt); tokens > p.maxPromptTokens {
+		return fmt.Errorf("%w: %d tokens, limit is %d", ErrPromptTooLarge, tokens, p.maxPromptTokens)
+	}
+	return nil
+}
+
+// estimateTokens roughly estimates the number of tokens in text
+func estimateTokens(text string) int {
+	return (len(text) + 3) / 4
+}
@@ -0,0 +1,62 @@
+package parser
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type fixedTokenizer struct {
+	tokens int
+}
+
+func (t fixedTokenizer) CountTokens(model, text string) int {
+	return t.tokens
+}
+
+func TestPromptSizeGuardUsesEstimate(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "pml-tokenizer-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	// 400 characters is estimated at 100 tokens
+	content := ":ask\n" + strings.Repeat("a", 400) + "\n:--\n"
+	srcFile := filepath.Join(tmpDir, "large.pml")
+	if err := os.WriteFile(srcFile, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var calls int32
+	parser := NewParser(&mockLLM{
+		Delay: 10 * time.Millisecond,
+		answer: func(prompt string) string {
+			atomic.AddInt32(&calls, 1)
+			return "Answer"
+		},
+	}, tmpDir, filepath.Join(tmpDir, "compiled"), filepath.Join(tmpDir, "results"))
+	parser.SetMaxPromptTokens(50)
+
+	err = parser.ProcessFile(context.Background(), srcFile)
+	if !errors.Is(err, ErrPromptTooLarge) {
+		t.Fatalf("Expected ErrPromptTooLarge, got %v", err)
+	}
+	if got := atomic.LoadInt32(&calls); got != 0 {
+		t.Errorf("Expected the oversized prompt not to be sent, got %d calls", got)
+	}
+
+	// A tokenizer replaces the estimate
+	parser.SetTokenizer(fixedTokenizer{tokens: 10})
+	if err := parser.ProcessFile(context.Background(), srcFile); err != nil {
+		t.Fatalf("ProcessFile failed with tokenizer: %v", err)
+	}
+	if got := atomic.LoadInt32(&calls); got != 1 {
+		t.Errorf("Expected 1 LLM call, got %d", got)
+	}
+}
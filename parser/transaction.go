@@ -0,0 +1,122 @@
+package parser
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// SetTransactional sets whether ProcessAllFiles updates PML files all or
+// nothing. The new content of each file is kept in memory until every file has
+// been processed, then all files are replaced together; if any file fails,
+// none is changed. Result files and cached answers are still saved, so a rerun
+// doesn't ask the LLM again. The checkpoint isn't used, as a failed run keeps
+// nothing to resume.
+func (p *Parser) SetTransactional(enabled bool) {
+	p.transactional = enabled
+}
+
+// sourceTxn holds the PML file updates of a transactional run until it ends
+type sourceTxn struct {
+	mu     sync.Mutex
+	staged map[string][]byte // Path to the new content of the file
+	order  []string          // Paths in the order they were first staged
+}
+
+// currentTxn returns the transaction of the current run, or nil outside a
+// transactional run
+func (p *Parser) currentTxn() *sourceTxn {
+	p.txnMu.Lock()
+	defer p.txnMu.Unlock()
+	return p.txn
+}
+
+// setTxn starts or, with nil, ends a transactional run
+func (p *Parser) setTxn(txn *sourceTxn) {
+	p.txnMu.Lock()
+	p.txn = txn
+	p.txnMu.Unlock()
+}
+
+// loadSource reads a PML file as the current run sees it: with its staged
+// update in a transactional run
+func (p *Parser) loadSource(path string) ([]byte, error) {
+	if txn := p.currentTxn(); txn != nil {
+		txn.mu.Lock()
+		content, ok := txn.staged[path]
+		txn.mu.Unlock()
+		if ok {
+			return content, nil
+		}
+	}
+	return readSource(path)
+}
+
+// saveSource writes a PML file, or stages the update in a transactional run
+func (p *Parser) saveSource(path string, content []byte) error {
+	txn := p.currentTxn()
+	if txn == nil {
+		return writeSource(path, content)
+	}
+	txn.mu.Lock()
+	defer txn.mu.Unlock()
+	if _, ok := txn.staged[path]; !ok {
+		txn.order = append(txn.order, path)
+	}
+	txn.staged[path] = content
+	return nil
+}
+
+// processFilesTransaction processes files with their updates staged, then
+// writes them all if every file succeeded
+func (p *Parser) processFilesTransaction(ctx context.Context, files []string) error {
+	txn := &sourceTxn{staged: make(map[string][]byte)}
+	p.setTxn(txn)
+	// processFiles returns once every file has stopped, so nothing is staged
+	// after the run ends
+	err := p.processFiles(ctx, files, nil)
+	p.setTxn(nil)
+	if err != nil {
+		p.debugf("Rolling back: %d processed files left unchanged\n", len(txn.order))
+		return err
+	}
+	return txn.commit()
+}
+
+// commit writes every staged file next to its PML file first, then renames them
+// all into place, so a failure to write any leaves every file unchanged
+func (txn *sourceTxn) commit() error {
+	writers := make([]*sourceWriter, 0, len(txn.order))
+	abort := func() {
+		for _, w := range writers {
+			w.abort()
+		}
+	}
+	for _, path := range txn.order {
+		w, err := createSource(path)
+		if err != nil {
+			abort()
+			return fmt.Errorf("failed to stage %s: %w", path, err)
+		}
+		writers = append(writers, w)
+		if _, err := w.Write(txn.staged[path]); err != nil {
+			abort()
+			return fmt.Errorf("failed to stage %s: %w", path, err)
+		}
+		if err := w.finish(); err != nil {
+			abort()
+			return fmt.Errorf("failed to stage %s: %w", path, err)
+		}
+	}
+
+	var errs []error
+	for _, w := range writers {
+		if err := os.Rename(w.tmp.Name(), w.path); err != nil {
+			os.Remove(w.tmp.Name())
+			errs = append(errs, fmt.Errorf("failed to replace %s: %w", w.path, err))
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,149 @@
+package parser
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestProcessAllFilesTransactional tests that a transactional run with a
+// failing file leaves every PML file unchanged, and that a successful one
+// updates them all
+func TestProcessAllFilesTransactional(t *testing.T) {
+	tmpDir := t.TempDir()
+	sources := map[string]string{
+		"a.pml": ":ask\nFirst question\n:--\n",
+		"b.pml": ":ask\nSecond question\n:--\n",
+		"c.pml": ":ask\nThis one will fail\n:--\n",
+	}
+	var files []string
+	for name, content := range sources {
+		path := filepath.Join(tmpDir, name)
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, path)
+	}
+
+	llm := &failingLLM{mockLLM: mockLLM{response: "Answer", Delay: time.Millisecond}}
+	parser := NewParser(llm, tmpDir, tmpDir, filepath.Join(tmpDir, "results"))
+	parser.SetForceProcess(true)
+	parser.SetFailFast(false) // The other files complete before the run fails
+	parser.SetTransactional(true)
+
+	if err := parser.ProcessAllFiles(context.Background(), files); err == nil {
+		t.Fatal("Expected the failing file to fail the run")
+	}
+	if calls := atomic.LoadInt32(&llm.calls); calls != 3 {
+		t.Errorf("Expected all three blocks to be asked, got %d calls", calls)
+	}
+	for name, content := range sources {
+		data, err := os.ReadFile(filepath.Join(tmpDir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != content {
+			t.Errorf("Expected %s to be unchanged after the failed run, got %q", name, data)
+		}
+	}
+
+	// Once nothing fails, every file is updated
+	if err := os.WriteFile(filepath.Join(tmpDir, "c.pml"), []byte(":ask\nThird question\n:--\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := parser.ProcessAllFiles(context.Background(), files); err != nil {
+		t.Fatalf("ProcessAllFiles() error = %v", err)
+	}
+	for name := range sources {
+		data, err := os.ReadFile(filepath.Join(tmpDir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := parseResultLink(strings.TrimSpace(string(data))); !ok {
+			t.Errorf("Expected %s to be replaced by its result link, got %q", name, data)
+		}
+		matches, _ := filepath.Glob(filepath.Join(tmpDir, "."+name+".*.tmp"))
+		if len(matches) > 0 {
+			t.Errorf("Expected no temporary files left for %s, got %v", name, matches)
+		}
+	}
+}
+
+// wideScheduler hands out n slots whatever is asked, so files run at once
+// whatever the number of CPUs
+type wideScheduler struct{ n int }
+
+func (s wideScheduler) NewSlots(int) Slots {
+	return make(chanSlots, s.n)
+}
+
+// lingeringLLM fails prompts mentioning "fail" once the others are asked, and
+// answers the others after a delay, even when their context is done
+type lingeringLLM struct {
+	mockLLM
+	asked    sync.WaitGroup // Done as each of the other prompts is asked
+	started  int32
+	finished int32
+}
+
+func (l *lingeringLLM) Ask(ctx context.Context, prompt string) (string, error) {
+	if strings.Contains(prompt, "fail") {
+		l.asked.Wait()
+		return "", errors.New("request failed")
+	}
+	atomic.AddInt32(&l.started, 1)
+	l.asked.Done()
+	time.Sleep(50 * time.Millisecond)
+	atomic.AddInt32(&l.finished, 1)
+	return "Answer", nil
+}
+
+// TestProcessAllFilesTransactionalFailFast tests that a failing file ends a
+// fail-fast transactional run only once the other files have stopped, leaving
+// every PML file unchanged
+func TestProcessAllFilesTransactionalFailFast(t *testing.T) {
+	tmpDir := t.TempDir()
+	sources := map[string]string{
+		"a.pml": ":ask\nFirst question\n:--\n",
+		"b.pml": ":ask\nSecond question\n:--\n",
+		"c.pml": ":ask\nThis one will fail\n:--\n",
+	}
+	var files []string
+	for name, content := range sources {
+		path := filepath.Join(tmpDir, name)
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, path)
+	}
+
+	llm := &lingeringLLM{}
+	llm.asked.Add(len(files) - 1)
+	parser := NewParser(llm, tmpDir, tmpDir, filepath.Join(tmpDir, "results"))
+	parser.SetForceProcess(true)
+	parser.SetFailFast(true)
+	parser.SetTransactional(true)
+	parser.SetScheduler(wideScheduler{n: len(files)})
+
+	if err := parser.ProcessAllFiles(context.Background(), files); err == nil {
+		t.Fatal("Expected the failing file to fail the run")
+	}
+	if started, finished := atomic.LoadInt32(&llm.started), atomic.LoadInt32(&llm.finished); started != finished {
+		t.Errorf("Expected the run to wait for the other files, %d of %d blocks finished", finished, started)
+	}
+	for name, content := range sources {
+		data, err := os.ReadFile(filepath.Join(tmpDir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != content {
+			t.Errorf("Expected %s to be unchanged after the failed run, got %q", name, data)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package parser
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// TTLAttribute sets how long a block's answer stays fresh, e.g. ":ask ttl=24h".
+// An older answer is asked again, even if it is cached or linked in the file.
+const TTLAttribute = "ttl"
+
+// blockTTL returns the duration of a block's ttl attribute, or 0 if it has none
+func blockTTL(attributes map[string]string) (time.Duration, error) {
+	value, ok := attributes[TTLAttribute]
+	if !ok {
+		return 0, nil
+	}
+	ttl, err := time.ParseDuration(value)
+	if err != nil || ttl <= 0 {
+		return 0, fmt.Errorf("invalid ttl %q: expected a positive duration such as 30m or 24h", value)
+	}
+	return ttl, nil
+}
+
+// expired reports whether an answer given at processed is older than the ttl
+// attribute among attributes. Answers without a valid ttl never expire.
+func (p *Parser) expired(attributes map[string]string, processed time.Time) bool {
+	ttl, err := blockTTL(attributes)
+	if err != nil || ttl == 0 {
+		return false
+	}
+	return p.now().Sub(processed) > ttl
+}
+
+// refreshExpiredResults reprocesses the blocks linked from the file at path
+// whose answers are older than their ttl attribute, replacing their links.
+// Locked results are left alone, as are blocks the tag filters or
+// SetOnlyChangedBlocks would skip, each block standing at its link.
+func (p *Parser) refreshExpiredResults(ctx context.Context, path string) error {
+	content, err := p.loadSource(path)
+	if err != nil {
+		return fmt.Errorf("failed to read file: %w", err)
+	}
+	settings, err := p.loadSettings(path)
+	if err != nil {
+		return fmt.Errorf("failed to load settings for %s: %w", filepath.Base(path), err)
+	}
+	includeTags := p.includeTags
+	if settings.Tags != nil {
+		includeTags = settings.Tags
+	}
+
+	var blocks []Block // The expired blocks, at their links
+	var checksums []string
+	offset := 0
+	for i, line := range strings.Split(string(content), "\n") {
+		end := offset + len(line)
+		offset = end + 1
+		link, ok := parseResultLink(line)
+		if !ok {
+			continue
+		}
+		resultPath := p.ResolveResultLink(path, link)
+		jsonStr, found, err := readMetadataLine(resultPath)
+		if err != nil || !found {
+			continue
+		}
+		var metadata struct {
+			ResultSource
+			Attributes map[string]string `json:"attributes"`
+			Locked     bool              `json:"locked"`
+			Timestamp  time.Time         `json:"timestamp"`
+		}
+		if err := json.Unmarshal([]byte(jsonStr), &metadata); err != nil || metadata.Timestamp.IsZero() {
+			continue
+		}
+		if metadata.Locked || p.isLocked(path, metadata.BlockChecksum) {
+			continue
+		}
+		if p.expired(metadata.Attributes, metadata.Timestamp) {
+			blocks = append(blocks, Block{Tags: splitTags(metadata.Attributes["tags"]), Line: i + 1, End: end})
+			checksums = append(checksums, metadata.BlockChecksum)
+		}
+	}
+	if len(blocks) == 0 {
+		return nil
+	}
+
+	selected := p.selectBlocks(path, string(content), blocks, includeTags)
+	for i, checksum := range checksums {
+		if !selected[i] {
+			p.debugf("Skipping expired result of block %s in %s\n", checksum, path)
+			continue
+		}
+		p.debugf("Refreshing expired result of block %s in %s\n", checksum, path)
+		if err := p.ReprocessBlock(ctx, path, checksum); err != nil {
+			return fmt.Errorf("failed to refresh expired result: %w", err)
+		}
+	}
+	return nil
+}
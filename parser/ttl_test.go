@@ -0,0 +1,170 @@
+package parser
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestTTLRefreshesStaleResults tests that linked and cached answers older than
+// their ttl are asked again while fresh ones are kept
+func TestTTLRefreshesStaleResults(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "pml-ttl-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	content := ":ask ttl=1h\nWhat is the price of gold?\n:--\n\n:ask ttl=48h\nWho built the pyramids?\n:--\n"
+	srcFile := filepath.Join(tmpDir, "ttl.pml")
+	if err := os.WriteFile(srcFile, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var mu sync.Mutex
+	calls := make(map[string]int)
+	parser := NewParser(&mockLLM{
+		Delay: 10 * time.Millisecond,
+		answer: func(prompt string) string {
+			mu.Lock()
+			defer mu.Unlock()
+			calls[strings.TrimSpace(prompt)]++
+			return "Answer"
+		},
+	}, tmpDir, filepath.Join(tmpDir, "compiled"), filepath.Join(tmpDir, "results"))
+	start := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	parser.SetClock(fixedClock{start})
+
+	process := func() {
+		t.Helper()
+		if err := parser.ProcessFile(context.Background(), srcFile); err != nil {
+			t.Fatalf("ProcessFile() error = %v", err)
+		}
+	}
+	expectCalls := func(stage string, price, pyramids int) {
+		t.Helper()
+		mu.Lock()
+		defer mu.Unlock()
+		if calls["What is the price of gold?"] != price || calls["Who built the pyramids?"] != pyramids {
+			t.Errorf("%s: expected %d and %d calls, got %v", stage, price, pyramids, calls)
+		}
+	}
+
+	process()
+	expectCalls("first run", 1, 1)
+
+	// Fresh links are left alone
+	parser.SetClock(fixedClock{start.Add(30 * time.Minute)})
+	process()
+	expectCalls("fresh links", 1, 1)
+
+	// The link past its ttl is replaced, the other one is kept
+	before, err := os.ReadFile(srcFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parser.SetClock(fixedClock{start.Add(2 * time.Hour)})
+	process()
+	expectCalls("stale link", 2, 1)
+	after, err := os.ReadFile(srcFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	beforeLinks, afterLinks := strings.Split(string(before), "\n"), strings.Split(string(after), "\n")
+	if len(beforeLinks) != len(afterLinks) || beforeLinks[0] == afterLinks[0] || beforeLinks[2] != afterLinks[2] {
+		t.Errorf("Expected only the stale link to be replaced:\n%s\n---\n%s", before, after)
+	}
+
+	// A cache hit past its ttl is asked again too
+	if err := os.WriteFile(srcFile, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	process()
+	expectCalls("fresh cache", 2, 1)
+	if err := os.WriteFile(srcFile, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	parser.SetClock(fixedClock{start.Add(4 * time.Hour)})
+	process()
+	expectCalls("stale cache", 3, 1)
+}
+
+// TestTTLRefreshFilters tests that expired links are asked again only for the
+// blocks the tag filters and changed lines select, in streamed files too
+func TestTTLRefreshFilters(t *testing.T) {
+	tests := []struct {
+		name      string
+		setup     func(p *Parser)
+		wantCalls int
+	}{
+		{"unfiltered", func(p *Parser) {}, 2},
+		{"excluded tag", func(p *Parser) { p.SetTagFilter(nil, []string{"market"}) }, 1},
+		{"other include tag", func(p *Parser) { p.SetTagFilter([]string{"history"}, nil) }, 1},
+		{"unchanged lines", func(p *Parser) {
+			p.changedLines = func(path string) ([]LineRange, error) { return nil, nil }
+		}, 1},
+		{"changed link line", func(p *Parser) {
+			p.changedLines = func(path string) ([]LineRange, error) { return []LineRange{{Start: 1, End: 1}}, nil }
+		}, 2},
+		{"streamed", func(p *Parser) { p.SetStreamingThreshold(1) }, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpDir, err := os.MkdirTemp("", "pml-ttl-*")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(tmpDir)
+
+			srcFile := filepath.Join(tmpDir, "ttl.pml")
+			if err := os.WriteFile(srcFile, []byte(":ask ttl=1h tags=market\nWhat is the price of gold?\n:--\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			var mu sync.Mutex
+			calls := 0
+			parser := NewParser(&mockLLM{
+				Delay: 10 * time.Millisecond,
+				answer: func(prompt string) string {
+					mu.Lock()
+					defer mu.Unlock()
+					calls++
+					return "Answer"
+				},
+			}, tmpDir, filepath.Join(tmpDir, "compiled"), filepath.Join(tmpDir, "results"))
+			start := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+			parser.SetClock(fixedClock{start})
+			if err := parser.ProcessFile(context.Background(), srcFile); err != nil {
+				t.Fatalf("ProcessFile() error = %v", err)
+			}
+
+			tt.setup(parser)
+			parser.SetClock(fixedClock{start.Add(2 * time.Hour)})
+			if err := parser.ProcessFile(context.Background(), srcFile); err != nil {
+				t.Fatalf("ProcessFile() error = %v", err)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if calls != tt.wantCalls {
+				t.Errorf("Expected %d LLM calls, got %d", tt.wantCalls, calls)
+			}
+		})
+	}
+}
+
+func TestBlockTTL(t *testing.T) {
+	if ttl, err := blockTTL(map[string]string{TTLAttribute: "90m"}); err != nil || ttl != 90*time.Minute {
+		t.Errorf("blockTTL(90m) = %v, %v", ttl, err)
+	}
+	if ttl, err := blockTTL(nil); err != nil || ttl != 0 {
+		t.Errorf("Expected no ttl without the attribute, got %v, %v", ttl, err)
+	}
+	for _, value := range []string{"soon", "0s", "-1h"} {
+		if _, err := blockTTL(map[string]string{TTLAttribute: value}); err == nil {
+			t.Errorf("Expected an error for ttl=%s", value)
+		}
+	}
+}
@@ -3,8 +3,12 @@ package parser
 
 import (
 	"context"
+	"io"
+	"regexp"
 	"sync"
 	"time"
+
+	"github.com/fireharp/pml/impl1/parser/directives"
 )
 
 // LLMClient interface for making LLM requests
@@ -13,31 +17,132 @@ type LLMClient interface {
 	Summarize(ctx context.Context, text string) (string, error)
 }
 
+// ModelLLMClient is implemented by LLM clients that can send a prompt to a specific model
+type ModelLLMClient interface {
+	AskWithModel(ctx context.Context, model, prompt string) (string, error)
+}
+
+// ImageLLMClient is implemented by LLM clients that can send an image along with a prompt
+type ImageLLMClient interface {
+	AskWithImage(ctx context.Context, model, prompt string, image []byte, mimeType string) (string, error)
+}
+
+// SystemLLMClient is implemented by LLM clients that can send a system prompt along with a prompt
+type SystemLLMClient interface {
+	AskWithSystem(ctx context.Context, model, system, prompt string) (string, error)
+}
+
+// EmbeddingLLMClient is implemented by LLM clients that can compute the embedding of a text
+type EmbeddingLLMClient interface {
+	Embed(ctx context.Context, text string) ([]float32, error)
+}
+
+// ApprovalFunc decides whether a side-effecting block may run
+type ApprovalFunc func(block Block) (bool, error)
+
 type Parser struct {
-	llm            LLMClient
-	sourcesDir     string
-	compiledDir    string
-	rootResultsDir string // For larger logs and detailed execution results
-	cacheFile      string // Path to the cache file
-	cache          map[string]CacheEntry
-	cacheMu        sync.RWMutex // Protects cache map
-	saveMu         sync.Mutex   // Protects cache file operations
-	debug          bool
-	forceProcess   bool
-	resultFiles    sync.Map // Map to track result files being written
-	fileLocks      sync.Map // Map to track file locks
-	usedNamesMu    sync.Mutex
-	usedNames      map[string]bool
+	llm                LLMClient
+	sourcesDir         string
+	compiledDir        string
+	rootResultsDir     string // For larger logs and detailed execution results
+	centralResults     bool   // Write results under rootResultsDir mirroring the sources tree
+	cacheFile          string // Path to the cache file
+	cache              map[string]CacheEntry
+	cacheMu            sync.RWMutex               // Protects cache map and cacheDirty
+	cacheDirty         bool                       // The cache has changes not yet saved to disk
+	cacheSeen          map[string]map[string]bool // Files and their block keys this process loaded or saved (protected by cacheMu)
+	sharedBlocks       map[string]PortableBlock   // Block results imported with ImportCache, by block checksum (protected by cacheMu)
+	saveMu             sync.Mutex                 // Protects cache file operations
+	indexMu            sync.Mutex                 // Serializes results index updates
+	indexQueueMu       sync.Mutex                 // Protects indexQueue
+	indexQueue         map[string][]IndexEntry    // Index entries of files being processed, by source file
+	debug              bool
+	forceProcess       bool
+	directives         *directives.DirectiveRegistry // Directives available in PML files
+	failFast           bool                          // Cancel the remaining files when one fails in ProcessAllFiles
+	includeTags        []string                      // Only blocks with one of these tags are processed (all if empty)
+	excludeTags        []string                      // Blocks with any of these tags are skipped
+	modelLimits        map[string]chan struct{}      // Per-model semaphores bounding in-flight LLM calls
+	approvalFunc       ApprovalFunc                  // Consulted before running side-effecting blocks
+	inputFunc          InputFunc                     // Answers :input blocks; they await input if nil
+	strictCache        bool                          // Fail blocks without a cached result instead of running them
+	stripFences        bool                          // Remove a code fence around answers before storing them
+	summarizeLinks     bool                          // Label result links with a short summary of the answer
+	batchLinkSummaries bool                          // Produce all link summaries of a file with one LLM request
+	summaryStrategy    SummaryStrategy               // Labels result links without the LLM (LLM summaries if nil)
+	refinePrior        bool                          // Include the prior answer in the prompt when a block is reprocessed
+	maxTokens          int64                         // Token budget for the run (0 means unlimited)
+	tokensUsed         int64                         // Tokens used so far, updated atomically
+	tokenizer          Tokenizer                     // Counts prompt tokens (estimated from length if nil)
+	maxPromptTokens    int                           // Largest prompt sent to the LLM (0 means unlimited)
+	bestOfReducer      string                        // Reducer of best-of-N blocks without a reducer attribute (majority if empty)
+	streamThreshold    int64                         // Files at least this large are streamed (0 means never)
+	maxBlocksPerFile   int                           // Files with more blocks are rejected (0 means unlimited)
+	templateValues     map[string]interface{}        // Values for prompt templates (templates are not rendered if nil)
+	envInterpolation   bool                          // Expand ${NAME} environment variable references in blocks
+	emitPython         bool                          // Write foo.pml.py next to each processed file
+	executeDo          bool                          // Run :do blocks as Python instead of by their directive
+	cacheKeyAttributes []string                      // Block attributes that are part of the block checksum
+	pruneDirs          []string                      // Directory names skipped when looking for PML files
+	extensions         []string                      // File extensions recognized as PML files
+	clock              Clock                         // Source of timestamps (real time if nil)
+	scheduler          Scheduler                     // Limits concurrent blocks and files (channel semaphores if nil)
+	newlineMode        NewlineMode                   // Trailing newline of rewritten PML files
+	normalization      PromptNormalization           // Normalization of block content before checksumming
+	diffOutput         io.Writer                     // Dry run: diffs of PML files are written here instead of the files
+	diffMu             sync.Mutex                    // Keeps the diffs of concurrently processed files apart
+	resultCallback     func(BlockResult)             // Receives each file's block results in block order
+	projectRoot        string                        // Overrides the project root used to run Python
+	env                string                        // Selects [env.<name>] sections of settings files, overriding $PML_ENV
+	systemPrompts      map[string]string             // Directive to the system prompt sent with its blocks
+	redactMu           sync.RWMutex                  // Protects redactPatterns and redactedValues
+	redactPatterns     []*regexp.Regexp              // Matches replaced by [REDACTED] in results and logs
+	redactedValues     map[string]bool               // Secrets replaced by [REDACTED] in results and logs
+	redactEnvValues    bool                          // Interpolated environment variable values are redacted
+	injectionPatterns  []*regexp.Regexp              // Validate warns about block content matching these (no scan if empty)
+	laxDirectives      bool                          // Unknown directives are text instead of syntax errors
+	closeAtEOF         bool                          // Blocks left open at the end of a file are closed there instead of syntax errors
+	markdownFences     bool                          // Markdown files are processed, parsing only their ```pml fences
+	resultSink         ResultSink                    // Receives each new block result
+	failOnSinkError    bool                          // A result sink error fails its block
+	changedLines       changedLinesFunc              // Only blocks overlapping these lines are processed (all if nil)
+	checkpointFile     string                        // ProcessAllFiles records completed files here (disabled if empty)
+	resume             bool                          // Skip files the checkpoint lists as completed
+	expectations       []ExpectationResult           // Outcomes of blocks with an expect attribute
+	expectMu           sync.Mutex                    // Protects expectations
+	resultLocks        sync.Map                      // Result file path to the *sync.Mutex serializing its writes
+	resultWriters      chan struct{}                 // Bounds the result files written at once
+	fileRunsMu         sync.Mutex                    // Protects fileRuns
+	fileRuns           map[string][]*fileRun         // Absolute path to the ProcessFile calls processing it
+	rewriteUnchanged   bool                          // Answers identical to the previous one still get a new result file
+	transactional      bool                          // ProcessAllFiles updates PML files all or nothing
+	txnMu              sync.Mutex                    // Protects txn
+	txn                *sourceTxn                    // PML file updates staged by the current transactional run
+	statsMu            sync.Mutex                    // Protects fileStats
+	fileStats          map[string]FileStat           // Path to the last processing of the file
+	fileSLA            time.Duration                 // Longest a file may take to process (no limit if 0)
+	failOnSLA          bool                          // A file exceeding fileSLA fails with an *SLAError
+	slaWarning         func(FileStat)                // Receives each file exceeding fileSLA
+	usedNamesMu        sync.Mutex
+	usedNames          map[string]bool
+	nameAdjectives     []string // Adjectives result file names are made of
+	nameNouns          []string // Nouns result file names are made of
 }
 
 // Block represents a block in PML file
 type Block struct {
 	Type        string
 	Content     []string
-	Response    string
-	IsEphemeral bool // Whether this block was generated during runtime
-	Start       int  // Start position in the original content
-	End         int  // End position in the original content
+	Response    string            // Prior answer to this block, used when refining previous results
+	Tags        []string          // Tags from the directive line, e.g. ":ask tags=smoke,fast"
+	Model       string            // Model override from the directive line, e.g. ":ask model=gpt-4o"
+	Attributes  map[string]string // All key=value attributes of the directive line
+	Image       *Image            // Image attached with the image attribute, e.g. ":ask image=diagram.png"
+	IsEphemeral bool              // Whether this block was generated during runtime
+	Include     string            // File the block was included from, empty for the file's own blocks
+	Line        int               // 1-based line of the directive in the original content
+	Start       int               // Start position in the original content
+	End         int               // End position in the original content
 }
 
 // FileBlocks holds the original file path plus the parsed blocks
@@ -52,9 +157,18 @@ type BlockResult struct {
 	BlockIdx int
 	Block    Block
 	Result   string
+	Warnings []string // What a :do block run as Python wrote to stderr
 	Err      error
 }
 
+// ResultSource identifies the block a result file was generated from
+type ResultSource struct {
+	SourceFile    string `json:"source_file"`
+	BlockIndex    int    `json:"block_index"`
+	BlockChecksum string `json:"block_checksum"`
+	BlockLine     int    `json:"block_line,omitempty"` // Line of the block in the source file when it was processed
+}
+
 // CacheEntry represents a cached processing result
 type CacheEntry struct {
 	Checksum string                `json:"checksum"`
@@ -64,19 +178,33 @@ type CacheEntry struct {
 
 // BlockCache represents a cached block processing result
 type BlockCache struct {
-	Checksum string    `json:"checksum"`
-	Result   string    `json:"result"`
-	ModTime  time.Time `json:"mod_time"`
+	Checksum   string            `json:"checksum"`
+	Result     string            `json:"result"`
+	ResultFile string            `json:"result_file,omitempty"` // Link path of the result file, as in ":--(r/...)"
+	Index      int               `json:"index"`                 // Position of the block in its file
+	Line       int               `json:"line,omitempty"`        // Line of the block in its file when it was processed
+	Attributes map[string]string `json:"attributes,omitempty"`  // Directive line attributes of the block
+	Locked     bool              `json:"locked,omitempty"`      // Never reprocess this block, even when forced
+	Summary    string            `json:"summary,omitempty"`     // Label of the result link, once the result was summarized
+	ModTime    time.Time         `json:"mod_time"`
 }
 
 // Directives used in PML files
 const (
-	DirectiveAsk = ":ask"
-	DirectiveDo  = ":do"
-	DirectiveEnd = ":--"
+	DirectiveAsk       = ":ask"
+	DirectiveDo        = ":do"
+	DirectiveSummary   = ":summary"   // Summarizes the results of all preceding blocks
+	DirectiveSummarize = ":summarize" // Summarizes its own content into a short label
+	DirectiveEmbed     = ":embed"     // Computes the embedding vector of its content
+	DirectiveInput     = ":input"     // Asks the user for input, never cached
+	DirectiveInclude   = ":include"   // Splices in the blocks of another file
+	DirectiveEnd       = ":--"
 )
 
-// Word lists for generating unique result names
+// ResultNotApproved is recorded as the result of a block the approval function rejected
+const ResultNotApproved = "skipped: not approved"
+
+// Default word lists for generating unique result names
 var (
 	adjectives = []string{
 		"happy", "clever", "swift", "gentle", "brave",
@@ -0,0 +1,30 @@
+package parser
+
+import (
+	"os"
+)
+
+// SetRewriteUnchangedResults sets whether a block answered again, e.g. when
+// processing is forced or with ReprocessBlock, gets a new result file even if
+// the answer is identical to the previous one. By default such an answer keeps
+// its result file and link, leaving the files byte-identical. Blocks with a
+// ttl are always rewritten, as the new timestamp restarts their ttl.
+func (p *Parser) SetRewriteUnchangedResults(rewrite bool) {
+	p.rewriteUnchanged = rewrite
+}
+
+// unchangedResult returns the link of the previous result of block when result
+// is identical to it and its result file is still there
+func (p *Parser) unchangedResult(plmPath string, block Block, previous *BlockCache, result string) (string, bool) {
+	if p.rewriteUnchanged || previous == nil || previous.ResultFile == "" || previous.Result != p.redact(result) {
+		return "", false
+	}
+	if _, ok := block.Attributes[TTLAttribute]; ok {
+		return "", false
+	}
+	if _, err := os.Stat(p.ResolveResultLink(plmPath, previous.ResultFile)); err != nil {
+		return "", false
+	}
+	p.debugf("Answer to block at line %d of %s is unchanged; keeping %s\n", block.Line, plmPath, previous.ResultFile)
+	return previous.ResultFile, true
+}
@@ -0,0 +1,107 @@
+package parser
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// readTree returns the content of every file under dir by relative path
+func readTree(t *testing.T, dir string) map[string]string {
+	t.Helper()
+	files := make(map[string]string)
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(dir, path)
+		files[rel] = string(data)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+// TestUnchangedResultKeepsFiles tests that answering a block again with the
+// same answer leaves the PML file and its result file byte-identical
+func TestUnchangedResultKeepsFiles(t *testing.T) {
+	tmpDir := t.TempDir()
+	content := ":ask\nWhat is 2+2?\n:--\n"
+	srcFile := filepath.Join(tmpDir, "same.pml")
+	if err := os.WriteFile(srcFile, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	llm := &mockLLM{response: "4", Delay: time.Millisecond}
+	parser := NewParser(llm, tmpDir, tmpDir, filepath.Join(tmpDir, "results"))
+	resultsDir := parser.resultsDirFor(srcFile)
+	if err := parser.ProcessFile(context.Background(), srcFile); err != nil {
+		t.Fatalf("ProcessFile() error = %v", err)
+	}
+	processed, err := os.ReadFile(srcFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	results := readTree(t, resultsDir)
+
+	// Results are timestamped, so any rewrite would show
+	time.Sleep(10 * time.Millisecond)
+
+	blocks, err := parser.parseBlocks(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := parser.ReprocessBlock(context.Background(), srcFile, parser.calculateBlockChecksum(blocks[0])); err != nil {
+		t.Fatalf("ReprocessBlock() error = %v", err)
+	}
+	assertUnchanged := func(step string) {
+		t.Helper()
+		data, err := os.ReadFile(srcFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != string(processed) {
+			t.Errorf("%s: expected the PML file to be unchanged, got %q, want %q", step, data, processed)
+		}
+		after := readTree(t, resultsDir)
+		if len(after) != len(results) {
+			t.Errorf("%s: expected no new result files, got %d files, want %d", step, len(after), len(results))
+		}
+		for name, before := range results {
+			if after[name] != before {
+				t.Errorf("%s: expected %s to be unchanged", step, name)
+			}
+		}
+	}
+	assertUnchanged("reprocess")
+
+	// A forced run over the same block links the same result
+	if err := os.WriteFile(srcFile, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	parser.SetForceProcess(true)
+	if err := parser.ProcessFile(context.Background(), srcFile); err != nil {
+		t.Fatalf("ProcessFile() error = %v", err)
+	}
+	assertUnchanged("forced run")
+
+	// Opting out rewrites the result
+	parser.SetRewriteUnchangedResults(true)
+	if err := os.WriteFile(srcFile, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := parser.ProcessFile(context.Background(), srcFile); err != nil {
+		t.Fatalf("ProcessFile() error = %v", err)
+	}
+	if after := readTree(t, resultsDir); len(after) == len(results) {
+		t.Errorf("Expected a new result file with SetRewriteUnchangedResults, got %v", after)
+	}
+}
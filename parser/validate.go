@@ -0,0 +1,170 @@
+package parser
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Severity ranks a validation issue
+type Severity string
+
+const (
+	SeverityError   Severity = "error"   // The file can't be processed as intended
+	SeverityWarning Severity = "warning" // The file can be processed, but probably not as intended
+)
+
+// Issue is a problem found in a PML file by Validate
+type Issue struct {
+	Severity Severity
+	File     string
+	Line     int // 1-based line of the problem, or 0 if it concerns the whole file
+	Message  string
+}
+
+func (i Issue) String() string {
+	if i.Line == 0 {
+		return fmt.Sprintf("%s: %s: %s", i.File, i.Severity, i.Message)
+	}
+	return fmt.Sprintf("%s:%d: %s: %s", i.File, i.Line, i.Severity, i.Message)
+}
+
+// Validate checks the PML file at path without processing it and returns every
+// issue found: syntax errors, environment variables and template values that
+// are not defined, unreadable sidecar settings, result links whose result file
+// is missing, blocks left failed by a previous run, blocks left open at the end
+// of the file, includes that can't be read or form a cycle, unreadable images,
+// duplicate blocks, blocks over the prompt size limit, invalid best_of,
+// reducer, format or ttl attributes, invalid expect patterns and, with
+// SetInjectionScan, content resembling a prompt injection.
+// The error is only set when the file can't be read.
+func (p *Parser) Validate(path string) ([]Issue, error) {
+	content, err := readSource(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file: %w", err)
+	}
+	text := p.blockSource(path, string(content))
+
+	var issues []Issue
+	report := func(severity Severity, line int, format string, args ...interface{}) {
+		issues = append(issues, Issue{Severity: severity, File: path, Line: line, Message: fmt.Sprintf(format, args...)})
+	}
+
+	// Result links must point at an existing result file
+	for i, line := range strings.Split(text, "\n") {
+		if message, ok := parseErrorMarker(strings.TrimSpace(line)); ok {
+			report(SeverityWarning, i+1, "block failed in the last run: %s", message)
+			continue
+		}
+		link, ok := parseResultLink(line)
+		if !ok {
+			continue
+		}
+		if _, err := os.Stat(p.ResolveResultLink(path, link)); err != nil {
+			report(SeverityError, i+1, "broken result link %s", link)
+		}
+	}
+
+	if _, err := p.loadSettings(path); err != nil {
+		report(SeverityError, 0, "failed to load settings for %s: %v", filepath.Base(path), err)
+	}
+
+	blocks, err := p.parseBlocks(text)
+	if err != nil {
+		var syntaxErr *SyntaxError
+		if errors.As(err, &syntaxErr) {
+			report(SeverityError, syntaxErr.Line, "%s", syntaxErr.Msg)
+		} else {
+			report(SeverityError, 0, "%v", err)
+		}
+		return issues, nil
+	}
+
+	if err := p.checkBlockCount(len(blocks)); err != nil {
+		report(SeverityError, 0, "%v", err)
+	}
+	if _, _, err := p.parseIncluding(path, string(content), includeChain(path)); err != nil {
+		report(SeverityError, 0, "%v", err)
+	}
+
+	// Without SetStrictEOF, a block left open is closed at the end of the file
+	if n := len(blocks); n > 0 && p.closeAtEOF {
+		source := text[blocks[n-1].Start:blocks[n-1].End]
+		if !isBlockEnd(strings.TrimSpace(source[strings.LastIndex(source, "\n")+1:])) {
+			report(SeverityWarning, blocks[n-1].Line, "file ended without closing block; it is closed at the end of the file")
+		}
+	}
+
+	seen := make(map[string]int) // Block checksum to the line of its first occurrence
+	for i := range blocks {
+		block := &blocks[i]
+		line := block.Line
+
+		if p.envInterpolation {
+			if err := p.expandBlockEnv(block, i); err != nil {
+				report(SeverityError, line, "%v", err)
+			}
+		}
+		if p.templateValues != nil {
+			if err := p.renderBlockTemplate(block, i); err != nil {
+				report(SeverityError, line, "%v", err)
+			}
+		}
+
+		// Scanned after expansion, as injections often come from interpolated content
+		for j, contentLine := range block.Content {
+			if match, ok := p.injectionMatch(contentLine); ok {
+				report(SeverityWarning, line+1+j, "content resembles a prompt injection (%q); check where it came from", match)
+			}
+		}
+
+		if err := attachImage(block, i, filepath.Dir(path)); err != nil {
+			report(SeverityError, line, "%v", err)
+		}
+
+		checksum := p.calculateBlockChecksum(*block)
+		if first, ok := seen[checksum]; ok {
+			report(SeverityWarning, line, "duplicate of the block at line %d", first)
+		} else {
+			seen[checksum] = line
+		}
+
+		if err := p.checkPromptSize(block.Model, p.blockPrompt(*block)); err != nil {
+			report(SeverityError, line, "%v", err)
+		}
+
+		if _, _, err := p.bestOf(*block); err != nil {
+			report(SeverityError, line, "%v", err)
+		}
+
+		if _, err := blockTTL(block.Attributes); err != nil {
+			report(SeverityError, line, "%v", err)
+		}
+
+		if format, ok := block.Attributes[FormatAttribute]; ok && format != FormatJSON {
+			// JSON can only be checked once there is an answer
+			if _, err := p.formatResult("", format); err != nil {
+				report(SeverityError, line, "%v", err)
+			}
+		}
+
+		if expect, ok := block.Attributes[ExpectAttribute]; ok {
+			if _, err := matchExpectation(expect, ""); err != nil {
+				report(SeverityError, line, "%v", err)
+			}
+		}
+	}
+	return issues, nil
+}
+
+// HasErrors reports whether any of issues is an error
+func HasErrors(issues []Issue) bool {
+	for _, issue := range issues {
+		if issue.Severity == SeverityError {
+			return true
+		}
+	}
+	return false
+}
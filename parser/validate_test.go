@@ -0,0 +1,97 @@
+package parser
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestValidate tests that every kind of issue in a file is reported in one pass
+func TestValidate(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "pml-validate-*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	p := NewParser(&mockLLM{}, tmpDir, filepath.Join(tmpDir, "compiled"), filepath.Join(tmpDir, "results"))
+	p.SetMaxPromptTokens(10)
+	p.SetTemplateValues(map[string]interface{}{"Name": "Ada"})
+
+	pmlFile := filepath.Join(tmpDir, "test.pml")
+	content := strings.Join([]string{
+		":ask",                        // 1
+		"Say hello to {{.Name}}",      // 2
+		":--",                         // 3
+		":--(r/missing_block0_0.pml)", // 4: broken link
+		":ask",                        // 5: duplicate of line 1
+		"Say hello to {{.Name}}",      // 6
+		":--",                         // 7
+		":ask",                        // 8: undefined template value
+		"Say hello to {{.Nickname}}",  // 9
+		":--",                         // 10
+		":ask",                        // 11: over the prompt size limit
+		strings.Repeat("very ", 20),   // 12
+		":--",                         // 13
+		":ask expect=/[/",             // 14: invalid expect pattern
+		"Anything",                    // 15
+		":--",                         // 16
+		"",
+	}, "\n")
+	if err := os.WriteFile(pmlFile, []byte(content), 0644); err != nil {
+		t.Fatalf("Failed to write test file: %v", err)
+	}
+
+	issues, err := p.Validate(pmlFile)
+	if err != nil {
+		t.Fatalf("Validate failed: %v", err)
+	}
+
+	want := []struct {
+		line     int
+		severity Severity
+		message  string
+	}{
+		{4, SeverityError, "broken result link"},
+		{5, SeverityWarning, "duplicate of the block at line 1"},
+		{8, SeverityError, "Nickname"},
+		{11, SeverityError, "prompt"},
+		{14, SeverityError, "invalid expect pattern"},
+	}
+	if len(issues) != len(want) {
+		t.Fatalf("Expected %d issues, got %d: %v", len(want), len(issues), issues)
+	}
+	for i, w := range want {
+		issue := issues[i]
+		if issue.Line != w.line || issue.Severity != w.severity || !strings.Contains(issue.Message, w.message) || issue.File != pmlFile {
+			t.Errorf("Issue %d: expected %s at line %d containing %q, got %v", i, w.severity, w.line, w.message, issue)
+		}
+	}
+	if !HasErrors(issues) {
+		t.Error("Expected HasErrors to be true")
+	}
+}
+
+// TestValidateSyntaxError tests that a syntax error is reported at its line
+func TestValidateSyntaxError(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "pml-validate-*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	p := NewParser(&mockLLM{}, tmpDir, filepath.Join(tmpDir, "compiled"), filepath.Join(tmpDir, "results"))
+	pmlFile := filepath.Join(tmpDir, "test.pml")
+	if err := os.WriteFile(pmlFile, []byte("Intro\n\n:ask\nUnterminated\n"), 0644); err != nil {
+		t.Fatalf("Failed to write test file: %v", err)
+	}
+
+	issues, err := p.Validate(pmlFile)
+	if err != nil {
+		t.Fatalf("Validate failed: %v", err)
+	}
+	if len(issues) != 1 || issues[0].Line != 3 || issues[0].Severity != SeverityError {
+		t.Fatalf("Expected one error at line 3, got %v", issues)
+	}
+}
@@ -0,0 +1,107 @@
+package parser
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// warmConcurrency is the number of prompts WarmFromPrompts sends at once
+const warmConcurrency = 10
+
+// WarmFromPrompts asks each prompt as an :ask block and caches the answer, so
+// blocks with the same content in any file are answered from the cache. Prompts
+// already cached are skipped unless processing is forced. The answers are kept
+// with the results imported by ImportCache, and are exported with them.
+func (p *Parser) WarmFromPrompts(ctx context.Context, prompts []string) error {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	var mu sync.Mutex // Protects warmed and errs
+	warmed := make(map[string]PortableBlock)
+	var errs []error
+	var wg sync.WaitGroup
+	slots := p.newSlots(warmConcurrency)
+	seen := make(map[string]bool)
+	for _, prompt := range prompts {
+		if strings.TrimSpace(prompt) == "" {
+			continue
+		}
+		block := Block{Type: DirectiveAsk, Content: strings.Split(prompt, "\n"), Attributes: map[string]string{}}
+		checksum := p.calculateBlockChecksum(block)
+		if seen[checksum] {
+			continue
+		}
+		seen[checksum] = true
+		p.cacheMu.RLock()
+		cached := p.sharedResult(checksum, block.Attributes)
+		p.cacheMu.RUnlock()
+		if cached != nil && !p.forceProcess {
+			continue
+		}
+
+		if err := slots.Acquire(ctx); err != nil {
+			mu.Lock()
+			errs = append(errs, err)
+			mu.Unlock()
+			break
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer slots.Release()
+			result, _, err := p.runBlock(ctx, block)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				errs = append(errs, fmt.Errorf("failed to warm %q: %w", firstLine(prompt), err))
+				return
+			}
+			warmed[checksum] = PortableBlock{Result: p.redact(result), ModTime: p.now()}
+		}()
+	}
+	wg.Wait()
+
+	// Keep the answers given before any failure
+	if len(warmed) > 0 {
+		if err := p.addSharedBlocks(warmed); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// LoadPrompts reads the prompts of a file holding a JSON array of strings, or
+// one prompt per line otherwise. Empty lines are skipped.
+func LoadPrompts(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read prompts file: %w", err)
+	}
+	text := strings.TrimSpace(string(data))
+	if strings.HasPrefix(text, "[") {
+		var prompts []string
+		if err := json.Unmarshal([]byte(text), &prompts); err != nil {
+			return nil, fmt.Errorf("failed to parse prompts file: %w", err)
+		}
+		return prompts, nil
+	}
+	var prompts []string
+	for _, line := range strings.Split(text, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			prompts = append(prompts, line)
+		}
+	}
+	return prompts, nil
+}
+
+// firstLine returns the first line of s
+func firstLine(s string) string {
+	line, _, _ := strings.Cut(s, "\n")
+	return line
+}
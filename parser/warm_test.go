@@ -0,0 +1,75 @@
+package parser
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestWarmFromPrompts tests that a block matching a warmed prompt is answered
+// from the cache
+func TestWarmFromPrompts(t *testing.T) {
+	tmpDir := t.TempDir()
+	var calls int32
+	llm := &mockLLM{response: "Warm answer", Delay: time.Millisecond, callback: func() { atomic.AddInt32(&calls, 1) }}
+	parser := NewParser(llm, tmpDir, tmpDir, filepath.Join(tmpDir, "results"))
+
+	prompts := []string{"What is PML?", "What is Go?", "What is PML?", ""}
+	if err := parser.WarmFromPrompts(context.Background(), prompts); err != nil {
+		t.Fatalf("WarmFromPrompts() error = %v", err)
+	}
+	if got := atomic.LoadInt32(&calls); got != 2 {
+		t.Fatalf("Expected each distinct prompt to be asked once, got %d calls", got)
+	}
+
+	// Warming again, or processing a matching block, doesn't call the LLM
+	atomic.StoreInt32(&calls, 0)
+	if err := parser.WarmFromPrompts(context.Background(), prompts); err != nil {
+		t.Fatalf("WarmFromPrompts() error = %v", err)
+	}
+	srcFile := filepath.Join(tmpDir, "demo.pml")
+	if err := os.WriteFile(srcFile, []byte(":ask\nWhat is PML?\n:--\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var answer string
+	parser.SetResultCallback(func(r BlockResult) { answer = r.Result })
+	if err := parser.ProcessFile(context.Background(), srcFile); err != nil {
+		t.Fatalf("ProcessFile() error = %v", err)
+	}
+	if got := atomic.LoadInt32(&calls); got != 0 {
+		t.Errorf("Expected the warmed block to hit the cache, got %d calls", got)
+	}
+	if answer != "Warm answer" {
+		t.Errorf("Expected the warmed answer, got %q", answer)
+	}
+}
+
+// TestLoadPrompts tests reading prompts from JSON arrays and from lines
+func TestLoadPrompts(t *testing.T) {
+	tmpDir := t.TempDir()
+	for name, content := range map[string]string{
+		"prompts.json": `["What is PML?", "Explain\nthis"]`,
+		"prompts.txt":  "What is PML?\n\n  Explain this  \n",
+	} {
+		path := filepath.Join(tmpDir, name)
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		prompts, err := LoadPrompts(path)
+		if err != nil {
+			t.Fatalf("LoadPrompts(%s) error = %v", name, err)
+		}
+		want := []string{"What is PML?", "Explain this"}
+		if strings.HasSuffix(name, ".json") {
+			want[1] = "Explain\nthis"
+		}
+		if !reflect.DeepEqual(prompts, want) {
+			t.Errorf("LoadPrompts(%s) = %q, want %q", name, prompts, want)
+		}
+	}
+}
@@ -14,15 +14,28 @@ import (
 	"github.com/fsnotify/fsnotify"
 )
 
+// Default timings for NewResultsWatcher callers that have no preference
+const (
+	DefaultKillDebounce = 500 * time.Millisecond
+	DefaultKillCooldown = 5 * time.Second
+)
+
 // ResultsWatcher watches for file system changes in the results directory and kills processes writing to it
 type ResultsWatcher struct {
 	watchPath string
 	fsWatcher *fsnotify.Watcher
 	done      chan struct{}
+	debounce  time.Duration        // Quiet period after the last write to a file before acting
+	cooldown  time.Duration        // Minimum time between kills for the same file
+	pending   map[string]time.Time // Files with writes waiting for the debounce window
+	lastKill  map[string]time.Time // When processes writing to each file were last killed
+	killFunc  func(filePath string) error
 }
 
-// NewResultsWatcher creates a new watcher for the results directory
-func NewResultsWatcher(resultsDir string) (*ResultsWatcher, error) {
+// NewResultsWatcher creates a new watcher for the results directory. Writes to a file
+// are coalesced until no event has been seen for debounce, and a file is not acted on
+// again until cooldown has passed.
+func NewResultsWatcher(resultsDir string, debounce, cooldown time.Duration) (*ResultsWatcher, error) {
 	fsWatcher, err := fsnotify.NewWatcher()
 	if err != nil {
 		return nil, fmt.Errorf("failed to create watcher: %w", err)
@@ -37,7 +50,12 @@ func NewResultsWatcher(resultsDir string) (*ResultsWatcher, error) {
 		watchPath: resultsDir,
 		fsWatcher: fsWatcher,
 		done:      make(chan struct{}),
+		debounce:  debounce,
+		cooldown:  cooldown,
+		pending:   make(map[string]time.Time),
+		lastKill:  make(map[string]time.Time),
 	}
+	w.killFunc = w.killWritingProcesses
 
 	// Write PID file
 	if err := w.writePidFile(); err != nil {
@@ -84,6 +102,11 @@ func (w *ResultsWatcher) Start() {
 		}
 	}
 
+	// Fires once writes have settled for the debounce window
+	flush := time.NewTimer(w.debounce)
+	flush.Stop()
+	defer flush.Stop()
+
 	// Keep watching until explicitly stopped
 	for {
 		select {
@@ -113,13 +136,12 @@ func (w *ResultsWatcher) Start() {
 				// Check for write or create events
 				if event.Op&fsnotify.Write == fsnotify.Write || event.Op&fsnotify.Create == fsnotify.Create {
 					log.Printf("Detected modification in: %s (op: %v)\n", event.Name, event.Op)
-					if _, err := os.Stat(event.Name); err != nil {
-						log.Printf("Warning: File no longer exists: %v\n", err)
-						continue
-					}
-					if err := w.killWritingProcesses(event.Name); err != nil {
-						log.Printf("Error killing processes: %v\n", err)
-					}
+					w.pending[event.Name] = time.Now()
+					flush.Reset(w.debounce)
+				}
+			case <-flush.C:
+				if wait := w.flushPending(time.Now()); wait > 0 {
+					flush.Reset(wait)
 				}
 			case err, ok := <-w.fsWatcher.Errors:
 				if !ok {
@@ -133,6 +155,35 @@ func (w *ResultsWatcher) Start() {
 	}
 }
 
+// flushPending acts on files whose writes have settled and returns how long to
+// wait before the remaining pending files settle (0 if none are left)
+func (w *ResultsWatcher) flushPending(now time.Time) time.Duration {
+	var wait time.Duration
+	for filePath, last := range w.pending {
+		if remaining := w.debounce - now.Sub(last); remaining > 0 {
+			if wait == 0 || remaining < wait {
+				wait = remaining
+			}
+			continue
+		}
+		delete(w.pending, filePath)
+
+		if killed, ok := w.lastKill[filePath]; ok && now.Sub(killed) < w.cooldown {
+			log.Printf("Skipping %s: still cooling down from the last kill\n", filePath)
+			continue
+		}
+		if _, err := os.Stat(filePath); err != nil {
+			log.Printf("Warning: File no longer exists: %v\n", err)
+			continue
+		}
+		w.lastKill[filePath] = now
+		if err := w.killFunc(filePath); err != nil {
+			log.Printf("Error killing processes: %v\n", err)
+		}
+	}
+	return wait
+}
+
 // Stop stops the watcher
 func (w *ResultsWatcher) Stop() error {
 	close(w.done)
@@ -0,0 +1,62 @@
+package watcher
+
+import (
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestResultsWatcherDebounce(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "results-watcher-test-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	w, err := NewResultsWatcher(tmpDir, 150*time.Millisecond, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var kills int32
+	w.killFunc = func(string) error {
+		atomic.AddInt32(&kills, 1)
+		return nil
+	}
+
+	go w.Start()
+	defer w.Stop()
+
+	// Wait for watcher to start
+	time.Sleep(100 * time.Millisecond)
+
+	// A burst of writes to the same file
+	resultFile := filepath.Join(tmpDir, "result.pml")
+	for i := 0; i < 10; i++ {
+		if err := os.WriteFile(resultFile, []byte("partial result"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Nothing happens while writes are still settling
+	if got := atomic.LoadInt32(&kills); got != 0 {
+		t.Errorf("Expected no kills during the burst, got %d", got)
+	}
+
+	time.Sleep(400 * time.Millisecond)
+	if got := atomic.LoadInt32(&kills); got != 1 {
+		t.Errorf("Expected 1 kill after the debounce window, got %d", got)
+	}
+
+	// Another burst within the cooldown does not kill again
+	if err := os.WriteFile(resultFile, []byte("more"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(400 * time.Millisecond)
+	if got := atomic.LoadInt32(&kills); got != 1 {
+		t.Errorf("Expected no further kills during the cooldown, got %d", got)
+	}
+}
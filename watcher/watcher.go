@@ -9,8 +9,10 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/fireharp/pml/impl1/parser"
 	"github.com/fsnotify/fsnotify"
 )
 
@@ -30,14 +32,25 @@ type FileProcessor interface {
 	ProcessFile(ctx context.Context, path string) error
 }
 
+// ReloadFunc rebuilds the file processor from a changed config file. An error
+// keeps the current processor, e.g. while the file is only partially written.
+type ReloadFunc func(configPath string) (FileProcessor, error)
+
 // Watcher watches for file system changes
 type Watcher struct {
-	watchPath string
-	fsWatcher *fsnotify.Watcher
-	processor FileProcessor
+	watchPath  string
+	fsWatcher  *fsnotify.Watcher
+	mu         sync.RWMutex // Guards processor against a concurrent reload
+	processor  FileProcessor
+	pruneDirs  []string   // Events under directories with these names are ignored
+	extensions []string   // Only files with these extensions are processed (all files if empty)
+	configPath string     // Config file whose changes trigger reload
+	reload     ReloadFunc // Rebuilds the processor when configPath changes
 }
 
-// NewWatcher creates a new file system watcher
+// NewWatcher creates a new file system watcher. The processor handles every
+// event until a config reload replaces it, so a *parser.Parser passed here keeps
+// its in-memory cache warm across events.
 func NewWatcher(watchPath string, processor FileProcessor) (*Watcher, error) {
 	if processor == nil {
 		return nil, fmt.Errorf("processor cannot be nil")
@@ -62,9 +75,72 @@ func NewWatcher(watchPath string, processor FileProcessor) (*Watcher, error) {
 		watchPath: absPath,
 		fsWatcher: fsWatcher,
 		processor: processor,
+		pruneDirs: append([]string(nil), parser.DefaultPruneDirs...),
 	}, nil
 }
 
+// AddPruneDirs adds directory names whose events are ignored
+func (w *Watcher) AddPruneDirs(names ...string) {
+	w.pruneDirs = append(w.pruneDirs, names...)
+}
+
+// SetExtensions limits processing to files with the given PML extensions, e.g.
+// those of Parser.SetExtensions. By default every file event is passed to the
+// processor, which decides what it handles.
+func (w *Watcher) SetExtensions(exts []string) {
+	w.extensions = append([]string(nil), exts...)
+}
+
+// WatchConfig reloads settings whenever the config file at path changes, so new
+// settings apply from the next file event without restarting the watcher
+func (w *Watcher) WatchConfig(path string, reload ReloadFunc) error {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return fmt.Errorf("failed to get absolute path: %w", err)
+	}
+	w.configPath = absPath
+	w.reload = reload
+	return nil
+}
+
+// reloadConfig replaces the processor from the config file, keeping the old one on error
+func (w *Watcher) reloadConfig() {
+	processor, err := w.reload(w.configPath)
+	if err != nil {
+		log.Printf("Failed to reload %s, keeping previous settings: %v", w.configPath, err)
+		return
+	}
+	if processor != nil {
+		w.mu.Lock()
+		w.processor = processor
+		w.mu.Unlock()
+	}
+	log.Printf("Reloaded settings from %s", w.configPath)
+}
+
+// currentProcessor returns the processor in use, which a reload may replace
+func (w *Watcher) currentProcessor() FileProcessor {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return w.processor
+}
+
+// isPruned reports whether path is inside, or is, a pruned directory
+func (w *Watcher) isPruned(path string) bool {
+	rel, err := filepath.Rel(w.watchPath, path)
+	if err != nil {
+		return false
+	}
+	for _, part := range strings.Split(rel, string(filepath.Separator)) {
+		for _, pruned := range w.pruneDirs {
+			if part == pruned {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 // getPidDir returns the directory where PID files are stored
 func getPidDir() (string, error) {
 	homeDir, err := os.UserHomeDir()
@@ -156,6 +232,11 @@ func (w *Watcher) Start(ctx context.Context) error {
 	if err := w.fsWatcher.Add(w.watchPath); err != nil {
 		return fmt.Errorf("failed to add watch path: %w", err)
 	}
+	if w.configPath != "" && filepath.Dir(w.configPath) != w.watchPath {
+		if err := w.fsWatcher.Add(filepath.Dir(w.configPath)); err != nil {
+			return fmt.Errorf("failed to watch config file: %w", err)
+		}
+	}
 
 	fmt.Printf("PML-INIT: Starting watcher for %s\n", w.watchPath)
 
@@ -170,12 +251,34 @@ func (w *Watcher) Start(ctx context.Context) error {
 				return fmt.Errorf("watcher event channel closed")
 			}
 
+			if w.configPath != "" && event.Name == w.configPath {
+				if event.Op&(fsnotify.Write|fsnotify.Create) != 0 {
+					w.reloadConfig()
+				}
+				continue
+			}
+			if filepath.Dir(event.Name) != w.watchPath {
+				// Other files next to a config file outside the watched directory
+				continue
+			}
+
 			// Debounce write events
 			if event.Op&fsnotify.Write == fsnotify.Write {
 				// Skip if the file is being written to avoid processing partial writes
 				continue
 			}
 
+			if w.isPruned(event.Name) {
+				continue
+			}
+			if len(w.extensions) > 0 && !parser.HasPMLExtension(event.Name, w.extensions) {
+				continue
+			}
+			// Writing a generated file, e.g. foo.pml.py, must not process it again
+			if parser.IsGeneratedFile(event.Name, w.extensions) {
+				continue
+			}
+
 			// Create structured event
 			fileEvent := FileEvent{
 				Type:      w.getEventType(event.Op),
@@ -190,7 +293,7 @@ func (w *Watcher) Start(ctx context.Context) error {
 
 			// Process file if it was created or closed after writing
 			if event.Op&(fsnotify.Create|fsnotify.Chmod) != 0 {
-				if err := w.processor.ProcessFile(ctx, event.Name); err != nil {
+				if err := w.currentProcessor().ProcessFile(ctx, event.Name); err != nil {
 					log.Printf("Failed to process file: %v", err)
 				}
 			}
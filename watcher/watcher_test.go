@@ -8,8 +8,11 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/fireharp/pml/impl1/parser"
 )
 
 // mockProcessor is a mock file processor for testing
@@ -351,3 +354,211 @@ func TestCleanupNonExistentProcesses(t *testing.T) {
 		t.Errorf("PID files remain after cleanup. got = %d, want = 0", remainingPidFiles)
 	}
 }
+
+func TestWatchConfigReload(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "watcher-config-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	watchDir := filepath.Join(tmpDir, "sources")
+	if err := os.Mkdir(watchDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	configFile := filepath.Join(tmpDir, "config")
+	if err := os.WriteFile(configFile, []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Each processor reports the setting it was built with
+	processed := make(chan string, 10)
+	newProcessor := func(setting string) FileProcessor {
+		return &mockProcessor{callback: func(string) { processed <- setting }}
+	}
+
+	w, err := NewWatcher(watchDir, newProcessor("old"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	err = w.WatchConfig(configFile, func(path string) (FileProcessor, error) {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if !strings.HasPrefix(string(data), "setting=") {
+			return nil, fmt.Errorf("invalid config %q", data)
+		}
+		return newProcessor(strings.TrimPrefix(string(data), "setting=")), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if err := w.Start(ctx); err != nil && err != context.Canceled {
+			t.Errorf("Watcher.Start() error = %v", err)
+		}
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	// createFile triggers a file event and returns the setting of the processor that handled it
+	createFile := func(name string) string {
+		if err := os.WriteFile(filepath.Join(watchDir, name), []byte("content"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case setting := <-processed:
+			// Drain events from the same write
+			time.Sleep(50 * time.Millisecond)
+			for len(processed) > 0 {
+				<-processed
+			}
+			return setting
+		case <-time.After(time.Second):
+			t.Fatal("Timeout waiting for file to be processed")
+			return ""
+		}
+	}
+
+	if err := os.WriteFile(configFile, []byte("setting=new"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if got := createFile("a.pml"); got != "new" {
+		t.Errorf("Expected the reloaded processor to handle the next event, got %q", got)
+	}
+
+	// An invalid config keeps the previous settings
+	if err := os.WriteFile(configFile, []byte("garbage"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if got := createFile("b.pml"); got != "new" {
+		t.Errorf("Expected an invalid config to keep the previous processor, got %q", got)
+	}
+
+	cancel()
+	wg.Wait()
+}
+
+// TestWatcherExtensions tests that only files with the configured extensions are processed
+func TestWatcherExtensions(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "watcher-ext-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	processed := make(chan string, 16)
+	w, err := NewWatcher(tmpDir, &mockProcessor{callback: func(path string) { processed <- path }})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	w.SetExtensions([]string{".prompt"})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if err := w.Start(ctx); err != nil && err != context.Canceled {
+			t.Errorf("Watcher.Start() error = %v", err)
+		}
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	if err := os.WriteFile(filepath.Join(tmpDir, "notes.txt"), []byte("ignored"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	promptFile := filepath.Join(tmpDir, "greeting.prompt")
+	if err := os.WriteFile(promptFile, []byte(":ask\nHello\n:--\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case path := <-processed:
+		if path != promptFile {
+			t.Errorf("Processed file = %v, want %v", path, promptFile)
+		}
+	case <-time.After(time.Second):
+		t.Error("Timeout waiting for file to be processed")
+	}
+
+	cancel()
+	wg.Wait()
+}
+
+// countingLLM answers every prompt and counts the calls
+type countingLLM struct {
+	calls int32
+}
+
+func (c *countingLLM) Ask(_ context.Context, _ string) (string, error) {
+	atomic.AddInt32(&c.calls, 1)
+	return "Answer", nil
+}
+
+func (c *countingLLM) Summarize(_ context.Context, text string) (string, error) {
+	return text, nil
+}
+
+// TestWatcherKeepsParserCache tests that repeated events for an unchanged file
+// are answered from the long-lived parser's cache
+func TestWatcherKeepsParserCache(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "watcher-cache-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	llm := &countingLLM{}
+	p := parser.NewParser(llm, tmpDir, filepath.Join(tmpDir, "compiled"), filepath.Join(tmpDir, "results"))
+	w, err := NewWatcher(tmpDir, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	w.SetExtensions(p.Extensions())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if err := w.Start(ctx); err != nil && err != context.Canceled {
+			t.Errorf("Watcher.Start() error = %v", err)
+		}
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	pmlFile := filepath.Join(tmpDir, "test.pml")
+	if err := os.WriteFile(pmlFile, []byte(":ask\nWhat is PML?\n:--\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(200 * time.Millisecond)
+
+	// Attribute changes fire events without changing the file
+	for _, mode := range []os.FileMode{0600, 0644, 0600} {
+		if err := os.Chmod(pmlFile, mode); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	if got := atomic.LoadInt32(&llm.calls); got != 1 {
+		t.Errorf("Expected only the first event to call the LLM, got %d calls", got)
+	}
+
+	cancel()
+	wg.Wait()
+}